@@ -0,0 +1,350 @@
+// Package asm assembles MIPS R3000 programs for tests and small tools. It
+// accepts the syntax printed by ps.Instruction.String as well as the usual
+// lowercase mnemonics, ABI register names, labels and a few directives and
+// pseudo-instructions.
+//
+// Jumps and branches are followed by a nop in their delay slot unless
+// ".set noreorder" is in effect. Numeric jump and branch operands are the
+// raw instruction fields, as printed by the disassembler; use labels or
+// expressions containing labels to name destinations.
+package asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Program is the result of assembling a source file.
+type Program struct {
+	// Origin is the address of the first byte of Code.
+	Origin uint32
+	Code   []byte
+	Labels map[string]uint32
+}
+
+// Error is an assembly error on a source line.
+type Error struct {
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// statement is a single instruction or directive.
+type statement struct {
+	line      int
+	address   uint32
+	mnemonic  string
+	operands  []string
+	size      uint32
+	noreorder bool
+}
+
+type assembler struct {
+	// final is set once all label addresses are known.
+	final  bool
+	origin uint32
+	// here is the address of the statement being assembled, the value of ".".
+	here       uint32
+	labels     map[string]uint32
+	statements []statement
+}
+
+// Assemble assembles source for the given load address.
+func Assemble(origin uint32, source string) (*Program, error) {
+	a := &assembler{origin: origin, labels: make(map[string]uint32)}
+	if err := a.layout(source); err != nil {
+		return nil, err
+	}
+
+	a.final = true
+	code := make([]byte, 0, a.size())
+	for _, s := range a.statements {
+		data, err := a.encode(s)
+		if err != nil {
+			return nil, &Error{s.line, err}
+		}
+		if uint32(len(data)) != s.size {
+			return nil, &Error{s.line, fmt.Errorf("%s: size changed between passes", s.mnemonic)}
+		}
+		code = append(code, data...)
+	}
+	return &Program{Origin: origin, Code: code, Labels: a.labels}, nil
+}
+
+// MustAssemble is like Assemble but panics on errors. It is meant for tests.
+func MustAssemble(origin uint32, source string) *Program {
+	program, err := Assemble(origin, source)
+	if err != nil {
+		panic(err)
+	}
+	return program
+}
+
+func (a *assembler) size() uint32 {
+	if len(a.statements) == 0 {
+		return 0
+	}
+	last := a.statements[len(a.statements)-1]
+	return last.address + last.size - a.origin
+}
+
+// layout splits the source into statements and assigns their addresses and
+// the values of labels.
+func (a *assembler) layout(source string) error {
+	lines := strings.Split(source, "\n")
+
+	// Collect the label names first so that identifiers can be told apart
+	// from hexadecimal numbers such as "ACh".
+	for _, text := range lines {
+		labels, _ := splitLabels(stripComment(text))
+		for _, label := range labels {
+			a.labels[label] = 0
+		}
+	}
+
+	address := a.origin
+	noreorder := false
+	defined := make(map[string]bool)
+	for i, text := range lines {
+		labels, rest := splitLabels(stripComment(text))
+		for _, label := range labels {
+			if defined[label] {
+				return &Error{i + 1, fmt.Errorf("label %s redefined", label)}
+			}
+			defined[label] = true
+			a.labels[label] = address
+		}
+		if rest == "" {
+			continue
+		}
+
+		mnemonic, operands := splitStatement(rest)
+		if mnemonic == ".set" {
+			switch strings.Join(operands, ",") {
+			case "reorder":
+				noreorder = false
+			case "noreorder":
+				noreorder = true
+			default:
+				return &Error{i + 1, fmt.Errorf(".set: unknown option %q", strings.Join(operands, ","))}
+			}
+			continue
+		}
+
+		s := statement{line: i + 1, address: address, mnemonic: mnemonic, operands: operands, noreorder: noreorder}
+		size, err := a.measure(s)
+		if err != nil {
+			return &Error{i + 1, err}
+		}
+		s.size = size
+		a.statements = append(a.statements, s)
+		address += size
+	}
+	return nil
+}
+
+// stripComment removes "#" and ";" comments outside of string literals.
+func stripComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case isCharLiteral(line[i:]) && !quoted:
+			i += 2
+		case (c == '#' || c == ';') && !quoted:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// isCharLiteral reports whether s starts with a character literal such as
+// '#', whose character must not be taken for syntax.
+func isCharLiteral(s string) bool {
+	return len(s) >= 3 && s[0] == '\'' && s[2] == '\''
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		letter := c == '_' || c == '.' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if !letter && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// splitLabels returns the labels at the start of a line and the rest of it.
+func splitLabels(line string) (labels []string, rest string) {
+	rest = strings.TrimSpace(line)
+	for {
+		i := strings.IndexByte(rest, ':')
+		if i < 0 || !isIdentifier(rest[:i]) {
+			return labels, rest
+		}
+		labels = append(labels, rest[:i])
+		rest = strings.TrimSpace(rest[i+1:])
+	}
+}
+
+// splitStatement splits a statement into its lowercase mnemonic and its
+// comma-separated operands.
+func splitStatement(text string) (string, []string) {
+	i := strings.IndexAny(text, " \t")
+	if i < 0 {
+		return strings.ToLower(text), nil
+	}
+	mnemonic := strings.ToLower(text[:i])
+	rest := strings.TrimSpace(text[i:])
+
+	var operands []string
+	depth, quoted, start := 0, false, 0
+	for j := 0; j < len(rest); j++ {
+		switch c := rest[j]; {
+		case c == '\\' && quoted:
+			j++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case isCharLiteral(rest[j:]):
+			j += 2
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			operands = append(operands, strings.TrimSpace(rest[start:j]))
+			start = j + 1
+		}
+	}
+	return mnemonic, append(operands, strings.TrimSpace(rest[start:]))
+}
+
+// measure returns the size of a statement in bytes.
+func (a *assembler) measure(s statement) (uint32, error) {
+	a.here = s.address
+	switch s.mnemonic {
+	case ".word":
+		return 4 * uint32(len(s.operands)), nil
+	case ".half":
+		return 2 * uint32(len(s.operands)), nil
+	case ".byte":
+		return uint32(len(s.operands)), nil
+	case ".ascii", ".asciiz":
+		str, err := a.stringOperand(s)
+		if err != nil {
+			return 0, err
+		}
+		if s.mnemonic == ".asciiz" {
+			return uint32(len(str)) + 1, nil
+		}
+		return uint32(len(str)), nil
+	case ".align":
+		n, err := a.constant(s, 0)
+		if err != nil {
+			return 0, err
+		}
+		if n > 16 {
+			return 0, fmt.Errorf(".align: %d out of range", n)
+		}
+		align := uint32(1) << n
+		return (align - s.address%align) % align, nil
+	case ".space":
+		return a.constant(s, 0)
+	}
+
+	words, err := a.expand(s)
+	if err != nil {
+		return 0, err
+	}
+	return 4 * uint32(len(words)), nil
+}
+
+// constant evaluates an operand that must not depend on labels.
+func (a *assembler) constant(s statement, i int) (uint32, error) {
+	if len(s.operands) <= i {
+		return 0, fmt.Errorf("%s: missing operand", s.mnemonic)
+	}
+	value, usesLabel, err := a.eval(s.operands[i])
+	if err != nil {
+		return 0, err
+	}
+	if usesLabel {
+		return 0, fmt.Errorf("%s: %s is not a constant", s.mnemonic, s.operands[i])
+	}
+	return value, nil
+}
+
+func (a *assembler) stringOperand(s statement) (string, error) {
+	if len(s.operands) != 1 {
+		return "", fmt.Errorf("%s: expected one string", s.mnemonic)
+	}
+	str, err := strconv.Unquote(s.operands[0])
+	if err != nil {
+		return "", fmt.Errorf("%s: bad string %s", s.mnemonic, s.operands[0])
+	}
+	return str, nil
+}
+
+// encode produces the bytes of a statement once all labels are known.
+func (a *assembler) encode(s statement) ([]byte, error) {
+	a.here = s.address
+	var data []byte
+	switch s.mnemonic {
+	case ".word", ".half", ".byte":
+		for i := range s.operands {
+			value, _, err := a.eval(s.operands[i])
+			if err != nil {
+				return nil, err
+			}
+			switch s.mnemonic {
+			case ".word":
+				data = appendWord(data, value)
+			case ".half":
+				data = append(data, uint8(value), uint8(value>>8))
+			case ".byte":
+				data = append(data, uint8(value))
+			}
+		}
+		return data, nil
+	case ".ascii", ".asciiz":
+		str, err := a.stringOperand(s)
+		if err != nil {
+			return nil, err
+		}
+		data = []byte(str)
+		if s.mnemonic == ".asciiz" {
+			data = append(data, 0)
+		}
+		return data, nil
+	case ".align", ".space":
+		return make([]byte, s.size), nil
+	}
+
+	words, err := a.expand(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, word := range words {
+		data = appendWord(data, word)
+	}
+	return data, nil
+}
+
+func appendWord(data []byte, word uint32) []byte {
+	return append(data, uint8(word), uint8(word>>8), uint8(word>>16), uint8(word>>24))
+}
@@ -0,0 +1,158 @@
+package asm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/weqqr/ps/ps"
+)
+
+func words(code []byte) []uint32 {
+	w := make([]uint32, len(code)/4)
+	for i := range w {
+		w[i] = binary.LittleEndian.Uint32(code[i*4:])
+	}
+	return w
+}
+
+func assertWords(t *testing.T, code []byte, expected ...uint32) {
+	t.Helper()
+	actual := words(code)
+	if len(actual) != len(expected) {
+		t.Fatalf("got %d words %08X, expected %08X", len(actual), actual, expected)
+	}
+	for i := range actual {
+		if actual[i] != expected[i] {
+			t.Fatalf("word %d: %08X != %08X", i, actual[i], expected[i])
+		}
+	}
+}
+
+// TestRoundTrip assembles the output of Instruction.String.
+func TestRoundTrip(t *testing.T) {
+	for _, word := range []uint32{
+		0x00000000, 0x00084080, 0x00084082, 0x00084083, 0x01094004, 0x01094006, 0x01094007,
+		0x01000008, 0x0100F809, 0x0000000C, 0x0000000D, 0x00004010, 0x01000011, 0x00004012,
+		0x01000013, 0x01090018, 0x01090019, 0x0109001A, 0x0109001B, 0x01095020, 0x01095021,
+		0x01095022, 0x01095023, 0x01095024, 0x01095025, 0x01095026, 0x01095027, 0x0109502A,
+		0x0109502B, 0x08004000, 0x0C004000, 0x1109FFFF, 0x15090004, 0x19000002, 0x1D00FFF0,
+		0x2128FFFC, 0x25280010, 0x2928FFFF, 0x2D280001, 0x3128FFFF, 0x35281234, 0x39280001,
+		0x3C081F80, 0x81280004, 0x85280006, 0x89280003, 0x8D28FFFC, 0x91280001, 0x95280002,
+		0x99280000, 0xA1282041, 0xA5280002, 0xA9280003, 0xAD28FFF0, 0xB9280000,
+	} {
+		text := ps.NewInstruction(word).String()
+		program, err := Assemble(0, ".set noreorder\n"+text)
+		if err != nil {
+			t.Fatalf("%08X %s: %v", word, text, err)
+		}
+		if actual := words(program.Code)[0]; actual != word {
+			t.Fatalf("%s: %08X != %08X", text, actual, word)
+		}
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	program, err := Assemble(0x80010000, `
+_start:	la    $a0, message     # pseudo-instructions
+	li    $t0, -1
+	li    $t1, 0x12345678
+	move  $s0, $a0
+loop:	lbu   $t2, 0($a0)
+	addiu $a0, $a0, 1
+	bnez  $t2, loop          ; delay slot filled with a nop
+	jal   done
+	.set noreorder
+	b     loop
+	nop
+	.set reorder
+done:	jr    $ra
+message:
+	.asciiz "hi, \"you\""
+	.align 2
+table:	.word message, done+4
+	.half 0xABCD
+	.byte 'A', 10h
+	.byte '#', ';', ','      # not comments or separators
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertWords(t, program.Code[:4*17],
+		0x3C048001, 0x24840040, // la
+		0x2408FFFF,             // li -1
+		0x3C091234, 0x35295678, // li 0x12345678
+		0x00808021,             // move
+		0x908A0000, 0x24840001, // loop
+		0x1540FFFD, 0x00000000, // bnez + nop
+		0x0C00400E, 0x00000000, // jal + nop
+		0x1000FFF9, 0x00000000, // b + nop
+		0x03E00008, 0x00000000, // jr + nop
+		0x202C6968, // "hi, "
+	)
+	assertEqual(t, program.Labels["message"], uint32(0x80010040))
+	assertEqual(t, program.Labels["table"], uint32(0x8001004C))
+	assertWords(t, program.Code[0x4C:0x54], 0x80010040, 0x8001003C)
+	if !bytes.Equal(program.Code[0x54:], []byte{0xCD, 0xAB, 'A', 0x10, '#', ';', ','}) {
+		t.Fatalf("data: % X", program.Code[0x54:])
+	}
+
+	exe := program.EXE()
+	assertEqual(t, string(exe[:8]), "PS-X EXE")
+	assertEqual(t, len(exe), 0x1000)
+	assertEqual(t, binary.LittleEndian.Uint32(exe[0x10:]), uint32(0x80010000))
+}
+
+func assertEqual(t *testing.T, actual interface{}, expected interface{}) {
+	t.Helper()
+	if actual != expected {
+		t.Fatalf("assertion failed: %v != %v", actual, expected)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for source, line := range map[string]int{
+		"nop\nfoo $1":                           2,
+		"addiu $t0, $t0, 10000h":                1,
+		"j missing":                             1,
+		"lw $t0, 4($t10)":                       1,
+		"a: nop\na: nop":                        2,
+		"beq $0, $0, far\n.space 0x20000\nfar:": 1,
+	} {
+		_, err := Assemble(0x80010000, source)
+		var asmErr *Error
+		if !errors.As(err, &asmErr) {
+			t.Fatalf("%q: expected an error, got %v", source, err)
+		}
+		assertEqual(t, asmErr.Line, line)
+	}
+}
+
+// TestRun runs an assembled program on the emulator.
+func TestRun(t *testing.T) {
+	program := MustAssemble(0x80010000, `
+	li    $t0, 10
+	move  $v0, $zero
+sum:	addu  $v0, $v0, $t0
+	addiu $t0, $t0, -1
+	bgtz  $t0, sum
+	lui   $t1, 0x1F80
+	sb    $v0, 0x2082($t1)    # exit port
+	b     .
+`)
+
+	bus, err := ps.NewBus(make([]byte, ps.BIOSSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := ps.NewCPU()
+	bus.Write(program.Origin, program.Code)
+	cpu.Jump(program.Origin)
+
+	code, exited, err := cpu.Run(bus, 1000)
+	assertEqual(t, err, nil)
+	assertEqual(t, exited, true)
+	assertEqual(t, code, 55)
+}
@@ -0,0 +1,30 @@
+package asm
+
+import "encoding/binary"
+
+const (
+	exeHeaderSize = 0x800
+	exeMarker     = "Sony Computer Entertainment Inc. for North America area"
+)
+
+// EXE returns the program as a PS-X EXE file. Execution starts at the label
+// _start if there is one and at the origin otherwise. The stack is left to
+// the loader.
+// http://problemkaputt.de/psx-spx.htm#cdromfileformats
+func (program *Program) EXE() []byte {
+	entry := program.Origin
+	if start, ok := program.Labels["_start"]; ok {
+		entry = start
+	}
+
+	// The text size is a multiple of 2048 bytes.
+	size := (len(program.Code) + exeHeaderSize - 1) &^ (exeHeaderSize - 1)
+	exe := make([]byte, exeHeaderSize+size)
+	copy(exe, "PS-X EXE")
+	binary.LittleEndian.PutUint32(exe[0x10:], entry)
+	binary.LittleEndian.PutUint32(exe[0x18:], program.Origin)
+	binary.LittleEndian.PutUint32(exe[0x1C:], uint32(size))
+	copy(exe[0x4C:], exeMarker)
+	copy(exe[exeHeaderSize:], program.Code)
+	return exe
+}
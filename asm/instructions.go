@@ -0,0 +1,558 @@
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// registerNames are the ABI names of the general purpose registers.
+var registerNames = map[string]uint32{
+	"zero": 0, "at": 1, "v0": 2, "v1": 3,
+	"a0": 4, "a1": 5, "a2": 6, "a3": 7,
+	"t0": 8, "t1": 9, "t2": 10, "t3": 11, "t4": 12, "t5": 13, "t6": 14, "t7": 15,
+	"s0": 16, "s1": 17, "s2": 18, "s3": 19, "s4": 20, "s5": 21, "s6": 22, "s7": 23,
+	"t8": 24, "t9": 25, "k0": 26, "k1": 27, "gp": 28, "sp": 29, "fp": 30, "s8": 30, "ra": 31,
+}
+
+// Instruction formats, named after their operands.
+const (
+	formatRdRsRt = iota
+	formatRdRtSa
+	formatRdRtRs
+	formatRs
+	formatRd
+	formatRsRt
+	formatJalr
+	formatCode
+	formatRtRsSigned
+	formatRtRsUnsigned
+	formatRtImm
+	formatRsRtBranch
+	formatRsBranch
+	formatJump
+	formatMemory
+	formatMove
+	formatCop
+	formatNone
+)
+
+type encoding struct {
+	format int
+	// word holds the fixed bits of the instruction.
+	word uint32
+}
+
+func special(function uint32) uint32 { return function }
+func primary(opcode uint32) uint32   { return opcode << 26 }
+func bcond(rt uint32) uint32         { return 1<<26 | rt<<16 }
+func cop(n, rs uint32) uint32        { return (0x10+n)<<26 | rs<<21 }
+
+var encodings = map[string]encoding{
+	"sll":     {formatRdRtSa, special(0x00)},
+	"srl":     {formatRdRtSa, special(0x02)},
+	"sra":     {formatRdRtSa, special(0x03)},
+	"sllv":    {formatRdRtRs, special(0x04)},
+	"srlv":    {formatRdRtRs, special(0x06)},
+	"srav":    {formatRdRtRs, special(0x07)},
+	"jr":      {formatRs, special(0x08)},
+	"jalr":    {formatJalr, special(0x09)},
+	"syscall": {formatCode, special(0x0C)},
+	"break":   {formatCode, special(0x0D)},
+	"mfhi":    {formatRd, special(0x10)},
+	"mthi":    {formatRs, special(0x11)},
+	"mflo":    {formatRd, special(0x12)},
+	"mtlo":    {formatRs, special(0x13)},
+	"mult":    {formatRsRt, special(0x18)},
+	"multu":   {formatRsRt, special(0x19)},
+	"div":     {formatRsRt, special(0x1A)},
+	"divu":    {formatRsRt, special(0x1B)},
+	"add":     {formatRdRsRt, special(0x20)},
+	"addu":    {formatRdRsRt, special(0x21)},
+	"sub":     {formatRdRsRt, special(0x22)},
+	"subu":    {formatRdRsRt, special(0x23)},
+	"and":     {formatRdRsRt, special(0x24)},
+	"or":      {formatRdRsRt, special(0x25)},
+	"xor":     {formatRdRsRt, special(0x26)},
+	"nor":     {formatRdRsRt, special(0x27)},
+	"slt":     {formatRdRsRt, special(0x2A)},
+	"sltu":    {formatRdRsRt, special(0x2B)},
+
+	"bltz":   {formatRsBranch, bcond(0x00)},
+	"bgez":   {formatRsBranch, bcond(0x01)},
+	"bltzal": {formatRsBranch, bcond(0x10)},
+	"bgezal": {formatRsBranch, bcond(0x11)},
+
+	"j":     {formatJump, primary(0x02)},
+	"jal":   {formatJump, primary(0x03)},
+	"beq":   {formatRsRtBranch, primary(0x04)},
+	"bne":   {formatRsRtBranch, primary(0x05)},
+	"blez":  {formatRsBranch, primary(0x06)},
+	"bgtz":  {formatRsBranch, primary(0x07)},
+	"addi":  {formatRtRsSigned, primary(0x08)},
+	"addiu": {formatRtRsSigned, primary(0x09)},
+	"slti":  {formatRtRsSigned, primary(0x0A)},
+	"sltiu": {formatRtRsSigned, primary(0x0B)},
+	"andi":  {formatRtRsUnsigned, primary(0x0C)},
+	"ori":   {formatRtRsUnsigned, primary(0x0D)},
+	"xori":  {formatRtRsUnsigned, primary(0x0E)},
+	"lui":   {formatRtImm, primary(0x0F)},
+
+	"mfc0": {formatMove, cop(0, 0x00)},
+	"mtc0": {formatMove, cop(0, 0x04)},
+	"rfe":  {formatNone, cop(0, 0x10) | 0x10},
+	"mfc2": {formatMove, cop(2, 0x00)},
+	"cfc2": {formatMove, cop(2, 0x02)},
+	"mtc2": {formatMove, cop(2, 0x04)},
+	"ctc2": {formatMove, cop(2, 0x06)},
+	"cop2": {formatCop, cop(2, 0x10)},
+
+	"lb":   {formatMemory, primary(0x20)},
+	"lh":   {formatMemory, primary(0x21)},
+	"lwl":  {formatMemory, primary(0x22)},
+	"lw":   {formatMemory, primary(0x23)},
+	"lbu":  {formatMemory, primary(0x24)},
+	"lhu":  {formatMemory, primary(0x25)},
+	"lwr":  {formatMemory, primary(0x26)},
+	"sb":   {formatMemory, primary(0x28)},
+	"sh":   {formatMemory, primary(0x29)},
+	"swl":  {formatMemory, primary(0x2A)},
+	"sw":   {formatMemory, primary(0x2B)},
+	"swr":  {formatMemory, primary(0x2E)},
+	"lwc2": {formatMemory, primary(0x32)},
+	"swc2": {formatMemory, primary(0x3A)},
+}
+
+var operandCounts = map[int][]int{
+	formatRdRsRt:       {3},
+	formatRdRtSa:       {3},
+	formatRdRtRs:       {3},
+	formatRs:           {1},
+	formatRd:           {1},
+	formatRsRt:         {2},
+	formatJalr:         {1, 2},
+	formatCode:         {0, 1},
+	formatRtRsSigned:   {3},
+	formatRtRsUnsigned: {3},
+	formatRtImm:        {2},
+	formatRsRtBranch:   {3},
+	formatRsBranch:     {2},
+	formatJump:         {1},
+	formatMemory:       {2},
+	formatMove:         {2},
+	formatCop:          {1},
+	formatNone:         {0},
+}
+
+const nop = 0
+
+// errRange marks errors that depend on label addresses. They are ignored
+// while the addresses are still being assigned.
+var errRange = errors.New("out of range")
+
+// expand encodes an instruction or pseudo-instruction into words, including
+// the nop filling its delay slot.
+func (a *assembler) expand(s statement) ([]uint32, error) {
+	words, err := a.expandInstruction(s)
+	if err != nil && (a.final || !errors.Is(err, errRange)) {
+		return nil, err
+	}
+
+	if !s.noreorder && isJump(s.mnemonic) {
+		words = append(words, nop)
+	}
+	return words, nil
+}
+
+func isJump(mnemonic string) bool {
+	switch mnemonic {
+	case "b", "beqz", "bnez":
+		return true
+	}
+	e, ok := encodings[mnemonic]
+	if !ok {
+		return false
+	}
+	switch e.format {
+	case formatRsRtBranch, formatRsBranch, formatJump, formatJalr:
+		return true
+	}
+	return mnemonic == "jr"
+}
+
+func (a *assembler) expandInstruction(s statement) ([]uint32, error) {
+	ops := s.operands
+	switch s.mnemonic {
+	case "nop":
+		if len(ops) != 0 {
+			return nil, fmt.Errorf("nop: unexpected operands")
+		}
+		return []uint32{nop}, nil
+	case "move":
+		if len(ops) != 2 {
+			return nil, fmt.Errorf("move: expected 2 operands")
+		}
+		rd, err := register(ops[0])
+		if err != nil {
+			return nil, err
+		}
+		rs, err := register(ops[1])
+		if err != nil {
+			return nil, err
+		}
+		return []uint32{special(0x21) | rs<<21 | rd<<11}, nil
+	case "li", "la":
+		if len(ops) != 2 {
+			return nil, fmt.Errorf("%s: expected 2 operands", s.mnemonic)
+		}
+		rt, err := register(ops[0])
+		if err != nil {
+			return nil, err
+		}
+		value, usesLabel, err := a.eval(ops[1])
+		if err != nil {
+			return nil, err
+		}
+		return loadImmediate(rt, value, usesLabel || s.mnemonic == "la"), nil
+	case "b":
+		if len(ops) != 1 {
+			return nil, fmt.Errorf("b: expected 1 operand")
+		}
+		return a.expandInstruction(statement{line: s.line, address: s.address, mnemonic: "beq", operands: []string{"$zero", "$zero", ops[0]}})
+	case "beqz", "bnez":
+		if len(ops) != 2 {
+			return nil, fmt.Errorf("%s: expected 2 operands", s.mnemonic)
+		}
+		return a.expandInstruction(statement{line: s.line, address: s.address, mnemonic: s.mnemonic[:3], operands: []string{ops[0], "$zero", ops[1]}})
+	}
+
+	e, ok := encodings[s.mnemonic]
+	if !ok {
+		return nil, fmt.Errorf("unknown instruction %s", s.mnemonic)
+	}
+	if !validCount(operandCounts[e.format], len(ops)) {
+		return nil, fmt.Errorf("%s: wrong number of operands", s.mnemonic)
+	}
+
+	// The word is still returned with range errors, its size is needed while
+	// assigning addresses.
+	word, err := a.operands(s, e, ops)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", s.mnemonic, err)
+	}
+	return []uint32{word}, err
+}
+
+func validCount(counts []int, n int) bool {
+	for _, count := range counts {
+		if count == n {
+			return true
+		}
+	}
+	return false
+}
+
+// loadImmediate returns the shortest sequence loading value into rt. Values
+// that depend on labels always use lui and addiu.
+func loadImmediate(rt, value uint32, full bool) []uint32 {
+	switch {
+	case full:
+		return []uint32{
+			primary(0x0F) | rt<<16 | (value+0x8000)>>16,
+			primary(0x09) | rt<<21 | rt<<16 | value&0xFFFF,
+		}
+	case value+0x8000 < 0x10000:
+		return []uint32{primary(0x09) | rt<<16 | value&0xFFFF}
+	case value < 0x10000:
+		return []uint32{primary(0x0D) | rt<<16 | value}
+	case value&0xFFFF == 0:
+		return []uint32{primary(0x0F) | rt<<16 | value>>16}
+	}
+	return []uint32{
+		primary(0x0F) | rt<<16 | value>>16,
+		primary(0x0D) | rt<<21 | rt<<16 | value&0xFFFF,
+	}
+}
+
+func (a *assembler) operands(s statement, e encoding, ops []string) (uint32, error) {
+	word := e.word
+	var regs [3]uint32
+	for i := range ops {
+		switch {
+		case e.format == formatRdRtSa && i == 2,
+			e.format == formatRtRsSigned && i == 2,
+			e.format == formatRtRsUnsigned && i == 2,
+			e.format == formatRtImm && i == 1,
+			e.format == formatRsRtBranch && i == 2,
+			e.format == formatRsBranch && i == 1,
+			e.format == formatMemory && i == 1,
+			e.format == formatJump,
+			e.format == formatCode,
+			e.format == formatCop:
+			continue
+		}
+		r, err := register(ops[i])
+		if err != nil {
+			return 0, err
+		}
+		regs[i] = r
+	}
+
+	switch e.format {
+	case formatRdRsRt:
+		return word | regs[1]<<21 | regs[2]<<16 | regs[0]<<11, nil
+	case formatRdRtSa:
+		sa, err := a.immediate(ops[2], 0, 31)
+		return word | regs[1]<<16 | regs[0]<<11 | sa<<6, err
+	case formatRdRtRs:
+		return word | regs[2]<<21 | regs[1]<<16 | regs[0]<<11, nil
+	case formatRs:
+		return word | regs[0]<<21, nil
+	case formatRd:
+		return word | regs[0]<<11, nil
+	case formatRsRt:
+		return word | regs[0]<<21 | regs[1]<<16, nil
+	case formatJalr:
+		if len(ops) == 1 {
+			return word | regs[0]<<21 | 31<<11, nil
+		}
+		return word | regs[1]<<21 | regs[0]<<11, nil
+	case formatCode:
+		if len(ops) == 0 {
+			return word, nil
+		}
+		code, err := a.immediate(ops[0], 0, 0xFFFFF)
+		return word | code<<6, err
+	case formatRtRsSigned:
+		imm, err := a.signed16(ops[2])
+		return word | regs[1]<<21 | regs[0]<<16 | imm, err
+	case formatRtRsUnsigned:
+		imm, err := a.immediate(ops[2], 0, 0xFFFF)
+		return word | regs[1]<<21 | regs[0]<<16 | imm, err
+	case formatRtImm:
+		imm, err := a.immediate(ops[1], 0, 0xFFFF)
+		return word | regs[0]<<16 | imm, err
+	case formatRsRtBranch:
+		offset, err := a.branchOffset(s, ops[2])
+		return word | regs[0]<<21 | regs[1]<<16 | offset, err
+	case formatRsBranch:
+		offset, err := a.branchOffset(s, ops[1])
+		return word | regs[0]<<21 | offset, err
+	case formatJump:
+		target, err := a.jumpTarget(s, ops[0])
+		return word | target, err
+	case formatMemory:
+		offset, base, err := a.memory(ops[1])
+		return word | base<<21 | regs[0]<<16 | offset, err
+	case formatMove:
+		return word | regs[0]<<16 | regs[1]<<11, nil
+	case formatCop:
+		command, err := a.immediate(ops[0], 0, 0x1FFFFFF)
+		return word | command, err
+	}
+	return word, nil
+}
+
+// register parses "$n" or an ABI name such as "$sp".
+func register(operand string) (uint32, error) {
+	if !strings.HasPrefix(operand, "$") {
+		return 0, fmt.Errorf("expected a register, got %q", operand)
+	}
+	name := strings.ToLower(operand[1:])
+	if r, ok := registerNames[name]; ok {
+		return r, nil
+	}
+	n, err := strconv.ParseUint(name, 10, 8)
+	if err != nil || n > 31 {
+		return 0, fmt.Errorf("unknown register %s", operand)
+	}
+	return uint32(n), nil
+}
+
+func (a *assembler) immediate(operand string, low, high uint32) (uint32, error) {
+	value, _, err := a.eval(operand)
+	if err != nil {
+		return 0, err
+	}
+	if value < low || value > high {
+		return 0, fmt.Errorf("%s: %w", operand, errRange)
+	}
+	return value, nil
+}
+
+// signed16 accepts values that fit a sign-extended 16-bit field, written
+// either as negative numbers, as 32-bit values (FFFFFFFCh) or as 16-bit ones.
+func (a *assembler) signed16(operand string) (uint32, error) {
+	value, _, err := a.eval(operand)
+	if err != nil {
+		return 0, err
+	}
+	if value > 0xFFFF && value < 0xFFFF8000 {
+		return 0, fmt.Errorf("%s: %w", operand, errRange)
+	}
+	return value & 0xFFFF, nil
+}
+
+func (a *assembler) branchOffset(s statement, operand string) (uint32, error) {
+	value, usesLabel, err := a.eval(operand)
+	if err != nil {
+		return 0, err
+	}
+	if !usesLabel {
+		if value > 0xFFFF {
+			return 0, fmt.Errorf("%s: %w", operand, errRange)
+		}
+		return value, nil
+	}
+
+	offset := int64(int32(value-s.address-4)) >> 2
+	if value&3 != 0 || offset < -0x8000 || offset > 0x7FFF {
+		return 0, fmt.Errorf("branch to %s: %w", operand, errRange)
+	}
+	return uint32(offset) & 0xFFFF, nil
+}
+
+func (a *assembler) jumpTarget(s statement, operand string) (uint32, error) {
+	value, usesLabel, err := a.eval(operand)
+	if err != nil {
+		return 0, err
+	}
+	if !usesLabel {
+		if value > 0x3FFFFFF {
+			return 0, fmt.Errorf("%s: %w", operand, errRange)
+		}
+		return value, nil
+	}
+	if value&3 != 0 || value&0xF0000000 != (s.address+4)&0xF0000000 {
+		return 0, fmt.Errorf("jump to %s: %w", operand, errRange)
+	}
+	return value >> 2 & 0x3FFFFFF, nil
+}
+
+// memory parses "offset($base)".
+func (a *assembler) memory(operand string) (offset, base uint32, err error) {
+	i := strings.LastIndexByte(operand, '(')
+	if i < 0 || !strings.HasSuffix(operand, ")") {
+		return 0, 0, fmt.Errorf("expected offset($base), got %q", operand)
+	}
+	base, err = register(strings.TrimSpace(operand[i+1 : len(operand)-1]))
+	if err != nil {
+		return 0, 0, err
+	}
+	if strings.TrimSpace(operand[:i]) == "" {
+		return 0, base, nil
+	}
+	offset, err = a.signed16(operand[:i])
+	return offset, base, err
+}
+
+// eval evaluates an expression of numbers, labels, "." for the current
+// address, %hi() and %lo() joined by + and -. It reports whether a label was used.
+func (a *assembler) eval(expression string) (value uint32, usesLabel bool, err error) {
+	s := strings.TrimSpace(expression)
+	if s == "" {
+		return 0, false, errors.New("missing operand")
+	}
+
+	sign := uint32(1)
+	for s != "" {
+		switch s[0] {
+		case '+':
+			s = strings.TrimSpace(s[1:])
+			continue
+		case '-':
+			sign = -sign
+			s = strings.TrimSpace(s[1:])
+			continue
+		}
+
+		term, rest := splitTerm(s)
+		v, label, err := a.term(term)
+		if err != nil {
+			return 0, false, err
+		}
+		value += sign * v
+		usesLabel = usesLabel || label
+
+		s = strings.TrimSpace(rest)
+		if s == "" {
+			break
+		}
+		if s[0] != '+' && s[0] != '-' {
+			return 0, false, fmt.Errorf("bad expression %q", expression)
+		}
+		sign = 1
+	}
+	return value, usesLabel, nil
+}
+
+// splitTerm returns the first term of an expression.
+func splitTerm(s string) (term, rest string) {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '+', '-':
+			if depth == 0 {
+				return strings.TrimSpace(s[:i]), s[i:]
+			}
+		case '\'':
+			// Skip character literals such as '-'.
+			if i+2 < len(s) {
+				i += 2
+			}
+		}
+	}
+	return strings.TrimSpace(s), ""
+}
+
+func (a *assembler) term(term string) (uint32, bool, error) {
+	for _, function := range []string{"%hi(", "%lo("} {
+		if strings.HasPrefix(term, function) && strings.HasSuffix(term, ")") {
+			v, label, err := a.eval(term[len(function) : len(term)-1])
+			if function == "%hi(" {
+				return (v + 0x8000) >> 16, label, err
+			}
+			return v & 0xFFFF, label, err
+		}
+	}
+
+	if term == "." {
+		return a.here, true, nil
+	}
+	if address, ok := a.labels[term]; ok {
+		return address, true, nil
+	}
+	if v, ok := parseNumber(term); ok {
+		return v, false, nil
+	}
+	if isIdentifier(term) {
+		return 0, false, fmt.Errorf("undefined label %s", term)
+	}
+	return 0, false, fmt.Errorf("bad number %q", term)
+}
+
+// parseNumber parses decimal numbers, hexadecimal numbers written as 0x1F or
+// 1Fh and character literals.
+func parseNumber(s string) (uint32, bool) {
+	if len(s) == 3 && s[0] == '\'' && s[2] == '\'' {
+		return uint32(s[1]), true
+	}
+
+	base := 10
+	switch {
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		s, base = s[2:], 16
+	case strings.HasSuffix(s, "h") || strings.HasSuffix(s, "H"):
+		s, base = s[:len(s)-1], 16
+	}
+	v, err := strconv.ParseUint(s, base, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(v), true
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/weqqr/ps/ps"
+)
+
+const debugHelp = `commands:
+  step [N]             (s) execute N instructions
+  next                 (n) step over subroutine calls
+  continue             (c) run until a breakpoint or watchpoint
+  until ADDR           (u) run until execution reaches ADDR
+  break ADDR           (b) set a breakpoint
+  watch ADDR [LEN]     stop when memory is written
+  rwatch ADDR [LEN]    stop when memory is read
+  awatch ADDR [LEN]    stop when memory is read or written
+  delete ADDR          (d) delete the breakpoints and watchpoints at ADDR
+  info                 list breakpoints and watchpoints
+  regs                 (r) show the general purpose registers
+  cop0                 show the COP0 registers
+  gte                  show the GTE registers
+  x ADDR [LEN]         dump memory
+  edit ADDR BYTE...    change memory, bytes are hexadecimal
+  set REG VALUE        change a register
+  list [ADDR [N]]      (l) disassemble around ADDR or PC
+  print EXPR           (p) evaluate an expression
+  quit                 (q) exit
+
+ADDR, LEN, VALUE and EXPR are expressions like "$sp+10h" or "main+0x20".
+Numbers are decimal unless written as 0x1F or 1Fh. Ctrl-C stops a running
+program and an empty line repeats step and next.
+`
+
+func debugCommand(args []string) {
+	m := newMachine(flag.NewFlagSet("ps debug", flag.ExitOnError), args)
+	defer m.close()
+	d := ps.NewDebugger(m.CPU, m.Bus)
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		for range interrupts {
+			d.Interrupt()
+		}
+	}()
+
+	r := &repl{d: d, console: m.Console, out: os.Stdout}
+	r.where()
+	input := bufio.NewScanner(os.Stdin)
+	var last string
+	for {
+		fmt.Fprint(r.out, "(ps) ")
+		if !input.Scan() {
+			fmt.Fprintln(r.out)
+			return
+		}
+		line := strings.TrimSpace(input.Text())
+		if line == "" {
+			line = last
+		}
+		last = ""
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "q", "quit":
+			return
+		case "s", "step", "n", "next":
+			last = line
+		}
+		if err := r.execute(fields[0], fields[1:]); err != nil {
+			fmt.Fprintf(r.out, "error: %v\n", err)
+		}
+	}
+}
+
+type repl struct {
+	d       *ps.Debugger
+	console *ps.Console
+	out     io.Writer
+}
+
+func (r *repl) execute(command string, args []string) error {
+	d := r.d
+	switch command {
+	case "s", "step":
+		count := uint32(1)
+		if len(args) > 0 {
+			var err error
+			if count, err = d.Evaluate(args[0]); err != nil {
+				return err
+			}
+		}
+		stop := ps.Stop{Reason: ps.StopStep}
+		for i := uint32(0); i < count && stop.Reason == ps.StopStep; i++ {
+			stop = d.Step()
+		}
+		r.stopped(stop)
+	case "n", "next":
+		r.stopped(d.Next())
+	case "c", "continue":
+		r.stopped(d.Continue())
+	case "u", "until":
+		address, err := r.argument(args, 0)
+		if err != nil {
+			return err
+		}
+		r.stopped(d.Until(address))
+	case "b", "break":
+		address, err := r.argument(args, 0)
+		if err != nil {
+			return err
+		}
+		d.AddBreakpoint(address)
+		fmt.Fprintf(r.out, "breakpoint at %s\n", d.CPU.Symbols.Format(address))
+	case "watch", "rwatch", "awatch":
+		address, err := r.argument(args, 0)
+		if err != nil {
+			return err
+		}
+		size := uint32(4)
+		if len(args) > 1 {
+			if size, err = r.argument(args, 1); err != nil {
+				return err
+			}
+		}
+		kind := map[string]ps.WatchKind{"watch": ps.WatchWrite, "rwatch": ps.WatchRead, "awatch": ps.WatchAccess}[command]
+		d.AddWatchpoint(ps.Watchpoint{Address: address, Size: size, Kind: kind})
+		fmt.Fprintf(r.out, "%s watchpoint at %s, %d bytes\n", kind, d.CPU.Symbols.Format(address), size)
+	case "d", "delete":
+		address, err := r.argument(args, 0)
+		if err != nil {
+			return err
+		}
+		if !d.RemoveBreakpoint(address) && !d.RemoveWatchpoint(address) {
+			return fmt.Errorf("nothing set at %08Xh", address)
+		}
+	case "info":
+		for _, address := range d.Breakpoints() {
+			fmt.Fprintf(r.out, "breakpoint  %08X  %s\n", address, d.CPU.Symbols.Format(address))
+		}
+		for _, w := range d.Watchpoints() {
+			fmt.Fprintf(r.out, "%-10s  %08X  %s, %d bytes\n", w.Kind, w.Address, d.CPU.Symbols.Format(w.Address), w.Size)
+		}
+	case "r", "regs":
+		d.PrintRegisters(r.out)
+	case "cop0":
+		d.PrintCOP0(r.out)
+	case "gte":
+		d.PrintGTE(r.out)
+	case "x":
+		address, err := r.argument(args, 0)
+		if err != nil {
+			return err
+		}
+		length := uint32(64)
+		if len(args) > 1 {
+			if length, err = r.argument(args, 1); err != nil {
+				return err
+			}
+		}
+		return r.dump(address, length)
+	case "edit":
+		address, err := r.argument(args, 0)
+		if err != nil {
+			return err
+		}
+		data := make([]byte, len(args)-1)
+		for i, arg := range args[1:] {
+			value, err := strconv.ParseUint(arg, 16, 8)
+			if err != nil {
+				return fmt.Errorf("bad byte %q", arg)
+			}
+			data[i] = uint8(value)
+		}
+		return d.WriteMemory(address, data)
+	case "set":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: set REG VALUE")
+		}
+		value, err := d.Evaluate(args[1])
+		if err != nil {
+			return err
+		}
+		return d.SetRegister(args[0], value)
+	case "l", "list":
+		address, count := d.CPU.Pc-16, uint32(12)
+		if len(args) > 0 {
+			var err error
+			if address, err = r.argument(args, 0); err != nil {
+				return err
+			}
+		}
+		if len(args) > 1 {
+			var err error
+			if count, err = r.argument(args, 1); err != nil {
+				return err
+			}
+		}
+		return r.list(address, count)
+	case "p", "print":
+		value, err := d.Evaluate(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(r.out, "%08Xh  %d  %s\n", value, int32(value), d.CPU.Symbols.Format(value))
+	case "h", "help":
+		fmt.Fprint(r.out, debugHelp)
+	default:
+		return fmt.Errorf("unknown command %q, try help", command)
+	}
+	return nil
+}
+
+func (r *repl) argument(args []string, i int) (uint32, error) {
+	if len(args) <= i {
+		return 0, fmt.Errorf("missing argument")
+	}
+	return r.d.Evaluate(args[i])
+}
+
+// stopped reports why execution stopped and where.
+func (r *repl) stopped(stop ps.Stop) {
+	r.console.Flush()
+	if report, ok := stop.Err.(*ps.CrashReport); ok {
+		report.WriteTo(r.out)
+		return
+	}
+	if stop.Reason != ps.StopStep {
+		fmt.Fprintln(r.out, stop)
+	}
+	r.where()
+}
+
+func (r *repl) where() {
+	if err := r.list(r.d.CPU.Pc, 1); err != nil {
+		fmt.Fprintf(r.out, "error: %v\n", err)
+	}
+}
+
+func (r *repl) list(address, count uint32) error {
+	address &^= 3
+	symbols := r.d.CPU.Symbols
+	for i := uint32(0); i < count; i++ {
+		var word [4]byte
+		if err := r.d.ReadMemory(address, word[:]); err != nil {
+			return err
+		}
+
+		if symbol, ok := symbols.Lookup(address); ok && symbol.Address == address && count > 1 {
+			fmt.Fprintf(r.out, "%s:\n", symbol.Name)
+		}
+		marker := "  "
+		if address == r.d.CPU.Pc {
+			marker = "=>"
+		}
+		inst := ps.Disassemble(address, binary.LittleEndian.Uint32(word[:]), symbols)
+		fmt.Fprintf(r.out, "%s %08X  %08X  %s\n", marker, address, inst.Word, inst)
+		address += 4
+	}
+	return nil
+}
+
+func (r *repl) dump(address, length uint32) error {
+	data := make([]byte, length)
+	if err := r.d.ReadMemory(address, data); err != nil {
+		return err
+	}
+	for offset := 0; offset < len(data); offset += 16 {
+		line := data[offset:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+
+		var hex, text strings.Builder
+		for i, b := range line {
+			if i == 8 {
+				hex.WriteByte(' ')
+			}
+			fmt.Fprintf(&hex, "%02X ", b)
+			if b >= 0x20 && b < 0x7F {
+				text.WriteByte(b)
+			} else {
+				text.WriteByte('.')
+			}
+		}
+		fmt.Fprintf(r.out, "%08X  %-49s |%s|\n", address+uint32(offset), hex.String(), text.String())
+	}
+	return nil
+}
+
+// dapCommand serves the Debug Adapter Protocol on stdin and stdout, so that
+// editors can launch and debug programs in the emulator.
+func dapCommand(args []string) {
+	flags := flag.NewFlagSet("ps dap", flag.ExitOnError)
+	flags.Parse(args)
+	if err := ps.ServeDAP(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "ps dap: %v\n", err)
+		os.Exit(1)
+	}
+}
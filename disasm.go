@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/weqqr/ps/ps"
+)
+
+const disasmUsage = `usage: ps disasm [flags] FILE
+
+Disassembles a PS-X EXE, an ELF or a raw image such as a BIOS dump. Branch
+and jump destinations without a symbol get sub_/loc_ labels.
+
+flags:
+`
+
+// segment is a block of code loaded at a fixed address.
+type segment struct {
+	address uint32
+	data    []byte
+}
+
+func (s segment) contains(address uint32) bool {
+	return address-s.address < uint32(len(s.data))
+}
+
+func disasmCommand(args []string) {
+	flags := flag.NewFlagSet("ps disasm", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, disasmUsage)
+		flags.PrintDefaults()
+	}
+	base := uint32(0xBFC00000)
+	start, length := uint32(0), uint32(0)
+	flags.Func("base", "load address of raw images (default BFC00000h)", addressFlag(&base))
+	flags.Func("start", "first address to disassemble (default: start of the file)", addressFlag(&start))
+	flags.Func("length", "number of bytes to disassemble (default: to the end of the segment)", addressFlag(&length))
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := disasm(flags.Arg(0), base, start, length); err != nil {
+		fmt.Fprintf(os.Stderr, "ps disasm: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// addressFlag parses addresses written as 0x1F801000, 1F801000h or decimal.
+func addressFlag(value *uint32) func(string) error {
+	return func(s string) error {
+		s = strings.TrimSpace(s)
+		if strings.HasSuffix(s, "h") || strings.HasSuffix(s, "H") {
+			s = "0x" + s[:len(s)-1]
+		}
+		n, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			return fmt.Errorf("bad address %q", s)
+		}
+		*value = uint32(n)
+		return nil
+	}
+}
+
+func disasm(path string, base, start, length uint32) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var segments []segment
+	symbols := ps.NewSymbolTable()
+	switch {
+	case bytes.HasPrefix(data, []byte(elf.ELFMAG)):
+		program, err := ps.ParseELF(data)
+		if err != nil {
+			return err
+		}
+		for _, s := range program.Segments {
+			segments = append(segments, segment{s.Address, s.Data})
+		}
+		symbols = program.Symbols
+	case bytes.HasPrefix(data, []byte("PS-X EXE")):
+		exe, err := ps.ParseEXE(data)
+		if err != nil {
+			return err
+		}
+		segments = append(segments, segment{exe.TextAddress, exe.Text})
+		if _, ok := symbols.Lookup(exe.PC); !ok {
+			symbols.Add(ps.Symbol{Name: "start", Address: exe.PC})
+		}
+	default:
+		segments = append(segments, segment{base, data})
+	}
+
+	code, err := selectRange(segments, start, length)
+	if err != nil {
+		return err
+	}
+
+	instructions := make([]ps.Disassembly, len(code.data)/4)
+	for i := range instructions {
+		address := code.address + uint32(i*4)
+		instructions[i] = ps.Disassemble(address, binary.LittleEndian.Uint32(code.data[i*4:]), symbols)
+	}
+
+	// Name the destinations that have no symbol and disassemble again so that
+	// the operands use the new labels.
+	labels := make(map[uint32]bool)
+	var generated []ps.Symbol
+	for _, inst := range instructions {
+		if !inst.HasTarget || !code.contains(inst.Target) || labels[inst.Target] {
+			continue
+		}
+		if symbol, ok := symbols.Lookup(inst.Target); ok && symbol.Address == inst.Target {
+			continue
+		}
+		labels[inst.Target] = true
+		prefix := "loc"
+		if inst.Mnemonic == "JAL" || inst.Mnemonic == "BLTZAL" || inst.Mnemonic == "BGEZAL" {
+			prefix = "sub"
+		}
+		generated = append(generated, ps.Symbol{Name: fmt.Sprintf("%s_%08X", prefix, inst.Target), Address: inst.Target})
+	}
+	symbols.Add(generated...)
+
+	for i, inst := range instructions {
+		inst = ps.Disassemble(inst.Address, inst.Word, symbols)
+		if symbol, ok := symbols.Lookup(inst.Address); ok && symbol.Address == inst.Address {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%s:\n", symbol.Name)
+		}
+		fmt.Printf("%08X  %08X  %s\n", inst.Address, inst.Word, inst)
+	}
+	return nil
+}
+
+// selectRange finds the segment containing start and cuts it to length bytes.
+// A zero start selects the first segment.
+func selectRange(segments []segment, start, length uint32) (segment, error) {
+	for _, s := range segments {
+		if start == 0 {
+			start = s.address
+		}
+		if !s.contains(start) {
+			continue
+		}
+		data := s.data[start-s.address:]
+		if length != 0 && length < uint32(len(data)) {
+			data = data[:length]
+		}
+		return segment{start, data[:len(data)&^3]}, nil
+	}
+	return segment{}, fmt.Errorf("%08Xh is not in the file", start)
+}
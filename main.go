@@ -1,20 +1,292 @@
 package main
 
 import (
-	"github.com/weqqr/ps/ps"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"os"
+	"strings"
+
+	"github.com/weqqr/ps/ps"
 )
 
+// commands maps subcommand names to their entry points. Running ps without a
+// subcommand starts the emulator.
+var commands = map[string]func(args []string){
+	"dap":       dapCommand,
+	"debug":     debugCommand,
+	"disasm":    disasmCommand,
+	"memcard":   memcardCommand,
+	"tracediff": tracediffCommand,
+}
+
 func main() {
-	bios, err := os.ReadFile("SCPH1001.bin")
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
+	run(os.Args[1:])
+}
+
+func run(args []string) {
+	flags := flag.NewFlagSet("ps", flag.ExitOnError)
+	gdb := flags.String("gdb", "", "wait for GDB to attach on a TCP address (\"localhost:3333\") or a Unix socket (\"unix:PATH\")")
+	limit := flags.Int("steps", 0, "stop after this many CPU cycles, 0 runs forever")
+	m := newMachine(flags, args)
+
+	if *gdb != "" {
+		if err := serveGDB(m, *gdb); err != nil {
+			log.Fatal(err)
+		}
+		if code, exited := m.Bus.ExitCode(); exited {
+			m.close()
+			os.Exit(code)
+		}
+	}
+
+	for steps := 0; *limit == 0 || steps < *limit; steps += uniromPollInterval {
+		if m.shim != nil {
+			m.shim.Service(m.CPU, m.Bus)
+		}
+		n := uniromPollInterval
+		if *limit != 0 && *limit-steps < n {
+			n = *limit - steps
+		}
+		err := m.RunCycles(n)
+		if exit, ok := err.(*ps.ExitError); ok {
+			m.close()
+			os.Exit(exit.Code)
+		}
+		if err != nil {
+			m.crash(err)
+		}
+	}
+	m.close()
+}
+
+// machine is an emulated console set up from command-line flags.
+type machine struct {
+	*ps.System
+	shim *ps.UniromShim
+	// tapCards are the memory cards in multitaps, which System doesn't see.
+	tapCards []*ps.MemoryCard
+
+	traceFile *os.File
+	// crashPath is where crash reports go instead of stderr if set.
+	crashPath string
+}
+
+// crash reports that emulation stopped with err and exits.
+func (m *machine) crash(err error) {
+	m.close()
+	report, ok := err.(*ps.CrashReport)
+	if !ok {
+		log.Fatal(err)
+	}
+	if m.crashPath == "" {
+		report.WriteTo(os.Stderr)
+		os.Exit(1)
+	}
+	file, err := os.Create(m.crashPath)
+	if err == nil {
+		_, err = report.WriteTo(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Printf("writing the crash report: %v", err)
+	}
+	log.Fatalf("%v, report written to %s", report, m.crashPath)
+}
+
+// close writes out the output that is still buffered and reports write errors.
+func (m *machine) close() {
+	if err := m.Flush(); err != nil {
+		log.Print(err)
+	}
+	for _, card := range m.tapCards {
+		if err := card.Err(); err != nil {
+			log.Printf("memory card: %v", err)
+		}
+	}
+	if m.traceFile == nil {
+		return
+	}
+	if err := m.traceFile.Close(); err != nil {
+		log.Printf("trace: %v", err)
+	}
+}
+
+// newMachine defines the flags shared by the emulator and the debugger on
+// flags, parses args and sets up a machine accordingly.
+func newMachine(flags *flag.FlagSet, args []string) *machine {
+	biosPath := flags.String("bios", "SCPH1001.bin", "BIOS image")
+	cards := [2]*string{
+		flags.String("card1", "", "memory card image (.mcr/.mcd) for slot 1"),
+		flags.String("card2", "", "memory card image (.mcr/.mcd) for slot 2"),
+	}
+	multitaps := [2]*bool{
+		flags.Bool("multitap1", false, "plug a multitap with four controllers into port 1"),
+		flags.Bool("multitap2", false, "plug a multitap with four controllers into port 2"),
+	}
+	serial := flags.String("serial", "", "connect the serial port to a new pty (\"pty\") or a Unix socket (\"unix:PATH\")")
+	exePath := flags.String("exe", "", "PS-X EXE or ELF program to run once the BIOS has initialized the kernel")
+	unirom := flags.Bool("unirom", false, "answer Unirom serial commands (nops) in the emulator instead of passing them to the guest")
+	hle := flags.Bool("hle", false, "emulate the BIOS kernel instead of running a BIOS image")
+	traceKernel := flags.Bool("tracekernel", false, "log calls to the BIOS kernel functions with their arguments and results")
+	pcdrv := flags.String("pcdrv", "", "serve PCdrv file system calls from this host directory")
+	cdrom := flags.String("cdrom", "", "disc image (.iso/.bin) to boot with the emulated BIOS")
+	trace := flags.String("trace", "", "record a binary execution trace to this file, see ps tracediff")
+	crash := flags.String("crash", "", "write crash reports to this file instead of stderr")
+	flags.Parse(args)
+
+	config := ps.Config{TTY: os.Stdout, Log: os.Stderr}
+	bios, err := os.ReadFile(*biosPath)
+	if os.IsNotExist(err) && !*hle {
+		log.Printf("%s not found, emulating the BIOS", *biosPath)
+		*hle = true
+	}
+	if !*hle {
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.BIOS = bios
+	} else if *cdrom != "" {
+		if config.Disc, err = ps.OpenDisc(*cdrom); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *exePath != "" {
+		if config.Program, err = ps.OpenProgram(*exePath); err != nil {
+			log.Fatal(err)
+		}
+		if elf, ok := config.Program.(*ps.ELF); ok && elf.LinesErr != nil {
+			log.Printf("elf: ignoring line tables: %v", elf.LinesErr)
+		}
+	}
+
+	m := &machine{crashPath: *crash}
+	for port := range multitaps {
+		var card *ps.MemoryCard
+		if *cards[port] != "" {
+			card, err = ps.OpenMemoryCard(*cards[port])
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		// With a multitap, the memory card goes into sub-port A.
+		if *multitaps[port] {
+			tap := ps.NewMultitap()
+			for i := range tap.Controllers {
+				tap.Connect(i, ps.NewDualShock())
+			}
+			if card != nil {
+				tap.InsertMemoryCard(0, card)
+				m.tapCards = append(m.tapCards, card)
+			}
+			config.Controllers[port] = tap
+			continue
+		}
+
+		if port == 0 {
+			config.Controllers[port] = ps.NewDualShock()
+		}
+		config.MemoryCards[port] = card
+	}
+
+	if *trace != "" {
+		m.traceFile, err = os.Create(*trace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Trace = m.traceFile
+	}
+
+	if m.System, err = ps.NewSystem(config); err != nil {
+		log.Fatal(err)
+	}
+	bus, cpu := m.Bus, m.CPU
+	if *traceKernel {
+		cpu.Tracer = ps.NewKernelTracer()
+	}
+	if *pcdrv != "" {
+		cpu.PCdrv = ps.NewPCdrv(*pcdrv)
+	}
+
+	if *serial != "" {
+		link, err := openSerial(*serial)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *unirom {
+			m.shim = ps.NewUniromShim(link)
+		} else {
+			bus.ConnectSerial(link)
+		}
+	}
+
+	return m
+}
+
+// serveGDB waits for a GDB connection on addr and lets it control the machine
+// until it detaches. The program keeps running after that.
+func serveGDB(m *machine, addr string) error {
+	var listener net.Listener
+	var err error
+	if strings.HasPrefix(addr, "unix:") {
+		listener, err = ps.ListenUnix(strings.TrimPrefix(addr, "unix:"))
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
 	if err != nil {
-		panic(err)
+		return err
 	}
+	log.Printf("waiting for gdb on %s", listener.Addr())
+	conn, err := listener.Accept()
+	listener.Close()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	d := ps.NewDebugger(m.CPU, m.Bus)
+	defer m.Bus.SetMemoryHook(nil)
+	err = ps.ServeGDB(d, conn)
+	if errors.Is(err, ps.ErrKilled) {
+		m.close()
+		os.Exit(0)
+	}
+	return err
+}
 
-	bus := ps.NewBus(bios)
-	cpu := ps.NewCPU()
+// uniromPollInterval is the number of instructions between checks for pending
+// Unirom commands.
+const uniromPollInterval = 4096
 
-	for {
-		cpu.Cycle(&bus)
+func openSerial(spec string) (io.ReadWriter, error) {
+	if spec == "pty" {
+		master, name, err := ps.OpenPTY()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("serial port connected to %s", name)
+		return master, nil
 	}
+
+	if strings.HasPrefix(spec, "unix:") {
+		path := strings.TrimPrefix(spec, "unix:")
+		log.Printf("waiting for a serial connection on %s", path)
+		return ps.AcceptSerialSocket(path)
+	}
+
+	return nil, fmt.Errorf("unknown serial link %q", spec)
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/weqqr/ps/memcard"
+)
+
+const memcardUsage = `usage: ps memcard <command> [arguments]
+
+commands:
+  list CARD              list the saves on CARD
+  export CARD N FILE     write save N to FILE (.mcs, .psv, .mcb)
+  import CARD FILE       copy a single save into CARD
+  delete CARD N          delete save N
+  icon CARD N FILE       render the icon of save N to FILE (.png, .gif)
+  convert CARD FILE      convert CARD to FILE (.mcr, .gme, .vmp, .vgs)
+  format CARD            create an empty card
+
+Saves are numbered from 1 in the order printed by list.
+`
+
+func memcardCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, memcardUsage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		err = memcardList(args[1:])
+	case "export":
+		err = memcardExport(args[1:])
+	case "import":
+		err = memcardImport(args[1:])
+	case "delete":
+		err = memcardDelete(args[1:])
+	case "icon":
+		err = memcardIcon(args[1:])
+	case "convert":
+		err = memcardConvert(args[1:])
+	case "format":
+		err = memcardFormat(args[1:])
+	default:
+		fmt.Fprint(os.Stderr, memcardUsage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ps memcard %s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
+
+func expectArgs(args []string, count int) error {
+	if len(args) != count {
+		return fmt.Errorf("expected %d arguments, got %d", count, len(args))
+	}
+	return nil
+}
+
+// openSave opens the card at path and returns it with its n-th save.
+func openSave(path, n string) (*memcard.Card, *memcard.Save, error) {
+	card, err := memcard.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	saves, err := card.Saves()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	index, err := strconv.Atoi(n)
+	if err != nil || index < 1 || index > len(saves) {
+		return nil, nil, fmt.Errorf("no save %q on %s", n, path)
+	}
+
+	return card, saves[index-1], nil
+}
+
+func memcardList(args []string) error {
+	if err := expectArgs(args, 1); err != nil {
+		return err
+	}
+
+	card, err := memcard.Open(args[0])
+	if err != nil {
+		return err
+	}
+
+	saves, err := card.Saves()
+	if err != nil {
+		return err
+	}
+
+	for i, save := range saves {
+		fmt.Printf("%2d  %-20s  %2d  %s\n", i+1, save.Filename, save.BlockCount(), save.Title())
+	}
+	fmt.Printf("%d blocks free\n", card.FreeBlocks())
+	return nil
+}
+
+func memcardExport(args []string) error {
+	if err := expectArgs(args, 3); err != nil {
+		return err
+	}
+
+	_, save, err := openSave(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	return save.WriteFile(args[2])
+}
+
+func memcardImport(args []string) error {
+	if err := expectArgs(args, 2); err != nil {
+		return err
+	}
+
+	card, err := memcard.Open(args[0])
+	if err != nil {
+		return err
+	}
+
+	save, err := memcard.OpenSave(args[1])
+	if err != nil {
+		return err
+	}
+
+	if err := card.Import(save); err != nil {
+		return err
+	}
+
+	return card.WriteFile(args[0])
+}
+
+func memcardDelete(args []string) error {
+	if err := expectArgs(args, 2); err != nil {
+		return err
+	}
+
+	card, save, err := openSave(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	card.Delete(save)
+	return card.WriteFile(args[0])
+}
+
+func memcardIcon(args []string) error {
+	if err := expectArgs(args, 3); err != nil {
+		return err
+	}
+
+	_, save, err := openSave(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	var encode func(w io.Writer) error
+	switch strings.ToLower(filepath.Ext(args[2])) {
+	case ".png":
+		encode = save.WritePNG
+	case ".gif":
+		encode = save.WriteGIF
+	default:
+		return fmt.Errorf("unknown image format %q", filepath.Ext(args[2]))
+	}
+
+	file, err := os.Create(args[2])
+	if err != nil {
+		return err
+	}
+	err = encode(file)
+	info, statErr := file.Stat()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	// Don't leave a truncated image behind, but never remove devices such
+	// as /dev/stdout.
+	if err != nil && statErr == nil && info.Mode().IsRegular() {
+		os.Remove(args[2])
+	}
+	return err
+}
+
+func memcardConvert(args []string) error {
+	if err := expectArgs(args, 2); err != nil {
+		return err
+	}
+
+	card, err := memcard.Open(args[0])
+	if err != nil {
+		return err
+	}
+
+	return card.WriteFile(args[1])
+}
+
+func memcardFormat(args []string) error {
+	if err := expectArgs(args, 1); err != nil {
+		return err
+	}
+
+	return memcard.New().WriteFile(args[0])
+}
@@ -0,0 +1,383 @@
+// Package memcard reads and writes PlayStation memory card images and the
+// saves stored on them.
+// http://problemkaputt.de/psx-spx.htm#memorycarddataformat
+package memcard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	Size      = 128 * 1024
+	FrameSize = 128
+	BlockSize = 8192
+	Blocks    = 16
+
+	// SaveBlocks is the number of blocks available for saves. Block 0 holds
+	// the directory.
+	SaveBlocks = Blocks - 1
+)
+
+// Directory frame allocation states
+const (
+	stateFirst        = 0x51
+	stateMiddle       = 0x52
+	stateLast         = 0x53
+	stateFree         = 0xA0
+	stateDeletedFirst = 0xA1
+	stateDeletedLast  = 0xA3
+)
+
+const noBlock = 0xFFFF
+
+var (
+	ErrNotFormatted = errors.New("memcard: card is not formatted")
+	ErrFull         = errors.New("memcard: not enough free blocks")
+)
+
+// Card is a raw memory card image.
+type Card struct {
+	Data [Size]byte
+}
+
+// New returns a freshly formatted card.
+func New() *Card {
+	card := &Card{}
+	card.Format()
+	return card
+}
+
+// Format erases the card and writes an empty directory.
+func (card *Card) Format() {
+	card.Data = [Size]byte{}
+
+	header := card.frame(0)
+	copy(header, "MC")
+	setChecksum(header)
+
+	for i := 1; i <= SaveBlocks; i++ {
+		entry := card.frame(i)
+		entry[0] = stateFree
+		binary.LittleEndian.PutUint16(entry[8:], noBlock)
+		setChecksum(entry)
+	}
+
+	// Broken sector list
+	for i := 16; i < 36; i++ {
+		frame := card.frame(i)
+		binary.LittleEndian.PutUint32(frame[0:], 0xFFFFFFFF)
+		binary.LittleEndian.PutUint16(frame[8:], noBlock)
+		setChecksum(frame)
+	}
+
+	copy(card.frame(63), header)
+}
+
+// Formatted reports whether the card has a valid directory header.
+func (card *Card) Formatted() bool {
+	return bytes.HasPrefix(card.frame(0), []byte("MC"))
+}
+
+// frame returns frame i of the directory block.
+func (card *Card) frame(i int) []byte {
+	return card.Data[i*FrameSize : (i+1)*FrameSize]
+}
+
+func (card *Card) block(i int) []byte {
+	return card.Data[i*BlockSize : (i+1)*BlockSize]
+}
+
+func checksum(frame []byte) byte {
+	var sum byte
+	for _, b := range frame[:FrameSize-1] {
+		sum ^= b
+	}
+	return sum
+}
+
+func setChecksum(frame []byte) {
+	frame[FrameSize-1] = checksum(frame)
+}
+
+// Saves returns the saves stored on the card in directory order.
+func (card *Card) Saves() ([]*Save, error) {
+	if !card.Formatted() {
+		return nil, ErrNotFormatted
+	}
+
+	var saves []*Save
+	for i := 1; i <= SaveBlocks; i++ {
+		entry := card.frame(i)
+		if entry[0] != stateFirst {
+			continue
+		}
+
+		save := &Save{
+			Filename: cString(entry[0x0A:0x1E]),
+		}
+
+		for block := i; ; {
+			if block < 1 || block > SaveBlocks || len(save.Blocks) == SaveBlocks {
+				return nil, fmt.Errorf("memcard: broken block chain in save %q", save.Filename)
+			}
+			save.Blocks = append(save.Blocks, block)
+			save.Data = append(save.Data, card.block(block)...)
+
+			next := binary.LittleEndian.Uint16(card.frame(block)[8:])
+			if next == noBlock {
+				break
+			}
+			block = int(next) + 1
+		}
+
+		saves = append(saves, save)
+	}
+
+	return saves, nil
+}
+
+// FreeBlocks returns the number of blocks that aren't used by any save.
+func (card *Card) FreeBlocks() int {
+	return len(card.freeBlocks())
+}
+
+func (card *Card) freeBlocks() []int {
+	var free []int
+	for i := 1; i <= SaveBlocks; i++ {
+		state := card.frame(i)[0]
+		if state == stateFree || (state >= stateDeletedFirst && state <= stateDeletedLast) {
+			free = append(free, i)
+		}
+	}
+	return free
+}
+
+// Import writes save to free blocks of the card. save.Blocks is updated to
+// the blocks the save now occupies.
+func (card *Card) Import(save *Save) error {
+	if !card.Formatted() {
+		return ErrNotFormatted
+	}
+
+	count := save.BlockCount()
+	if count == 0 {
+		return fmt.Errorf("memcard: save %q is empty", save.Filename)
+	}
+
+	free := card.freeBlocks()
+	if len(free) < count {
+		return ErrFull
+	}
+
+	blocks := free[:count]
+	for n, block := range blocks {
+		entry := card.frame(block)
+		for i := range entry {
+			entry[i] = 0
+		}
+
+		switch {
+		case n == 0:
+			entry[0] = stateFirst
+			binary.LittleEndian.PutUint32(entry[4:], uint32(count*BlockSize))
+			copy(entry[0x0A:0x1E], save.Filename)
+		case n == count-1:
+			entry[0] = stateLast
+		default:
+			entry[0] = stateMiddle
+		}
+
+		next := uint16(noBlock)
+		if n < count-1 {
+			next = uint16(blocks[n+1] - 1)
+		}
+		binary.LittleEndian.PutUint16(entry[8:], next)
+		setChecksum(entry)
+
+		data := card.block(block)
+		for i := range data {
+			data[i] = 0
+		}
+		copy(data, save.Data[n*BlockSize:])
+	}
+
+	save.Blocks = append([]int(nil), blocks...)
+	return nil
+}
+
+// Delete marks the blocks of save as deleted. The data is kept, as the BIOS
+// does, until the blocks are reused.
+func (card *Card) Delete(save *Save) {
+	for _, block := range save.Blocks {
+		entry := card.frame(block)
+		if entry[0] >= stateFirst && entry[0] <= stateLast {
+			entry[0] += stateDeletedFirst - stateFirst
+			setChecksum(entry)
+		}
+	}
+}
+
+// CardFormat is a memory card image file format.
+type CardFormat string
+
+const (
+	// FormatRaw is a plain 128 KiB dump (.mcr, .mcd).
+	FormatRaw CardFormat = "raw"
+	// FormatGME is the InterAct DexDrive format (.gme).
+	FormatGME CardFormat = "gme"
+	// FormatVMP is the PSP virtual memory card format (.vmp). The PSP checks
+	// a signature that isn't generated here, so exported cards have to be
+	// resigned before they can be used on a PSP.
+	FormatVMP CardFormat = "vmp"
+	// FormatVGS is the Connectix Virtual Game Station format (.vgs).
+	FormatVGS CardFormat = "vgs"
+)
+
+const (
+	gmeMagic      = "123-456-STD"
+	gmeHeaderSize = 0xF40
+	vmpMagic      = "\x00PMV"
+	vmpHeaderSize = 0x80
+	vgsMagic      = "VgsM"
+	vgsHeaderSize = 0x40
+)
+
+// CardFormatFromPath picks a card format based on the file extension.
+func CardFormatFromPath(path string) (CardFormat, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mcr", ".mcd", ".mc", ".bin", ".ddf":
+		return FormatRaw, nil
+	case ".gme":
+		return FormatGME, nil
+	case ".vmp":
+		return FormatVMP, nil
+	case ".vgs", ".mem":
+		return FormatVGS, nil
+	}
+	return "", fmt.Errorf("memcard: unknown card format %q", filepath.Ext(path))
+}
+
+// Decode parses a card image in any supported format.
+func Decode(data []byte) (*Card, error) {
+	var offset int
+	switch {
+	case len(data) == Size:
+		offset = 0
+	case bytes.HasPrefix(data, []byte(gmeMagic)):
+		offset = gmeHeaderSize
+	case bytes.HasPrefix(data, []byte(vmpMagic)):
+		offset = vmpHeaderSize
+	case bytes.HasPrefix(data, []byte(vgsMagic)):
+		offset = vgsHeaderSize
+	default:
+		return nil, errors.New("memcard: unrecognized card image")
+	}
+
+	if len(data)-offset != Size {
+		return nil, fmt.Errorf("memcard: card image has %d bytes of data, expected %d", len(data)-offset, Size)
+	}
+
+	card := &Card{}
+	copy(card.Data[:], data[offset:])
+	return card, nil
+}
+
+// Encode returns the card image in the given format.
+func (card *Card) Encode(format CardFormat) ([]byte, error) {
+	var header []byte
+
+	switch format {
+	case FormatRaw:
+	case FormatGME:
+		header = make([]byte, gmeHeaderSize)
+		copy(header, gmeMagic)
+		header[0x12] = 0x01
+		header[0x14] = 0x01
+		header[0x15] = 'M'
+		for i := 0; i < SaveBlocks; i++ {
+			entry := card.frame(i + 1)
+			header[0x16+i] = entry[0]
+			header[0x26+i] = entry[8]
+		}
+	case FormatVMP:
+		header = make([]byte, vmpHeaderSize)
+		copy(header, vmpMagic)
+		binary.LittleEndian.PutUint32(header[4:], vmpHeaderSize)
+	case FormatVGS:
+		header = make([]byte, vgsHeaderSize)
+		copy(header, vgsMagic)
+		binary.LittleEndian.PutUint32(header[4:], 1)
+		binary.LittleEndian.PutUint32(header[8:], 1)
+		binary.LittleEndian.PutUint32(header[12:], 1)
+	default:
+		return nil, fmt.Errorf("memcard: unknown card format %q", format)
+	}
+
+	return append(header, card.Data[:]...), nil
+}
+
+// Open reads a card image from path.
+func Open(path string) (*Card, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(data)
+}
+
+// WriteFile writes the card to path in the format implied by its extension.
+// The file is replaced in one step, so a failed write keeps the old image.
+func (card *Card) WriteFile(path string) error {
+	format, err := CardFormatFromPath(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := card.Encode(format)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, data)
+}
+
+// writeFile replaces the file at path with data through a temporary file, so
+// that a crash or a full disk can't leave a half-written image behind.
+func writeFile(path string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Chmod(0644); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,157 @@
+package memcard
+
+import (
+	"bytes"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testSave(blocks int) *Save {
+	data := make([]byte, blocks*BlockSize)
+	copy(data, "SC")
+	data[0x02] = 0x12
+	data[0x03] = byte(blocks)
+	// "ＰＳ　１" followed by hiragana "あ"
+	copy(data[0x04:], []byte{0x82, 0x6F, 0x82, 0x72, 0x81, 0x40, 0x82, 0x50, 0x82, 0xA0})
+	data[0x60] = 0x1F // palette entry 0 is red, 1 is transparent
+	for i := 0; i < 128; i++ {
+		data[FrameSize+i] = 0x10
+		data[FrameSize*2+i] = 0x01
+	}
+
+	return &Save{Filename: "BASLUS-00067TEST", Data: data}
+}
+
+func TestImportExport(t *testing.T) {
+	card := New()
+	save := testSave(2)
+
+	if err := card.Import(save); err != nil {
+		t.Fatal(err)
+	}
+	if card.FreeBlocks() != SaveBlocks-2 {
+		t.Fatalf("%d free blocks", card.FreeBlocks())
+	}
+
+	saves, err := card.Saves()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saves) != 1 {
+		t.Fatalf("%d saves", len(saves))
+	}
+
+	read := saves[0]
+	if read.ProductCode() != "SLUS-00067" || read.Identifier() != "TEST" || read.Region() != "BA" {
+		t.Fatalf("bad filename %q", read.Filename)
+	}
+	if read.Title() != "ＰＳ　１あ" {
+		t.Fatalf("bad title %q", read.Title())
+	}
+	if !bytes.Equal(read.Data, save.Data) {
+		t.Fatal("save data mismatch")
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"save.mcs", "save.psv", "BASLUS-00067TEST.mcb"} {
+		path := filepath.Join(dir, name)
+		if err := read.WriteFile(path); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := OpenSave(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Filename != read.Filename || !bytes.Equal(loaded.Data, read.Data) {
+			t.Fatalf("%s: round trip mismatch", name)
+		}
+	}
+
+	card.Delete(read)
+	if card.FreeBlocks() != SaveBlocks {
+		t.Fatalf("%d free blocks after delete", card.FreeBlocks())
+	}
+}
+
+func TestCardFormats(t *testing.T) {
+	card := New()
+	if err := card.Import(testSave(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"card.mcr", "card.gme", "card.vmp", "card.vgs"} {
+		path := filepath.Join(dir, name)
+		if err := card.WriteFile(path); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Data != card.Data {
+			t.Fatalf("%s: round trip mismatch", name)
+		}
+	}
+
+	// Writing goes through temporary files, which don't stay behind.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("%d files after writing 4 cards", len(entries))
+	}
+	info, err := os.Stat(filepath.Join(dir, "card.mcr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Fatalf("card written with mode %v", info.Mode())
+	}
+}
+
+func TestIcons(t *testing.T) {
+	save := testSave(1)
+
+	icons := save.Icons()
+	if len(icons) != 2 {
+		t.Fatalf("%d icon frames", len(icons))
+	}
+	if r, _, _, a := icons[0].At(0, 0).RGBA(); r != 0xFFFF || a != 0xFFFF {
+		t.Fatal("pixel (0, 0) of frame 0 should be red")
+	}
+	if _, _, _, a := icons[0].At(1, 0).RGBA(); a != 0 {
+		t.Fatal("pixel (1, 0) of frame 0 should be transparent")
+	}
+
+	var buffer bytes.Buffer
+	if err := save.WriteGIF(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	animation, err := gif.DecodeAll(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(animation.Image) != 2 {
+		t.Fatalf("%d GIF frames", len(animation.Image))
+	}
+}
+
+func TestShiftJIS(t *testing.T) {
+	for _, test := range []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte{0x88, 0x9F, 0xEA, 0xA4, 0x82, 0xA0, 'A', 0xB1, 0, 'B'}, "亜熙あAｱ"},
+		// The last kanji of level 1, the unassigned cell after it and a
+		// lone lead byte
+		{[]byte{0x98, 0x72, 0x98, 0x73, 0x88}, "腕��"},
+	} {
+		if s := DecodeShiftJIS(test.data); s != test.expected {
+			t.Errorf("% X: got %q, want %q", test.data, s, test.expected)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package memcard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	IconSize = 16
+
+	// iconFrameDelay is the time each icon frame is shown by the BIOS, in
+	// 1/100 s (16 frames at 60 Hz).
+	iconFrameDelay = 27
+)
+
+// Save is a file stored on a memory card.
+type Save struct {
+	// Filename is the directory name, e.g. "BASLUS-00067DRAX00". It consists
+	// of the region, the product code and a game-specific identifier.
+	Filename string
+
+	// Blocks lists the card blocks the save occupies, in chain order. It is
+	// empty for saves that were not read from a card.
+	Blocks []int
+
+	// Data is the save contents, a whole number of blocks long. It starts
+	// with the title frame followed by the icon frames.
+	Data []byte
+}
+
+// Region returns the region prefix of the filename: "BI" (Japan), "BA"
+// (America) or "BE" (Europe).
+func (save *Save) Region() string {
+	if len(save.Filename) < 2 {
+		return ""
+	}
+	return save.Filename[:2]
+}
+
+// ProductCode returns the product code of the game, e.g. "SLUS-00067".
+func (save *Save) ProductCode() string {
+	if len(save.Filename) < 12 {
+		return ""
+	}
+	return save.Filename[2:12]
+}
+
+// Identifier returns the game-specific part of the filename.
+func (save *Save) Identifier() string {
+	if len(save.Filename) < 12 {
+		return ""
+	}
+	return save.Filename[12:]
+}
+
+// BlockCount returns the number of card blocks needed to store the save.
+func (save *Save) BlockCount() int {
+	return (len(save.Data) + BlockSize - 1) / BlockSize
+}
+
+func (save *Save) hasTitleFrame() bool {
+	return len(save.Data) >= FrameSize*2 && bytes.HasPrefix(save.Data, []byte("SC"))
+}
+
+// Title returns the title shown by the BIOS memory card manager, decoded from
+// Shift-JIS.
+func (save *Save) Title() string {
+	if !save.hasTitleFrame() {
+		return ""
+	}
+	return DecodeShiftJIS(save.Data[0x04:0x44])
+}
+
+// Icons returns the frames of the save icon. Palette entry 0000h is
+// transparent.
+func (save *Save) Icons() []*image.Paletted {
+	if !save.hasTitleFrame() {
+		return nil
+	}
+
+	count := int(save.Data[0x02] & 0x03)
+	if count > 3 || len(save.Data) < FrameSize*(count+1) {
+		return nil
+	}
+
+	palette := make(color.Palette, 16)
+	for i := range palette {
+		palette[i] = decodeColor(binary.LittleEndian.Uint16(save.Data[0x60+i*2:]))
+	}
+
+	icons := make([]*image.Paletted, count)
+	for n := range icons {
+		icon := image.NewPaletted(image.Rect(0, 0, IconSize, IconSize), palette)
+		bitmap := save.Data[FrameSize*(n+1):]
+		for i := 0; i < IconSize*IconSize/2; i++ {
+			icon.Pix[i*2] = bitmap[i] & 0x0F
+			icon.Pix[i*2+1] = bitmap[i] >> 4
+		}
+		icons[n] = icon
+	}
+
+	return icons
+}
+
+// decodeColor converts a 15-bit BGR color to RGBA.
+func decodeColor(value uint16) color.Color {
+	if value == 0 {
+		return color.RGBA{}
+	}
+
+	expand := func(c uint16) uint8 {
+		c &= 0x1F
+		return uint8(c<<3 | c>>2)
+	}
+	return color.RGBA{R: expand(value), G: expand(value >> 5), B: expand(value >> 10), A: 0xFF}
+}
+
+// WritePNG writes the first icon frame as a PNG image.
+func (save *Save) WritePNG(w io.Writer) error {
+	icons := save.Icons()
+	if len(icons) == 0 {
+		return errors.New("memcard: save has no icon")
+	}
+	return png.Encode(w, icons[0])
+}
+
+// WriteGIF writes the icon as an animated GIF image.
+func (save *Save) WriteGIF(w io.Writer) error {
+	icons := save.Icons()
+	if len(icons) == 0 {
+		return errors.New("memcard: save has no icon")
+	}
+
+	animation := &gif.GIF{}
+	for _, icon := range icons {
+		animation.Image = append(animation.Image, icon)
+		animation.Delay = append(animation.Delay, iconFrameDelay)
+		animation.Disposal = append(animation.Disposal, gif.DisposalBackground)
+	}
+	return gif.EncodeAll(w, animation)
+}
+
+// SaveFormat is a single save file format.
+type SaveFormat string
+
+const (
+	// FormatMCS is the PSXGameEdit/Memory Juggler format (.mcs): a directory
+	// frame followed by the save data.
+	FormatMCS SaveFormat = "mcs"
+	// FormatPSV is the PS3 virtual memory card export (.psv). The signature
+	// checked by the PS3 isn't generated, so exported saves have to be
+	// resigned before being copied to a PS3.
+	FormatPSV SaveFormat = "psv"
+	// FormatMCB is the Smart Link format (.mcb): raw save data, named after
+	// the file.
+	FormatMCB SaveFormat = "mcb"
+)
+
+const (
+	psvMagic      = "\x00VSP"
+	psvHeaderSize = 0x84
+)
+
+// SaveFormatFromPath picks a save format based on the file extension.
+func SaveFormatFromPath(path string) (SaveFormat, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mcs":
+		return FormatMCS, nil
+	case ".psv":
+		return FormatPSV, nil
+	case ".mcb":
+		return FormatMCB, nil
+	}
+	return "", fmt.Errorf("memcard: unknown save format %q", filepath.Ext(path))
+}
+
+// DecodeSave parses a single save. name is used as the filename for formats
+// that don't store one.
+func DecodeSave(data []byte, format SaveFormat, name string) (*Save, error) {
+	save := &Save{}
+
+	switch format {
+	case FormatMCS:
+		if len(data) < FrameSize || data[0] != stateFirst {
+			return nil, errors.New("memcard: invalid MCS header")
+		}
+		save.Filename = cString(data[0x0A:0x1E])
+		save.Data = data[FrameSize:]
+	case FormatPSV:
+		if len(data) < psvHeaderSize || !bytes.HasPrefix(data, []byte(psvMagic)) {
+			return nil, errors.New("memcard: invalid PSV header")
+		}
+		if data[0x3C] != 1 {
+			return nil, errors.New("memcard: PSV file doesn't contain a PS1 save")
+		}
+		save.Filename = cString(data[0x64 : 0x64+20])
+		save.Data = data[psvHeaderSize:]
+	case FormatMCB:
+		save.Filename = name
+		save.Data = data
+	default:
+		return nil, fmt.Errorf("memcard: unknown save format %q", format)
+	}
+
+	if len(save.Data) == 0 || len(save.Data)%BlockSize != 0 {
+		return nil, fmt.Errorf("memcard: save size %d isn't a multiple of the block size", len(save.Data))
+	}
+	if save.BlockCount() > SaveBlocks {
+		return nil, fmt.Errorf("memcard: save is %d blocks long", save.BlockCount())
+	}
+
+	save.Data = append([]byte(nil), save.Data...)
+	return save, nil
+}
+
+// Encode returns the save in the given format.
+func (save *Save) Encode(format SaveFormat) ([]byte, error) {
+	var header []byte
+
+	switch format {
+	case FormatMCS:
+		header = make([]byte, FrameSize)
+		header[0] = stateFirst
+		binary.LittleEndian.PutUint32(header[4:], uint32(len(save.Data)))
+		binary.LittleEndian.PutUint16(header[8:], noBlock)
+		copy(header[0x0A:0x1E], save.Filename)
+		setChecksum(header)
+	case FormatPSV:
+		header = make([]byte, psvHeaderSize)
+		copy(header, psvMagic)
+		header[0x38] = 0x14
+		header[0x3C] = 1
+		binary.LittleEndian.PutUint32(header[0x40:], uint32(len(save.Data)))
+		binary.LittleEndian.PutUint32(header[0x44:], psvHeaderSize)
+		copy(header[0x64:0x64+20], save.Filename)
+	case FormatMCB:
+	default:
+		return nil, fmt.Errorf("memcard: unknown save format %q", format)
+	}
+
+	return append(header, save.Data...), nil
+}
+
+// OpenSave reads a single save from path.
+func OpenSave(path string) (*Save, error) {
+	format, err := SaveFormatFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return DecodeSave(data, format, name)
+}
+
+// WriteFile writes the save to path in the format implied by its extension.
+func (save *Save) WriteFile(path string) error {
+	format, err := SaveFormatFromPath(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := save.Encode(format)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, data)
+}
@@ -0,0 +1,138 @@
+package memcard
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// JIS X 0208 row 1 and the start of row 2: punctuation and symbols.
+var jisSymbols = []rune(
+	"　、。，．・：；？！゛゜´｀¨＾￣＿ヽヾゝゞ〃仝々〆〇ー―‐／＼～∥｜…‥‘’“”（）〔〕［］｛｝〈〉《》「」『』【】" +
+		"＋－±×÷＝≠＜＞≦≧∞∴♂♀°′″℃￥＄￠￡％＃＆＊＠§☆★○●◎◇" +
+		"◆□■△▲▽▼※〒→←↑↓〓")
+
+// jisRune returns the character at the given JIS X 0208 row and cell (both
+// starting at 1). The mathematical symbols at the end of row 2 and the box
+// drawing characters of row 8 are not supported.
+func jisRune(row, cell int) rune {
+	if row >= 16 && row <= 84 {
+		return jisKanji[(row-16)*94+cell-1]
+	}
+
+	switch row {
+	case 1:
+		return jisSymbols[cell-1]
+	case 2:
+		if cell <= 14 {
+			return jisSymbols[94+cell-1]
+		}
+	case 3:
+		switch {
+		case cell >= 16 && cell <= 25:
+			return '０' + rune(cell-16)
+		case cell >= 33 && cell <= 58:
+			return 'Ａ' + rune(cell-33)
+		case cell >= 65 && cell <= 90:
+			return 'ａ' + rune(cell-65)
+		}
+	case 4:
+		if cell <= 83 {
+			return 'ぁ' + rune(cell-1)
+		}
+	case 5:
+		if cell <= 86 {
+			return 'ァ' + rune(cell-1)
+		}
+	case 6:
+		switch {
+		case cell >= 1 && cell <= 24:
+			return greek(cell-1, 'Α')
+		case cell >= 33 && cell <= 56:
+			return greek(cell-33, 'α')
+		}
+	case 7:
+		switch {
+		case cell >= 1 && cell <= 33:
+			return cyrillic(cell-1, 'А', 'Ё')
+		case cell >= 49 && cell <= 81:
+			return cyrillic(cell-49, 'а', 'ё')
+		}
+	}
+	return utf8.RuneError
+}
+
+// greek skips the unassigned code point between Ρ and Σ.
+func greek(index int, first rune) rune {
+	if index >= 17 {
+		index++
+	}
+	return first + rune(index)
+}
+
+// cyrillic places Ё after Е, as in the JIS ordering.
+func cyrillic(index int, first, yo rune) rune {
+	switch {
+	case index < 6:
+		return first + rune(index)
+	case index == 6:
+		return yo
+	default:
+		return first + rune(index-1)
+	}
+}
+
+// DecodeShiftJIS decodes a zero-terminated Shift-JIS string. Characters that
+// can't be decoded are replaced with U+FFFD.
+func DecodeShiftJIS(b []byte) string {
+	var s strings.Builder
+
+	for i := 0; i < len(b); i++ {
+		lead := b[i]
+		switch {
+		case lead == 0:
+			return s.String()
+		case lead < 0x80:
+			s.WriteByte(lead)
+			continue
+		case lead >= 0xA1 && lead <= 0xDF:
+			s.WriteRune('｡' + rune(lead-0xA1))
+			continue
+		case (lead < 0x81 || lead > 0x9F) && (lead < 0xE0 || lead > 0xEF):
+			s.WriteRune(utf8.RuneError)
+			continue
+		}
+
+		if i+1 >= len(b) {
+			s.WriteRune(utf8.RuneError)
+			break
+		}
+		i++
+		trail := b[i]
+		if trail < 0x40 || trail == 0x7F || trail > 0xFC {
+			s.WriteRune(utf8.RuneError)
+			continue
+		}
+
+		var row int
+		if lead <= 0x9F {
+			row = int(lead-0x81)*2 + 1
+		} else {
+			row = int(lead-0xC1)*2 + 1
+		}
+
+		var cell int
+		switch {
+		case trail >= 0x9F:
+			row++
+			cell = int(trail-0x9F) + 1
+		case trail >= 0x80:
+			cell = int(trail - 0x40)
+		default:
+			cell = int(trail-0x40) + 1
+		}
+
+		s.WriteRune(jisRune(row, cell))
+	}
+
+	return s.String()
+}
@@ -1,6 +1,7 @@
 package ps
 
 import (
+	"io"
 	"log"
 )
 
@@ -11,21 +12,55 @@ const (
 	FirstExpansionRegion  = 0x1F000000
 	Scratchpad            = 0x1F800000
 	IOPorts               = 0x1F801000
-	SecondExpansionRegion = 0x1F801000
-	ThirdExpansionRegion  = 0x1F802000
+	SecondExpansionRegion = 0x1F802000
+	ThirdExpansionRegion  = 0x1FA00000
 	BIOSAddress           = 0x1FC00000
 	CacheControl          = 0xFFFE0000
 
 	MainRAMSize               = 2048 * 1024
 	FirstExpansionRegionSize  = 8192 * 1024
 	ScratchpadSize            = 1 * 1024
-	IOPortsSize               = 8 * 1024
+	IOPortsSize               = 4 * 1024
 	SecondExpansionRegionSize = 8 * 1024
 	ThirdExpansionRegionSize  = 2048 * 1024
 	BIOSSize                  = 512 * 1024
 	CacheControlSize          = 512
 )
 
+// I/O ports
+// http://problemkaputt.de/psx-spx.htm#iomap
+const (
+	JoypadPort       = 0x1F801040
+	SerialPort       = 0x1F801050
+	InterruptControl = 0x1F801070
+
+	JoypadPortSize       = 16
+	SerialPortSize       = 16
+	InterruptControlSize = 8
+)
+
+// CyclesPerInstruction is the average number of CPU clock cycles it takes to
+// execute a single instruction.
+const CyclesPerInstruction = 2
+
+// Device is a peripheral mapped into the I/O port region or the second
+// expansion region. Offsets are relative
+// to the start of the device's range. Narrow accesses are truncated by the bus.
+type Device interface {
+	Load(offset uint32) uint32
+	Store(offset uint32, value uint32)
+}
+
+// Ticker is implemented by devices that need to advance with the CPU clock.
+type Ticker interface {
+	Tick(cycles uint32)
+}
+
+type mapping struct {
+	start, size uint32
+	device      Device
+}
+
 type MemoryOperation int
 
 const (
@@ -40,6 +75,11 @@ func (op MemoryOperation) String() string {
 	return "store"
 }
 
+// MemoryHook is called after each load and store the CPU makes, with the
+// size of the access in bytes and the value loaded or stored. Instruction
+// fetches are not reported.
+type MemoryHook func(address, size uint32, op MemoryOperation, value uint32)
+
 type Bus struct {
 	mainRAM               []byte
 	firstExpansionRegion  []byte
@@ -49,14 +89,32 @@ type Bus struct {
 	thirdExpansionRegion  []byte
 	bios                  []byte
 	cacheControl          []byte
+
+	devices []mapping
+	tickers []Ticker
+
+	interrupts *Interrupts
+	sio0       *SIO0
+	sio1       *SIO1
+	timing     *VideoTiming
+	debug      *debugPorts
+
+	memoryHook MemoryHook
+	trace      *TraceRecorder
+	history    *History
+
+	// logger receives diagnostics about the guest, nil discards them.
+	logger *log.Logger
 }
 
-func NewBus(bios []byte) Bus {
+func NewBus(bios []byte) (*Bus, error) {
 	if len(bios) != BIOSSize {
-		log.Fatal("Error: BIOSAddress size must be exactly 512 KiB")
+		return nil, ErrBIOSSize
 	}
 
-	return Bus{
+	interrupts := &Interrupts{}
+
+	bus := &Bus{
 		mainRAM:               make([]byte, MainRAMSize),
 		firstExpansionRegion:  make([]byte, FirstExpansionRegionSize),
 		scratchpad:            make([]byte, ScratchpadSize),
@@ -65,20 +123,177 @@ func NewBus(bios []byte) Bus {
 		thirdExpansionRegion:  make([]byte, ThirdExpansionRegionSize),
 		bios:                  bios,
 		cacheControl:          make([]byte, CacheControlSize),
+		interrupts:            interrupts,
+		sio0:                  NewSIO0(interrupts),
+		sio1:                  NewSIO1(interrupts),
+		timing:                NewVideoTiming(interrupts, RegionNTSC),
+		debug:                 &debugPorts{},
 	}
+
+	bus.debug.logf = bus.logf
+	bus.AddTicker(bus.timing)
+
+	bus.Attach(InterruptControl, InterruptControlSize, bus.interrupts)
+	bus.Attach(JoypadPort, JoypadPortSize, bus.sio0)
+	bus.Attach(SerialPort, SerialPortSize, bus.sio1)
+	bus.Attach(DebugPorts, DebugPortsSize, bus.debug)
+
+	return bus, nil
 }
 
 func inRange(value, start, size uint32) bool {
 	return value >= start && value < start+size
 }
 
+// Attach maps device at physical address range [start, start+size). Devices
+// that implement Ticker are also advanced by Tick.
+func (bus *Bus) Attach(start, size uint32, device Device) {
+	bus.devices = append(bus.devices, mapping{start: start, size: size, device: device})
+	if ticker, ok := device.(Ticker); ok {
+		bus.AddTicker(ticker)
+	}
+}
+
+// AddTicker registers a component that isn't memory-mapped to be advanced by
+// Tick.
+func (bus *Bus) AddTicker(ticker Ticker) {
+	bus.tickers = append(bus.tickers, ticker)
+}
+
+// removeTicker stops advancing ticker.
+func (bus *Bus) removeTicker(ticker Ticker) {
+	for i, t := range bus.tickers {
+		if t == ticker {
+			bus.tickers = append(bus.tickers[:i:i], bus.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Tick advances all attached devices by the given number of CPU cycles.
+func (bus *Bus) Tick(cycles uint32) {
+	for _, ticker := range bus.tickers {
+		ticker.Tick(cycles)
+	}
+}
+
+// Interrupts returns the interrupt controller.
+func (bus *Bus) Interrupts() *Interrupts {
+	return bus.interrupts
+}
+
+// Timing returns the video timing, which tracks the beam position.
+func (bus *Bus) Timing() *VideoTiming {
+	return bus.timing
+}
+
+// ConnectController plugs c into the given controller port (0 or 1). Passing
+// nil disconnects the port.
+func (bus *Bus) ConnectController(port int, c Controller) {
+	p := bus.sio0.Port(port)
+	if old, ok := p.Controller.(pluggable); ok {
+		old.unplug(bus)
+	}
+	p.Controller = c
+	if c, ok := c.(pluggable); ok {
+		c.plug(bus)
+	}
+}
+
+// ConnectSerial attaches link to the far end of the serial port (SIO1).
+// Passing nil disconnects it.
+func (bus *Bus) ConnectSerial(link io.ReadWriter) {
+	bus.sio1.Connect(link)
+}
+
+// ConnectConsole maps the DUART used for TTY output to console.
+func (bus *Bus) ConnectConsole(console *Console) {
+	bus.Attach(DUART, DUARTSize, console)
+}
+
+// InsertMemoryCard puts card into the given memory card slot (0 or 1),
+// replacing the card that was there before. Passing nil removes the card.
+func (bus *Bus) InsertMemoryCard(slot int, card *MemoryCard) {
+	port := bus.sio0.Port(slot)
+	port.deselect()
+	if card != nil {
+		card.insert()
+	}
+	port.MemoryCard = card
+}
+
+func (bus *Bus) device(address uint32) (Device, uint32, bool) {
+	address = address & 0x1FFFFFFF
+	if !inRange(address, IOPorts, IOPortsSize) && !inRange(address, SecondExpansionRegion, SecondExpansionRegionSize) {
+		return nil, 0, false
+	}
+
+	for _, m := range bus.devices {
+		if inRange(address, m.start, m.size) {
+			return m.device, address - m.start, true
+		}
+	}
+
+	return nil, 0, false
+}
+
+// SetLogOutput sends diagnostics about the guest, like POST codes and
+// unimplemented kernel functions, to w. They are discarded by default and
+// when w is nil.
+func (bus *Bus) SetLogOutput(w io.Writer) {
+	bus.logger = nil
+	if w != nil {
+		bus.logger = log.New(w, "", log.LstdFlags)
+	}
+}
+
+func (bus *Bus) logf(format string, v ...interface{}) {
+	if bus.logger != nil {
+		bus.logger.Printf(format, v...)
+	}
+}
+
+// SetMemoryHook installs hook to observe memory accesses. Passing nil
+// removes it.
+func (bus *Bus) SetMemoryHook(hook MemoryHook) {
+	bus.memoryHook = hook
+}
+
+// observe reports an access to the memory hook, the trace recorder and the
+// history.
+func (bus *Bus) observe(address, size uint32, op MemoryOperation, value uint32) {
+	if bus.memoryHook != nil {
+		bus.memoryHook(address, size, op, value)
+	}
+	if bus.trace != nil {
+		bus.trace.access(address, size, op, value)
+	}
+	if bus.history != nil {
+		bus.history.recordAccess(address, size, op, value)
+	}
+}
+
+// Map returns the memory region containing address and the offset of address
+// in it. An unmapped address stops emulation with a panic that Step and Run
+// turn into a *CrashReport, so code outside of them should use Read and
+// Write.
 func (bus *Bus) Map(address uint32, op MemoryOperation) (uint32, []byte) {
 	if op == OpStore {
-		log.Printf("[Map] Address %08Xh mapped for %s", address, op)
+		bus.logf("[Map] Address %08Xh mapped for %s", address, op)
 	}
 
+	offset, data, ok := bus.memory(address)
+	if !ok {
+		fatal(&BusError{Address: address, Op: op})
+	}
+	return offset, data
+}
+
+// memory returns the memory region containing address and the offset of
+// address in it.
+func (bus *Bus) memory(address uint32) (uint32, []byte, bool) {
 	if inRange(address, CacheControl, CacheControlSize) {
-		return address - CacheControl, bus.cacheControl
+		return address - CacheControl, bus.cacheControl, true
 	}
 
 	// Mask segment
@@ -86,39 +301,83 @@ func (bus *Bus) Map(address uint32, op MemoryOperation) (uint32, []byte) {
 
 	switch {
 	case inRange(address, MainRAM, MainRAMSize):
-		return address - MainRAM, bus.mainRAM
+		return address - MainRAM, bus.mainRAM, true
 	case inRange(address, FirstExpansionRegion, FirstExpansionRegionSize):
-		return address - FirstExpansionRegion, bus.firstExpansionRegion
+		return address - FirstExpansionRegion, bus.firstExpansionRegion, true
 	case inRange(address, Scratchpad, ScratchpadSize):
-		return address - Scratchpad, bus.scratchpad
+		return address - Scratchpad, bus.scratchpad, true
 	case inRange(address, IOPorts, IOPortsSize):
-		return address - IOPorts, bus.ioPorts
+		return address - IOPorts, bus.ioPorts, true
 	case inRange(address, SecondExpansionRegion, SecondExpansionRegionSize):
-		return address - SecondExpansionRegion, bus.secondExpansionRegion
+		return address - SecondExpansionRegion, bus.secondExpansionRegion, true
 	case inRange(address, ThirdExpansionRegion, ThirdExpansionRegionSize):
-		return address - ThirdExpansionRegion, bus.thirdExpansionRegion
+		return address - ThirdExpansionRegion, bus.thirdExpansionRegion, true
 	case inRange(address, BIOSAddress, BIOSSize):
-		return address - BIOSAddress, bus.bios
-	default:
-		log.Fatalf("unknown memory region at address %x", address)
+		return address - BIOSAddress, bus.bios, true
 	}
-
-	return 0, []byte{}
+	return 0, nil, false
 }
 
 func (bus *Bus) LoadByte(address uint32) uint8 {
+	value := bus.loadByte(address)
+	bus.observe(address, 1, OpLoad, uint32(value))
+	return value
+}
+
+func (bus *Bus) LoadHalfword(address uint32) uint16 {
+	value := bus.loadHalfword(address)
+	bus.observe(address, 2, OpLoad, uint32(value))
+	return value
+}
+
+func (bus *Bus) LoadWord(address uint32) uint32 {
+	value := bus.loadWord(address)
+	bus.observe(address, 4, OpLoad, value)
+	return value
+}
+
+// fetch loads an instruction word without reporting it to the memory hook.
+func (bus *Bus) fetch(address uint32) uint32 {
+	return bus.loadWord(address)
+}
+
+func (bus *Bus) StoreByte(address uint32, value uint8) {
+	bus.storeByte(address, value)
+	bus.observe(address, 1, OpStore, uint32(value))
+}
+
+func (bus *Bus) StoreHalfword(address uint32, value uint16) {
+	bus.storeHalfword(address, value)
+	bus.observe(address, 2, OpStore, uint32(value))
+}
+
+func (bus *Bus) StoreWord(address uint32, value uint32) {
+	bus.storeWord(address, value)
+	bus.observe(address, 4, OpStore, value)
+}
+
+func (bus *Bus) loadByte(address uint32) uint8 {
+	if device, offset, ok := bus.device(address); ok {
+		return uint8(device.Load(offset))
+	}
 	address, data := bus.Map(address, OpLoad)
 	return data[address]
 }
 
-func (bus *Bus) LoadHalfword(address uint32) uint16 {
+func (bus *Bus) loadHalfword(address uint32) uint16 {
+	if device, offset, ok := bus.device(address); ok {
+		return uint16(device.Load(offset))
+	}
 	address, data := bus.Map(address, OpLoad)
 	a := uint16(data[address+1])
 	b := uint16(data[address])
 	return (a << 8) | b
 }
 
-func (bus *Bus) LoadWord(address uint32) uint32 {
+func (bus *Bus) loadWord(address uint32) uint32 {
+	if device, offset, ok := bus.device(address); ok {
+		return device.Load(offset)
+	}
 	address, data := bus.Map(address, OpLoad)
 	a := uint32(data[address+3])
 	b := uint32(data[address+2])
@@ -127,18 +386,30 @@ func (bus *Bus) LoadWord(address uint32) uint32 {
 	return (a << 24) | (b << 16) | (c << 8) | d
 }
 
-func (bus *Bus) StoreByte(address uint32, value uint8) {
+func (bus *Bus) storeByte(address uint32, value uint8) {
+	if device, offset, ok := bus.device(address); ok {
+		device.Store(offset, uint32(value))
+		return
+	}
 	address, data := bus.Map(address, OpStore)
 	data[address] = value
 }
 
-func (bus *Bus) StoreHalfword(address uint32, value uint16) {
+func (bus *Bus) storeHalfword(address uint32, value uint16) {
+	if device, offset, ok := bus.device(address); ok {
+		device.Store(offset, uint32(value))
+		return
+	}
 	address, data := bus.Map(address, OpStore)
 	data[address+1] = uint8(value >> 8)
 	data[address] = uint8(value)
 }
 
-func (bus *Bus) StoreWord(address uint32, value uint32) {
+func (bus *Bus) storeWord(address uint32, value uint32) {
+	if device, offset, ok := bus.device(address); ok {
+		device.Store(offset, value)
+		return
+	}
 	address, data := bus.Map(address, OpStore)
 
 	data[address+3] = uint8(value >> 24)
@@ -146,3 +417,49 @@ func (bus *Bus) StoreWord(address uint32, value uint32) {
 	data[address+1] = uint8(value >> 8)
 	data[address] = uint8(value)
 }
+
+// Write copies data to memory starting at address, bypassing I/O devices. It
+// is used to side-load programs. It returns a *BusError if the range runs
+// into unmapped memory, after writing the part before it.
+func (bus *Bus) Write(address uint32, data []byte) error {
+	for len(data) > 0 {
+		offset, memory, ok := bus.memory(address)
+		if !ok {
+			return &BusError{Address: address, Op: OpStore}
+		}
+		n := copy(memory[offset:], data)
+		data = data[n:]
+		address += uint32(n)
+	}
+	return nil
+}
+
+// Read fills data with memory contents starting at address, bypassing I/O
+// devices. It returns a *BusError if the range runs into unmapped memory.
+func (bus *Bus) Read(address uint32, data []byte) error {
+	for len(data) > 0 {
+		offset, memory, ok := bus.memory(address)
+		if !ok {
+			return &BusError{Address: address, Op: OpLoad}
+		}
+		n := copy(data, memory[offset:])
+		data = data[n:]
+		address += uint32(n)
+	}
+	return nil
+}
+
+// write is Write for the emulated machine, where an unmapped address stops
+// emulation like an access by the CPU does.
+func (bus *Bus) write(address uint32, data []byte) {
+	if err := bus.Write(address, data); err != nil {
+		fatal(err)
+	}
+}
+
+// read is Read for the emulated machine.
+func (bus *Bus) read(address uint32, data []byte) {
+	if err := bus.Read(address, data); err != nil {
+		fatal(err)
+	}
+}
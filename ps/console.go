@@ -0,0 +1,95 @@
+package ps
+
+import (
+	"bytes"
+	"io"
+)
+
+// DUART channel A registers, used for TTY output on development units.
+// http://problemkaputt.de/psx-spx.htm#exp2dualserialportforttydebugterminal
+const (
+	DUART     = 0x1F802020
+	DUARTSize = 16
+
+	duartStatusA   = 0x1
+	duartTransmitA = 0x3
+
+	// duartTransmitReady reports an empty transmitter, TxRDY and TxEMT.
+	duartTransmitReady = 0x0C
+)
+
+// Console captures the text printed by the guest through the BIOS putchar
+// functions or the DUART and writes it to an io.Writer a line at a time.
+type Console struct {
+	w    io.Writer
+	line []byte
+	// err is the first error writing the output of putchar.
+	err error
+}
+
+func NewConsole(w io.Writer) *Console {
+	return &Console{w: w}
+}
+
+// Write buffers p and writes out every completed line.
+func (console *Console) Write(p []byte) (int, error) {
+	console.line = append(console.line, p...)
+
+	i := bytes.LastIndexByte(console.line, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	_, err := console.w.Write(console.line[:i+1])
+	console.line = append(console.line[:0], console.line[i+1:]...)
+	return len(p), err
+}
+
+// Flush writes out an incomplete last line and reports the first error
+// writing the output of the guest since the last Flush.
+func (console *Console) Flush() error {
+	err := console.err
+	console.err = nil
+	if len(console.line) > 0 {
+		_, flushErr := console.w.Write(console.line)
+		console.line = console.line[:0]
+		if err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+func (console *Console) putchar(c uint8) {
+	if _, err := console.Write([]byte{c}); err != nil && console.err == nil {
+		console.err = err
+	}
+}
+
+// Install hooks the putchar functions of a real BIOS, A0:3Ch and B0:3Dh.
+// The HLE kernel writes to its TTY instead.
+func (console *Console) Install(cpu *CPU) {
+	for _, entry := range []struct{ table, number uint32 }{{0xA0, 0x3C}, {0xB0, 0x3D}} {
+		number := entry.number
+		hook := func(cpu *CPU, bus *Bus) {
+			if cpu.GPR[9] == number {
+				console.putchar(uint8(cpu.GPR[4]))
+			}
+		}
+		for _, segment := range []uint32{0x00000000, 0x80000000, 0xA0000000} {
+			cpu.AddHook(segment|entry.table, hook)
+		}
+	}
+}
+
+func (console *Console) Load(offset uint32) uint32 {
+	if offset == duartStatusA {
+		return duartTransmitReady
+	}
+	return 0
+}
+
+func (console *Console) Store(offset uint32, value uint32) {
+	if offset == duartTransmitA {
+		console.putchar(uint8(value))
+	}
+}
@@ -0,0 +1,98 @@
+package ps
+
+// Button is a bit in the 16-bit button state reported by pads. The state is
+// sent active-low: a cleared bit means the button is pressed.
+// http://problemkaputt.de/psx-spx.htm#controllersstandarddigitalanalogcontrollers
+type Button uint16
+
+const (
+	ButtonSelect Button = 1 << iota
+	ButtonL3
+	ButtonR3
+	ButtonStart
+	ButtonUp
+	ButtonRight
+	ButtonDown
+	ButtonLeft
+	ButtonL2
+	ButtonR2
+	ButtonL1
+	ButtonR1
+	ButtonTriangle
+	ButtonCircle
+	ButtonCross
+	ButtonSquare
+)
+
+// Controller IDs, sent as the first two bytes of a reply (low byte first).
+const (
+	IDDigitalPad = 0x5A41
+	IDAnalogPad  = 0x5A73
+	IDConfigMode = 0x5AF3
+)
+
+// Buttons holds the pressed state of pad buttons.
+type Buttons struct {
+	pressed uint16
+}
+
+// SetButton presses or releases b.
+func (buttons *Buttons) SetButton(b Button, pressed bool) {
+	if pressed {
+		buttons.pressed |= uint16(b)
+	} else {
+		buttons.pressed &^= uint16(b)
+	}
+}
+
+// Pressed reports whether b is held down.
+func (buttons *Buttons) Pressed(b Button) bool {
+	return buttons.pressed&uint16(b) != 0
+}
+
+// state returns the active-low button bytes as sent over SIO0.
+func (buttons *Buttons) state() (uint8, uint8) {
+	value := ^buttons.pressed
+	return uint8(value), uint8(value >> 8)
+}
+
+// DigitalPad is the SCPH-1080 digital controller. It only understands the
+// read command (42h).
+type DigitalPad struct {
+	Buttons
+
+	position int
+}
+
+func NewDigitalPad() *DigitalPad {
+	return &DigitalPad{}
+}
+
+func (pad *DigitalPad) Transfer(value uint8) (uint8, bool) {
+	position := pad.position
+	pad.position++
+
+	switch position {
+	case 0:
+		return 0xFF, true
+	case 1:
+		if value != 0x42 {
+			return 0xFF, false
+		}
+		return uint8(IDDigitalPad & 0xFF), true
+	case 2:
+		return uint8(IDDigitalPad >> 8), true
+	case 3:
+		low, _ := pad.state()
+		return low, true
+	case 4:
+		_, high := pad.state()
+		return high, false
+	}
+
+	return 0xFF, false
+}
+
+func (pad *DigitalPad) Deselect() {
+	pad.position = 0
+}
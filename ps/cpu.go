@@ -1,9 +1,6 @@
 package ps
 
-import (
-	"fmt"
-	"log"
-)
+import "fmt"
 
 type CPU struct {
 	// GPR is a General Purpose Registers.
@@ -16,6 +13,10 @@ type CPU struct {
 	// control registers (used in CTC/CFC).
 	COP0R []uint32
 
+	// COP2D and COP2C hold the GTE data and control registers. Only register
+	// transfers are emulated, not the GTE commands.
+	COP2D, COP2C []uint32
+
 	// LoadDelaySlot emulates MIPS load delay
 	LoadDelaySlot  uint32
 	LoadDelayValue uint32
@@ -26,18 +27,79 @@ type CPU struct {
 	// LO contains quotient
 	// HI contains the remainder
 	LO, HI uint32
+
+	// current is the address of the executing instruction, and delaySlot
+	// is set if it is in the delay slot of a jump or branch. branch is set
+	// after executing a jump or branch.
+	current   uint32
+	delaySlot bool
+	branch    bool
+
+	// Symbols names addresses in the debugger.
+	Symbols *SymbolTable
+
+	// Tracer logs calls to the kernel function tables if set.
+	Tracer *KernelTracer
+
+	// PCdrv serves host file system calls made with BREAK if set.
+	PCdrv *PCdrv
+
+	// hooks are called before the instruction at their address is fetched.
+	hooks map[uint32][]*Hook
+
+	// trace records the executed instructions if set.
+	trace *TraceRecorder
+	// history keeps the last instructions for crash reports if set.
+	history *History
 }
 
+// Hook is called when the CPU reaches a hooked address. It may change the
+// registers and memory, or redirect execution with Jump.
+type Hook func(cpu *CPU, bus *Bus)
+
 func NewCPU() CPU {
 	return CPU{
 		GPR:            make([]uint32, 32),
 		GPRNext:        make([]uint32, 32),
 		COP0R:          make([]uint32, 32),
+		COP2D:          make([]uint32, 32),
+		COP2C:          make([]uint32, 32),
 		LoadDelaySlot:  0,
 		LoadDelayValue: 0,
 		Pc:             0xBFC00000, // Bios start
 		PcNext:         0xBFC00004,
+		hooks:          make(map[uint32][]*Hook),
+	}
+}
+
+// AddHook registers hook to be called whenever execution reaches address. It
+// returns a function that removes the hook again.
+func (cpu *CPU) AddHook(address uint32, hook Hook) (remove func()) {
+	entry := &hook
+	cpu.hooks[address] = append(cpu.hooks[address], entry)
+
+	return func() {
+		hooks := cpu.hooks[address]
+		for i, h := range hooks {
+			if h == entry {
+				cpu.hooks[address] = append(hooks[:i:i], hooks[i+1:]...)
+				break
+			}
+		}
+		if len(cpu.hooks[address]) == 0 {
+			delete(cpu.hooks, address)
+		}
+	}
+}
+
+// runHooks runs the hooks at the current address and reports whether one of
+// them redirected execution. Hooks may remove themselves while running.
+func (cpu *CPU) runHooks(bus *Bus) bool {
+	pc := cpu.Pc
+	for _, hook := range append([]*Hook(nil), cpu.hooks[pc]...) {
+		(*hook)(cpu, bus)
 	}
+	return cpu.Pc != pc
 }
 
 func (cpu *CPU) DumpRegisters() {
@@ -51,13 +113,35 @@ func (cpu *CPU) DumpRegisters() {
 }
 
 func (cpu *CPU) SetGPR(index, value uint32) {
-	cpu.GPRNext[index] = value
+	if index != 0 {
+		cpu.GPRNext[index] = value
+	}
 }
 
 func (cpu *CPU) GetGPR(index uint32) uint32 {
 	return cpu.GPR[index]
 }
 
+// forceGPR writes a register between instructions, bypassing GPRNext.
+func (cpu *CPU) forceGPR(index, value uint32) {
+	if index == 0 {
+		return
+	}
+	cpu.GPR[index] = value
+	cpu.GPRNext[index] = value
+}
+
+// Jump continues execution at address. A pending load completes first, as
+// the instruction that loaded it has finished.
+func (cpu *CPU) Jump(address uint32) {
+	cpu.branch = false
+	cpu.Pc = address
+	cpu.PcNext = address + 4
+	cpu.forceGPR(cpu.LoadDelaySlot, cpu.LoadDelayValue)
+	cpu.LoadDelaySlot = 0
+	cpu.LoadDelayValue = 0
+}
+
 func (cpu *CPU) SLL(instruction Instruction) {
 	cpu.SetGPR(instruction.Rd, cpu.GetGPR(instruction.Rt)<<instruction.ShiftAmount)
 }
@@ -90,16 +174,20 @@ func (cpu *CPU) JR(instruction Instruction) {
 }
 
 func (cpu *CPU) JALR(instruction Instruction) {
-	cpu.SetGPR(instruction.Rd, cpu.PcNext+4)
-	cpu.PcNext = cpu.GetGPR(instruction.Rs)
+	target := cpu.GetGPR(instruction.Rs)
+	cpu.SetGPR(instruction.Rd, cpu.PcNext)
+	cpu.PcNext = target
 }
 
 func (cpu *CPU) SYSCALL(instruction Instruction, bus *Bus) {
-	//TODO SystemCallException
+	cpu.exception(ExceptionSyscall)
 }
 
 func (cpu *CPU) BREAK(instruction Instruction, bus *Bus) {
-	//TODO BreakpointException
+	if cpu.PCdrv != nil && cpu.PCdrv.handle(cpu, bus, instruction.Code()) {
+		return
+	}
+	cpu.exception(ExceptionBreakpoint)
 }
 
 func (cpu *CPU) MFHI(instruction Instruction) {
@@ -119,7 +207,7 @@ func (cpu *CPU) MTLO(instruction Instruction) {
 }
 
 func (cpu *CPU) MULT(instruction Instruction) {
-	temp := int64(cpu.GetGPR(instruction.Rs)) * int64(cpu.GetGPR(instruction.Rt))
+	temp := int64(int32(cpu.GetGPR(instruction.Rs))) * int64(int32(cpu.GetGPR(instruction.Rt)))
 	cpu.LO = uint32(temp & 0xFFFFFFFF)
 	cpu.HI = uint32(temp>>32) & 0xFFFFFFFF
 }
@@ -130,14 +218,40 @@ func (cpu *CPU) MULTU(instruction Instruction) {
 	cpu.HI = uint32(temp>>32) & 0xFFFFFFFF
 }
 
+// DIV and DIVU don't trap on division by zero or overflow, see
+// http://problemkaputt.de/psx-spx.htm#cpuarithmeticinstructions
 func (cpu *CPU) DIV(instruction Instruction) {
-	cpu.LO = cpu.GetGPR(instruction.Rs) / cpu.GetGPR(instruction.Rt)
-	cpu.HI = cpu.GetGPR(instruction.Rs) % cpu.GetGPR(instruction.Rt)
+	n := int32(cpu.GetGPR(instruction.Rs))
+	d := int32(cpu.GetGPR(instruction.Rt))
+
+	switch {
+	case d == 0:
+		cpu.HI = uint32(n)
+		if n >= 0 {
+			cpu.LO = 0xFFFFFFFF
+		} else {
+			cpu.LO = 1
+		}
+	case uint32(n) == 0x80000000 && d == -1:
+		cpu.LO = 0x80000000
+		cpu.HI = 0
+	default:
+		cpu.LO = uint32(n / d)
+		cpu.HI = uint32(n % d)
+	}
 }
 
 func (cpu *CPU) DIVU(instruction Instruction) {
-	cpu.LO = cpu.GetGPR(instruction.Rs) / cpu.GetGPR(instruction.Rt)
-	cpu.HI = cpu.GetGPR(instruction.Rs) % cpu.GetGPR(instruction.Rt)
+	n := cpu.GetGPR(instruction.Rs)
+	d := cpu.GetGPR(instruction.Rt)
+
+	if d == 0 {
+		cpu.LO = 0xFFFFFFFF
+		cpu.HI = n
+		return
+	}
+	cpu.LO = n / d
+	cpu.HI = n % d
 }
 
 func (cpu *CPU) ADD(instruction Instruction) {
@@ -173,7 +287,7 @@ func (cpu *CPU) NOR(instruction Instruction) {
 }
 
 func (cpu *CPU) SLT(instruction Instruction) {
-	if cpu.GetGPR(instruction.Rs) < cpu.GetGPR(instruction.Rt) {
+	if int32(cpu.GetGPR(instruction.Rs)) < int32(cpu.GetGPR(instruction.Rt)) {
 		cpu.SetGPR(instruction.Rd, 1)
 	} else {
 		cpu.SetGPR(instruction.Rd, 0)
@@ -181,7 +295,7 @@ func (cpu *CPU) SLT(instruction Instruction) {
 }
 
 func (cpu *CPU) SLTU(instruction Instruction) {
-	if (cpu.GetGPR(instruction.Rs) >> 1) < (cpu.GetGPR(instruction.Rt) >> 1) {
+	if cpu.GetGPR(instruction.Rs) < cpu.GetGPR(instruction.Rt) {
 		cpu.SetGPR(instruction.Rd, 1)
 	} else {
 		cpu.SetGPR(instruction.Rd, 0)
@@ -189,33 +303,33 @@ func (cpu *CPU) SLTU(instruction Instruction) {
 }
 
 func (cpu *CPU) BLTZ(instruction Instruction) {
-	address := cpu.PcNext + (instruction.Imm16sx << 2)
+	address := cpu.Pc + (instruction.Imm16sx << 2)
 	if (cpu.GetGPR(instruction.Rs) >> 31) == 1 {
 		cpu.PcNext = address
 	}
 }
 
 func (cpu *CPU) BGEZ(instruction Instruction) {
-	address := cpu.PcNext + (instruction.Imm16sx << 2)
+	address := cpu.Pc + (instruction.Imm16sx << 2)
 	if (cpu.GetGPR(instruction.Rs) >> 31) == 0 {
 		cpu.PcNext = address
 	}
 }
 
 func (cpu *CPU) BLTZAL(instruction Instruction) {
-	address := cpu.PcNext + (instruction.Imm16sx << 2)
+	address := cpu.Pc + (instruction.Imm16sx << 2)
+	cpu.SetGPR(31, cpu.PcNext)
 	if (cpu.GetGPR(instruction.Rs) >> 31) == 1 {
 		cpu.PcNext = address
 	}
-	cpu.SetGPR(31, cpu.PcNext+4)
 }
 
 func (cpu *CPU) BGEZAL(instruction Instruction) {
-	address := cpu.PcNext + (instruction.Imm16sx << 2)
+	address := cpu.Pc + (instruction.Imm16sx << 2)
+	cpu.SetGPR(31, cpu.PcNext)
 	if (cpu.GetGPR(instruction.Rs) >> 31) == 0 {
 		cpu.PcNext = address
 	}
-	cpu.SetGPR(31, cpu.PcNext+4)
 }
 
 func (cpu *CPU) J(instruction Instruction) {
@@ -223,33 +337,33 @@ func (cpu *CPU) J(instruction Instruction) {
 }
 
 func (cpu *CPU) JAL(instruction Instruction) {
-	cpu.SetGPR(31, cpu.PcNext+4)
+	cpu.SetGPR(31, cpu.PcNext)
 	cpu.PcNext = cpu.PcNext&0xF0000000 | (instruction.Address << 2)
 }
 
 func (cpu *CPU) BEQ(instruction Instruction) {
-	address := cpu.PcNext + (instruction.Imm16sx << 2)
+	address := cpu.Pc + (instruction.Imm16sx << 2)
 	if cpu.GetGPR(instruction.Rs) == cpu.GetGPR(instruction.Rt) {
 		cpu.PcNext = address
 	}
 }
 
 func (cpu *CPU) BNE(instruction Instruction) {
-	address := cpu.PcNext + (instruction.Imm16sx << 2)
+	address := cpu.Pc + (instruction.Imm16sx << 2)
 	if cpu.GetGPR(instruction.Rs) != cpu.GetGPR(instruction.Rt) {
 		cpu.PcNext = address
 	}
 }
 
 func (cpu *CPU) BLEZ(instruction Instruction) {
-	address := cpu.PcNext + (instruction.Imm16sx << 2)
+	address := cpu.Pc + (instruction.Imm16sx << 2)
 	if (cpu.GetGPR(instruction.Rs)>>31) == 1 || cpu.GetGPR(instruction.Rs) == 0 {
 		cpu.PcNext = address
 	}
 }
 
 func (cpu *CPU) BGTZ(instruction Instruction) {
-	address := cpu.PcNext + (instruction.Imm16sx << 2)
+	address := cpu.Pc + (instruction.Imm16sx << 2)
 	if (cpu.GetGPR(instruction.Rs)>>31) == 0 && cpu.GetGPR(instruction.Rs) != 0 {
 		cpu.PcNext = address
 	}
@@ -264,7 +378,7 @@ func (cpu *CPU) ADDIU(instruction Instruction) {
 }
 
 func (cpu *CPU) SLTI(instruction Instruction) {
-	if cpu.GetGPR(instruction.Rs) < instruction.Imm16sx {
+	if int32(cpu.GetGPR(instruction.Rs)) < int32(instruction.Imm16sx) {
 		cpu.SetGPR(instruction.Rt, 1)
 	} else {
 		cpu.SetGPR(instruction.Rt, 0)
@@ -272,7 +386,7 @@ func (cpu *CPU) SLTI(instruction Instruction) {
 }
 
 func (cpu *CPU) SLTIU(instruction Instruction) {
-	if (cpu.GetGPR(instruction.Rs) >> 1) < instruction.Imm16sx {
+	if cpu.GetGPR(instruction.Rs) < instruction.Imm16sx {
 		cpu.SetGPR(instruction.Rt, 1)
 	} else {
 		cpu.SetGPR(instruction.Rt, 0)
@@ -297,39 +411,46 @@ func (cpu *CPU) LUI(instruction Instruction) {
 
 func (cpu *CPU) MFC(instruction Instruction, bus *Bus, z uint32) {
 	cpu.LoadDelaySlot = instruction.Rt
-	cpu.LoadDelayValue = cpu.COP0R[instruction.Rd]
-
 	if z == 2 {
-		panic("unimplemented")
+		cpu.LoadDelayValue = cpu.COP2D[instruction.Rd]
+		return
 	}
+	cpu.LoadDelayValue = cpu.COP0R[instruction.Rd]
 }
 
 func (cpu *CPU) CFC(instruction Instruction, bus *Bus, z uint32) {
 	if z == 0 {
-		panic("COP0 has no control registers")
+		fatal(unimplemented("CFC0, COP0 has no control registers"))
 	}
 
-	if z == 2 {
-		panic("unimplemented")
-	}
+	cpu.LoadDelaySlot = instruction.Rt
+	cpu.LoadDelayValue = cpu.COP2C[instruction.Rd]
 }
 
 func (cpu *CPU) MTC(instruction Instruction, bus *Bus, z uint32) {
-	cpu.COP0R[instruction.Rd] = cpu.GetGPR(instruction.Rt)
-
 	if z == 2 {
-		panic("unimplemented")
+		cpu.COP2D[instruction.Rd] = cpu.GetGPR(instruction.Rt)
+		return
 	}
+	cpu.COP0R[instruction.Rd] = cpu.GetGPR(instruction.Rt)
 }
 
 func (cpu *CPU) CTC(instruction Instruction, bus *Bus, z uint32) {
 	if z == 0 {
-		panic("COP0 has no control registers")
+		fatal(unimplemented("CTC0, COP0 has no control registers"))
 	}
 
-	if z == 2 {
-		panic("unimplemented")
-	}
+	cpu.COP2C[instruction.Rd] = cpu.GetGPR(instruction.Rt)
+}
+
+func (cpu *CPU) LWC2(instruction Instruction, bus *Bus) {
+	address := instruction.Imm16sx + cpu.GetGPR(instruction.Rs)
+	cpu.COP2D[instruction.Rt] = bus.LoadWord(address)
+}
+
+func (cpu *CPU) SWC2(instruction Instruction, bus *Bus) {
+	address := instruction.Imm16sx + cpu.GetGPR(instruction.Rs)
+	bus.StoreWord(address, cpu.COP2D[instruction.Rt])
 }
 
 func (cpu *CPU) LB(instruction Instruction, bus *Bus) {
@@ -353,27 +474,27 @@ func (cpu *CPU) LW(instruction Instruction, bus *Bus) {
 	cpu.LoadDelayValue = value
 }
 
+// LWL and LWR merge with a load to the same register that is still in its
+// delay slot, which is already in GPRNext.
 func (cpu *CPU) LWL(instruction Instruction, bus *Bus) {
 	address := instruction.Imm16sx + cpu.GetGPR(instruction.Rs)
-	var temp uint32 = 0
+	word := bus.LoadWord(address &^ 3)
+	current := cpu.GPRNext[instruction.Rt]
 
-	switch address % 4 {
+	var value uint32
+	switch address & 3 {
 	case 0:
-		cpu.SetGPR(instruction.Rt, bus.LoadWord(address/4))
-		break
+		value = current&0x00FFFFFF | word<<24
 	case 1:
-		temp = bus.LoadWord(address/4) & 0xFFFFFF << 8
-		cpu.SetGPR(instruction.Rt, cpu.GetGPR(instruction.Rt)&0xFF|temp)
-		break
+		value = current&0x0000FFFF | word<<16
 	case 2:
-		temp = bus.LoadWord(address/4) & 0xFFFF << 16
-		cpu.SetGPR(instruction.Rt, cpu.GetGPR(instruction.Rt)&0xFFFF|temp)
-		break
+		value = current&0x000000FF | word<<8
 	case 3:
-		temp = bus.LoadWord(address/4) & 0xFF << 24
-		cpu.SetGPR(instruction.Rt, cpu.GetGPR(instruction.Rt)&0xFFFFFF|temp)
-		break
+		value = word
 	}
+
+	cpu.LoadDelaySlot = instruction.Rt
+	cpu.LoadDelayValue = value
 }
 
 func (cpu *CPU) LBU(instruction Instruction, bus *Bus) {
@@ -392,30 +513,28 @@ func (cpu *CPU) LHU(instruction Instruction, bus *Bus) {
 
 func (cpu *CPU) LWR(instruction Instruction, bus *Bus) {
 	address := instruction.Imm16sx + cpu.GetGPR(instruction.Rs)
-	var temp uint32 = 0
+	word := bus.LoadWord(address &^ 3)
+	current := cpu.GPRNext[instruction.Rt]
 
-	switch address % 4 {
+	var value uint32
+	switch address & 3 {
 	case 0:
-		cpu.SetGPR(instruction.Rt, bus.LoadWord(address/4))
-		break
+		value = word
 	case 1:
-		temp = (bus.LoadWord(address/4) & 0xFF000000 >> 24) & 0xFF
-		cpu.SetGPR(instruction.Rt, cpu.GetGPR(instruction.Rt)&0xFFFFFF00|temp)
-		break
+		value = current&0xFF000000 | word>>8
 	case 2:
-		temp = (bus.LoadWord(address/4) & 0xFFFF0000 >> 16) & 0xFFFF
-		cpu.SetGPR(instruction.Rt, cpu.GetGPR(instruction.Rt)&0xFFFF0000|temp)
-		break
+		value = current&0xFFFF0000 | word>>16
 	case 3:
-		temp = (bus.LoadWord(address/4) & 0xFFFFFF00 >> 8) & 0xFFFFFF
-		cpu.SetGPR(instruction.Rt, cpu.GetGPR(instruction.Rt)&0xFF000000|temp)
-		break
+		value = current&0xFFFFFF00 | word>>24
 	}
+
+	cpu.LoadDelaySlot = instruction.Rt
+	cpu.LoadDelayValue = value
 }
 
 func (cpu *CPU) SB(instruction Instruction, bus *Bus) {
 	if cpu.COP0R[12]&0x10000 != 0 {
-		log.Printf("Ignored store to cache")
+		bus.logf("Ignored store to cache")
 		return
 	}
 	address := instruction.Imm16sx + cpu.GetGPR(instruction.Rs)
@@ -424,7 +543,7 @@ func (cpu *CPU) SB(instruction Instruction, bus *Bus) {
 
 func (cpu *CPU) SH(instruction Instruction, bus *Bus) {
 	if cpu.COP0R[12]&0x10000 != 0 {
-		log.Printf("Ignored store to cache")
+		bus.logf("Ignored store to cache")
 		return
 	}
 	address := instruction.Imm16sx + cpu.GetGPR(instruction.Rs)
@@ -432,12 +551,31 @@ func (cpu *CPU) SH(instruction Instruction, bus *Bus) {
 }
 
 func (cpu *CPU) SWL(instruction Instruction, bus *Bus) {
-	//TODO Later
+	if cpu.COP0R[12]&0x10000 != 0 {
+		bus.logf("Ignored store to cache")
+		return
+	}
+
+	address := instruction.Imm16sx + cpu.GetGPR(instruction.Rs)
+	word := bus.LoadWord(address &^ 3)
+	value := cpu.GetGPR(instruction.Rt)
+
+	switch address & 3 {
+	case 0:
+		word = word&0xFFFFFF00 | value>>24
+	case 1:
+		word = word&0xFFFF0000 | value>>16
+	case 2:
+		word = word&0xFF000000 | value>>8
+	case 3:
+		word = value
+	}
+	bus.StoreWord(address&^3, word)
 }
 
 func (cpu *CPU) SW(instruction Instruction, bus *Bus) {
 	if cpu.COP0R[12]&0x10000 != 0 {
-		log.Printf("Ignored store to cache")
+		bus.logf("Ignored store to cache")
 		return
 	}
 
@@ -446,7 +584,26 @@ func (cpu *CPU) SW(instruction Instruction, bus *Bus) {
 }
 
 func (cpu *CPU) SWR(instruction Instruction, bus *Bus) {
-	//TODO Later
+	if cpu.COP0R[12]&0x10000 != 0 {
+		bus.logf("Ignored store to cache")
+		return
+	}
+
+	address := instruction.Imm16sx + cpu.GetGPR(instruction.Rs)
+	word := bus.LoadWord(address &^ 3)
+	value := cpu.GetGPR(instruction.Rt)
+
+	switch address & 3 {
+	case 0:
+		word = value
+	case 1:
+		word = word&0x000000FF | value<<8
+	case 2:
+		word = word&0x0000FFFF | value<<16
+	case 3:
+		word = word&0x00FFFFFF | value<<24
+	}
+	bus.StoreWord(address&^3, word)
 }
 
 func (cpu *CPU) Execute(instruction Instruction, bus *Bus) {
@@ -469,10 +626,10 @@ func (cpu *CPU) Execute(instruction Instruction, bus *Bus) {
 			cpu.JR(instruction)
 		case 0x09:
 			cpu.JALR(instruction)
-		//case 0x0C:
-		//	cpu.SYSCALL(instruction, bus)
-		//case 0x0D:
-		//	cpu.BREAK(instruction, bus)
+		case 0x0C:
+			cpu.SYSCALL(instruction, bus)
+		case 0x0D:
+			cpu.BREAK(instruction, bus)
 		case 0x10:
 			cpu.MFHI(instruction)
 		case 0x11:
@@ -510,20 +667,19 @@ func (cpu *CPU) Execute(instruction Instruction, bus *Bus) {
 		case 0x2B:
 			cpu.SLTU(instruction)
 		default:
-			log.Fatalf("unknown special instruction: %02x", instruction.Function)
+			fatal(unimplemented("special instruction %02Xh", instruction.Function))
 		}
 	case 0x01:
-		switch instruction.Rt {
+		// Only bit 0 and bit 4 of rt are decoded, other values are aliases.
+		switch instruction.Rt & 0x11 {
 		case 0x00:
 			cpu.BLTZ(instruction)
 		case 0x01:
 			cpu.BGEZ(instruction)
-		case 0x0A:
+		case 0x10:
 			cpu.BLTZAL(instruction)
-		case 0x0B:
+		case 0x11:
 			cpu.BGEZAL(instruction)
-		default:
-			log.Fatalf("unknown bcondz instruction: %02x", instruction.Function)
 		}
 	case 0x02:
 		cpu.J(instruction)
@@ -566,8 +722,14 @@ func (cpu *CPU) Execute(instruction Instruction, bus *Bus) {
 			cpu.MTC(instruction, bus, z)
 		case 0x6:
 			cpu.CTC(instruction, bus, z)
+		case 0x10:
+			if z == 0 && instruction.Function == 0x10 {
+				cpu.RFE(instruction)
+				break
+			}
+			fallthrough
 		default:
-			log.Fatalf("unknown coprocessor opcode instruction: %02x", instruction.Rs)
+			fatal(unimplemented("COP%d operation %02Xh", z, instruction.Rs))
 		}
 	case 0x20:
 		cpu.LB(instruction, bus)
@@ -587,21 +749,49 @@ func (cpu *CPU) Execute(instruction Instruction, bus *Bus) {
 		cpu.SB(instruction, bus)
 	case 0x29:
 		cpu.SH(instruction, bus)
-	//case 0x2A:
-	//	cpu.SWL(instruction, bus)
+	case 0x2A:
+		cpu.SWL(instruction, bus)
 	case 0x2B:
 		cpu.SW(instruction, bus)
-	//case 0x2E:
-	//	cpu.SWR(instruction, bus)
+	case 0x2E:
+		cpu.SWR(instruction, bus)
+	case 0x32:
+		cpu.LWC2(instruction, bus)
+	case 0x3A:
+		cpu.SWC2(instruction, bus)
 	default:
-		log.Fatalf("unknown primary instruction: %02x", instruction.Opcode)
+		fatal(unimplemented("primary instruction %02Xh", instruction.Opcode))
 	}
 }
 
+// Cycle runs the hooks at PC and then executes one instruction, unless a hook
+// moved PC. It panics if emulation cannot continue, such as on an access to
+// an unmapped address or an unimplemented instruction; use Step or Run to
+// get a *CrashReport instead.
 func (cpu *CPU) Cycle(bus *Bus) {
-	instruction := NewInstruction(bus.LoadWord(cpu.Pc))
-	log.Printf("%08x %s", cpu.Pc, instruction)
-	// cpu.DumpRegisters()
+	cpu.checkInterrupts(bus)
+	if cpu.Tracer != nil {
+		cpu.Tracer.enter(cpu, bus)
+	}
+	redirected := len(cpu.hooks) != 0 && cpu.runHooks(bus)
+	if cpu.Tracer != nil {
+		cpu.Tracer.leave(cpu, bus)
+	}
+	// Let the next cycle start at the new address, so that it runs the hooks
+	// there and debuggers can stop at it.
+	if redirected {
+		return
+	}
+
+	cpu.current = cpu.Pc
+	cpu.delaySlot = cpu.branch
+	cpu.branch = false
+
+	word := bus.fetch(cpu.Pc)
+	instruction := NewInstruction(word)
+	if cpu.history != nil {
+		cpu.history.record(cpu.Pc, word)
+	}
 	cpu.Pc = cpu.PcNext
 	cpu.PcNext += 4
 	cpu.SetGPR(cpu.LoadDelaySlot, cpu.LoadDelayValue)
@@ -609,5 +799,11 @@ func (cpu *CPU) Cycle(bus *Bus) {
 	cpu.LoadDelayValue = 0
 
 	cpu.Execute(instruction, bus)
+	cpu.branch = instruction.IsJump()
 	copy(cpu.GPR, cpu.GPRNext)
+	if cpu.trace != nil {
+		cpu.trace.record(cpu, cpu.current, word)
+	}
+
+	bus.Tick(CyclesPerInstruction)
 }
@@ -0,0 +1,247 @@
+package ps
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// fatalError stops emulation when it cannot continue. Cycle panics with it
+// and Step and Run turn it into a CrashReport.
+type fatalError struct {
+	err error
+}
+
+func fatal(err error) {
+	panic(fatalError{err})
+}
+
+// History is a ring buffer of the last instructions executed by a CPU and
+// the memory accesses they made, for crash reports.
+type History struct {
+	steps []historyStep
+	// accesses holds the accesses of the steps and the step they belong
+	// to, in a second ring so that steps stay small.
+	accesses []historyAccess
+	step     uint64
+	access   uint64
+}
+
+type historyStep struct {
+	pc, word uint32
+}
+
+type historyAccess struct {
+	step uint64
+	TraceAccess
+}
+
+// NewHistory keeps the last size instructions and 2*size memory accesses.
+func NewHistory(size int) *History {
+	return &History{steps: make([]historyStep, size), accesses: make([]historyAccess, 2*size)}
+}
+
+// Attach starts recording the instructions of cpu and the memory accesses on
+// bus.
+func (h *History) Attach(cpu *CPU, bus *Bus) {
+	cpu.history, bus.history = h, h
+}
+
+// record is called when an instruction is fetched, so that it is recorded
+// even if executing it fails. Accesses made by hooks before the fetch are
+// attributed to the previous instruction.
+func (h *History) record(pc, word uint32) {
+	h.steps[h.step%uint64(len(h.steps))] = historyStep{pc, word}
+	h.step++
+}
+
+func (h *History) recordAccess(address, size uint32, op MemoryOperation, value uint32) {
+	h.accesses[h.access%uint64(len(h.accesses))] = historyAccess{h.step, TraceAccess{op, uint8(size), address, value}}
+	h.access++
+}
+
+// Steps returns the recorded instructions, oldest first. The instruction
+// that was executing during a crash is the last one, and the accesses it
+// made before the crash are included.
+func (h *History) Steps() []TraceStep {
+	first := uint64(0)
+	if h.step > uint64(len(h.steps)) {
+		first = h.step - uint64(len(h.steps))
+	}
+	var steps []TraceStep
+	for n := first; n < h.step; n++ {
+		s := h.steps[n%uint64(len(h.steps))]
+		steps = append(steps, TraceStep{PC: s.pc, Word: s.word, Exception: -1})
+	}
+
+	// Accesses hold the number of steps recorded when they were made, which
+	// is one more than the index of their step.
+	firstAccess := uint64(0)
+	if h.access > uint64(len(h.accesses)) {
+		firstAccess = h.access - uint64(len(h.accesses))
+	}
+	for n := firstAccess; n < h.access; n++ {
+		a := h.accesses[n%uint64(len(h.accesses))]
+		if a.step > first && a.step <= h.step {
+			step := &steps[a.step-1-first]
+			step.Accesses = append(step.Accesses, a.TraceAccess)
+		}
+	}
+	return steps
+}
+
+// CrashReport describes the machine state when emulation stopped on a fatal
+// error.
+type CrashReport struct {
+	// Err is the cause, a *BusError, an *UnimplementedError or a panic of
+	// the emulator.
+	Err error
+	// PC is the address of the instruction that was executing.
+	PC     uint32
+	GPR    [32]uint32
+	HI, LO uint32
+	COP0   []uint32
+
+	// Recent holds the last executed instructions, oldest first, if the
+	// CPU has a History.
+	Recent []TraceStep
+	// Code is the disassembly around PC.
+	Code []Disassembly
+	// Stack holds words from the stack pointer upwards.
+	Stack []uint32
+	// GoStack is the stack trace of the emulator when Err is a panic of the
+	// emulator rather than an error of the emulated program.
+	GoStack []byte
+}
+
+func (report *CrashReport) Error() string {
+	return fmt.Sprintf("crash at %08Xh: %v", report.PC, report.Err)
+}
+
+func (report *CrashReport) Unwrap() error {
+	return report.Err
+}
+
+// crashReport captures the state of the machine after err.
+func (cpu *CPU) crashReport(bus *Bus, err error) *CrashReport {
+	report := &CrashReport{
+		Err:  err,
+		PC:   cpu.current,
+		HI:   cpu.HI,
+		LO:   cpu.LO,
+		COP0: append([]uint32(nil), cpu.COP0R...),
+	}
+	copy(report.GPR[:], cpu.GPR)
+	if cpu.history != nil {
+		report.Recent = cpu.history.Steps()
+	}
+
+	peek := func(address uint32) (uint32, bool) {
+		offset, memory, ok := bus.memory(address)
+		if !ok || offset+4 > uint32(len(memory)) {
+			return 0, false
+		}
+		return binary.LittleEndian.Uint32(memory[offset:]), true
+	}
+	for address := report.PC&^3 - 8*4; address <= report.PC&^3+4*4; address += 4 {
+		if word, ok := peek(address); ok {
+			report.Code = append(report.Code, Disassemble(address, word, cpu.Symbols))
+		}
+	}
+	for sp := cpu.GPR[29]; len(report.Stack) < 32; sp += 4 {
+		word, ok := peek(sp)
+		if !ok {
+			break
+		}
+		report.Stack = append(report.Stack, word)
+	}
+	return report
+}
+
+// WriteTo writes the report as text.
+func (report *CrashReport) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\nregisters:\n", report.Error())
+	for i := 0; i < 32; i += 4 {
+		fmt.Fprintf(&b, "  %4s %08X  %4s %08X  %4s %08X  %4s %08X\n",
+			RegisterNames[i], report.GPR[i], RegisterNames[i+1], report.GPR[i+1],
+			RegisterNames[i+2], report.GPR[i+2], RegisterNames[i+3], report.GPR[i+3])
+	}
+	fmt.Fprintf(&b, "    pc %08X    hi %08X    lo %08X\n", report.PC, report.HI, report.LO)
+
+	b.WriteString("\ncop0:\n")
+	indices := make([]int, 0, len(cop0RegisterNames))
+	for i := range cop0RegisterNames {
+		indices = append(indices, int(i))
+	}
+	sort.Ints(indices)
+	for _, i := range indices {
+		if i < len(report.COP0) {
+			fmt.Fprintf(&b, "  %8s %08X\n", cop0RegisterNames[uint32(i)], report.COP0[i])
+		}
+	}
+
+	if len(report.Recent) > 0 {
+		b.WriteString("\nrecent instructions:\n")
+		for _, step := range report.Recent {
+			fmt.Fprintf(&b, "  %s\n", step)
+		}
+	}
+
+	b.WriteString("\ncode:\n")
+	for _, inst := range report.Code {
+		marker := "  "
+		if inst.Address == report.PC&^3 {
+			marker = "=>"
+		}
+		fmt.Fprintf(&b, "%s %08X  %08X  %s\n", marker, inst.Address, inst.Word, inst)
+	}
+
+	b.WriteString("\nstack:\n")
+	sp := report.GPR[29]
+	for i := 0; i < len(report.Stack); i += 4 {
+		fmt.Fprintf(&b, "  %08X ", sp+uint32(i*4))
+		end := i + 4
+		if end > len(report.Stack) {
+			end = len(report.Stack)
+		}
+		for _, word := range report.Stack[i:end] {
+			fmt.Fprintf(&b, " %08X", word)
+		}
+		b.WriteByte('\n')
+	}
+
+	if report.GoStack != nil {
+		fmt.Fprintf(&b, "\nemulator stack:\n%s", report.GoStack)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// recoverCrash turns a panic during emulation into a crash report in *err.
+func (cpu *CPU) recoverCrash(bus *Bus, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	cause, ok := r.(fatalError)
+	if ok {
+		*err = cpu.crashReport(bus, cause.err)
+		return
+	}
+	report := cpu.crashReport(bus, fmt.Errorf("panic: %v", r))
+	report.GoStack = debug.Stack()
+	*err = report
+}
+
+// Step executes one cycle like Cycle, but returns a *CrashReport if
+// emulation cannot continue instead of panicking.
+func (cpu *CPU) Step(bus *Bus) (err error) {
+	defer cpu.recoverCrash(bus, &err)
+	cpu.Cycle(bus)
+	return nil
+}
@@ -0,0 +1,619 @@
+package ps
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Variable references of the register scopes.
+const (
+	dapRegisters = iota + 1
+	dapCOP0
+	dapGTE
+)
+
+// dapRequest is a Debug Adapter Protocol request.
+// https://microsoft.github.io/debug-adapter-protocol/specification
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapResponse struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+// DAPLaunchArguments are the arguments of the launch request. Without a
+// BIOS, the kernel is emulated.
+type DAPLaunchArguments struct {
+	Program     string `json:"program"`
+	BIOS        string `json:"bios"`
+	StopOnEntry bool   `json:"stopOnEntry"`
+}
+
+type dapSource struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path"`
+}
+
+type dapBreakpoint struct {
+	Verified bool       `json:"verified"`
+	Line     int        `json:"line,omitempty"`
+	Source   *dapSource `json:"source,omitempty"`
+	Message  string     `json:"message,omitempty"`
+}
+
+type dapFrame struct {
+	ID                          int        `json:"id"`
+	Name                        string     `json:"name"`
+	Source                      *dapSource `json:"source,omitempty"`
+	Line                        int        `json:"line"`
+	Column                      int        `json:"column"`
+	InstructionPointerReference string     `json:"instructionPointerReference"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+var errRunning = errors.New("the program is running")
+
+// dapServer is a debug adapter session. Requests are handled one at a time,
+// except that the program runs in another goroutine so that it can be
+// paused.
+type dapServer struct {
+	r *bufio.Reader
+	w io.Writer
+
+	// writes serializes the messages sent by the running program with the
+	// responses.
+	writes sync.Mutex
+	seq    int
+
+	cpu     *CPU
+	bus     *Bus
+	d       *Debugger
+	console *Console
+	lines   *LineTable
+
+	entry       uint32
+	stopOnEntry bool
+
+	// breakpoints holds the addresses set in each source file.
+	breakpoints map[string][]uint32
+
+	// running is closed when the program stops. It is nil before the
+	// first run.
+	running chan struct{}
+	// reason and run describe the current run so that it can be resumed
+	// after a suspension.
+	reason string
+	run    func() Stop
+	// suspending asks the running program to stop without a stopped event.
+	// suspended reports whether it did.
+	suspending int32
+	suspended  bool
+
+	// pending starts the program once the response to the current request
+	// has been sent.
+	pending func()
+}
+
+// ServeDAP runs a debug adapter that launches programs in the emulator and
+// debugs them with source breakpoints and stepping through their DWARF line
+// tables. It reads requests from r and writes responses and events to w
+// until the client disconnects.
+func ServeDAP(r io.Reader, w io.Writer) error {
+	s := &dapServer{
+		r:           bufio.NewReader(r),
+		w:           w,
+		breakpoints: make(map[string][]uint32),
+	}
+	for {
+		request, err := s.receive()
+		if err == io.EOF {
+			s.pause()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		body, err := s.handle(request)
+		response := dapResponse{
+			Type:       "response",
+			RequestSeq: request.Seq,
+			Success:    err == nil,
+			Command:    request.Command,
+			Body:       body,
+		}
+		if err != nil {
+			response.Message = err.Error()
+		}
+		if err := s.send(&response); err != nil {
+			return err
+		}
+		if s.pending != nil {
+			s.pending()
+			s.pending = nil
+		}
+
+		switch request.Command {
+		case "launch":
+			if response.Success {
+				s.event("initialized", nil)
+			}
+		case "disconnect", "terminate":
+			return nil
+		}
+	}
+}
+
+// receive reads a message framed by a Content-Length header.
+func (s *dapServer) receive() (*dapRequest, error) {
+	length := -1
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "Content-Length:") {
+			length, err = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Content-Length:")))
+			if err != nil {
+				return nil, fmt.Errorf("dap: bad header %q", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("dap: missing Content-Length")
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return nil, err
+	}
+	var request dapRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, fmt.Errorf("dap: %v", err)
+	}
+	return &request, nil
+}
+
+func (s *dapServer) send(message interface{}) error {
+	s.writes.Lock()
+	defer s.writes.Unlock()
+	s.seq++
+	switch m := message.(type) {
+	case *dapResponse:
+		m.Seq = s.seq
+	case *dapEvent:
+		m.Seq = s.seq
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	return err
+}
+
+func (s *dapServer) event(event string, body interface{}) {
+	s.send(&dapEvent{Type: "event", Event: event, Body: body})
+}
+
+// Write sends the program's console output.
+func (s *dapServer) Write(p []byte) (int, error) {
+	s.event("output", map[string]string{"category": "stdout", "output": string(p)})
+	return len(p), nil
+}
+
+// dapLog sends the emulator's diagnostics to the debug console.
+type dapLog struct {
+	s *dapServer
+}
+
+func (l dapLog) Write(p []byte) (int, error) {
+	l.s.event("output", map[string]string{"category": "console", "output": string(p)})
+	return len(p), nil
+}
+
+func (s *dapServer) isRunning() bool {
+	if s.running == nil {
+		return false
+	}
+	select {
+	case <-s.running:
+		return false
+	default:
+		return true
+	}
+}
+
+// start runs the program until run returns and reports why it stopped.
+// reason names a finished step.
+func (s *dapServer) start(reason string, run func() Stop) {
+	done := make(chan struct{})
+	s.running = done
+	s.reason, s.run = reason, run
+	go func() {
+		stop := run()
+		s.console.Flush()
+		s.suspended = stop.Reason == StopInterrupt && atomic.CompareAndSwapInt32(&s.suspending, 1, 0)
+		// Requests that follow the stopped event see the program stopped.
+		close(done)
+		if s.suspended {
+			return
+		}
+
+		switch stop.Reason {
+		case StopExit:
+			s.event("exited", map[string]int{"exitCode": stop.Code})
+			s.event("terminated", nil)
+			return
+		case StopBreakpoint:
+			reason = "breakpoint"
+		case StopWatchpoint:
+			reason = "data breakpoint"
+		case StopInterrupt:
+			reason = "pause"
+		case StopCrash:
+			reason = "exception"
+		}
+		s.event("stopped", map[string]interface{}{
+			"reason":            reason,
+			"description":       stop.String(),
+			"threadId":          1,
+			"allThreadsStopped": true,
+		})
+	}()
+}
+
+// later starts the program once the response to the current request has been
+// sent, so that the client never sees a stopped event before the response.
+func (s *dapServer) later(reason string, run func() Stop) {
+	s.pending = func() { s.start(reason, run) }
+}
+
+// suspend stops the running program without telling the client and returns
+// a function that resumes it. The program isn't resumed if it stopped on its
+// own in the meantime, as that stop has been reported.
+func (s *dapServer) suspend() func() {
+	if !s.isRunning() {
+		return func() {}
+	}
+	atomic.StoreInt32(&s.suspending, 1)
+	s.d.Interrupt()
+	<-s.running
+	if !s.suspended {
+		atomic.StoreInt32(&s.suspending, 0)
+		atomic.StoreInt32(&s.d.interrupted, 0)
+		return func() {}
+	}
+	reason, run := s.reason, s.run
+	return func() { s.start(reason, run) }
+}
+
+// pause stops the program and waits for it.
+func (s *dapServer) pause() {
+	if s.isRunning() {
+		s.d.Interrupt()
+		<-s.running
+	}
+}
+
+func (s *dapServer) handle(request *dapRequest) (interface{}, error) {
+	switch request.Command {
+	case "initialize":
+		return map[string]bool{
+			"supportsConfigurationDoneRequest": true,
+			"supportsSteppingGranularity":      true,
+			"supportsTerminateRequest":         true,
+		}, nil
+	case "launch":
+		var args DAPLaunchArguments
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return nil, s.launch(args)
+	case "threads":
+		return map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": 1, "name": "R3000"}},
+		}, nil
+	case "pause":
+		if s.isRunning() {
+			s.d.Interrupt()
+		}
+		return nil, nil
+	case "disconnect", "terminate":
+		s.pause()
+		if request.Command == "terminate" {
+			s.event("terminated", nil)
+		}
+		return nil, nil
+	}
+
+	if s.d == nil {
+		return nil, errors.New("no program launched")
+	}
+	if request.Command == "setBreakpoints" {
+		// Breakpoints are changed while the program is suspended, which
+		// the client doesn't notice.
+		s.pending = s.suspend()
+		return s.setBreakpoints(request.Arguments)
+	}
+	if s.isRunning() {
+		return nil, errRunning
+	}
+	switch request.Command {
+	case "setExceptionBreakpoints":
+		return nil, nil
+	case "configurationDone":
+		if s.stopOnEntry {
+			s.later("entry", func() Stop { return s.d.Until(s.entry) })
+		} else {
+			s.later("", s.d.Continue)
+		}
+		return nil, nil
+	case "stackTrace":
+		return s.stackTrace(), nil
+	case "scopes":
+		return map[string]interface{}{
+			"scopes": []map[string]interface{}{
+				{"name": "Registers", "variablesReference": dapRegisters, "presentationHint": "registers"},
+				{"name": "COP0", "variablesReference": dapCOP0, "presentationHint": "registers"},
+				{"name": "GTE", "variablesReference": dapGTE, "presentationHint": "registers"},
+			},
+		}, nil
+	case "variables":
+		var args struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"variables": s.variables(args.VariablesReference)}, nil
+	case "evaluate":
+		var args struct {
+			Expression string `json:"expression"`
+		}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		value, err := s.d.Evaluate(args.Expression)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"result": fmt.Sprintf("0x%08X", value), "variablesReference": 0}, nil
+	case "continue":
+		s.later("", s.d.Continue)
+		return map[string]bool{"allThreadsContinued": true}, nil
+	case "next", "stepIn", "stepOut":
+		var args struct {
+			Granularity string `json:"granularity"`
+		}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		instruction := args.Granularity == "instruction"
+		switch {
+		case request.Command == "stepOut":
+			s.later("step", s.stepOut)
+		case instruction && request.Command == "next":
+			s.later("step", s.d.Next)
+		case instruction:
+			s.later("step", s.d.Step)
+		default:
+			into := request.Command == "stepIn"
+			s.later("step", func() Stop { return s.stepLine(into) })
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported request %q", request.Command)
+}
+
+// launch sets up a machine like "ps -exe" does and stops before the first
+// instruction of the BIOS. The program runs once configuration is done.
+func (s *dapServer) launch(args DAPLaunchArguments) error {
+	if s.d != nil {
+		return errors.New("a program is already launched")
+	}
+
+	program, err := OpenProgram(args.Program)
+	if err != nil {
+		return err
+	}
+	config := Config{Program: program, TTY: s, Log: dapLog{s}}
+	config.Controllers[0] = NewDualShock()
+	if args.BIOS != "" {
+		if config.BIOS, err = os.ReadFile(args.BIOS); err != nil {
+			return err
+		}
+	}
+	system, err := NewSystem(config)
+	if err != nil {
+		return err
+	}
+	s.cpu, s.bus, s.console = system.CPU, system.Bus, system.Console
+
+	switch program := program.(type) {
+	case *ELF:
+		s.lines = program.Lines
+		s.entry = program.Entry
+	case *EXE:
+		s.entry = program.PC
+	}
+	s.stopOnEntry = args.StopOnEntry
+	s.d = NewDebugger(s.cpu, s.bus)
+	return nil
+}
+
+// setBreakpoints replaces the breakpoints of a source file. A breakpoint on a
+// line without code moves to the next line that has some.
+func (s *dapServer) setBreakpoints(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	path := args.Source.Path
+	for _, address := range s.breakpoints[path] {
+		s.d.RemoveBreakpoint(address)
+	}
+	s.breakpoints[path] = nil
+
+	breakpoints := make([]dapBreakpoint, len(args.Breakpoints))
+	for i, b := range args.Breakpoints {
+		line, ok := s.lines.Address(path, b.Line)
+		if !ok {
+			breakpoints[i] = dapBreakpoint{Line: b.Line, Message: "no code at or after this line"}
+			continue
+		}
+		s.d.AddBreakpoint(line.Address)
+		s.breakpoints[path] = append(s.breakpoints[path], line.Address)
+		breakpoints[i] = dapBreakpoint{Verified: true, Line: line.Line, Source: &args.Source}
+	}
+	return map[string]interface{}{"breakpoints": breakpoints}, nil
+}
+
+func (s *dapServer) stackTrace() interface{} {
+	var frames []dapFrame
+	for i, frame := range s.d.Backtrace(64) {
+		f := dapFrame{
+			ID:                          i,
+			Name:                        s.cpu.Symbols.Format(frame.PC),
+			InstructionPointerReference: fmt.Sprintf("0x%08X", frame.PC),
+		}
+		if line, ok := s.lines.Lookup(frame.PC); ok {
+			f.Source = &dapSource{Name: filepath.Base(line.File), Path: line.File}
+			f.Line, f.Column = line.Line, 1
+		}
+		frames = append(frames, f)
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}
+}
+
+// variables lists the registers of a scope. Registers are the same in all
+// frames.
+func (s *dapServer) variables(reference int) []dapVariable {
+	var variables []dapVariable
+	add := func(name string, value uint32) {
+		variables = append(variables, dapVariable{Name: name, Value: fmt.Sprintf("0x%08X", value)})
+	}
+	cpu := s.cpu
+	switch reference {
+	case dapRegisters:
+		for i, name := range RegisterNames {
+			add(name, cpu.GPR[i])
+		}
+		add("pc", cpu.Pc)
+		add("hi", cpu.HI)
+		add("lo", cpu.LO)
+	case dapCOP0:
+		indices := make([]int, 0, len(cop0RegisterNames))
+		for i := range cop0RegisterNames {
+			indices = append(indices, int(i))
+		}
+		sort.Ints(indices)
+		for _, i := range indices {
+			add(cop0RegisterNames[uint32(i)], cpu.COP0R[i])
+		}
+	case dapGTE:
+		for i, name := range gteDataRegisterNames {
+			add(name, cpu.COP2D[i])
+		}
+		for i, name := range gteControlRegisterNames {
+			add(name, cpu.COP2C[i])
+		}
+	}
+	return variables
+}
+
+// stepLine steps until execution reaches another source line or comes back to
+// the start of the current one. Calls are stepped over unless into is set and
+// the subroutine has line information.
+func (s *dapServer) stepLine(into bool) Stop {
+	d := s.d
+	start, ok := s.lines.Lookup(d.CPU.Pc)
+	if !ok {
+		return d.Step()
+	}
+	for {
+		stop := Stop{}
+		target, call := s.callTarget()
+		if _, known := s.lines.Lookup(target); call && (!into || !known) {
+			stop = d.Next()
+		} else {
+			stop = d.Step()
+		}
+		if stop.Reason != StopStep {
+			return stop
+		}
+
+		// Code without line information is stepped through.
+		line, ok := s.lines.Lookup(d.CPU.Pc)
+		if ok && (line != start || d.CPU.Pc == line.Address) {
+			return stop
+		}
+	}
+}
+
+// callTarget returns the destination of the call instruction at PC.
+func (s *dapServer) callTarget() (uint32, bool) {
+	pc := s.d.CPU.Pc
+	word := s.bus.fetch(pc)
+	inst := NewInstruction(word)
+	switch {
+	case !isCall(inst):
+		return 0, false
+	case inst.Opcode == 0x00:
+		return s.d.CPU.GPR[inst.Rs], true
+	}
+	return Disassemble(pc, word, nil).Target, true
+}
+
+// stepOut runs until the current function returns to its caller.
+func (s *dapServer) stepOut() Stop {
+	frames := s.d.Backtrace(2)
+	if len(frames) < 2 {
+		return s.stepLine(false)
+	}
+	caller := frames[1]
+	return s.d.run(func() bool {
+		return s.cpu.Pc == caller.PC+8 && s.cpu.GPR[29] >= caller.SP
+	})
+}
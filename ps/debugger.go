@@ -0,0 +1,531 @@
+package ps
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// WatchKind selects the accesses a watchpoint stops on.
+type WatchKind int
+
+const (
+	WatchWrite WatchKind = 1 << iota
+	WatchRead
+
+	WatchAccess = WatchRead | WatchWrite
+)
+
+func (kind WatchKind) String() string {
+	switch kind {
+	case WatchWrite:
+		return "write"
+	case WatchRead:
+		return "read"
+	}
+	return "access"
+}
+
+// Watchpoint stops execution when memory in [Address, Address+Size) is
+// accessed.
+type Watchpoint struct {
+	Address, Size uint32
+	Kind          WatchKind
+}
+
+func (w Watchpoint) matches(address, size uint32, op MemoryOperation) bool {
+	if op == OpLoad && w.Kind&WatchRead == 0 || op == OpStore && w.Kind&WatchWrite == 0 {
+		return false
+	}
+	// Compare physical addresses so that KUSEG, KSEG0 and KSEG1 accesses match.
+	address, start := address&0x1FFFFFFF, w.Address&0x1FFFFFFF
+	return address < start+w.Size && start < address+size
+}
+
+type StopReason int
+
+const (
+	// StopStep means that a step, next or until command finished.
+	StopStep StopReason = iota
+	StopBreakpoint
+	StopWatchpoint
+	StopInterrupt
+	StopExit
+	// StopCrash means that emulation cannot continue, Err is a
+	// *CrashReport.
+	StopCrash
+)
+
+// Stop describes why the debugger returned control.
+type Stop struct {
+	Reason StopReason
+
+	// Watchpoint is the watchpoint that was hit, and Address, Op and Value
+	// describe the access that hit it.
+	Watchpoint Watchpoint
+	Address    uint32
+	Op         MemoryOperation
+	Value      uint32
+
+	// Code is the exit code of the program for StopExit.
+	Code int
+	Err  error
+}
+
+func (stop Stop) String() string {
+	switch stop.Reason {
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopWatchpoint:
+		return fmt.Sprintf("%s watchpoint: %s %08Xh at %08Xh", stop.Watchpoint.Kind, stop.Op, stop.Value, stop.Address)
+	case StopInterrupt:
+		return "interrupted"
+	case StopExit:
+		return fmt.Sprintf("exited with code %d", stop.Code)
+	case StopCrash:
+		return stop.Err.Error()
+	}
+	return "stepped"
+}
+
+// Debugger runs a CPU under control of breakpoints and watchpoints.
+type Debugger struct {
+	CPU *CPU
+	Bus *Bus
+
+	breakpoints map[uint32]bool
+	watchpoints []Watchpoint
+
+	// hit is set by the memory hook when an access matches a watchpoint.
+	hit         *Stop
+	interrupted int32
+}
+
+func NewDebugger(cpu *CPU, bus *Bus) *Debugger {
+	d := &Debugger{
+		CPU:         cpu,
+		Bus:         bus,
+		breakpoints: make(map[uint32]bool),
+	}
+	bus.SetMemoryHook(d.access)
+	return d
+}
+
+func (d *Debugger) access(address, size uint32, op MemoryOperation, value uint32) {
+	if d.hit != nil {
+		return
+	}
+	for _, w := range d.watchpoints {
+		if w.matches(address, size, op) {
+			d.hit = &Stop{Reason: StopWatchpoint, Watchpoint: w, Address: address, Op: op, Value: value}
+			return
+		}
+	}
+}
+
+func (d *Debugger) AddBreakpoint(address uint32) {
+	d.breakpoints[address] = true
+}
+
+// RemoveBreakpoint deletes the breakpoint at address and reports whether
+// there was one.
+func (d *Debugger) RemoveBreakpoint(address uint32) bool {
+	ok := d.breakpoints[address]
+	delete(d.breakpoints, address)
+	return ok
+}
+
+// Breakpoints returns the breakpoint addresses in ascending order.
+func (d *Debugger) Breakpoints() []uint32 {
+	addresses := make([]uint32, 0, len(d.breakpoints))
+	for address := range d.breakpoints {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i] < addresses[j] })
+	return addresses
+}
+
+func (d *Debugger) AddWatchpoint(w Watchpoint) {
+	if w.Size == 0 {
+		w.Size = 1
+	}
+	d.watchpoints = append(d.watchpoints, w)
+}
+
+// RemoveWatchpoint deletes the watchpoints at address and reports whether
+// there were any.
+func (d *Debugger) RemoveWatchpoint(address uint32) bool {
+	kept := d.watchpoints[:0]
+	for _, w := range d.watchpoints {
+		if w.Address != address {
+			kept = append(kept, w)
+		}
+	}
+	removed := len(kept) != len(d.watchpoints)
+	d.watchpoints = kept
+	return removed
+}
+
+// RemoveWatchpointOf deletes one watchpoint with the address, size and kind
+// of w and reports whether there was one. Others at the same address stay.
+func (d *Debugger) RemoveWatchpointOf(w Watchpoint) bool {
+	if w.Size == 0 {
+		w.Size = 1
+	}
+	for i, existing := range d.watchpoints {
+		if existing == w {
+			d.watchpoints = append(d.watchpoints[:i], d.watchpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Debugger) Watchpoints() []Watchpoint {
+	return append([]Watchpoint(nil), d.watchpoints...)
+}
+
+// Interrupt stops a running Continue, Next or Until, or the next one if
+// none is running. It may be called from another goroutine.
+func (d *Debugger) Interrupt() {
+	atomic.StoreInt32(&d.interrupted, 1)
+}
+
+// cycle executes one instruction and reports whether it has to stop.
+func (d *Debugger) cycle() (Stop, bool) {
+	d.hit = nil
+	if err := d.CPU.Step(d.Bus); err != nil {
+		return Stop{Reason: StopCrash, Err: err}, true
+	}
+	if code, exited := d.Bus.ExitCode(); exited {
+		return Stop{Reason: StopExit, Code: code}, true
+	}
+	if d.hit != nil {
+		return *d.hit, true
+	}
+	return Stop{}, false
+}
+
+// run executes instructions until done returns true, a breakpoint or a
+// watchpoint is hit or Interrupt is called. The breakpoint at the current
+// PC is stepped over.
+func (d *Debugger) run(done func() bool) Stop {
+	for {
+		if stop, ok := d.cycle(); ok {
+			return stop
+		}
+		switch {
+		case done():
+			return Stop{Reason: StopStep}
+		case d.breakpoints[d.CPU.Pc]:
+			return Stop{Reason: StopBreakpoint}
+		case atomic.CompareAndSwapInt32(&d.interrupted, 1, 0):
+			return Stop{Reason: StopInterrupt}
+		}
+	}
+}
+
+// Step executes a single instruction.
+func (d *Debugger) Step() Stop {
+	return d.run(func() bool { return true })
+}
+
+// Next is like Step, but runs subroutine calls to completion.
+func (d *Debugger) Next() Stop {
+	pc := d.CPU.Pc
+	if !isCall(NewInstruction(d.Bus.fetch(pc))) {
+		return d.Step()
+	}
+
+	// The return address follows the delay slot. Checking the stack pointer
+	// keeps recursive calls from stopping early.
+	sp := d.CPU.GPR[29]
+	return d.run(func() bool {
+		return d.CPU.Pc == pc+8 && d.CPU.GPR[29] >= sp
+	})
+}
+
+func isCall(instruction Instruction) bool {
+	switch {
+	case instruction.Opcode == 0x03:
+		return true
+	case instruction.Opcode == 0x00 && instruction.Function == 0x09:
+		return true
+	case instruction.Opcode == 0x01 && instruction.Rt&0x10 != 0:
+		return true
+	}
+	return false
+}
+
+// Until runs until execution reaches address.
+func (d *Debugger) Until(address uint32) Stop {
+	return d.run(func() bool { return d.CPU.Pc == address })
+}
+
+// Continue runs until a breakpoint or watchpoint is hit.
+func (d *Debugger) Continue() Stop {
+	return d.run(func() bool { return false })
+}
+
+// Frame is an entry of the call stack. PC is the current instruction of the
+// innermost frame and the call instruction of the others.
+type Frame struct {
+	PC, SP uint32
+}
+
+// Backtrace walks up to max frames of the call stack. Without frame pointers
+// or unwind tables, it finds the frame size and the saved return address by
+// scanning each function from its symbol to the current instruction for
+// "addiu $sp, $sp, -size" and "sw $ra, offset($sp)", so it needs symbols.
+func (d *Debugger) Backtrace(max int) []Frame {
+	pc, sp, ra := d.CPU.Pc, d.CPU.GPR[29], d.CPU.GPR[31]
+	frames := []Frame{{pc, sp}}
+	for len(frames) < max {
+		symbol, ok := d.CPU.Symbols.Lookup(pc)
+		if !ok {
+			break
+		}
+
+		var size uint32
+		saved := false
+		for address := symbol.Address; address < pc; address += 4 {
+			word, ok := d.readWord(address)
+			if !ok {
+				break
+			}
+			inst := NewInstruction(word)
+			switch {
+			case inst.Opcode == 0x09 && inst.Rs == 29 && inst.Rt == 29 && int32(inst.Imm16sx) < 0:
+				size = -inst.Imm16sx
+			case inst.Opcode == 0x2B && inst.Rs == 29 && inst.Rt == 31:
+				ra, saved = d.readWord(sp + inst.Imm16sx)
+			}
+		}
+
+		// Only the innermost function can keep its return address in $ra.
+		if !saved && len(frames) > 1 || ra < 8 {
+			break
+		}
+		pc, sp = ra-8, sp+size
+		frames = append(frames, Frame{pc, sp})
+	}
+	return frames
+}
+
+func (d *Debugger) readWord(address uint32) (uint32, bool) {
+	var word [4]byte
+	if d.ReadMemory(address, word[:]) != nil {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(word[:]), true
+}
+
+var errUnmapped = errors.New("address is not mapped")
+
+// ReadMemory fills data with memory contents starting at address. Unlike
+// Bus.Read it fails instead of exiting on unmapped addresses.
+func (d *Debugger) ReadMemory(address uint32, data []byte) error {
+	for len(data) > 0 {
+		offset, memory, ok := d.Bus.memory(address)
+		if !ok {
+			return fmt.Errorf("%08Xh: %w", address, errUnmapped)
+		}
+		n := copy(data, memory[offset:])
+		data = data[n:]
+		address += uint32(n)
+	}
+	return nil
+}
+
+// WriteMemory copies data to memory starting at address.
+func (d *Debugger) WriteMemory(address uint32, data []byte) error {
+	for len(data) > 0 {
+		offset, memory, ok := d.Bus.memory(address)
+		if !ok {
+			return fmt.Errorf("%08Xh: %w", address, errUnmapped)
+		}
+		n := copy(memory[offset:], data)
+		data = data[n:]
+		address += uint32(n)
+	}
+	return nil
+}
+
+// register returns a pointer to the register called name, which is an ABI
+// name, a number, pc, hi, lo or a COP0 register name.
+func (d *Debugger) register(name string) (*uint32, bool) {
+	name = strings.ToLower(strings.TrimPrefix(name, "$"))
+	switch name {
+	case "pc":
+		return &d.CPU.Pc, true
+	case "hi":
+		return &d.CPU.HI, true
+	case "lo":
+		return &d.CPU.LO, true
+	case "s8":
+		name = "fp"
+	}
+	for i, register := range RegisterNames {
+		if name == register || name == strconv.Itoa(i) {
+			return &d.CPU.GPR[i], true
+		}
+	}
+	for i, register := range cop0RegisterNames {
+		if name == strings.ToLower(register) {
+			return &d.CPU.COP0R[i], true
+		}
+	}
+	return nil, false
+}
+
+// Register returns the value of a register, see SetRegister for the names.
+func (d *Debugger) Register(name string) (uint32, bool) {
+	register, ok := d.register(name)
+	if !ok {
+		return 0, false
+	}
+	return *register, true
+}
+
+// SetRegister changes a register between instructions. Registers are named
+// as in the disassembly ($a0, $sp), by number ($4), or as pc, hi, lo and the
+// COP0 register names (sr, cause, epc...).
+func (d *Debugger) SetRegister(name string, value uint32) error {
+	register, ok := d.register(name)
+	if !ok {
+		return fmt.Errorf("unknown register %s", name)
+	}
+	if register == &d.CPU.Pc {
+		d.CPU.Jump(value)
+		return nil
+	}
+	for i := range d.CPU.GPR {
+		if register == &d.CPU.GPR[i] {
+			d.CPU.forceGPR(uint32(i), value)
+			return nil
+		}
+	}
+	*register = value
+	return nil
+}
+
+// Evaluate computes the value of an expression made of numbers, registers
+// and symbols joined by + and -. Numbers are decimal, or hexadecimal with a
+// 0x prefix or an h suffix.
+func (d *Debugger) Evaluate(expression string) (uint32, error) {
+	var result uint32
+	sign := uint32(1)
+	rest := strings.TrimSpace(expression)
+	if rest == "" {
+		return 0, errors.New("empty expression")
+	}
+	for {
+		if strings.HasPrefix(rest, "-") {
+			sign, rest = -sign, strings.TrimSpace(rest[1:])
+			continue
+		}
+		if strings.HasPrefix(rest, "+") {
+			rest = strings.TrimSpace(rest[1:])
+			continue
+		}
+
+		end := strings.IndexAny(rest, "+-")
+		if end < 0 {
+			end = len(rest)
+		}
+		value, err := d.term(strings.TrimSpace(rest[:end]))
+		if err != nil {
+			return 0, err
+		}
+		result += sign * value
+		sign = 1
+
+		rest = rest[end:]
+		if rest == "" {
+			return result, nil
+		}
+	}
+}
+
+func (d *Debugger) term(term string) (uint32, error) {
+	if term == "" {
+		return 0, errors.New("missing operand")
+	}
+	if strings.HasPrefix(term, "$") {
+		if value, ok := d.Register(term); ok {
+			return value, nil
+		}
+		return 0, fmt.Errorf("unknown register %s", term)
+	}
+	if address, ok := d.CPU.Symbols.Address(term); ok {
+		return address, nil
+	}
+	if value, ok := parseNumber(term); ok {
+		return value, nil
+	}
+	if value, ok := d.Register(term); ok {
+		return value, nil
+	}
+	return 0, fmt.Errorf("unknown symbol %s", term)
+}
+
+func parseNumber(s string) (uint32, bool) {
+	if len(s) > 1 && (s[len(s)-1] == 'h' || s[len(s)-1] == 'H') {
+		s = "0x" + s[:len(s)-1]
+	}
+	value, err := strconv.ParseUint(s, 0, 32)
+	return uint32(value), err == nil
+}
+
+// PrintRegisters writes the general purpose registers, PC, HI and LO.
+func (d *Debugger) PrintRegisters(w io.Writer) {
+	cpu := d.CPU
+	for i := 0; i < 32; i += 4 {
+		fmt.Fprintf(w, "%4s %08X  %4s %08X  %4s %08X  %4s %08X\n",
+			RegisterNames[i], cpu.GPR[i], RegisterNames[i+1], cpu.GPR[i+1],
+			RegisterNames[i+2], cpu.GPR[i+2], RegisterNames[i+3], cpu.GPR[i+3])
+	}
+	fmt.Fprintf(w, "%4s %08X  %4s %08X  %4s %08X\n", "pc", cpu.Pc, "hi", cpu.HI, "lo", cpu.LO)
+}
+
+// PrintCOP0 writes the COP0 registers that have names.
+func (d *Debugger) PrintCOP0(w io.Writer) {
+	indices := make([]int, 0, len(cop0RegisterNames))
+	for i := range cop0RegisterNames {
+		indices = append(indices, int(i))
+	}
+	sort.Ints(indices)
+	for n, i := range indices {
+		fmt.Fprintf(w, "%8s %08X", cop0RegisterNames[uint32(i)], d.CPU.COP0R[i])
+		if n%4 == 3 || n == len(indices)-1 {
+			fmt.Fprintln(w)
+		} else {
+			fmt.Fprint(w, "  ")
+		}
+	}
+}
+
+// PrintGTE writes the GTE data and control registers.
+func (d *Debugger) PrintGTE(w io.Writer) {
+	for _, bank := range []struct {
+		names  *[32]string
+		values []uint32
+	}{
+		{&gteDataRegisterNames, d.CPU.COP2D},
+		{&gteControlRegisterNames, d.CPU.COP2C},
+	} {
+		for i := 0; i < 32; i++ {
+			fmt.Fprintf(w, "%8s %08X", bank.names[i], bank.values[i])
+			if i%4 == 3 {
+				fmt.Fprintln(w)
+			} else {
+				fmt.Fprint(w, "  ")
+			}
+		}
+	}
+}
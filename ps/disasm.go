@@ -0,0 +1,249 @@
+package ps
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RegisterNames are the ABI names of the general purpose registers.
+var RegisterNames = [32]string{
+	"zero", "at", "v0", "v1", "a0", "a1", "a2", "a3",
+	"t0", "t1", "t2", "t3", "t4", "t5", "t6", "t7",
+	"s0", "s1", "s2", "s3", "s4", "s5", "s6", "s7",
+	"t8", "t9", "k0", "k1", "gp", "sp", "fp", "ra",
+}
+
+// COP0 register names
+// http://problemkaputt.de/psx-spx.htm#cop0registersummary
+var cop0RegisterNames = map[uint32]string{
+	3: "BPC", 5: "BDA", 6: "JUMPDEST", 7: "DCIC", 8: "BadVaddr", 9: "BDAM",
+	11: "BPCM", 12: "SR", 13: "CAUSE", 14: "EPC", 15: "PRID",
+}
+
+// GTE register names
+// http://problemkaputt.de/psx-spx.htm#gteregisters
+var (
+	gteDataRegisterNames = [32]string{
+		"VXY0", "VZ0", "VXY1", "VZ1", "VXY2", "VZ2", "RGBC", "OTZ",
+		"IR0", "IR1", "IR2", "IR3", "SXY0", "SXY1", "SXY2", "SXYP",
+		"SZ0", "SZ1", "SZ2", "SZ3", "RGB0", "RGB1", "RGB2", "RES1",
+		"MAC0", "MAC1", "MAC2", "MAC3", "IRGB", "ORGB", "LZCS", "LZCR",
+	}
+	gteControlRegisterNames = [32]string{
+		"RT11RT12", "RT13RT21", "RT22RT23", "RT31RT32", "RT33", "TRX", "TRY", "TRZ",
+		"L11L12", "L13L21", "L22L23", "L31L32", "L33", "RBK", "GBK", "BBK",
+		"LR1LR2", "LR3LG1", "LG2LG3", "LB1LB2", "LB3", "RFC", "GFC", "BFC",
+		"OFX", "OFY", "H", "DQA", "DQB", "ZSF3", "ZSF4", "FLAG",
+	}
+)
+
+// GTE commands by their function field
+// http://problemkaputt.de/psx-spx.htm#gtecommandencoding
+var gteCommands = map[uint32]string{
+	0x01: "RTPS", 0x06: "NCLIP", 0x0C: "OP", 0x10: "DPCS", 0x11: "INTPL",
+	0x12: "MVMVA", 0x13: "NCDS", 0x14: "CDP", 0x16: "NCDT", 0x1B: "NCCS",
+	0x1C: "CC", 0x1E: "NCS", 0x20: "NCT", 0x28: "SQR", 0x29: "DCPL",
+	0x2A: "DPCT", 0x2D: "AVSZ3", 0x2E: "AVSZ4", 0x30: "RTPT", 0x3D: "GPF",
+	0x3E: "GPL", 0x3F: "NCCT",
+}
+
+var (
+	specialMnemonics = map[uint32]string{
+		0x0C: "SYSCALL", 0x0D: "BREAK",
+		0x18: "MULT", 0x19: "MULTU", 0x1A: "DIV", 0x1B: "DIVU",
+		0x20: "ADD", 0x21: "ADDU", 0x22: "SUB", 0x23: "SUBU",
+		0x24: "AND", 0x25: "OR", 0x26: "XOR", 0x27: "NOR", 0x2A: "SLT", 0x2B: "SLTU",
+	}
+	bcondMnemonics   = map[uint32]string{0x00: "BLTZ", 0x01: "BGEZ", 0x10: "BLTZAL", 0x11: "BGEZAL"}
+	primaryMnemonics = map[uint32]string{
+		0x08: "ADDI", 0x09: "ADDIU", 0x0A: "SLTI", 0x0B: "SLTIU", 0x0C: "ANDI", 0x0D: "ORI", 0x0E: "XORI",
+		0x20: "LB", 0x21: "LH", 0x22: "LWL", 0x23: "LW", 0x24: "LBU", 0x25: "LHU", 0x26: "LWR",
+		0x28: "SB", 0x29: "SH", 0x2A: "SWL", 0x2B: "SW", 0x2E: "SWR",
+	}
+)
+
+// Disassembly is a decoded instruction.
+type Disassembly struct {
+	Address  uint32
+	Word     uint32
+	Mnemonic string
+	Operands []string
+
+	// Target is the destination of a jump or branch, if it is known from the
+	// instruction alone.
+	Target    uint32
+	HasTarget bool
+}
+
+func (d Disassembly) String() string {
+	if len(d.Operands) == 0 {
+		return d.Mnemonic
+	}
+	return fmt.Sprintf("%-8s%s", d.Mnemonic, strings.Join(d.Operands, ", "))
+}
+
+func gpr(index uint32) string {
+	return "$" + RegisterNames[index&0x1F]
+}
+
+func signedHex(value uint32) string {
+	if int32(value) < 0 {
+		return fmt.Sprintf("-%Xh", -value)
+	}
+	return fmt.Sprintf("%Xh", value)
+}
+
+// Disassemble decodes the instruction word at address. Jump and branch
+// destinations and their symbols are resolved with symbols, which may be nil.
+func Disassemble(address, word uint32, symbols *SymbolTable) Disassembly {
+	inst := NewInstruction(word)
+	d := Disassembly{Address: address, Word: word}
+	set := func(mnemonic string, operands ...string) Disassembly {
+		d.Mnemonic, d.Operands = mnemonic, operands
+		return d
+	}
+	target := func() string {
+		d.Target, d.HasTarget = inst.Target(address)
+		return symbols.Format(d.Target)
+	}
+	memory := func(mnemonic, rt string) Disassembly {
+		return set(mnemonic, rt, fmt.Sprintf("%s(%s)", signedHex(inst.Imm16sx), gpr(inst.Rs)))
+	}
+	rs, rt, rd := gpr(inst.Rs), gpr(inst.Rt), gpr(inst.Rd)
+
+	switch inst.Opcode {
+	case 0x00:
+		switch inst.Function {
+		case 0x00:
+			if word == 0 {
+				return set("NOP")
+			}
+			return set("SLL", rd, rt, fmt.Sprint(inst.ShiftAmount))
+		case 0x02:
+			return set("SRL", rd, rt, fmt.Sprint(inst.ShiftAmount))
+		case 0x03:
+			return set("SRA", rd, rt, fmt.Sprint(inst.ShiftAmount))
+		case 0x04:
+			return set("SLLV", rd, rt, rs)
+		case 0x06:
+			return set("SRLV", rd, rt, rs)
+		case 0x07:
+			return set("SRAV", rd, rt, rs)
+		case 0x08:
+			return set("JR", rs)
+		case 0x09:
+			if inst.Rd == 31 {
+				return set("JALR", rs)
+			}
+			return set("JALR", rd, rs)
+		case 0x0C, 0x0D:
+			mnemonic := specialMnemonics[inst.Function]
+			if inst.Code() == 0 {
+				return set(mnemonic)
+			}
+			return set(mnemonic, fmt.Sprintf("%Xh", inst.Code()))
+		case 0x10:
+			return set("MFHI", rd)
+		case 0x11:
+			return set("MTHI", rs)
+		case 0x12:
+			return set("MFLO", rd)
+		case 0x13:
+			return set("MTLO", rs)
+		case 0x21:
+			if inst.Rt == 0 {
+				return set("MOVE", rd, rs)
+			}
+		}
+		name, ok := specialMnemonics[inst.Function]
+		switch {
+		case !ok:
+			return set(".word", fmt.Sprintf("%08Xh", word))
+		case inst.Function < 0x20:
+			return set(name, rs, rt)
+		}
+		return set(name, rd, rs, rt)
+	case 0x01:
+		return set(bcondMnemonics[inst.Rt&0x11], rs, target())
+	case 0x02:
+		return set("J", target())
+	case 0x03:
+		return set("JAL", target())
+	case 0x04:
+		if inst.Rs == 0 && inst.Rt == 0 {
+			return set("B", target())
+		}
+		return set("BEQ", rs, rt, target())
+	case 0x05:
+		return set("BNE", rs, rt, target())
+	case 0x06:
+		return set("BLEZ", rs, target())
+	case 0x07:
+		return set("BGTZ", rs, target())
+	case 0x08, 0x09, 0x0A, 0x0B:
+		return set(primaryMnemonics[inst.Opcode], rt, rs, signedHex(inst.Imm16sx))
+	case 0x0C, 0x0D, 0x0E:
+		return set(primaryMnemonics[inst.Opcode], rt, rs, fmt.Sprintf("%Xh", inst.Imm16))
+	case 0x0F:
+		return set("LUI", rt, fmt.Sprintf("%Xh", inst.Imm16))
+	case 0x10:
+		return disassembleCOP0(inst, set)
+	case 0x12:
+		return disassembleCOP2(inst, set)
+	case 0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x28, 0x29, 0x2A, 0x2B, 0x2E:
+		return memory(primaryMnemonics[inst.Opcode], rt)
+	case 0x32:
+		return memory("LWC2", gteDataRegisterNames[inst.Rt])
+	case 0x3A:
+		return memory("SWC2", gteDataRegisterNames[inst.Rt])
+	}
+	return set(".word", fmt.Sprintf("%08Xh", word))
+}
+
+func cop0Register(index uint32) string {
+	if name, ok := cop0RegisterNames[index]; ok {
+		return name
+	}
+	return fmt.Sprintf("$%d", index)
+}
+
+func disassembleCOP0(inst Instruction, set func(string, ...string) Disassembly) Disassembly {
+	switch {
+	case inst.Rs == 0x00:
+		return set("MFC0", gpr(inst.Rt), cop0Register(inst.Rd))
+	case inst.Rs == 0x04:
+		return set("MTC0", gpr(inst.Rt), cop0Register(inst.Rd))
+	case inst.Rs == 0x10 && inst.Function == 0x10:
+		return set("RFE")
+	}
+	return set("COP0", fmt.Sprintf("%Xh", inst.Address&0x1FFFFFF))
+}
+
+func disassembleCOP2(inst Instruction, set func(string, ...string) Disassembly) Disassembly {
+	switch inst.Rs {
+	case 0x00:
+		return set("MFC2", gpr(inst.Rt), gteDataRegisterNames[inst.Rd])
+	case 0x02:
+		return set("CFC2", gpr(inst.Rt), gteControlRegisterNames[inst.Rd])
+	case 0x04:
+		return set("MTC2", gpr(inst.Rt), gteDataRegisterNames[inst.Rd])
+	case 0x06:
+		return set("CTC2", gpr(inst.Rt), gteControlRegisterNames[inst.Rd])
+	}
+
+	command := inst.Address & 0x1FFFFFF
+	name, ok := gteCommands[command&0x3F]
+	if inst.Rs&0x10 == 0 || !ok {
+		return set("COP2", fmt.Sprintf("%Xh", command))
+	}
+
+	sf := fmt.Sprintf("sf=%d", command>>19&1)
+	lm := fmt.Sprintf("lm=%d", command>>10&1)
+	if name != "MVMVA" {
+		return set(name, sf, lm)
+	}
+	mx := [4]string{"RT", "LLM", "LCM", "none"}[command>>17&3]
+	v := [4]string{"V0", "V1", "V2", "IR"}[command>>15&3]
+	cv := [4]string{"TR", "BK", "FC", "none"}[command>>13&3]
+	return set(name, sf, "mx="+mx, "v="+v, "cv="+cv, lm)
+}
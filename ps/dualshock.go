@@ -0,0 +1,229 @@
+package ps
+
+// Axis is an analog stick axis of the DualShock. Axes are listed in the order
+// they are sent over SIO0.
+type Axis int
+
+const (
+	AxisRightX Axis = iota
+	AxisRightY
+	AxisLeftX
+	AxisLeftY
+)
+
+// Rumble mapping values set by command 4Dh.
+const (
+	rumbleSmallMotor = 0x00
+	rumbleLargeMotor = 0x01
+	rumbleNone       = 0xFF
+)
+
+// DualShock is the SCPH-1200 analog controller with vibration motors.
+// http://problemkaputt.de/psx-spx.htm#controllersconfigurationcommands
+type DualShock struct {
+	Buttons
+
+	axes [4]uint8
+
+	// analog is set when the analog LED is lit, locked when the game has
+	// disabled the analog button with command 44h.
+	analog     bool
+	locked     bool
+	configMode bool
+
+	// mapping assigns bytes 3..8 of the read command to the motors.
+	mapping    [6]uint8
+	smallMotor uint8
+	largeMotor uint8
+
+	position int
+	command  uint8
+	response []uint8
+}
+
+func NewDualShock() *DualShock {
+	ds := &DualShock{}
+	for i := range ds.axes {
+		ds.axes[i] = 0x80
+	}
+	for i := range ds.mapping {
+		ds.mapping[i] = rumbleNone
+	}
+	return ds
+}
+
+// SetAxis sets a stick position, where 00h is left/up, 80h is centered and
+// FFh is right/down.
+func (ds *DualShock) SetAxis(axis Axis, value uint8) {
+	ds.axes[axis] = value
+}
+
+// PressAnalog emulates pressing the Analog button, which toggles between
+// digital and analog mode unless the game has locked the mode.
+func (ds *DualShock) PressAnalog() {
+	if !ds.locked {
+		ds.analog = !ds.analog
+	}
+}
+
+// Analog reports whether the controller is in analog mode.
+func (ds *DualShock) Analog() bool {
+	return ds.analog
+}
+
+// Motors returns the current strength of the small (either 00h or FFh) and
+// the large (00h-FFh) motor.
+func (ds *DualShock) Motors() (small, large uint8) {
+	if ds.smallMotor&1 != 0 {
+		small = 0xFF
+	}
+	return small, ds.largeMotor
+}
+
+func (ds *DualShock) id() uint16 {
+	switch {
+	case ds.configMode:
+		return IDConfigMode
+	case ds.analog:
+		return IDAnalogPad
+	default:
+		return IDDigitalPad
+	}
+}
+
+func (ds *DualShock) readResponse() []uint8 {
+	id := ds.id()
+	low, high := ds.state()
+	response := []uint8{uint8(id), uint8(id >> 8), low, high}
+	if ds.analog || ds.configMode {
+		response = append(response, ds.axes[:]...)
+	}
+	return response
+}
+
+func (ds *DualShock) configResponse(data ...uint8) []uint8 {
+	response := []uint8{uint8(IDConfigMode & 0xFF), uint8(IDConfigMode >> 8), 0, 0, 0, 0, 0, 0}
+	copy(response[2:], data)
+	return response
+}
+
+// commandResponse returns the bytes sent back for command, starting with the
+// ID. It returns nil for commands that aren't acknowledged.
+func (ds *DualShock) commandResponse(command uint8) []uint8 {
+	switch command {
+	case 0x42:
+		return ds.readResponse()
+	case 0x43:
+		if ds.configMode {
+			return ds.configResponse()
+		}
+		return ds.readResponse()
+	}
+
+	if !ds.configMode {
+		return nil
+	}
+
+	switch command {
+	case 0x41:
+		if ds.analog {
+			return ds.configResponse(0xFF, 0xFF, 0x03, 0x00, 0x00, 0x5A)
+		}
+		return ds.configResponse()
+	case 0x45:
+		led := uint8(0)
+		if ds.analog {
+			led = 1
+		}
+		return ds.configResponse(0x01, 0x02, led, 0x02, 0x01, 0x00)
+	case 0x47:
+		return ds.configResponse(0x00, 0x00, 0x02, 0x00, 0x01, 0x00)
+	case 0x48:
+		return ds.configResponse(0x00, 0x00, 0x00, 0x00, 0x01, 0x00)
+	case 0x4D:
+		return ds.configResponse(ds.mapping[:]...)
+	case 0x40, 0x44, 0x46, 0x49, 0x4A, 0x4B, 0x4C, 0x4E, 0x4F:
+		return ds.configResponse()
+	}
+
+	return nil
+}
+
+// receive handles the n-th parameter byte (sent along with reply byte 3+n).
+func (ds *DualShock) receive(n int, value uint8) {
+	switch ds.command {
+	case 0x42:
+		switch ds.mapping[n] {
+		case rumbleSmallMotor:
+			ds.smallMotor = value
+		case rumbleLargeMotor:
+			ds.largeMotor = value
+		}
+	case 0x43:
+		if n == 0 {
+			ds.configMode = value == 1
+		}
+	case 0x44:
+		switch n {
+		case 0:
+			ds.analog = value == 1
+		case 1:
+			ds.locked = value == 3
+		}
+	case 0x46:
+		if n == 0 {
+			switch value {
+			case 0:
+				copy(ds.response[3:], []uint8{0x00, 0x01, 0x02, 0x00, 0x0A})
+			case 1:
+				copy(ds.response[3:], []uint8{0x00, 0x01, 0x01, 0x01, 0x14})
+			}
+		}
+	case 0x4C:
+		if n == 0 {
+			switch value {
+			case 0:
+				ds.response[5] = 0x04
+			case 1:
+				ds.response[5] = 0x07
+			}
+		}
+	case 0x4D:
+		ds.mapping[n] = value
+		ds.smallMotor = 0
+		ds.largeMotor = 0
+	}
+}
+
+func (ds *DualShock) Transfer(value uint8) (uint8, bool) {
+	position := ds.position
+	ds.position++
+
+	switch {
+	case position == 0:
+		return 0xFF, true
+	case position == 1:
+		ds.command = value
+		ds.response = ds.commandResponse(value)
+		if ds.response == nil {
+			return 0xFF, false
+		}
+		return ds.response[0], true
+	}
+
+	index := position - 1
+	if index >= len(ds.response) {
+		return 0xFF, false
+	}
+
+	if position >= 3 {
+		ds.receive(position-3, value)
+	}
+
+	return ds.response[index], index < len(ds.response)-1
+}
+
+func (ds *DualShock) Deselect() {
+	ds.position = 0
+	ds.response = nil
+}
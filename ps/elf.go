@@ -0,0 +1,127 @@
+package ps
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ELFSegment is a PT_LOAD segment. Memory past the end of Data up to Size is
+// cleared when loading.
+type ELFSegment struct {
+	Address uint32
+	Size    uint32
+	Data    []byte
+}
+
+// ELF is a MIPS ELF executable, as produced by PSn00bSDK and similar
+// toolchains before conversion to PS-X EXE.
+type ELF struct {
+	Entry uint32
+	// GP is the value of the _gp symbol, or zero if there is none.
+	GP       uint32
+	Segments []ELFSegment
+	Symbols  *SymbolTable
+	// Lines maps addresses to source lines if the file has DWARF line
+	// tables.
+	Lines *LineTable
+	// LinesErr tells why the line tables were ignored, if they were.
+	LinesErr error
+}
+
+// ParseELF parses a 32-bit little-endian MIPS ELF executable.
+func ParseELF(data []byte) (*ELF, error) {
+	file, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if file.Class != elf.ELFCLASS32 || file.Data != elf.ELFDATA2LSB || file.Machine != elf.EM_MIPS {
+		return nil, errors.New("not a 32-bit little-endian MIPS ELF")
+	}
+
+	program := &ELF{
+		Entry:   uint32(file.Entry),
+		Symbols: NewSymbolTable(),
+		Lines:   &LineTable{},
+	}
+
+	for _, prog := range file.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Memsz == 0 {
+			continue
+		}
+		// Sizes are checked before they are allocated.
+		if prog.Off > uint64(len(data)) || prog.Filesz > uint64(len(data))-prog.Off {
+			return nil, fmt.Errorf("segment at %08Xh is larger than the file", prog.Vaddr)
+		}
+		if prog.Memsz > MainRAMSize || prog.Filesz > prog.Memsz {
+			return nil, fmt.Errorf("segment at %08Xh has a bad size of %d bytes", prog.Vaddr, prog.Memsz)
+		}
+		segment := ELFSegment{
+			Address: uint32(prog.Vaddr),
+			Size:    uint32(prog.Memsz),
+			Data:    make([]byte, prog.Filesz),
+		}
+		if _, err := io.ReadFull(prog.Open(), segment.Data); err != nil {
+			return nil, fmt.Errorf("reading segment at %08Xh: %w", segment.Address, err)
+		}
+		program.Segments = append(program.Segments, segment)
+	}
+
+	symbols, err := file.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, err
+	}
+	var imported []Symbol
+	for _, symbol := range symbols {
+		if symbol.Name == "_gp" {
+			program.GP = uint32(symbol.Value)
+		}
+
+		switch elf.ST_TYPE(symbol.Info) {
+		case elf.STT_FUNC, elf.STT_OBJECT, elf.STT_NOTYPE:
+		default:
+			continue
+		}
+		if symbol.Name == "" || symbol.Section == elf.SHN_UNDEF {
+			continue
+		}
+		imported = append(imported, Symbol{
+			Name:    symbol.Name,
+			Address: uint32(symbol.Value),
+			Size:    uint32(symbol.Size),
+		})
+	}
+	program.Symbols.Add(imported...)
+
+	// Programs without usable debug information still run.
+	if debug, err := file.DWARF(); err == nil {
+		program.LinesErr = program.Lines.add(debug)
+	}
+
+	return program, nil
+}
+
+func OpenELF(path string) (*ELF, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseELF(data)
+}
+
+func (program *ELF) Load(cpu *CPU, bus *Bus) {
+	for _, segment := range program.Segments {
+		bus.write(segment.Address, segment.Data)
+		if segment.Size > uint32(len(segment.Data)) {
+			bus.write(segment.Address+uint32(len(segment.Data)), make([]byte, segment.Size-uint32(len(segment.Data))))
+		}
+	}
+
+	if program.GP != 0 {
+		cpu.forceGPR(28, program.GP)
+	}
+	cpu.Jump(program.Entry)
+}
@@ -0,0 +1,34 @@
+package ps
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrBIOSSize is returned by NewBus for BIOS images that are not 512 KiB.
+var ErrBIOSSize = errors.New("BIOS image must be exactly 512 KiB")
+
+// BusError is a load or store to an address that no memory or device
+// responds to.
+type BusError struct {
+	Address uint32
+	Op      MemoryOperation
+}
+
+func (err *BusError) Error() string {
+	return fmt.Sprintf("%s at unmapped address %08Xh", err.Op, err.Address)
+}
+
+// UnimplementedError reports that the guest used a feature that the emulator
+// doesn't support yet.
+type UnimplementedError struct {
+	Feature string
+}
+
+func (err *UnimplementedError) Error() string {
+	return "unimplemented: " + err.Feature
+}
+
+func unimplemented(format string, args ...interface{}) error {
+	return &UnimplementedError{Feature: fmt.Sprintf(format, args...)}
+}
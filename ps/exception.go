@@ -0,0 +1,83 @@
+package ps
+
+// COP0 registers
+// http://problemkaputt.de/psx-spx.htm#cop0registersummary
+const (
+	COP0BadVaddr = 8
+	COP0SR       = 12
+	COP0Cause    = 13
+	COP0EPC      = 14
+)
+
+// Exception codes, stored in bits 2-6 of the Cause register.
+const (
+	ExceptionInterrupt           = 0x00
+	ExceptionAddressLoad         = 0x04
+	ExceptionAddressStore        = 0x05
+	ExceptionSyscall             = 0x08
+	ExceptionBreakpoint          = 0x09
+	ExceptionReservedInstruction = 0x0A
+	ExceptionOverflow            = 0x0C
+)
+
+const (
+	srInterruptEnable = 1 << 0
+	srBootVectors     = 1 << 22
+
+	causeInterruptPending = 1 << 10
+	causeBranchDelay      = 1 << 31
+
+	// ExceptionVector is the general exception handler with SR.BEV cleared.
+	ExceptionVector     = 0x80000080
+	bootExceptionVector = 0xBFC00180
+)
+
+// exception enters the exception handler for the instruction at cpu.current.
+func (cpu *CPU) exception(code uint32) {
+	if cpu.trace != nil {
+		cpu.trace.exception(code)
+	}
+	sr := cpu.COP0R[COP0SR]
+	// Push the interrupt enable/user mode bits, which disables interrupts.
+	cpu.COP0R[COP0SR] = sr&^0x3F | (sr<<2)&0x3F
+
+	cause := cpu.COP0R[COP0Cause]&^(0x7C|causeBranchDelay) | code<<2
+	cpu.COP0R[COP0EPC] = cpu.current
+	if cpu.delaySlot {
+		cpu.COP0R[COP0EPC] = cpu.current - 4
+		cause |= causeBranchDelay
+	}
+	cpu.COP0R[COP0Cause] = cause
+
+	if sr&srBootVectors != 0 {
+		cpu.Jump(bootExceptionVector)
+	} else {
+		cpu.Jump(ExceptionVector)
+	}
+	cpu.branch = false
+}
+
+// RFE pops the interrupt enable/user mode bits pushed by an exception.
+func (cpu *CPU) RFE(instruction Instruction) {
+	sr := cpu.COP0R[COP0SR]
+	cpu.COP0R[COP0SR] = sr&^0x0F | (sr>>2)&0x0F
+}
+
+// checkInterrupts reflects I_STAT & I_MASK in Cause and takes the interrupt
+// exception before the next instruction if it is enabled.
+func (cpu *CPU) checkInterrupts(bus *Bus) {
+	if bus.Interrupts().Pending() {
+		cpu.COP0R[COP0Cause] |= causeInterruptPending
+	} else {
+		cpu.COP0R[COP0Cause] &^= causeInterruptPending
+	}
+
+	sr := cpu.COP0R[COP0SR]
+	if sr&srInterruptEnable == 0 || cpu.COP0R[COP0Cause]&sr&0x700 == 0 {
+		return
+	}
+
+	cpu.current = cpu.Pc
+	cpu.delaySlot = cpu.branch
+	cpu.exception(ExceptionInterrupt)
+}
@@ -0,0 +1,100 @@
+package ps
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	exeMagic      = "PS-X EXE"
+	EXEHeaderSize = 0x800
+)
+
+// EXE is a PS-X EXE program.
+// http://problemkaputt.de/psx-spx.htm#cdromfileformats
+type EXE struct {
+	PC, GP      uint32
+	TextAddress uint32
+	Text        []byte
+
+	// BSSAddress and BSSSize describe memory that is cleared before start.
+	BSSAddress, BSSSize uint32
+
+	// StackBase and StackOffset set up $sp and $fp. A zero base keeps the
+	// stack pointer of the caller.
+	StackBase, StackOffset uint32
+}
+
+// ParseEXEHeader parses the 2 KiB header of a PS-X EXE. It returns the size
+// of the text segment that follows the header. Text segments larger than RAM
+// and BSS segments outside of it are errors.
+func ParseEXEHeader(header []byte) (*EXE, uint32, error) {
+	if len(header) < EXEHeaderSize || string(header[:len(exeMagic)]) != exeMagic {
+		return nil, 0, errors.New("not a PS-X EXE")
+	}
+
+	word := func(offset int) uint32 {
+		return binary.LittleEndian.Uint32(header[offset:])
+	}
+
+	exe := &EXE{
+		PC:          word(0x10),
+		GP:          word(0x14),
+		TextAddress: word(0x18),
+		BSSAddress:  word(0x28),
+		BSSSize:     word(0x2C),
+		StackBase:   word(0x30),
+		StackOffset: word(0x34),
+	}
+	size := word(0x1C)
+	if size > MainRAMSize {
+		return nil, 0, fmt.Errorf("PS-X EXE text segment of %d bytes is larger than RAM", size)
+	}
+	if exe.BSSSize != 0 {
+		start := exe.BSSAddress & 0x1FFFFFFF
+		if !inRange(start, MainRAM, MainRAMSize) || exe.BSSSize > MainRAM+MainRAMSize-start {
+			return nil, 0, fmt.Errorf("PS-X EXE BSS at %08Xh, %d bytes is outside of RAM", exe.BSSAddress, exe.BSSSize)
+		}
+	}
+	return exe, size, nil
+}
+
+// ParseEXE parses a PS-X EXE file.
+func ParseEXE(data []byte) (*EXE, error) {
+	exe, size, err := ParseEXEHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(data)-EXEHeaderSize) < size {
+		return nil, fmt.Errorf("PS-X EXE is truncated: text segment is %d bytes, file has %d", size, len(data)-EXEHeaderSize)
+	}
+
+	exe.Text = data[EXEHeaderSize : EXEHeaderSize+size]
+	return exe, nil
+}
+
+func OpenEXE(path string) (*EXE, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEXE(data)
+}
+
+// Load copies the program into memory, sets up the registers and jumps to its
+// entry point.
+func (exe *EXE) Load(cpu *CPU, bus *Bus) {
+	bus.write(exe.TextAddress, exe.Text)
+	if exe.BSSSize != 0 {
+		bus.write(exe.BSSAddress, make([]byte, exe.BSSSize))
+	}
+
+	cpu.forceGPR(28, exe.GP)
+	if exe.StackBase != 0 {
+		cpu.forceGPR(29, exe.StackBase+exe.StackOffset)
+		cpu.forceGPR(30, exe.StackBase+exe.StackOffset)
+	}
+	cpu.Jump(exe.PC)
+}
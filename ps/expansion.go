@@ -0,0 +1,66 @@
+package ps
+
+// Debug registers in the second expansion region. The BIOS shows boot
+// progress on the POST displays and test programs report their result to the
+// exit port.
+// http://problemkaputt.de/psx-spx.htm#exp2postregisters
+const (
+	DebugPorts     = 0x1F802040
+	DebugPortsSize = 0x50
+
+	POST     = 0x1F802041
+	POST2    = 0x1F802042
+	POST3    = 0x1F802070
+	ExitPort = 0x1F802082
+)
+
+type debugPorts struct {
+	post     [3]uint8
+	exited   bool
+	exitCode int
+
+	logf func(format string, v ...interface{})
+}
+
+func (ports *debugPorts) Load(offset uint32) uint32 {
+	return 0
+}
+
+func (ports *debugPorts) Store(offset uint32, value uint32) {
+	switch DebugPorts + offset {
+	case POST:
+		ports.setPOST(0, value)
+	case POST2:
+		ports.setPOST(1, value)
+	case POST3:
+		ports.setPOST(2, value)
+	case ExitPort:
+		ports.exited = true
+		ports.exitCode = int(int32(value))
+		ports.logf("exit port: exit code %d", ports.exitCode)
+	}
+}
+
+func (ports *debugPorts) setPOST(display int, value uint32) {
+	ports.post[display] = uint8(value)
+	ports.logf("POST%d: %02Xh", display+1, uint8(value))
+}
+
+// ExitCode returns the code written to the exit port, if any.
+func (bus *Bus) ExitCode() (code int, exited bool) {
+	return bus.debug.exitCode, bus.debug.exited
+}
+
+// Run executes up to steps instructions, or until the guest writes to the
+// exit port. A steps value of 0 runs without limit. If emulation cannot
+// continue, it stops with a *CrashReport.
+func (cpu *CPU) Run(bus *Bus, steps int) (code int, exited bool, err error) {
+	defer cpu.recoverCrash(bus, &err)
+	for i := 0; steps == 0 || i < steps; i++ {
+		cpu.Cycle(bus)
+		if code, exited = bus.ExitCode(); exited {
+			return code, true, nil
+		}
+	}
+	return 0, false, nil
+}
@@ -0,0 +1,354 @@
+package ps
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrKilled is returned by ServeGDB when the debugger kills the program.
+var ErrKilled = errors.New("gdb: program killed")
+
+// gdbPacketSize is the largest packet the stub accepts, as announced in
+// qSupported. Replies are kept within it too.
+const gdbPacketSize = 0x4000
+
+// gdbRegisters maps GDB's MIPS register numbers to debugger register names.
+// 38 to 71 are the FPU registers, which the PlayStation doesn't have.
+var gdbRegisters = func() []string {
+	names := append(RegisterNames[:], "sr", "lo", "hi", "badvaddr", "cause", "pc")
+	for i := 0; i < 32; i++ {
+		names = append(names, "")
+	}
+	return append(names, "", "")
+}()
+
+// gdbTargetXML describes the registers in the order of gdbRegisters.
+// https://sourceware.org/gdb/current/onlinedocs/gdb.html/MIPS-Features.html
+var gdbTargetXML = func() string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+<architecture>mips:3000</architecture>
+<feature name="org.gnu.gdb.mips.cpu">
+`)
+	for i := 0; i < 32; i++ {
+		fmt.Fprintf(&b, "<reg name=\"r%d\" bitsize=\"32\" regnum=\"%d\"/>\n", i, i)
+	}
+	b.WriteString(`<reg name="lo" bitsize="32" regnum="33"/>
+<reg name="hi" bitsize="32" regnum="34"/>
+<reg name="pc" bitsize="32" regnum="37"/>
+</feature>
+<feature name="org.gnu.gdb.mips.cp0">
+<reg name="status" bitsize="32" regnum="32"/>
+<reg name="badvaddr" bitsize="32" regnum="35"/>
+<reg name="cause" bitsize="32" regnum="36"/>
+</feature>
+<feature name="org.gnu.gdb.mips.fpu">
+`)
+	for i := 0; i < 32; i++ {
+		fmt.Fprintf(&b, "<reg name=\"f%d\" bitsize=\"32\" type=\"ieee_single\" regnum=\"%d\"/>\n", i, 38+i)
+	}
+	b.WriteString(`<reg name="fcsr" bitsize="32" group="float" regnum="70"/>
+<reg name="fir" bitsize="32" group="float" regnum="71"/>
+</feature>
+</target>
+`)
+	return b.String()
+}()
+
+// gdbConn is a GDB remote serial protocol connection.
+// https://sourceware.org/gdb/current/onlinedocs/gdb.html/Remote-Protocol.html
+type gdbConn struct {
+	d  *Debugger
+	rw io.ReadWriter
+
+	// writes serializes the acknowledgements sent by the reader with the
+	// replies.
+	writes sync.Mutex
+	noAck  int32
+
+	packets chan string
+}
+
+// ServeGDB lets GDB control the debugger over rw until it detaches or
+// disconnects. Execution is stopped while GDB is attached.
+func ServeGDB(d *Debugger, rw io.ReadWriter) error {
+	c := &gdbConn{d: d, rw: rw, packets: make(chan string)}
+	go c.read()
+
+	for packet := range c.packets {
+		reply, err := c.handle(packet)
+		if err != nil {
+			return err
+		}
+		if err := c.send(reply); err != nil {
+			return err
+		}
+		switch packet {
+		case "D":
+			return nil
+		case "QStartNoAckMode":
+			atomic.StoreInt32(&c.noAck, 1)
+		}
+	}
+	return nil
+}
+
+// read receives packets and passes them to the main loop. A Ctrl-C byte
+// interrupts the running program.
+func (c *gdbConn) read() {
+	defer close(c.packets)
+	r := bufio.NewReader(c.rw)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch b {
+		case 0x03:
+			c.d.Interrupt()
+			continue
+		case '$':
+		default:
+			// Acknowledgements
+			continue
+		}
+
+		data, err := r.ReadString('#')
+		if err != nil {
+			return
+		}
+		data = data[:len(data)-1]
+		var sum [2]byte
+		if _, err := io.ReadFull(r, sum[:]); err != nil {
+			return
+		}
+
+		valid := fmt.Sprintf("%02x", gdbChecksum(data)) == strings.ToLower(string(sum[:]))
+		if atomic.LoadInt32(&c.noAck) == 0 {
+			ack := "+"
+			if !valid {
+				ack = "-"
+			}
+			if c.write(ack) != nil {
+				return
+			}
+		}
+		if valid {
+			c.packets <- data
+		}
+	}
+}
+
+func gdbChecksum(data string) uint8 {
+	var sum uint8
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+func (c *gdbConn) write(s string) error {
+	c.writes.Lock()
+	defer c.writes.Unlock()
+	_, err := io.WriteString(c.rw, s)
+	return err
+}
+
+func (c *gdbConn) send(data string) error {
+	return c.write(fmt.Sprintf("$%s#%02x", data, gdbChecksum(data)))
+}
+
+func (c *gdbConn) handle(packet string) (string, error) {
+	d := c.d
+	switch {
+	case packet == "?":
+		return "S05", nil
+	case packet == "g":
+		var b strings.Builder
+		for i := range gdbRegisters {
+			b.WriteString(c.register(i))
+		}
+		return b.String(), nil
+	case strings.HasPrefix(packet, "G"):
+		data := packet[1:]
+		for i := range gdbRegisters {
+			if len(data) < 8 {
+				break
+			}
+			c.setRegister(i, data[:8])
+			data = data[8:]
+		}
+		return "OK", nil
+	case strings.HasPrefix(packet, "p"):
+		n, err := strconv.ParseUint(packet[1:], 16, 8)
+		if err != nil || int(n) >= len(gdbRegisters) {
+			return "E01", nil
+		}
+		return c.register(int(n)), nil
+	case strings.HasPrefix(packet, "P"):
+		equals := strings.IndexByte(packet, '=')
+		if equals < 0 {
+			return "E01", nil
+		}
+		n, err := strconv.ParseUint(packet[1:equals], 16, 8)
+		value := packet[equals+1:]
+		if err != nil || int(n) >= len(gdbRegisters) || len(value) != 8 {
+			return "E01", nil
+		}
+		c.setRegister(int(n), value)
+		return "OK", nil
+	case strings.HasPrefix(packet, "m"):
+		var address, length uint32
+		if _, err := fmt.Sscanf(packet, "m%x,%x", &address, &length); err != nil {
+			return "E01", nil
+		}
+		// GDB reads the rest with further requests.
+		if length > gdbPacketSize/2 {
+			length = gdbPacketSize / 2
+		}
+		data := make([]byte, length)
+		if err := d.ReadMemory(address, data); err != nil {
+			return "E14", nil
+		}
+		return hex.EncodeToString(data), nil
+	case strings.HasPrefix(packet, "M"):
+		var address, length uint32
+		colon := strings.IndexByte(packet, ':')
+		if colon < 0 {
+			return "E01", nil
+		}
+		if _, err := fmt.Sscanf(packet[:colon], "M%x,%x", &address, &length); err != nil {
+			return "E01", nil
+		}
+		data, err := hex.DecodeString(packet[colon+1:])
+		if err != nil || uint32(len(data)) != length {
+			return "E01", nil
+		}
+		if err := d.WriteMemory(address, data); err != nil {
+			return "E14", nil
+		}
+		return "OK", nil
+	case strings.HasPrefix(packet, "Z"), strings.HasPrefix(packet, "z"):
+		var kind int
+		var address uint32
+		if _, err := fmt.Sscanf(packet[1:], "%d,%x", &kind, &address); err != nil {
+			return "E01", nil
+		}
+		size := uint32(4)
+		if i := strings.LastIndexByte(packet, ','); i > 0 {
+			if n, err := strconv.ParseUint(packet[i+1:], 16, 32); err == nil {
+				size = uint32(n)
+			}
+		}
+		insert := packet[0] == 'Z'
+		switch kind {
+		case 0, 1:
+			if insert {
+				d.AddBreakpoint(address)
+			} else {
+				d.RemoveBreakpoint(address)
+			}
+		case 2, 3, 4:
+			kinds := map[int]WatchKind{2: WatchWrite, 3: WatchRead, 4: WatchAccess}
+			w := Watchpoint{Address: address, Size: size, Kind: kinds[kind]}
+			if insert {
+				d.AddWatchpoint(w)
+			} else {
+				d.RemoveWatchpointOf(w)
+			}
+		default:
+			return "", nil
+		}
+		return "OK", nil
+	case strings.HasPrefix(packet, "s"), strings.HasPrefix(packet, "c"):
+		if len(packet) > 1 {
+			address, err := strconv.ParseUint(packet[1:], 16, 32)
+			if err != nil {
+				return "E01", nil
+			}
+			d.CPU.Jump(uint32(address))
+		}
+		if packet[0] == 's' {
+			return gdbStopReply(d.Step()), nil
+		}
+		return gdbStopReply(d.Continue()), nil
+	case packet == "k":
+		return "", ErrKilled
+	case packet == "D", packet == "QStartNoAckMode":
+		return "OK", nil
+	case packet == "qAttached":
+		return "1", nil
+	case packet == "qfThreadInfo":
+		return "m1", nil
+	case packet == "qsThreadInfo":
+		return "l", nil
+	case packet == "qC":
+		return "QC1", nil
+	case strings.HasPrefix(packet, "H"):
+		return "OK", nil
+	case strings.HasPrefix(packet, "qSupported"):
+		return fmt.Sprintf("PacketSize=%X;qXfer:features:read+;QStartNoAckMode+", gdbPacketSize), nil
+	case strings.HasPrefix(packet, "qXfer:features:read:target.xml:"):
+		var offset, length int
+		if _, err := fmt.Sscanf(packet, "qXfer:features:read:target.xml:%x,%x", &offset, &length); err != nil {
+			return "E01", nil
+		}
+		if offset >= len(gdbTargetXML) {
+			return "l", nil
+		}
+		rest := gdbTargetXML[offset:]
+		if len(rest) > length {
+			return "m" + rest[:length], nil
+		}
+		return "l" + rest, nil
+	}
+	return "", nil
+}
+
+// register encodes a register in target byte order. Registers that don't
+// exist are reported as unavailable.
+func (c *gdbConn) register(n int) string {
+	value, ok := c.d.Register(gdbRegisters[n])
+	if !ok {
+		return "xxxxxxxx"
+	}
+	return fmt.Sprintf("%02x%02x%02x%02x", uint8(value), uint8(value>>8), uint8(value>>16), uint8(value>>24))
+}
+
+func (c *gdbConn) setRegister(n int, digits string) {
+	value, err := strconv.ParseUint(digits, 16, 32)
+	if gdbRegisters[n] == "" || err != nil {
+		return
+	}
+	// Swap from target byte order.
+	v := uint32(value)
+	v = v>>24 | v>>8&0xFF00 | v<<8&0xFF0000 | v<<24
+	c.d.SetRegister(gdbRegisters[n], v)
+}
+
+// gdbStopReply reports why the program stopped with the signal numbers GDB
+// expects: SIGTRAP for breakpoints and steps, SIGINT for Ctrl-C and SIGSEGV
+// for crashes.
+func gdbStopReply(stop Stop) string {
+	switch stop.Reason {
+	case StopInterrupt:
+		return "S02"
+	case StopCrash:
+		return "S0B"
+	case StopExit:
+		return fmt.Sprintf("W%02x", uint8(stop.Code))
+	case StopWatchpoint:
+		kind := map[WatchKind]string{WatchWrite: "watch", WatchRead: "rwatch", WatchAccess: "awatch"}[stop.Watchpoint.Kind]
+		return fmt.Sprintf("T05%s:%08x;", kind, stop.Address)
+	}
+	return "S05"
+}
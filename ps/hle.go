@@ -0,0 +1,473 @@
+package ps
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Addresses used by the HLE kernel. The first 64 KiB of RAM belong to the
+// kernel and are never used by games, so the kernel keeps its stack and the
+// few instructions it needs there.
+const (
+	// kernelReturn is where guest functions called by the kernel return to.
+	kernelReturn = 0x00001000
+	// kernelWaitLoop jumps back to the B0 dispatcher, so that a blocking
+	// call like WaitEvent is retried until it can complete.
+	kernelWaitLoop = 0x00001010
+	// kernelIdleLoop is where execution ends up once a program exits.
+	kernelIdleLoop = 0x00001020
+	kernelStack    = 0x8000EFF0
+
+	defaultStack = 0x801FFF00
+	kernelConfig = "cdrom:\\SYSTEM.CNF;1"
+	defaultBoot  = "cdrom:\\PSX.EXE;1"
+)
+
+// kernelFunction implements a function of one of the A0, B0 and C0 tables. Its
+// result is returned in $v0, unless the function redirected execution with
+// Kernel.jump.
+type kernelFunction func(k *Kernel, cpu *CPU, bus *Bus) uint32
+
+// guestCall is a call from the kernel into guest code. then may return a
+// follow-up call that depends on the result.
+type guestCall struct {
+	address uint32
+	args    []uint32
+	then    func(result uint32) *guestCall
+}
+
+// registers is a snapshot of the CPU registers.
+type registers struct {
+	gpr    [32]uint32
+	lo, hi uint32
+}
+
+func saveRegisters(cpu *CPU) registers {
+	var regs registers
+	copy(regs.gpr[:], cpu.GPR)
+	regs.lo, regs.hi = cpu.LO, cpu.HI
+	return regs
+}
+
+func (regs *registers) restore(cpu *CPU) {
+	copy(cpu.GPR, regs.gpr[:])
+	copy(cpu.GPRNext, regs.gpr[:])
+	cpu.LO, cpu.HI = regs.lo, regs.hi
+}
+
+// Kernel is a high-level emulation of the BIOS kernel, so that programs can
+// run without a BIOS image. The A0h, B0h and C0h function tables, the
+// syscall and interrupt handling and booting from disc are implemented in Go
+// and reached through CPU hooks.
+// http://problemkaputt.de/psx-spx.htm#biosfunctionsummary
+type Kernel struct {
+	// Disc is the CD image that programs are booted and read from.
+	Disc *Disc
+	// TTY receives the output of printf, putchar and writes to stdout.
+	TTY io.Writer
+
+	functions [3]map[uint32]kernelFunction
+
+	heap       heap
+	kernelHeap heap
+	seed       uint32
+	lastError  uint32
+
+	events  [eventCount]event
+	threads [threadCount]thread
+	thread  int
+	files   [fileCount]*openFile
+
+	// handlers are the heads of the SysEnqIntRP priority chains.
+	handlers [4]uint32
+	// autoAck holds whether the kernel acknowledges the interrupts of root
+	// counters 0-2 and VBlank (counter 3).
+	autoAck    [4]bool
+	customExit uint32
+
+	pads        [2]padBuffer
+	padsStarted bool
+
+	// inException is set while the kernel handles an interrupt, context
+	// and epc hold the state of the interrupted code.
+	inException bool
+	context     registers
+	epc         uint32
+
+	// calls holds the continuations of pending guest calls.
+	calls []func(cpu *CPU, bus *Bus, result uint32)
+
+	jumped bool
+}
+
+func NewKernel() *Kernel {
+	k := &Kernel{
+		TTY: os.Stdout,
+		functions: [3]map[uint32]kernelFunction{
+			kernelFunctionsA,
+			kernelFunctionsB,
+			kernelFunctionsC,
+		},
+	}
+	k.reset()
+	return k
+}
+
+func (k *Kernel) reset() {
+	k.heap = heap{}
+	k.kernelHeap = heap{}
+	k.seed = 0x24040001
+	k.events = [eventCount]event{}
+	k.threads = [threadCount]thread{{used: true}}
+	k.thread = 0
+	k.files = [fileCount]*openFile{{tty: true}, {tty: true}}
+	k.handlers = [4]uint32{}
+	k.autoAck = [4]bool{true, true, true, true}
+	k.customExit = 0
+	k.pads = [2]padBuffer{}
+	k.padsStarted = false
+	k.inException = false
+	k.calls = nil
+}
+
+// Install hooks the kernel into the CPU: the reset vector, the exception
+// vector and the function table entry points.
+func (k *Kernel) Install(cpu *CPU) {
+	cpu.AddHook(0xBFC00000, k.boot)
+	cpu.AddHook(ExceptionVector, k.exception)
+	cpu.AddHook(kernelReturn, k.callReturn)
+
+	for table, base := range []uint32{0xA0, 0xB0, 0xC0} {
+		table := table
+		hook := func(cpu *CPU, bus *Bus) {
+			k.dispatch(cpu, bus, table)
+		}
+		// Games call the tables through any of the RAM mirrors.
+		for _, segment := range []uint32{0x00000000, 0x80000000, 0xA0000000} {
+			cpu.AddHook(segment|base, hook)
+		}
+	}
+}
+
+// boot initializes the kernel and starts the program on the disc. Without a
+// disc, it continues at the shell address where a side-loaded program can be
+// started with FastBoot.
+func (k *Kernel) boot(cpu *CPU, bus *Bus) {
+	k.reset()
+	cpu.COP0R[COP0SR] = 0
+	cpu.forceGPR(29, defaultStack)
+
+	// j B0h; nop
+	bus.write(kernelWaitLoop, []byte{0x2C, 0x00, 0x00, 0x08, 0, 0, 0, 0})
+	// j kernelIdleLoop; nop
+	idle := []byte{0x08, 0x04, 0x00, 0x08, 0, 0, 0, 0}
+	bus.write(kernelIdleLoop, idle)
+	bus.write(ShellAddress, idle)
+
+	if k.Disc == nil {
+		k.jump(cpu, ShellAddress)
+		return
+	}
+
+	path, stack := k.readConfig()
+	exe, err := k.loadEXE(path)
+	if err != nil {
+		bus.logf("hle: booting %s: %v", path, err)
+		k.jump(cpu, kernelIdleLoop)
+		return
+	}
+	if exe.StackBase == 0 {
+		exe.StackBase = stack
+	}
+	exe.Load(cpu, bus)
+}
+
+// readConfig returns the boot file and stack from SYSTEM.CNF.
+// http://problemkaputt.de/psx-spx.htm#cdromfilevideocontents
+func (k *Kernel) readConfig() (boot string, stack uint32) {
+	boot, stack = defaultBoot, defaultStack
+
+	data, err := k.Disc.ReadFile(kernelConfig)
+	if err != nil {
+		return boot, stack
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		switch key {
+		case "BOOT":
+			boot = value
+		case "STACK":
+			fmt.Sscanf(value, "%x", &stack)
+		}
+	}
+	return boot, stack
+}
+
+func (k *Kernel) loadEXE(path string) (*EXE, error) {
+	if k.Disc == nil {
+		return nil, fmt.Errorf("%s: no disc", path)
+	}
+	data, err := k.Disc.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEXE(data)
+}
+
+// jump redirects execution instead of returning to the caller.
+func (k *Kernel) jump(cpu *CPU, address uint32) {
+	k.jumped = true
+	cpu.Jump(address)
+}
+
+// dispatch calls the function in $t1 from one of the tables and returns to
+// $ra.
+func (k *Kernel) dispatch(cpu *CPU, bus *Bus, table int) {
+	number := cpu.GPR[9]
+	function, ok := k.functions[table][number]
+	if !ok {
+		bus.logf("hle: unimplemented function %02X:%02Xh", 0xA0+table*0x10, number)
+		k.returnToCaller(cpu, 0)
+		return
+	}
+
+	k.jumped = false
+	result := function(k, cpu, bus)
+	if !k.jumped {
+		k.returnToCaller(cpu, result)
+	}
+}
+
+func (k *Kernel) returnToCaller(cpu *CPU, result uint32) {
+	cpu.forceGPR(2, result)
+	k.jump(cpu, cpu.GPR[31])
+}
+
+// arg returns the nth argument of a kernel function. Arguments past the
+// fourth are passed on the stack.
+func arg(cpu *CPU, bus *Bus, n int) uint32 {
+	if n < 4 {
+		return cpu.GPR[4+n]
+	}
+	return bus.LoadWord(cpu.GPR[29] + uint32(n)*4)
+}
+
+// call runs a guest function and then continues with next. The registers of
+// the caller are restored before next runs.
+func (k *Kernel) call(cpu *CPU, address uint32, args []uint32, next func(cpu *CPU, bus *Bus, result uint32)) {
+	saved := saveRegisters(cpu)
+	k.calls = append(k.calls, func(cpu *CPU, bus *Bus, result uint32) {
+		saved.restore(cpu)
+		next(cpu, bus, result)
+	})
+
+	stack := (cpu.GPR[29] - 0x100) &^ 7
+	if k.inException && len(k.calls) == 1 {
+		stack = kernelStack
+	}
+
+	for i, value := range args {
+		cpu.forceGPR(uint32(4+i), value)
+	}
+	cpu.forceGPR(29, stack)
+	cpu.forceGPR(31, kernelReturn)
+	k.jump(cpu, address)
+}
+
+func (k *Kernel) callReturn(cpu *CPU, bus *Bus) {
+	if len(k.calls) == 0 {
+		bus.logf("hle: unexpected return to the kernel")
+		k.jump(cpu, kernelIdleLoop)
+		return
+	}
+
+	next := k.calls[len(k.calls)-1]
+	k.calls = k.calls[:len(k.calls)-1]
+	next(cpu, bus, cpu.GPR[2])
+}
+
+// callAll makes the guest calls one after another and then continues with
+// done.
+func (k *Kernel) callAll(cpu *CPU, bus *Bus, calls []guestCall, done func(cpu *CPU, bus *Bus)) {
+	if len(calls) == 0 {
+		done(cpu, bus)
+		return
+	}
+
+	first := calls[0]
+	k.call(cpu, first.address, first.args, func(cpu *CPU, bus *Bus, result uint32) {
+		rest := calls[1:]
+		if first.then != nil {
+			if next := first.then(result); next != nil {
+				rest = append([]guestCall{*next}, rest...)
+			}
+		}
+		k.callAll(cpu, bus, rest, done)
+	})
+}
+
+// returnAfter makes the guest calls and then returns result to the caller of
+// the current kernel function.
+func (k *Kernel) returnAfter(cpu *CPU, bus *Bus, calls []guestCall, result uint32) {
+	if len(calls) == 0 {
+		return
+	}
+	k.callAll(cpu, bus, calls, func(cpu *CPU, bus *Bus) {
+		k.returnToCaller(cpu, result)
+	})
+}
+
+// exception handles syscalls and interrupts.
+func (k *Kernel) exception(cpu *CPU, bus *Bus) {
+	code := (cpu.COP0R[COP0Cause] >> 2) & 0x1F
+	epc := cpu.COP0R[COP0EPC]
+
+	switch code {
+	case ExceptionSyscall:
+		k.syscall(cpu, bus)
+		k.returnFromException(cpu, k.resumeAddress(cpu, bus, epc))
+	case ExceptionInterrupt:
+		k.interrupt(cpu, bus)
+	default:
+		bus.logf("hle: unhandled exception %02Xh at %08Xh", code, epc)
+		k.returnFromException(cpu, k.resumeAddress(cpu, bus, epc))
+	}
+}
+
+// resumeAddress returns the address after the instruction that raised the
+// exception. If it was in a branch delay slot, EPC points to the branch,
+// which is evaluated again to find where execution continues.
+func (k *Kernel) resumeAddress(cpu *CPU, bus *Bus, epc uint32) uint32 {
+	if cpu.COP0R[COP0Cause]&causeBranchDelay == 0 {
+		return epc + 4
+	}
+	cpu.Pc = epc + 4
+	cpu.PcNext = epc + 8
+	cpu.Execute(NewInstruction(bus.LoadWord(epc)), bus)
+	copy(cpu.GPR, cpu.GPRNext)
+	return cpu.PcNext
+}
+
+// syscall implements the functions selected by $a0. They modify the status
+// register that is restored when returning from the exception.
+// http://problemkaputt.de/psx-spx.htm#biosmiscfunctions
+func (k *Kernel) syscall(cpu *CPU, bus *Bus) {
+	const interruptsEnabled = 0x404
+
+	sr := cpu.COP0R[COP0SR]
+	switch cpu.GPR[4] {
+	case 0x00:
+	case 0x01: // EnterCriticalSection
+		var result uint32
+		if sr&interruptsEnabled == interruptsEnabled {
+			result = 1
+		}
+		cpu.COP0R[COP0SR] = sr &^ interruptsEnabled
+		cpu.forceGPR(2, result)
+	case 0x02: // ExitCriticalSection
+		cpu.COP0R[COP0SR] = sr | interruptsEnabled
+	default:
+		bus.logf("hle: unimplemented syscall %02Xh", cpu.GPR[4])
+	}
+}
+
+func (k *Kernel) returnFromException(cpu *CPU, pc uint32) {
+	cpu.RFE(Instruction{})
+	k.jump(cpu, pc)
+}
+
+// interrupt delivers the events of pending interrupts, calls the handlers
+// queued with SysEnqIntRP and returns to the interrupted code, or to the exit
+// set with SetCustomExitFromException.
+func (k *Kernel) interrupt(cpu *CPU, bus *Bus) {
+	k.context = saveRegisters(cpu)
+	k.epc = cpu.COP0R[COP0EPC]
+	k.inException = true
+
+	interrupts := bus.Interrupts()
+	pending := interrupts.Stat & interrupts.Mask
+
+	var calls []guestCall
+	if pending&(1<<IRQVBlank) != 0 {
+		k.pollPads(bus)
+		if k.autoAck[3] {
+			interrupts.Stat &^= 1 << IRQVBlank
+		}
+		calls = append(calls, k.deliverEvent(classRootCounter+3, specInterrupt)...)
+	}
+	for counter := 0; counter < 3; counter++ {
+		irq := IRQTimer0 + IRQ(counter)
+		if pending&(1<<irq) == 0 {
+			continue
+		}
+		if k.autoAck[counter] {
+			interrupts.Stat &^= 1 << irq
+		}
+		calls = append(calls, k.deliverEvent(classRootCounter+uint32(counter), specInterrupt)...)
+	}
+
+	for priority := range k.handlers {
+		for _, entry := range k.handlerChain(bus, priority) {
+			second := bus.LoadWord(entry + 4)
+			first := bus.LoadWord(entry + 8)
+			if first == 0 {
+				continue
+			}
+			calls = append(calls, guestCall{
+				address: first,
+				then: func(result uint32) *guestCall {
+					if result == 0 || second == 0 {
+						return nil
+					}
+					return &guestCall{address: second, args: []uint32{result}}
+				},
+			})
+		}
+	}
+
+	k.callAll(cpu, bus, calls, k.exitInterrupt)
+}
+
+func (k *Kernel) exitInterrupt(cpu *CPU, bus *Bus) {
+	k.context.restore(cpu)
+	if k.customExit == 0 {
+		k.inException = false
+		k.returnFromException(cpu, k.epc)
+		return
+	}
+
+	// The custom exit is a setjmp buffer. Its code is expected to finish
+	// with ReturnFromException.
+	k.longjmp(cpu, bus, k.customExit, 1)
+}
+
+// readString reads a NUL-terminated string from guest memory.
+func readString(bus *Bus, address uint32) string {
+	var s strings.Builder
+	for i := uint32(0); i < 0x10000; i++ {
+		c := bus.LoadByte(address + i)
+		if c == 0 {
+			break
+		}
+		s.WriteByte(c)
+	}
+	return s.String()
+}
+
+func writeString(bus *Bus, address uint32, s string) {
+	bus.write(address, append([]byte(s), 0))
+}
+
+func (k *Kernel) print(s string) {
+	if k.TTY != nil {
+		io.WriteString(k.TTY, s)
+	}
+}
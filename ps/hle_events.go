@@ -0,0 +1,373 @@
+package ps
+
+const (
+	eventCount  = 16
+	threadCount = 4
+)
+
+// Event classes and specs
+// http://problemkaputt.de/psx-spx.htm#eventsummary
+const (
+	classRootCounter  = 0xF2000000
+	classHardwareCard = 0xF0000011
+	classSoftwareCard = 0xF4000001
+
+	specInterrupt = 0x0002
+	specIOEnd     = 0x0004
+	specTimeout   = 0x0100
+	specError     = 0x8000
+)
+
+// Event handles are 0xF1000000 plus the index, threads 0xFF000000 plus the
+// index.
+const (
+	eventHandle  = 0xF1000000
+	threadHandle = 0xFF000000
+)
+
+// Event status and modes.
+const (
+	eventFree     = 0
+	eventDisabled = 0x1000
+	eventEnabled  = 0x2000
+	eventReady    = 0x4000
+
+	eventModeCallback = 0x1000
+	eventModeMark     = 0x2000
+)
+
+type event struct {
+	class, spec uint32
+	mode        uint32
+	status      uint32
+	handler     uint32
+}
+
+type thread struct {
+	used bool
+	regs registers
+	pc   uint32
+}
+
+type padBuffer struct {
+	address, size uint32
+}
+
+func (k *Kernel) eventIndex(handle uint32) (int, bool) {
+	index := int(handle & 0xFFFF)
+	if handle&0xFFFF0000 != eventHandle || index >= eventCount || k.events[index].status == eventFree {
+		return 0, false
+	}
+	return index, true
+}
+
+// deliverEvent marks matching enabled events as ready and returns the calls
+// of those with a callback.
+func (k *Kernel) deliverEvent(class, spec uint32) []guestCall {
+	var calls []guestCall
+	for i := range k.events {
+		e := &k.events[i]
+		if e.status != eventEnabled || e.class != class || e.spec != spec {
+			continue
+		}
+		switch e.mode {
+		case eventModeCallback:
+			if e.handler != 0 {
+				calls = append(calls, guestCall{address: e.handler})
+			}
+		case eventModeMark:
+			e.status = eventReady
+		}
+	}
+	return calls
+}
+
+func kernelOpenEvent(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	for i := range k.events {
+		if k.events[i].status == eventFree {
+			k.events[i] = event{
+				class:   cpu.GPR[4],
+				spec:    cpu.GPR[5],
+				mode:    cpu.GPR[6],
+				handler: cpu.GPR[7],
+				status:  eventDisabled,
+			}
+			return eventHandle | uint32(i)
+		}
+	}
+	return 0xFFFFFFFF
+}
+
+func kernelCloseEvent(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	if i, ok := k.eventIndex(cpu.GPR[4]); ok {
+		k.events[i] = event{}
+	}
+	return 1
+}
+
+func kernelEnableEvent(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	if i, ok := k.eventIndex(cpu.GPR[4]); ok && k.events[i].status == eventDisabled {
+		k.events[i].status = eventEnabled
+	}
+	return 1
+}
+
+func kernelDisableEvent(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	if i, ok := k.eventIndex(cpu.GPR[4]); ok {
+		k.events[i].status = eventDisabled
+	}
+	return 1
+}
+
+func kernelTestEvent(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	if i, ok := k.eventIndex(cpu.GPR[4]); ok && k.events[i].status == eventReady {
+		k.events[i].status = eventEnabled
+		return 1
+	}
+	return 0
+}
+
+// kernelWaitEvent blocks until the event is ready by retrying the call from
+// the wait loop, so that interrupts are serviced while waiting.
+func kernelWaitEvent(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	i, ok := k.eventIndex(cpu.GPR[4])
+	if !ok {
+		return 0
+	}
+
+	switch k.events[i].status {
+	case eventReady:
+		k.events[i].status = eventEnabled
+		return 1
+	case eventEnabled:
+		k.jump(cpu, kernelWaitLoop)
+	}
+	return 0
+}
+
+func kernelDeliverEvent(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.returnAfter(cpu, bus, k.deliverEvent(cpu.GPR[4], cpu.GPR[5]), 0)
+	return 0
+}
+
+func kernelUnDeliverEvent(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	for i := range k.events {
+		e := &k.events[i]
+		if e.status == eventReady && e.mode == eventModeMark && e.class == cpu.GPR[4] && e.spec == cpu.GPR[5] {
+			e.status = eventEnabled
+		}
+	}
+	return 0
+}
+
+func kernelOpenThread(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	for i := range k.threads {
+		if k.threads[i].used {
+			continue
+		}
+		t := thread{used: true, pc: cpu.GPR[4]}
+		t.regs.gpr[29] = cpu.GPR[5]
+		t.regs.gpr[30] = cpu.GPR[5]
+		t.regs.gpr[28] = cpu.GPR[6]
+		k.threads[i] = t
+		return threadHandle | uint32(i)
+	}
+	return 0xFFFFFFFF
+}
+
+func kernelCloseThread(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	i := int(cpu.GPR[4] & 0xFFFF)
+	if i > 0 && i < threadCount {
+		k.threads[i] = thread{}
+	}
+	return 1
+}
+
+// kernelChangeThread saves the registers of the current thread, which
+// resumes by returning 1 from ChangeThread, and switches to another one.
+func kernelChangeThread(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	i := int(cpu.GPR[4] & 0xFFFF)
+	if cpu.GPR[4]&0xFFFF0000 != threadHandle || i >= threadCount || !k.threads[i].used {
+		return 0
+	}
+
+	current := &k.threads[k.thread]
+	current.regs = saveRegisters(cpu)
+	current.regs.gpr[2] = 1
+	current.pc = cpu.GPR[31]
+
+	k.thread = i
+	k.threads[i].regs.restore(cpu)
+	k.jump(cpu, k.threads[i].pc)
+	return 0
+}
+
+func kernelReturnFromException(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.context.restore(cpu)
+	k.inException = false
+	k.returnFromException(cpu, k.epc)
+	return 0
+}
+
+func kernelSetDefaultExitFromException(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.customExit = 0
+	return 0
+}
+
+func kernelSetCustomExitFromException(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.customExit = cpu.GPR[4]
+	return 0
+}
+
+// kernelSysEnqIntRP adds an interrupt handler entry to the front of a
+// priority chain. Entries hold the next entry, a second and a first function.
+func kernelSysEnqIntRP(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	priority, entry := cpu.GPR[4]&3, cpu.GPR[5]
+	bus.StoreWord(entry, k.handlers[priority])
+	k.handlers[priority] = entry
+	return 0
+}
+
+func kernelSysDeqIntRP(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	priority, entry := cpu.GPR[4]&3, cpu.GPR[5]
+	chain := k.handlerChain(bus, int(priority))
+	for i, e := range chain {
+		if e != entry {
+			continue
+		}
+		next := uint32(0)
+		if i+1 < len(chain) {
+			next = chain[i+1]
+		}
+		if i == 0 {
+			k.handlers[priority] = next
+		} else {
+			bus.StoreWord(chain[i-1], next)
+		}
+		break
+	}
+	return 0
+}
+
+// handlerChain returns the entries of a priority chain. The walk stops at an
+// entry seen before, as an entry queued twice links to itself.
+func (k *Kernel) handlerChain(bus *Bus, priority int) []uint32 {
+	var chain []uint32
+	seen := make(map[uint32]bool)
+	for entry := k.handlers[priority]; entry != 0 && !seen[entry]; entry = bus.LoadWord(entry) {
+		seen[entry] = true
+		chain = append(chain, entry)
+	}
+	return chain
+}
+
+// kernelChangeClearRCnt sets whether the kernel acknowledges the interrupt of
+// a root counter and returns the previous setting.
+func kernelChangeClearRCnt(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	counter := cpu.GPR[4] & 3
+	previous := k.autoAck[counter]
+	k.autoAck[counter] = cpu.GPR[5] != 0
+	if previous {
+		return 1
+	}
+	return 0
+}
+
+func kernelChangeClearPad(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.autoAck[3] = cpu.GPR[4] != 0
+	return 0
+}
+
+func kernelInitPad(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.pads[0] = padBuffer{cpu.GPR[4], cpu.GPR[5]}
+	k.pads[1] = padBuffer{cpu.GPR[6], cpu.GPR[7]}
+	return 1
+}
+
+func kernelStartPad(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.padsStarted = true
+	bus.Interrupts().Mask |= 1 << IRQVBlank
+	return 1
+}
+
+func kernelStopPad(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.padsStarted = false
+	return 1
+}
+
+// pollPads reads both controllers into the InitPad buffers. The buffers hold
+// a status byte (00h ok, FFh no pad), the low byte of the ID and the data.
+func (k *Kernel) pollPads(bus *Bus) {
+	if !k.padsStarted {
+		return
+	}
+
+	for i, pad := range k.pads {
+		if pad.address == 0 || pad.size == 0 {
+			continue
+		}
+
+		reply := bus.sio0.Port(i).exchange(AddressController, 0x42, 0, 0, 0, 0, 0, 0, 0)
+		data := []byte{0xFF}
+		if len(reply) >= 3 {
+			data = append([]byte{0x00, reply[1]}, reply[3:]...)
+		}
+		if uint32(len(data)) > pad.size {
+			data = data[:pad.size]
+		}
+		bus.write(pad.address, data)
+	}
+}
+
+// card returns the memory card of a BIOS port number, 00h for slot 1 and 10h
+// for slot 2.
+func (k *Kernel) card(bus *Bus, port uint32) *MemoryCard {
+	return bus.sio0.Port(int(port>>4) & 1).MemoryCard
+}
+
+// finishCard delivers the hardware and software card events for spec.
+func (k *Kernel) finishCard(cpu *CPU, bus *Bus, spec uint32) uint32 {
+	calls := append(k.deliverEvent(classHardwareCard, spec), k.deliverEvent(classSoftwareCard, spec)...)
+	k.returnAfter(cpu, bus, calls, 1)
+	return 1
+}
+
+func kernelCardInfo(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	if k.card(bus, cpu.GPR[4]) == nil {
+		return k.finishCard(cpu, bus, specTimeout)
+	}
+	return k.finishCard(cpu, bus, specIOEnd)
+}
+
+func (k *Kernel) cardSector(cpu *CPU, bus *Bus, write bool) uint32 {
+	card := k.card(bus, cpu.GPR[4])
+	sector, address := cpu.GPR[5], cpu.GPR[6]
+	if card == nil {
+		return k.finishCard(cpu, bus, specTimeout)
+	}
+	if sector >= MemoryCardSectors {
+		return k.finishCard(cpu, bus, specError)
+	}
+
+	data := card.data[sector*MemoryCardSectorSize : (sector+1)*MemoryCardSectorSize]
+	if write {
+		bus.read(address, data)
+		card.flag &^= memoryCardFlagFresh
+		card.writeBack()
+	} else {
+		bus.write(address, data)
+	}
+	return k.finishCard(cpu, bus, specIOEnd)
+}
+
+func kernelWriteCardSector(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	return k.cardSector(cpu, bus, true)
+}
+
+func kernelReadCardSector(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	return k.cardSector(cpu, bus, false)
+}
+
+func kernelGetCardStatus(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	return 1
+}
@@ -0,0 +1,220 @@
+package ps
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+const fileCount = 16
+
+// Error codes returned by GetLastError.
+const (
+	errorNoEntry     = 2
+	errorBadFile     = 9
+	errorInvalid     = 22
+	errorTooManyOpen = 24
+)
+
+// openFile is a file opened with open. The first two descriptors are the
+// TTY.
+type openFile struct {
+	tty    bool
+	file   DiscFile
+	offset uint32
+}
+
+func (k *Kernel) file(fd uint32) *openFile {
+	if fd >= fileCount {
+		return nil
+	}
+	return k.files[fd]
+}
+
+func (k *Kernel) fail(code uint32) uint32 {
+	k.lastError = code
+	return 0xFFFFFFFF
+}
+
+// kernelOpen opens a file on the CD ("cdrom:") or the TTY ("tty:").
+func kernelOpen(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	name := readString(bus, cpu.GPR[4])
+
+	f := &openFile{}
+	switch {
+	case strings.HasPrefix(name, "tty:"):
+		f.tty = true
+	case strings.HasPrefix(name, "cdrom:") && k.Disc != nil:
+		file, err := k.Disc.Lookup(name)
+		if err != nil || file.Dir {
+			return k.fail(errorNoEntry)
+		}
+		f.file = file
+	default:
+		bus.logf("hle: open %q: unsupported device", name)
+		return k.fail(errorNoEntry)
+	}
+
+	for fd := range k.files {
+		if k.files[fd] == nil {
+			k.files[fd] = f
+			return uint32(fd)
+		}
+	}
+	return k.fail(errorTooManyOpen)
+}
+
+func kernelClose(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	fd := cpu.GPR[4]
+	if k.file(fd) == nil {
+		return k.fail(errorBadFile)
+	}
+	k.files[fd] = nil
+	return fd
+}
+
+func kernelLseek(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	f := k.file(cpu.GPR[4])
+	if f == nil || f.tty {
+		return k.fail(errorBadFile)
+	}
+
+	switch cpu.GPR[6] {
+	case 0:
+		f.offset = cpu.GPR[5]
+	case 1:
+		f.offset += cpu.GPR[5]
+	default:
+		return k.fail(errorInvalid)
+	}
+	return f.offset
+}
+
+func kernelRead(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	f := k.file(cpu.GPR[4])
+	if f == nil {
+		return k.fail(errorBadFile)
+	}
+	if f.tty {
+		return 0
+	}
+
+	if cpu.GPR[6] > maxGuestSize {
+		return k.fail(errorInvalid)
+	}
+	data := make([]byte, cpu.GPR[6])
+	n, _ := k.Disc.ReadAt(f.file, data, f.offset)
+	bus.write(cpu.GPR[5], data[:n])
+	f.offset += uint32(n)
+	return uint32(n)
+}
+
+func kernelWrite(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	f := k.file(cpu.GPR[4])
+	if f == nil || !f.tty {
+		return k.fail(errorBadFile)
+	}
+	data, ok := readBytes(bus, cpu.GPR[5], cpu.GPR[6])
+	if !ok {
+		return k.fail(errorInvalid)
+	}
+	k.print(string(data))
+	return cpu.GPR[6]
+}
+
+func kernelPutc(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	if f := k.file(cpu.GPR[5]); f != nil && f.tty {
+		k.print(string([]byte{uint8(cpu.GPR[4])}))
+	}
+	return cpu.GPR[4]
+}
+
+func kernelGetLastError(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	return k.lastError
+}
+
+// Offsets in the exec structure filled by Load and used by Exec. It is the
+// PS-X EXE header starting at offset 10h, followed by saved registers.
+const (
+	execPC        = 0x00
+	execGP        = 0x04
+	execText      = 0x08
+	execTextSize  = 0x0C
+	execBSS       = 0x18
+	execBSSSize   = 0x1C
+	execStack     = 0x20
+	execStackSize = 0x24
+	execSize      = 0x3C
+)
+
+func (k *Kernel) load(bus *Bus, path string, header uint32) bool {
+	data, err := k.Disc.ReadFile(path)
+	var exe *EXE
+	if err == nil {
+		exe, err = ParseEXE(data)
+	}
+	if err != nil {
+		bus.logf("hle: load %s: %v", path, err)
+		return false
+	}
+
+	bus.write(binary.LittleEndian.Uint32(data[0x18:]), exe.Text)
+	bus.write(header, data[0x10:0x10+execSize])
+	return true
+}
+
+// exec starts the program described by the exec structure at header. It
+// fails if the BSS is larger than RAM.
+func (k *Kernel) exec(cpu *CPU, bus *Bus, header, argc, argv uint32) bool {
+	word := func(offset uint32) uint32 {
+		return bus.LoadWord(header + offset)
+	}
+
+	if size := word(execBSSSize); size != 0 && !fillBytes(bus, word(execBSS), size, 0) {
+		return false
+	}
+	if stack := word(execStack); stack != 0 {
+		cpu.forceGPR(29, stack+word(execStackSize))
+		cpu.forceGPR(30, stack+word(execStackSize))
+	}
+	cpu.forceGPR(28, word(execGP))
+	cpu.forceGPR(4, argc)
+	cpu.forceGPR(5, argv)
+	cpu.forceGPR(31, kernelIdleLoop)
+	k.jump(cpu, word(execPC))
+	return true
+}
+
+func kernelLoad(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	if k.Disc == nil || !k.load(bus, readString(bus, cpu.GPR[4]), cpu.GPR[5]) {
+		return 0
+	}
+	return 1
+}
+
+func kernelExec(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.exec(cpu, bus, cpu.GPR[4], cpu.GPR[5], cpu.GPR[6])
+	return 0
+}
+
+// kernelLoadExec loads a program and runs it with the given stack. The exec
+// structure is kept in kernel memory.
+func kernelLoadExec(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	const header = 0x00001100
+
+	path, stack, offset := readString(bus, cpu.GPR[4]), cpu.GPR[5], cpu.GPR[6]
+	if k.Disc == nil || !k.load(bus, path, header) {
+		return 0
+	}
+	if stack != 0 {
+		bus.StoreWord(header+execStack, stack)
+		bus.StoreWord(header+execStackSize, offset)
+	}
+	k.exec(cpu, bus, header, 1, 0)
+	return 0
+}
+
+func kernelExit(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	bus.logf("hle: program exited with status %d", int32(cpu.GPR[4]))
+	k.jump(cpu, kernelIdleLoop)
+	return 0
+}
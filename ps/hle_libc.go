@@ -0,0 +1,494 @@
+package ps
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// heap is a first-fit allocator over a range of guest memory. The block list
+// is kept on the host, so a guest overwriting its heap can't corrupt it.
+type heap struct {
+	start, end uint32
+	blocks     []heapBlock
+}
+
+type heapBlock struct {
+	address, size uint32
+}
+
+func (h *heap) init(address, size uint32) {
+	*h = heap{start: (address + 3) &^ 3, end: address + size}
+}
+
+// alloc returns the address of a free block of size bytes, or 0.
+func (h *heap) alloc(size uint32) uint32 {
+	if size > maxGuestSize {
+		return 0
+	}
+	size = (size + 3) &^ 3
+	if size == 0 {
+		size = 4
+	}
+
+	address := h.start
+	for i, block := range h.blocks {
+		if block.address-address >= size {
+			h.blocks = append(h.blocks[:i], append([]heapBlock{{address, size}}, h.blocks[i:]...)...)
+			return address
+		}
+		address = block.address + block.size
+	}
+
+	if address >= h.end || h.end-address < size {
+		return 0
+	}
+	h.blocks = append(h.blocks, heapBlock{address, size})
+	return address
+}
+
+func (h *heap) find(address uint32) int {
+	for i, block := range h.blocks {
+		if block.address == address {
+			return i
+		}
+	}
+	return -1
+}
+
+func (h *heap) free(address uint32) {
+	if i := h.find(address); i >= 0 {
+		h.blocks = append(h.blocks[:i], h.blocks[i+1:]...)
+	}
+}
+
+func kernelInitHeap(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.heap.init(cpu.GPR[4], cpu.GPR[5])
+	return 0
+}
+
+func kernelMalloc(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	return k.heap.alloc(cpu.GPR[4])
+}
+
+func kernelFree(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.heap.free(cpu.GPR[4])
+	return 0
+}
+
+func kernelCalloc(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	if uint64(cpu.GPR[4])*uint64(cpu.GPR[5]) > maxGuestSize {
+		return 0
+	}
+	size := cpu.GPR[4] * cpu.GPR[5]
+	address := k.heap.alloc(size)
+	if address != 0 {
+		fillBytes(bus, address, size, 0)
+	}
+	return address
+}
+
+func kernelRealloc(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	old, size := cpu.GPR[4], cpu.GPR[5]
+	if old == 0 {
+		return k.heap.alloc(size)
+	}
+	i := k.heap.find(old)
+	if i < 0 {
+		return 0
+	}
+	if size == 0 {
+		k.heap.free(old)
+		return 0
+	}
+
+	oldSize := k.heap.blocks[i].size
+	address := k.heap.alloc(size)
+	if address == 0 {
+		return 0
+	}
+	if oldSize > size {
+		oldSize = size
+	}
+	data, _ := readBytes(bus, old, oldSize)
+	bus.write(address, data)
+	k.heap.free(old)
+	return address
+}
+
+func kernelAllocKernelMemory(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	return k.kernelHeap.alloc(cpu.GPR[4])
+}
+
+func kernelFreeKernelMemory(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.kernelHeap.free(cpu.GPR[4])
+	return 0
+}
+
+func kernelSysInitMemory(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.kernelHeap.init(cpu.GPR[4], cpu.GPR[5])
+	return 0
+}
+
+// maxGuestSize bounds the sizes that kernel functions take from registers.
+// Larger sizes fail the call instead of making the host allocate up to 4 GiB.
+const maxGuestSize = MainRAMSize
+
+// readBytes reads size bytes at address, or fails if size is out of range.
+func readBytes(bus *Bus, address, size uint32) ([]byte, bool) {
+	if size > maxGuestSize {
+		return nil, false
+	}
+	data := make([]byte, size)
+	bus.read(address, data)
+	return data, true
+}
+
+// fillBytes sets size bytes at address to value, or fails if size is out of
+// range.
+func fillBytes(bus *Bus, address, size uint32, value uint8) bool {
+	if size > maxGuestSize {
+		return false
+	}
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = value
+	}
+	bus.write(address, data)
+	return true
+}
+
+func kernelStrlen(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	if cpu.GPR[4] == 0 {
+		return 0
+	}
+	return uint32(len(readString(bus, cpu.GPR[4])))
+}
+
+func kernelStrcpy(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	dst, src := cpu.GPR[4], cpu.GPR[5]
+	if dst == 0 || src == 0 {
+		return 0
+	}
+	writeString(bus, dst, readString(bus, src))
+	return dst
+}
+
+func kernelStrncpy(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	dst, src, n := cpu.GPR[4], cpu.GPR[5], cpu.GPR[6]
+	if dst == 0 || src == 0 || n > maxGuestSize {
+		return 0
+	}
+	s := readString(bus, src)
+	data := make([]byte, n)
+	copy(data, s)
+	bus.write(dst, data)
+	return dst
+}
+
+func kernelStrcat(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	dst, src := cpu.GPR[4], cpu.GPR[5]
+	if dst == 0 || src == 0 {
+		return 0
+	}
+	writeString(bus, dst+uint32(len(readString(bus, dst))), readString(bus, src))
+	return dst
+}
+
+func kernelStrncat(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	dst, src, n := cpu.GPR[4], cpu.GPR[5], int(cpu.GPR[6])
+	if dst == 0 || src == 0 {
+		return 0
+	}
+	s := readString(bus, src)
+	if len(s) > n {
+		s = s[:n]
+	}
+	writeString(bus, dst+uint32(len(readString(bus, dst))), s)
+	return dst
+}
+
+func compareResult(result int) uint32 {
+	switch {
+	case result < 0:
+		return 0xFFFFFFFF
+	case result > 0:
+		return 1
+	}
+	return 0
+}
+
+func kernelStrcmp(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	return compareResult(strings.Compare(readString(bus, cpu.GPR[4]), readString(bus, cpu.GPR[5])))
+}
+
+func kernelStrncmp(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	a, b, n := readString(bus, cpu.GPR[4]), readString(bus, cpu.GPR[5]), int(cpu.GPR[6])
+	if len(a) > n {
+		a = a[:n]
+	}
+	if len(b) > n {
+		b = b[:n]
+	}
+	return compareResult(strings.Compare(a, b))
+}
+
+func kernelStrchr(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	s := readString(bus, cpu.GPR[4])
+	if i := strings.IndexByte(s+"\x00", uint8(cpu.GPR[5])); i >= 0 {
+		return cpu.GPR[4] + uint32(i)
+	}
+	return 0
+}
+
+func kernelStrrchr(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	s := readString(bus, cpu.GPR[4])
+	if i := strings.LastIndexByte(s+"\x00", uint8(cpu.GPR[5])); i >= 0 {
+		return cpu.GPR[4] + uint32(i)
+	}
+	return 0
+}
+
+func kernelStrstr(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	if i := strings.Index(readString(bus, cpu.GPR[4]), readString(bus, cpu.GPR[5])); i >= 0 {
+		return cpu.GPR[4] + uint32(i)
+	}
+	return 0
+}
+
+func kernelToupper(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	c := uint8(cpu.GPR[4])
+	if c >= 'a' && c <= 'z' {
+		c -= 'a' - 'A'
+	}
+	return uint32(c)
+}
+
+func kernelTolower(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	c := uint8(cpu.GPR[4])
+	if c >= 'A' && c <= 'Z' {
+		c += 'a' - 'A'
+	}
+	return uint32(c)
+}
+
+func kernelMemcpy(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	dst, src, n := cpu.GPR[4], cpu.GPR[5], cpu.GPR[6]
+	if dst == 0 || src == 0 {
+		return dst
+	}
+	data, ok := readBytes(bus, src, n)
+	if !ok {
+		return 0
+	}
+	bus.write(dst, data)
+	return dst
+}
+
+func kernelBcopy(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	src, dst, n := cpu.GPR[4], cpu.GPR[5], cpu.GPR[6]
+	if dst != 0 && src != 0 {
+		if data, ok := readBytes(bus, src, n); ok {
+			bus.write(dst, data)
+		}
+	}
+	return 0
+}
+
+func kernelMemset(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	dst, value, n := cpu.GPR[4], uint8(cpu.GPR[5]), cpu.GPR[6]
+	if dst != 0 && !fillBytes(bus, dst, n, value) {
+		return 0
+	}
+	return dst
+}
+
+func kernelBzero(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	if cpu.GPR[4] != 0 {
+		fillBytes(bus, cpu.GPR[4], cpu.GPR[5], 0)
+	}
+	return 0
+}
+
+func kernelMemcmp(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	a, b, n := cpu.GPR[4], cpu.GPR[5], cpu.GPR[6]
+	dataA, okA := readBytes(bus, a, n)
+	dataB, okB := readBytes(bus, b, n)
+	if !okA || !okB {
+		return 0
+	}
+	return compareResult(strings.Compare(string(dataA), string(dataB)))
+}
+
+func kernelMemchr(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	s, c, n := cpu.GPR[4], uint8(cpu.GPR[5]), cpu.GPR[6]
+	data, _ := readBytes(bus, s, n)
+	for i, b := range data {
+		if b == c {
+			return s + uint32(i)
+		}
+	}
+	return 0
+}
+
+func kernelAbs(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	if value := int32(cpu.GPR[4]); value < 0 {
+		return uint32(-value)
+	}
+	return cpu.GPR[4]
+}
+
+// parseInteger parses a C integer literal with an optional sign and 0x or 0
+// prefix when base is 0. It returns the value and the number of characters
+// used.
+func parseInteger(s string, base int) (int64, int) {
+	i := 0
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n') {
+		i++
+	}
+	negative := false
+	if i < len(s) && (s[i] == '-' || s[i] == '+') {
+		negative = s[i] == '-'
+		i++
+	}
+	if (base == 0 || base == 16) && strings.HasPrefix(strings.ToLower(s[i:]), "0x") {
+		base = 16
+		i += 2
+	} else if base == 0 && strings.HasPrefix(s[i:], "0") {
+		base = 8
+	} else if base == 0 {
+		base = 10
+	}
+
+	var value int64
+	for ; i < len(s); i++ {
+		digit, err := strconv.ParseInt(s[i:i+1], base, 64)
+		if err != nil {
+			break
+		}
+		value = value*int64(base) + digit
+	}
+	if negative {
+		value = -value
+	}
+	return value, i
+}
+
+func kernelAtoi(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	value, _ := parseInteger(readString(bus, cpu.GPR[4]), 10)
+	return uint32(value)
+}
+
+func kernelStrtol(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	s := readString(bus, cpu.GPR[4])
+	value, n := parseInteger(s, int(cpu.GPR[6]))
+	if cpu.GPR[5] != 0 {
+		bus.StoreWord(cpu.GPR[5], cpu.GPR[4]+uint32(n))
+	}
+	return uint32(value)
+}
+
+// kernelRand is the BIOS linear congruential generator.
+func kernelRand(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.seed = k.seed*0x41C64E6D + 0x3039
+	return (k.seed >> 16) & 0x7FFF
+}
+
+func kernelSrand(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.seed = cpu.GPR[4]
+	return 0
+}
+
+// setjmp buffers hold $ra, $sp, $fp, $s0-$s7 and $gp.
+var jmpbufRegisters = []uint32{31, 29, 30, 16, 17, 18, 19, 20, 21, 22, 23, 28}
+
+func kernelSetjmp(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	for i, reg := range jmpbufRegisters {
+		bus.StoreWord(cpu.GPR[4]+uint32(i)*4, cpu.GPR[reg])
+	}
+	return 0
+}
+
+func (k *Kernel) longjmp(cpu *CPU, bus *Bus, buffer, result uint32) {
+	for i, reg := range jmpbufRegisters {
+		cpu.forceGPR(reg, bus.LoadWord(buffer+uint32(i)*4))
+	}
+	k.returnToCaller(cpu, result)
+}
+
+func kernelLongjmp(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.longjmp(cpu, bus, cpu.GPR[4], cpu.GPR[5])
+	return 0
+}
+
+func kernelPutchar(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.print(string([]byte{uint8(cpu.GPR[4])}))
+	return cpu.GPR[4]
+}
+
+func kernelPuts(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	k.print(readString(bus, cpu.GPR[4]) + "\n")
+	return 0
+}
+
+func kernelPrintf(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	next := 1
+	s := formatString(readString(bus, cpu.GPR[4]), func() uint32 {
+		value := arg(cpu, bus, next)
+		next++
+		return value
+	}, func(address uint32) string {
+		return readString(bus, address)
+	})
+	k.print(s)
+	return uint32(len(s))
+}
+
+// formatString implements the subset of printf conversions supported by the
+// BIOS.
+func formatString(format string, next func() uint32, str func(address uint32) string) string {
+	var out strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			out.WriteByte(format[i])
+			continue
+		}
+
+		// Collect flags, width and precision, dropping length modifiers.
+		spec := "%"
+		i++
+		for i < len(format) && strings.IndexByte("-+ #0123456789.*lh", format[i]) >= 0 {
+			switch format[i] {
+			case '*':
+				spec += strconv.Itoa(int(int32(next())))
+			case 'l', 'h':
+			default:
+				spec += string(format[i])
+			}
+			i++
+		}
+		if i >= len(format) {
+			break
+		}
+
+		switch verb := format[i]; verb {
+		case 'd', 'i':
+			fmt.Fprintf(&out, spec+"d", int32(next()))
+		case 'u':
+			fmt.Fprintf(&out, spec+"d", next())
+		case 'x', 'X', 'o':
+			fmt.Fprintf(&out, spec+string(verb), next())
+		case 'p':
+			fmt.Fprintf(&out, spec+"x", next())
+		case 'c':
+			fmt.Fprintf(&out, spec+"c", rune(uint8(next())))
+		case 's':
+			fmt.Fprintf(&out, spec+"s", str(next()))
+		case '%':
+			out.WriteByte('%')
+		default:
+			out.WriteString(spec + string(verb))
+		}
+	}
+	return out.String()
+}
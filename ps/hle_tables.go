@@ -0,0 +1,127 @@
+package ps
+
+// Kernel function tables, called by jumping to A0h, B0h or C0h with the
+// function number in $t1.
+// http://problemkaputt.de/psx-spx.htm#biosfunctionsummary
+
+func kernelNop(k *Kernel, cpu *CPU, bus *Bus) uint32 {
+	return 0
+}
+
+var kernelFunctionsA = map[uint32]kernelFunction{
+	0x00: kernelOpen,
+	0x01: kernelLseek,
+	0x02: kernelRead,
+	0x03: kernelWrite,
+	0x04: kernelClose,
+	0x06: kernelExit,
+	0x09: kernelPutc,
+	0x0C: kernelStrtol,
+	0x0D: kernelStrtol,
+	0x0E: kernelAbs,
+	0x0F: kernelAbs,
+	0x10: kernelAtoi,
+	0x11: kernelAtoi,
+	0x13: kernelSetjmp,
+	0x14: kernelLongjmp,
+	0x15: kernelStrcat,
+	0x16: kernelStrncat,
+	0x17: kernelStrcmp,
+	0x18: kernelStrncmp,
+	0x19: kernelStrcpy,
+	0x1A: kernelStrncpy,
+	0x1B: kernelStrlen,
+	0x1C: kernelStrchr,
+	0x1D: kernelStrrchr,
+	0x1E: kernelStrchr,
+	0x1F: kernelStrrchr,
+	0x24: kernelStrstr,
+	0x25: kernelToupper,
+	0x26: kernelTolower,
+	0x27: kernelBcopy,
+	0x28: kernelBzero,
+	0x29: kernelMemcmp,
+	0x2A: kernelMemcpy,
+	0x2B: kernelMemset,
+	0x2D: kernelMemchr,
+	0x2F: kernelRand,
+	0x30: kernelSrand,
+	0x33: kernelMalloc,
+	0x34: kernelFree,
+	0x37: kernelCalloc,
+	0x38: kernelRealloc,
+	0x39: kernelInitHeap,
+	0x3A: kernelExit,
+	0x3C: kernelPutchar,
+	0x3E: kernelPuts,
+	0x3F: kernelPrintf,
+	0x42: kernelLoad,
+	0x43: kernelExec,
+	0x44: kernelNop, // FlushCache
+	0x45: kernelNop, // init_a0_b0_c0_vectors
+	0x51: kernelLoadExec,
+	0x55: kernelNop, // _bu_init
+	0x56: kernelNop, // _96_init
+	0x70: kernelNop, // _bu_init
+	0x71: kernelNop, // _96_init
+	0x72: kernelNop, // _96_remove
+	0x9C: kernelNop, // SetConf
+	0x9D: kernelNop, // GetConf
+	0x9F: kernelNop, // SetMem
+	0xAB: kernelCardInfo,
+	0xAC: kernelCardInfo, // _card_load
+}
+
+var kernelFunctionsB = map[uint32]kernelFunction{
+	0x00: kernelAllocKernelMemory,
+	0x01: kernelFreeKernelMemory,
+	0x07: kernelDeliverEvent,
+	0x08: kernelOpenEvent,
+	0x09: kernelCloseEvent,
+	0x0A: kernelWaitEvent,
+	0x0B: kernelTestEvent,
+	0x0C: kernelEnableEvent,
+	0x0D: kernelDisableEvent,
+	0x0E: kernelOpenThread,
+	0x0F: kernelCloseThread,
+	0x10: kernelChangeThread,
+	0x12: kernelInitPad,
+	0x13: kernelStartPad,
+	0x14: kernelStopPad,
+	0x17: kernelReturnFromException,
+	0x18: kernelSetDefaultExitFromException,
+	0x19: kernelSetCustomExitFromException,
+	0x20: kernelUnDeliverEvent,
+	0x32: kernelOpen,
+	0x33: kernelLseek,
+	0x34: kernelRead,
+	0x35: kernelWrite,
+	0x36: kernelClose,
+	0x3D: kernelPutchar,
+	0x3F: kernelPuts,
+	0x4A: kernelNop, // InitCard
+	0x4B: kernelNop, // StartCard
+	0x4C: kernelNop, // StopCard
+	0x4E: kernelWriteCardSector,
+	0x4F: kernelReadCardSector,
+	0x50: kernelNop, // allow_new_card
+	0x54: kernelGetLastError,
+	0x55: kernelGetLastError,
+	0x5B: kernelChangeClearPad,
+	0x5C: kernelGetCardStatus,
+	0x5D: kernelGetCardStatus, // _card_wait
+}
+
+var kernelFunctionsC = map[uint32]kernelFunction{
+	0x00: kernelNop, // EnqueueTimerAndVblankIrqs
+	0x01: kernelNop, // EnqueueSyscallHandler
+	0x02: kernelSysEnqIntRP,
+	0x03: kernelSysDeqIntRP,
+	0x07: kernelNop, // InstallExceptionHandlers
+	0x08: kernelSysInitMemory,
+	0x09: kernelNop, // SysInitKernelVariables
+	0x0A: kernelChangeClearRCnt,
+	0x0C: kernelNop, // InitDefInt
+	0x12: kernelNop, // InstallDevices
+	0x1C: kernelNop, // AdjustA0Table
+}
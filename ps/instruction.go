@@ -75,19 +75,19 @@ func (inst Instruction) String() string {
 		case 0x13:
 			return fmt.Sprintf("MTLO    $%d", inst.Rs)
 		case 0x18:
-			return fmt.Sprintf("MULT    $%d, $%d", inst.Rt, inst.Rs)
+			return fmt.Sprintf("MULT    $%d, $%d", inst.Rs, inst.Rt)
 		case 0x19:
-			return fmt.Sprintf("MULTU   $%d, $%d", inst.Rt, inst.Rs)
+			return fmt.Sprintf("MULTU   $%d, $%d", inst.Rs, inst.Rt)
 		case 0x1A:
-			return fmt.Sprintf("DIV     $%d, $%d", inst.Rt, inst.Rs)
+			return fmt.Sprintf("DIV     $%d, $%d", inst.Rs, inst.Rt)
 		case 0x1B:
-			return fmt.Sprintf("DIVU    $%d, $%d", inst.Rt, inst.Rs)
+			return fmt.Sprintf("DIVU    $%d, $%d", inst.Rs, inst.Rt)
 		case 0x20:
 			return fmt.Sprintf("ADD     $%d, $%d, $%d", inst.Rd, inst.Rs, inst.Rt)
 		case 0x21:
 			return fmt.Sprintf("ADDU    $%d, $%d, $%d", inst.Rd, inst.Rs, inst.Rt)
 		case 0x22:
-			return fmt.Sprintf("SUB     $%d, $%d, $%d", inst.Rd, inst.Rt, inst.Rs)
+			return fmt.Sprintf("SUB     $%d, $%d, $%d", inst.Rd, inst.Rs, inst.Rt)
 		case 0x23:
 			return fmt.Sprintf("SUBU    $%d, $%d, $%d", inst.Rd, inst.Rs, inst.Rt)
 		case 0x24:
@@ -183,3 +183,29 @@ func (inst Instruction) String() string {
 		return fmt.Sprintf("Unknown opcode: %02xh", inst.Opcode)
 	}
 }
+
+// Code returns the code field of SYSCALL and BREAK.
+func (inst Instruction) Code() uint32 {
+	return inst.Address >> 6
+}
+
+// Target returns the destination of a jump or branch instruction at pc.
+func (inst Instruction) Target(pc uint32) (uint32, bool) {
+	switch inst.Opcode {
+	case 0x01, 0x04, 0x05, 0x06, 0x07:
+		return pc + 4 + inst.Imm16sx<<2, true
+	case 0x02, 0x03:
+		return (pc+4)&0xF0000000 | inst.Address<<2, true
+	}
+	return 0, false
+}
+
+// IsJump reports whether the instruction is a jump or branch, which is
+// followed by a delay slot.
+func (inst Instruction) IsJump() bool {
+	if inst.Opcode == 0x00 {
+		return inst.Function == 0x08 || inst.Function == 0x09
+	}
+	_, ok := inst.Target(0)
+	return ok
+}
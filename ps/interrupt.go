@@ -0,0 +1,58 @@
+package ps
+
+// IRQ is an interrupt request line of the interrupt controller.
+// http://problemkaputt.de/psx-spx.htm#interruptcontrol
+type IRQ uint32
+
+const (
+	IRQVBlank IRQ = iota
+	IRQGPU
+	IRQCDROM
+	IRQDMA
+	IRQTimer0
+	IRQTimer1
+	IRQTimer2
+	IRQController
+	IRQSIO
+	IRQSPU
+	IRQLightpen
+)
+
+// Interrupts is the interrupt controller located at 1F801070h.
+type Interrupts struct {
+	// Stat is I_STAT. A bit is set when the corresponding IRQ is requested and
+	// is acknowledged by writing 0 to it.
+	Stat uint32
+
+	// Mask is I_MASK.
+	Mask uint32
+}
+
+// Request sets the I_STAT bit for irq.
+func (interrupts *Interrupts) Request(irq IRQ) {
+	interrupts.Stat |= 1 << irq
+}
+
+// Pending reports whether any unmasked interrupt is requested.
+func (interrupts *Interrupts) Pending() bool {
+	return interrupts.Stat&interrupts.Mask != 0
+}
+
+func (interrupts *Interrupts) Load(offset uint32) uint32 {
+	switch offset &^ 3 {
+	case 0:
+		return interrupts.Stat
+	case 4:
+		return interrupts.Mask
+	}
+	return 0
+}
+
+func (interrupts *Interrupts) Store(offset uint32, value uint32) {
+	switch offset &^ 3 {
+	case 0:
+		interrupts.Stat &= value
+	case 4:
+		interrupts.Mask = value & 0x7FF
+	}
+}
@@ -0,0 +1,226 @@
+package ps
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	DiscSectorSize    = 2048
+	discRawSectorSize = 2352
+
+	isoVolumeDescriptorSector = 16
+	isoRootRecordOffset       = 156
+	isoDirectoryFlag          = 1 << 1
+)
+
+var discSync = []byte{0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x00}
+
+// Disc is a data CD image, either with 2048 byte sectors (.iso) or raw 2352
+// byte sectors (.bin) in mode 1 or mode 2 form 1.
+// http://problemkaputt.de/psx-spx.htm#cdromisovolumedescriptors
+type Disc struct {
+	image      io.ReaderAt
+	sectorSize int64
+	dataOffset int64
+	root       DiscFile
+}
+
+// DiscFile is a file or directory in the ISO9660 file system.
+type DiscFile struct {
+	Name   string
+	Sector uint32
+	Size   uint32
+	Dir    bool
+}
+
+func OpenDisc(path string) (*Disc, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	disc, err := NewDisc(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return disc, nil
+}
+
+// NewDisc reads the file system of the image.
+func NewDisc(image io.ReaderAt) (*Disc, error) {
+	disc := &Disc{image: image, sectorSize: DiscSectorSize}
+
+	header := make([]byte, 16)
+	if _, err := image.ReadAt(header, 0); err == nil && bytes.Equal(header[:12], discSync) {
+		disc.sectorSize = discRawSectorSize
+		disc.dataOffset = 16
+		if header[15] == 2 {
+			// Mode 2 sectors have an 8 byte subheader.
+			disc.dataOffset = 24
+		}
+	}
+
+	descriptor := make([]byte, DiscSectorSize)
+	if err := disc.ReadSector(isoVolumeDescriptorSector, descriptor); err != nil {
+		return nil, err
+	}
+	if descriptor[0] != 1 || string(descriptor[1:6]) != "CD001" {
+		return nil, errors.New("no ISO9660 primary volume descriptor")
+	}
+
+	root, length, err := parseDirectoryRecord(descriptor[isoRootRecordOffset:])
+	if err == nil && length == 0 {
+		err = errBadDirectoryRecord
+	}
+	if err != nil {
+		return nil, fmt.Errorf("root directory: %v", err)
+	}
+	disc.root = root
+	return disc, nil
+}
+
+// ReadSector reads the 2048 bytes of user data of a sector.
+func (disc *Disc) ReadSector(sector uint32, data []byte) error {
+	offset := int64(sector)*disc.sectorSize + disc.dataOffset
+	_, err := disc.image.ReadAt(data[:DiscSectorSize], offset)
+	return err
+}
+
+var errBadDirectoryRecord = errors.New("bad ISO9660 directory record")
+
+// parseDirectoryRecord returns the file described by the record at the start
+// of record and the length of the record, which is 0 for the padding at the
+// end of a sector.
+func parseDirectoryRecord(record []byte) (DiscFile, int, error) {
+	if len(record) == 0 || record[0] == 0 {
+		return DiscFile{}, 0, nil
+	}
+	length := int(record[0])
+	if length < 33 || length > len(record) || 33+int(record[32]) > length {
+		return DiscFile{}, 0, errBadDirectoryRecord
+	}
+
+	nameLength := int(record[32])
+	return DiscFile{
+		Name:   string(record[33 : 33+nameLength]),
+		Sector: binary.LittleEndian.Uint32(record[2:]),
+		Size:   binary.LittleEndian.Uint32(record[10:]),
+		Dir:    record[25]&isoDirectoryFlag != 0,
+	}, length, nil
+}
+
+// ReadDir lists a directory, skipping the "." and ".." entries.
+func (disc *Disc) ReadDir(dir DiscFile) ([]DiscFile, error) {
+	var files []DiscFile
+	data := make([]byte, DiscSectorSize)
+	for offset := uint32(0); offset < dir.Size; offset += DiscSectorSize {
+		if err := disc.ReadSector(dir.Sector+offset/DiscSectorSize, data); err != nil {
+			return nil, err
+		}
+
+		// Records never cross sector boundaries, the rest of a sector is
+		// padded with zeros.
+		for position := 0; position < DiscSectorSize; {
+			file, length, err := parseDirectoryRecord(data[position:])
+			if err != nil {
+				return nil, err
+			}
+			if length == 0 {
+				break
+			}
+			position += length
+			if file.Name != "\x00" && file.Name != "\x01" {
+				files = append(files, file)
+			}
+		}
+	}
+	return files, nil
+}
+
+// sameFileName compares names case-insensitively. The ";1" version suffix is
+// optional.
+func sameFileName(name, pattern string) bool {
+	if strings.EqualFold(name, pattern) {
+		return true
+	}
+	if i := strings.IndexByte(name, ';'); i >= 0 && strings.IndexByte(pattern, ';') < 0 {
+		return strings.EqualFold(name[:i], pattern)
+	}
+	return false
+}
+
+// Lookup finds a file by its path, such as "cdrom:\SLUS_000.01;1" or
+// "\DATA\LEVEL1.BIN".
+func (disc *Disc) Lookup(path string) (DiscFile, error) {
+	path = strings.TrimPrefix(path, "cdrom:")
+	file := disc.root
+	for _, component := range strings.FieldsFunc(path, func(r rune) bool { return r == '\\' || r == '/' }) {
+		if !file.Dir {
+			return DiscFile{}, fmt.Errorf("%s: not a directory", file.Name)
+		}
+
+		files, err := disc.ReadDir(file)
+		if err != nil {
+			return DiscFile{}, err
+		}
+
+		found := false
+		for _, f := range files {
+			if sameFileName(f.Name, component) {
+				file, found = f, true
+				break
+			}
+		}
+		if !found {
+			return DiscFile{}, fmt.Errorf("%s: file not found", path)
+		}
+	}
+	return file, nil
+}
+
+// ReadAt reads file contents starting at offset.
+func (disc *Disc) ReadAt(file DiscFile, data []byte, offset uint32) (int, error) {
+	if offset >= file.Size {
+		return 0, io.EOF
+	}
+	if remaining := file.Size - offset; uint32(len(data)) > remaining {
+		data = data[:remaining]
+	}
+
+	sector := make([]byte, DiscSectorSize)
+	n := 0
+	for n < len(data) {
+		position := offset + uint32(n)
+		if err := disc.ReadSector(file.Sector+position/DiscSectorSize, sector); err != nil {
+			return n, err
+		}
+		n += copy(data[n:], sector[position%DiscSectorSize:])
+	}
+	return n, nil
+}
+
+// ReadFile reads a whole file.
+func (disc *Disc) ReadFile(path string) ([]byte, error) {
+	file, err := disc.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, file.Size)
+	_, err = disc.ReadAt(file, data, 0)
+	return data, err
+}
+
+// Close closes the image if it was opened by OpenDisc.
+func (disc *Disc) Close() error {
+	if closer, ok := disc.image.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
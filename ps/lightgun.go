@@ -0,0 +1,203 @@
+package ps
+
+// Light gun buttons, mapped onto the pad button bits they are reported as.
+const (
+	GunConTrigger = ButtonCircle
+	GunConA       = ButtonStart
+	GunConB       = ButtonCross
+
+	JustifierTrigger   = ButtonCircle
+	JustifierAuxiliary = ButtonCross
+	JustifierStart     = ButtonStart
+)
+
+const (
+	IDGunCon    = 0x5A63
+	IDJustifier = 0x5A31
+)
+
+// GunCon coordinates reported when the gun doesn't point at the screen.
+const (
+	gunConNoLightX = 0x0001
+	gunConNoLightY = 0x000A
+)
+
+// justifierIRQEnable is sent as the 4th byte of a read to make the Justifier
+// raise the lightpen interrupt.
+const justifierIRQEnable = 0x10
+
+// aim holds the position a light gun points at and the timing of the console
+// it is plugged into.
+type aim struct {
+	timing *VideoTiming
+	x, y   float64
+}
+
+// Aim points the gun at normalized screen coordinates, where (0, 0) is the top
+// left and (1, 1) the bottom right corner of the displayed picture. Values
+// outside of that range point the gun away from the screen.
+func (aim *aim) Aim(x, y float64) {
+	aim.x, aim.y = x, y
+}
+
+func (aim *aim) beam() (dot, line uint32, ok bool) {
+	if aim.timing == nil {
+		return 0, 0, false
+	}
+	return aim.timing.BeamPosition(aim.x, aim.y)
+}
+
+// GunCon is the Namco GunCon (NPC-103). It latches the beam position when the
+// beam passes the aimed point and reports it as X in 8 MHz dot clock units and
+// Y in scanlines.
+// http://problemkaputt.de/psx-spx.htm#controllerslightguns
+type GunCon struct {
+	Buttons
+	aim
+
+	position int
+	response []uint8
+}
+
+// NewGunCon returns a GunCon that follows the video timing of the console it
+// is connected to.
+func NewGunCon() *GunCon {
+	return &GunCon{aim: aim{x: -1, y: -1}}
+}
+
+func (gun *GunCon) plug(bus *Bus) {
+	gun.timing = bus.Timing()
+}
+
+func (gun *GunCon) unplug(bus *Bus) {
+	gun.timing = nil
+}
+
+// Coordinates returns the values reported for the current aim.
+func (gun *GunCon) Coordinates() (x, y uint16) {
+	dot, line, ok := gun.beam()
+	if !ok {
+		return gunConNoLightX, gunConNoLightY
+	}
+	return uint16(uint64(dot) * DotClock / VideoClock), uint16(line)
+}
+
+func (gun *GunCon) Transfer(value uint8) (uint8, bool) {
+	position := gun.position
+	gun.position++
+
+	switch position {
+	case 0:
+		return 0xFF, true
+	case 1:
+		if value != 0x42 {
+			return 0xFF, false
+		}
+		low, high := gun.state()
+		x, y := gun.Coordinates()
+		gun.response = []uint8{
+			uint8(IDGunCon & 0xFF), uint8(IDGunCon >> 8),
+			low, high,
+			uint8(x), uint8(x >> 8),
+			uint8(y), uint8(y >> 8),
+		}
+	}
+
+	index := position - 1
+	if index >= len(gun.response) {
+		return 0xFF, false
+	}
+	return gun.response[index], index < len(gun.response)-1
+}
+
+func (gun *GunCon) Deselect() {
+	gun.position = 0
+	gun.response = nil
+}
+
+// Justifier is the Konami Justifier light gun. It only reports its buttons
+// over SIO0. When enabled by the game, it raises the lightpen interrupt
+// (IRQ10) as the beam passes the aimed point, and the game reads the beam
+// position from the root counters.
+type Justifier struct {
+	Buttons
+	aim
+
+	interrupts *Interrupts
+	irqEnabled bool
+	firedFrame uint64
+	fired      bool
+
+	position int
+}
+
+// NewJustifier returns a Justifier that follows the video timing of the
+// console it is connected to.
+func NewJustifier() *Justifier {
+	return &Justifier{aim: aim{x: -1, y: -1}}
+}
+
+func (gun *Justifier) plug(bus *Bus) {
+	gun.timing = bus.Timing()
+	gun.interrupts = bus.Interrupts()
+	bus.AddTicker(gun)
+}
+
+func (gun *Justifier) unplug(bus *Bus) {
+	bus.removeTicker(gun)
+	gun.timing = nil
+	gun.interrupts = nil
+}
+
+func (gun *Justifier) Transfer(value uint8) (uint8, bool) {
+	position := gun.position
+	gun.position++
+
+	low, high := gun.state()
+	switch position {
+	case 0:
+		return 0xFF, true
+	case 1:
+		if value != 0x42 {
+			return 0xFF, false
+		}
+		return uint8(IDJustifier & 0xFF), true
+	case 2:
+		return uint8(IDJustifier >> 8), true
+	case 3:
+		gun.irqEnabled = value == justifierIRQEnable
+		return low, true
+	case 4:
+		return high, false
+	}
+
+	return 0xFF, false
+}
+
+func (gun *Justifier) Deselect() {
+	gun.position = 0
+}
+
+// Tick raises IRQ10 once per frame when the beam reaches the aimed point.
+func (gun *Justifier) Tick(cycles uint32) {
+	if !gun.irqEnabled {
+		return
+	}
+
+	frame := gun.timing.Frame()
+	if gun.fired && gun.firedFrame == frame {
+		return
+	}
+
+	dot, line, ok := gun.beam()
+	if !ok {
+		return
+	}
+
+	beamDot, beamLine := gun.timing.Beam()
+	if beamLine == line && beamDot >= dot {
+		gun.interrupts.Request(IRQLightpen)
+		gun.fired = true
+		gun.firedFrame = frame
+	}
+}
@@ -0,0 +1,122 @@
+package ps
+
+import (
+	"debug/dwarf"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SourceLine is the first instruction generated for a line of source code.
+type SourceLine struct {
+	Address uint32
+	File    string
+	Line    int
+}
+
+// LineTable maps addresses to source lines. A nil *LineTable is empty.
+type LineTable struct {
+	// lines is sorted by address. Entries with a zero Line mark the end of
+	// a sequence of instructions.
+	lines []SourceLine
+}
+
+// add reads the line tables of all compilation units.
+func (table *LineTable) add(debug *dwarf.Data) error {
+	reader := debug.Reader()
+	for {
+		unit, err := reader.Next()
+		if err != nil {
+			return err
+		}
+		if unit == nil {
+			break
+		}
+		if unit.Tag != dwarf.TagCompileUnit {
+			reader.SkipChildren()
+			continue
+		}
+
+		lines, err := debug.LineReader(unit)
+		if err != nil {
+			return err
+		}
+		reader.SkipChildren()
+		if lines == nil {
+			continue
+		}
+
+		var entry dwarf.LineEntry
+		for {
+			if err := lines.Next(&entry); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			switch {
+			case entry.EndSequence:
+				table.lines = append(table.lines, SourceLine{Address: uint32(entry.Address)})
+			case entry.IsStmt && entry.File != nil:
+				line := SourceLine{
+					Address: uint32(entry.Address),
+					File:    entry.File.Name,
+					Line:    entry.Line,
+				}
+				// Keep only the first of consecutive rows for the same line,
+				// so that an address starting a row starts a line.
+				if n := len(table.lines); n > 0 && table.lines[n-1].Line == line.Line && table.lines[n-1].File == line.File {
+					continue
+				}
+				table.lines = append(table.lines, line)
+			}
+		}
+	}
+
+	sort.SliceStable(table.lines, func(i, j int) bool {
+		return table.lines[i].Address < table.lines[j].Address
+	})
+	return nil
+}
+
+// Lookup finds the source line containing address.
+func (table *LineTable) Lookup(address uint32) (SourceLine, bool) {
+	if table == nil {
+		return SourceLine{}, false
+	}
+	i := sort.Search(len(table.lines), func(i int) bool {
+		return table.lines[i].Address > address
+	})
+	if i == 0 || table.lines[i-1].Line == 0 {
+		return SourceLine{}, false
+	}
+	return table.lines[i-1], true
+}
+
+// Address finds the first instruction of line in file, or of the closest
+// line after it that generated code. Files match if one path ends with the
+// other, so "main.c" finds "/home/user/game/src/main.c".
+func (table *LineTable) Address(file string, line int) (SourceLine, bool) {
+	if table == nil {
+		return SourceLine{}, false
+	}
+	var best SourceLine
+	found := false
+	for _, l := range table.lines {
+		if l.Line < line || !sameFile(l.File, file) {
+			continue
+		}
+		if !found || l.Line < best.Line || l.Line == best.Line && l.Address < best.Address {
+			best, found = l, true
+		}
+	}
+	return best, found
+}
+
+func sameFile(a, b string) bool {
+	a, b = filepath.ToSlash(filepath.Clean(a)), filepath.ToSlash(filepath.Clean(b))
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	return a == b || strings.HasSuffix(a, "/"+b)
+}
@@ -0,0 +1,283 @@
+package ps
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	MemoryCardSize       = 128 * 1024
+	MemoryCardSectorSize = 128
+	MemoryCardSectors    = MemoryCardSize / MemoryCardSectorSize
+)
+
+// FLAG byte bits
+const (
+	memoryCardFlagError = 1 << 2
+	memoryCardFlagFresh = 1 << 3
+)
+
+// Memory end bytes sent after a read or a write command
+const (
+	memoryCardGood        = 0x47
+	memoryCardBadChecksum = 0x4E
+	memoryCardBadSector   = 0xFF
+)
+
+// MemoryCard is a 128 KiB memory card addressed with 81h on SIO0. It is backed
+// by a raw .mcr/.mcd image, which is rewritten after every sector write.
+// http://problemkaputt.de/psx-spx.htm#memorycardreadwritecommands
+type MemoryCard struct {
+	data []byte
+	path string
+	// err is the first error writing the image back after a sector write.
+	err error
+
+	// flag is sent in response to the command byte. Bit 3 is set until the
+	// first successful write after the card has been inserted.
+	flag uint8
+
+	position int
+	command  uint8
+	sector   uint16
+	checksum uint8
+	previous uint8
+	buffer   [MemoryCardSectorSize]byte
+}
+
+// NewMemoryCard returns a blank card that isn't backed by a file.
+func NewMemoryCard() *MemoryCard {
+	return &MemoryCard{
+		data: make([]byte, MemoryCardSize),
+		flag: memoryCardFlagFresh,
+	}
+}
+
+// OpenMemoryCard loads the card image at path. A blank image is created on the
+// first write if the file doesn't exist.
+func OpenMemoryCard(path string) (*MemoryCard, error) {
+	card := NewMemoryCard()
+	card.path = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return card, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) != MemoryCardSize {
+		return nil, fmt.Errorf("memory card %s: size must be exactly 128 KiB, got %d bytes", path, len(data))
+	}
+
+	copy(card.data, data)
+	return card, nil
+}
+
+// Data returns the raw card contents.
+func (card *MemoryCard) Data() []byte {
+	return card.data
+}
+
+// Path returns the file backing the card, or an empty string.
+func (card *MemoryCard) Path() string {
+	return card.path
+}
+
+// Flush writes the card image to its file. The image is written to a
+// temporary file first and then renamed over the old one, so that a crash
+// never leaves a truncated card behind.
+func (card *MemoryCard) Flush() error {
+	if card.path == "" {
+		return nil
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(card.path), filepath.Base(card.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(card.data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), card.path)
+}
+
+// writeBack flushes the image after the guest wrote a sector.
+func (card *MemoryCard) writeBack() {
+	if err := card.Flush(); err != nil && card.err == nil {
+		card.err = err
+	}
+}
+
+// Err returns the first error writing the image back to its file after the
+// guest wrote a sector.
+func (card *MemoryCard) Err() error {
+	return card.err
+}
+
+// insert resets the card to the state it has right after being plugged in.
+func (card *MemoryCard) insert() {
+	card.flag = memoryCardFlagFresh
+	card.Deselect()
+}
+
+func (card *MemoryCard) Transfer(value uint8) (uint8, bool) {
+	position := card.position
+	card.position++
+
+	switch position {
+	case 0:
+		return 0xFF, true
+	case 1:
+		card.command = value
+		switch value {
+		case 'R', 'W', 'S':
+			return card.flag, true
+		}
+		return card.flag, false
+	}
+
+	switch card.command {
+	case 'R':
+		return card.read(position, value)
+	case 'W':
+		return card.write(position, value)
+	case 'S':
+		return card.identify(position)
+	}
+
+	return 0xFF, false
+}
+
+func (card *MemoryCard) receiveAddress(position int, value uint8) uint8 {
+	reply := card.previous
+	if position == 4 {
+		card.sector = uint16(value) << 8
+		card.checksum = value
+		reply = 0x00
+	} else {
+		card.sector |= uint16(value)
+		card.checksum ^= value
+	}
+	card.previous = value
+	return reply
+}
+
+func (card *MemoryCard) validSector() bool {
+	return card.sector < MemoryCardSectors
+}
+
+func (card *MemoryCard) read(position int, value uint8) (uint8, bool) {
+	const data = 10
+
+	switch {
+	case position == 2:
+		return 0x5A, true
+	case position == 3:
+		return 0x5D, true
+	case position == 4 || position == 5:
+		return card.receiveAddress(position, value), true
+	case position == 6:
+		return 0x5C, true
+	case position == 7:
+		return 0x5D, true
+	case position == 8:
+		if !card.validSector() {
+			return 0xFF, true
+		}
+		return uint8(card.sector >> 8), true
+	case position == 9:
+		if !card.validSector() {
+			return 0xFF, false
+		}
+		return uint8(card.sector), true
+	case position < data+MemoryCardSectorSize:
+		b := card.data[int(card.sector)*MemoryCardSectorSize+position-data]
+		card.checksum ^= b
+		return b, true
+	case position == data+MemoryCardSectorSize:
+		return card.checksum, true
+	case position == data+MemoryCardSectorSize+1:
+		return memoryCardGood, false
+	}
+
+	return 0xFF, false
+}
+
+func (card *MemoryCard) write(position int, value uint8) (uint8, bool) {
+	const data = 6
+
+	switch {
+	case position == 2:
+		return 0x5A, true
+	case position == 3:
+		return 0x5D, true
+	case position == 4 || position == 5:
+		return card.receiveAddress(position, value), true
+	case position < data+MemoryCardSectorSize:
+		card.buffer[position-data] = value
+		card.checksum ^= value
+		reply := card.previous
+		card.previous = value
+		return reply, true
+	case position == data+MemoryCardSectorSize:
+		card.checksum ^= value
+		reply := card.previous
+		card.previous = value
+		return reply, true
+	case position == data+MemoryCardSectorSize+1:
+		return 0x5C, true
+	case position == data+MemoryCardSectorSize+2:
+		return 0x5D, true
+	case position == data+MemoryCardSectorSize+3:
+		return card.commit(), false
+	}
+
+	return 0xFF, false
+}
+
+// commit stores the received sector and returns the memory end byte. The
+// received checksum has been xored into card.checksum, so it is zero when the
+// sector was transferred correctly.
+func (card *MemoryCard) commit() uint8 {
+	if !card.validSector() {
+		card.flag |= memoryCardFlagError
+		return memoryCardBadSector
+	}
+	if card.checksum != 0 {
+		card.flag |= memoryCardFlagError
+		return memoryCardBadChecksum
+	}
+
+	card.flag &^= memoryCardFlagFresh | memoryCardFlagError
+	copy(card.data[int(card.sector)*MemoryCardSectorSize:], card.buffer[:])
+	card.writeBack()
+	return memoryCardGood
+}
+
+func (card *MemoryCard) identify(position int) (uint8, bool) {
+	reply := []uint8{0x5A, 0x5D, 0x5C, 0x5D, 0x04, 0x00, 0x00, 0x80}
+	index := position - 2
+	if index >= len(reply) {
+		return 0xFF, false
+	}
+	return reply[index], index < len(reply)-1
+}
+
+func (card *MemoryCard) Deselect() {
+	card.position = 0
+	card.previous = 0
+}
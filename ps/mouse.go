@@ -0,0 +1,112 @@
+package ps
+
+const IDMouse = 0x5A12
+
+// MouseMotion is a relative movement. Positive values move right and down.
+type MouseMotion struct {
+	DX, DY int
+}
+
+// Mouse is the SCPH-1090 mouse. Movement accumulates between reads and is
+// reported as signed 8-bit deltas; whatever doesn't fit is carried over to the
+// next read.
+// http://problemkaputt.de/psx-spx.htm#controllersmouse
+type Mouse struct {
+	left, right bool
+
+	dx, dy int
+
+	// script holds motions that are applied one per read, before the
+	// accumulated movement.
+	script []MouseMotion
+
+	position int
+	response []uint8
+}
+
+func NewMouse() *Mouse {
+	return &Mouse{}
+}
+
+// Move adds host mouse motion.
+func (mouse *Mouse) Move(dx, dy int) {
+	mouse.dx += dx
+	mouse.dy += dy
+}
+
+// Enqueue schedules motions to be reported by successive reads, e.g. to replay
+// scripted input.
+func (mouse *Mouse) Enqueue(motions ...MouseMotion) {
+	mouse.script = append(mouse.script, motions...)
+}
+
+// SetButtons sets the state of the left and right button.
+func (mouse *Mouse) SetButtons(left, right bool) {
+	mouse.left, mouse.right = left, right
+}
+
+func clampDelta(value int) int {
+	switch {
+	case value < -128:
+		return -128
+	case value > 127:
+		return 127
+	}
+	return value
+}
+
+// motion takes the next delta to report.
+func (mouse *Mouse) motion() (int8, int8) {
+	if len(mouse.script) > 0 {
+		mouse.Move(mouse.script[0].DX, mouse.script[0].DY)
+		mouse.script = mouse.script[1:]
+	}
+
+	dx, dy := clampDelta(mouse.dx), clampDelta(mouse.dy)
+	mouse.dx -= dx
+	mouse.dy -= dy
+	return int8(dx), int8(dy)
+}
+
+func (mouse *Mouse) buttons() uint8 {
+	// Bits 8-9 of the button halfword are always zero.
+	value := uint8(0xFC)
+	if mouse.right {
+		value &^= 1 << 2
+	}
+	if mouse.left {
+		value &^= 1 << 3
+	}
+	return value
+}
+
+func (mouse *Mouse) Transfer(value uint8) (uint8, bool) {
+	position := mouse.position
+	mouse.position++
+
+	switch position {
+	case 0:
+		return 0xFF, true
+	case 1:
+		if value != 0x42 {
+			return 0xFF, false
+		}
+		dx, dy := mouse.motion()
+		mouse.response = []uint8{
+			uint8(IDMouse & 0xFF), uint8(IDMouse >> 8),
+			0xFF, mouse.buttons(),
+			uint8(dx), uint8(dy),
+		}
+	}
+
+	index := position - 1
+	if index >= len(mouse.response) {
+		return 0xFF, false
+	}
+	return mouse.response[index], index < len(mouse.response)-1
+}
+
+func (mouse *Mouse) Deselect() {
+	mouse.position = 0
+	mouse.response = nil
+}
@@ -0,0 +1,187 @@
+package ps
+
+const multitapID = 0x80
+
+// multitapPadBytes is the size of each sub-port's record in a multi-read.
+const multitapPadBytes = 8
+
+// Multitap is the SCPH-1070 adapter that connects four controllers and four
+// memory cards to a single port. Sub-ports A-D are addressed with 01h-04h and
+// 81h-84h. Sending 01h as the third byte of a read from sub-port A makes the
+// next read from sub-port A return the state of all four controllers.
+// http://problemkaputt.de/psx-spx.htm#controllersmultitapadapter
+type Multitap struct {
+	Controllers [4]Controller
+	MemoryCards [4]*MemoryCard
+
+	// multiNext is latched into multi at the start of each transfer.
+	multi     bool
+	multiNext bool
+
+	position int
+	address  uint8
+	command  uint8
+	sub      Controller
+	subDone  bool
+
+	// bus is the bus the tap is plugged into, if any.
+	bus *Bus
+}
+
+func NewMultitap() *Multitap {
+	return &Multitap{}
+}
+
+// Connect plugs c into sub-port 0-3 (A-D). Passing nil disconnects it.
+func (tap *Multitap) Connect(subPort int, c Controller) {
+	if tap.bus == nil {
+		tap.Controllers[subPort] = c
+		return
+	}
+	bus := tap.bus
+	tap.unplug(bus)
+	tap.Controllers[subPort] = c
+	tap.plug(bus)
+}
+
+// plug passes the bus on to the controllers in the sub-ports.
+func (tap *Multitap) plug(bus *Bus) {
+	tap.bus = bus
+	for _, c := range tap.Controllers {
+		if c, ok := c.(pluggable); ok {
+			c.plug(bus)
+		}
+	}
+}
+
+func (tap *Multitap) unplug(bus *Bus) {
+	for _, c := range tap.Controllers {
+		if c, ok := c.(pluggable); ok {
+			c.unplug(bus)
+		}
+	}
+	tap.bus = nil
+}
+
+// InsertMemoryCard puts card into the memory card slot of sub-port 0-3.
+// Passing nil removes the card.
+func (tap *Multitap) InsertMemoryCard(subPort int, card *MemoryCard) {
+	tap.Deselect()
+	if card != nil {
+		card.insert()
+	}
+	tap.MemoryCards[subPort] = card
+}
+
+func (tap *Multitap) Accepts(address uint8) bool {
+	return (address >= 0x01 && address <= 0x04) || (address >= 0x81 && address <= 0x84)
+}
+
+// device returns the controller or card plugged into the addressed sub-port.
+func (tap *Multitap) device(address uint8) Controller {
+	index := int(address&0x7F) - 1
+	if address&0x80 != 0 {
+		if card := tap.MemoryCards[index]; card != nil {
+			return card
+		}
+		return nil
+	}
+	return tap.Controllers[index]
+}
+
+func (tap *Multitap) Transfer(value uint8) (uint8, bool) {
+	position := tap.position
+	tap.position++
+
+	if position == 0 {
+		tap.address = value
+		tap.multi = tap.multiNext && value == AddressController
+		tap.sub = tap.device(value)
+		if tap.multi {
+			return 0xFF, true
+		}
+		if tap.sub == nil {
+			return 0xFF, false
+		}
+		// Devices behind the multitap see the usual unnumbered address.
+		return tap.sub.Transfer(value&0x80 | AddressController)
+	}
+
+	if position == 1 {
+		tap.command = value
+	}
+	if position == 2 && tap.address == AddressController && tap.command == 0x42 {
+		tap.multiNext = value == 0x01
+	}
+
+	if tap.multi {
+		return tap.multiRead(position, value)
+	}
+
+	if tap.subDone {
+		return 0xFF, false
+	}
+	reply, ack := tap.sub.Transfer(value)
+	tap.subDone = !ack
+	return reply, ack
+}
+
+// multiRead returns the reply to the 42h command in multitap mode: the
+// multitap ID followed by an 8-byte record for each sub-port.
+func (tap *Multitap) multiRead(position int, value uint8) (uint8, bool) {
+	switch position {
+	case 1:
+		if value != 0x42 {
+			return 0xFF, false
+		}
+		return multitapID, true
+	case 2:
+		return 0x5A, true
+	}
+
+	index := position - 3
+	last := index == 4*multitapPadBytes-1
+	if index >= 4*multitapPadBytes {
+		return 0xFF, false
+	}
+
+	pad := tap.Controllers[index/multitapPadBytes]
+	offset := index % multitapPadBytes
+	if pad == nil {
+		return 0xFF, !last
+	}
+
+	// Each record is a complete 42h read of the sub-port's controller.
+	switch offset {
+	case 0:
+		pad.Deselect()
+		pad.Transfer(AddressController)
+		tap.subDone = false
+		value = 0x42
+	case 1:
+		value = 0x00
+	}
+
+	reply := uint8(0xFF)
+	if !tap.subDone {
+		var ack bool
+		reply, ack = pad.Transfer(value)
+		tap.subDone = !ack
+	}
+
+	if offset == multitapPadBytes-1 {
+		pad.Deselect()
+	}
+
+	return reply, !last
+}
+
+func (tap *Multitap) Deselect() {
+	if tap.sub != nil {
+		tap.sub.Deselect()
+	}
+	tap.position = 0
+	tap.sub = nil
+	tap.subDone = false
+	tap.multi = false
+}
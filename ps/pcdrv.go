@@ -0,0 +1,164 @@
+package ps
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// BREAK codes of the PCdrv functions used by PsyQ and PSn00bSDK. Arguments
+// are passed in $a1-$a3, $v0 is 0 on success and -1 on failure and $v1 holds
+// the result.
+const (
+	pcdrvInit  = 0x101
+	pcdrvCreat = 0x102
+	pcdrvOpen  = 0x103
+	pcdrvClose = 0x104
+	pcdrvRead  = 0x105
+	pcdrvWrite = 0x106
+	pcdrvSeek  = 0x107
+)
+
+const pcdrvFileCount = 32
+
+// PCdrv gives programs access to the files in a host directory. Paths can't
+// name files outside of it.
+type PCdrv struct {
+	root  string
+	files [pcdrvFileCount]*os.File
+}
+
+func NewPCdrv(root string) *PCdrv {
+	return &PCdrv{root: root}
+}
+
+// Close closes the files left open by the program.
+func (drv *PCdrv) Close() {
+	for fd, file := range drv.files {
+		if file != nil {
+			file.Close()
+			drv.files[fd] = nil
+		}
+	}
+}
+
+// path maps a guest path below the root. Both slashes and backslashes
+// separate directories and ".." stops at the root.
+func (drv *PCdrv) path(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	return filepath.Join(drv.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (drv *PCdrv) file(fd uint32) *os.File {
+	if fd >= pcdrvFileCount {
+		return nil
+	}
+	return drv.files[fd]
+}
+
+func (drv *PCdrv) open(name string, flag int) (uint32, error) {
+	for fd := range drv.files {
+		if drv.files[fd] != nil {
+			continue
+		}
+		file, err := os.OpenFile(drv.path(name), flag, 0644)
+		if err != nil {
+			return 0, err
+		}
+		drv.files[fd] = file
+		return uint32(fd), nil
+	}
+	return 0, os.ErrInvalid
+}
+
+// handle runs the PCdrv function for a BREAK code and reports whether the
+// code was one.
+func (drv *PCdrv) handle(cpu *CPU, bus *Bus, code uint32) bool {
+	a1, a2, a3 := cpu.GPR[5], cpu.GPR[6], cpu.GPR[7]
+
+	var result uint32
+	var err error
+	switch code {
+	case pcdrvInit:
+		drv.Close()
+	case pcdrvCreat:
+		result, err = drv.open(readString(bus, a1), os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	case pcdrvOpen:
+		flag := os.O_RDONLY
+		switch a2 & 3 {
+		case 1:
+			flag = os.O_WRONLY
+		case 2:
+			flag = os.O_RDWR
+		}
+		result, err = drv.open(readString(bus, a1), flag)
+	case pcdrvClose:
+		file := drv.file(a1)
+		if file == nil {
+			err = os.ErrInvalid
+			break
+		}
+		drv.files[a1] = nil
+		err = file.Close()
+	case pcdrvRead:
+		file := drv.file(a1)
+		if file == nil {
+			err = os.ErrInvalid
+			break
+		}
+		// The size comes from the guest, so copy through a fixed buffer.
+		var buffer [4096]byte
+		for result < a2 {
+			chunk := buffer[:]
+			if a2-result < uint32(len(chunk)) {
+				chunk = chunk[:a2-result]
+			}
+			n, readErr := io.ReadFull(file, chunk)
+			bus.write(a3+result, chunk[:n])
+			result += uint32(n)
+			if readErr != nil {
+				if readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+					err = readErr
+				}
+				break
+			}
+		}
+	case pcdrvWrite:
+		file := drv.file(a1)
+		if file == nil {
+			err = os.ErrInvalid
+			break
+		}
+		data, ok := readBytes(bus, a3, a2)
+		if !ok {
+			err = os.ErrInvalid
+			break
+		}
+		var n int
+		n, err = file.Write(data)
+		result = uint32(n)
+	case pcdrvSeek:
+		file := drv.file(a1)
+		if file == nil {
+			err = os.ErrInvalid
+			break
+		}
+		var offset int64
+		offset, err = file.Seek(int64(int32(a2)), int(a3))
+		result = uint32(offset)
+	default:
+		return false
+	}
+
+	if err != nil {
+		bus.logf("pcdrv: %v", err)
+		cpu.SetGPR(2, 0xFFFFFFFF)
+		cpu.SetGPR(3, 0xFFFFFFFF)
+		return true
+	}
+	cpu.SetGPR(2, 0)
+	cpu.SetGPR(3, result)
+	return true
+}
@@ -0,0 +1,40 @@
+package ps
+
+import (
+	"bytes"
+	"debug/elf"
+	"os"
+)
+
+// ShellAddress is where the BIOS jumps to start the shell once the kernel is
+// initialized. Side-loaded programs are started from there.
+const ShellAddress = 0x80030000
+
+// Program is an executable that can be side-loaded, such as an EXE or ELF.
+type Program interface {
+	// Load copies the program into memory, sets up the registers and jumps
+	// to its entry point.
+	Load(cpu *CPU, bus *Bus)
+}
+
+// FastBoot loads program when the BIOS is about to start the shell, skipping
+// the boot intro while leaving the kernel initialized.
+func FastBoot(cpu *CPU, program Program) {
+	var remove func()
+	remove = cpu.AddHook(ShellAddress, func(cpu *CPU, bus *Bus) {
+		remove()
+		program.Load(cpu, bus)
+	})
+}
+
+// OpenProgram opens a PS-X EXE or an ELF file.
+func OpenProgram(path string) (Program, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		return ParseELF(data)
+	}
+	return ParseEXE(data)
+}
@@ -1,7 +1,24 @@
 package ps
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/weqqr/ps/asm"
 )
 
 func assertEqual(t *testing.T, actual interface{}, expected interface{}) {
@@ -28,10 +45,47 @@ func TestInstructionDecoding(t *testing.T) {
 
 		Address: 0x0234ABCD,
 	})
+
+	// Operands print in source order.
+	for word, expected := range map[uint32]string{
+		0x01090018: "MULT    $8, $9",
+		0x01090019: "MULTU   $8, $9",
+		0x0109001A: "DIV     $8, $9",
+		0x0109001B: "DIVU    $8, $9",
+		0x01095022: "SUB     $10, $8, $9",
+		0x01095023: "SUBU    $10, $8, $9",
+	} {
+		assertEqual(t, NewInstruction(word).String(), expected)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	for word, expected := range map[uint32]string{
+		0x00000000: "NOP",
+		0x00808021: "MOVE    $s0, $a0",
+		0x2408FFFF: "ADDIU   $t0, $zero, -1h",
+		0x8FBF0010: "LW      $ra, 10h($sp)",
+		0x0480FFFF: "BLTZ    $a0, 80010000h",
+		0x04110004: "BGEZAL  $zero, 80010014h",
+		0x40086000: "MFC0    $t0, SR",
+		0x408C7000: "MTC0    $t4, EPC",
+		0x42000010: "RFE",
+		0x4848F800: "CFC2    $t0, FLAG",
+		0x4A180001: "RTPS    sf=1, lm=0",
+		0x4A0B2012: "MVMVA   sf=1, mx=LLM, v=V2, cv=BK, lm=0",
+		0xCBA90004: "LWC2    IR1, 4h($sp)",
+		0xFC000000: ".word   FC000000h",
+	} {
+		assertEqual(t, Disassemble(0x80010000, word, nil).String(), expected)
+	}
+
+	d := Disassemble(0x80010000, 0x0C004010, nil)
+	assertEqual(t, d.Target, uint32(0x80010040))
+	assertEqual(t, d.HasTarget, true)
 }
 
 func TestLoadStore(t *testing.T) {
-	bus := NewBus(make([]byte, 512*1024))
+	bus := newBus(t)
 
 	var addr uint32 = 0xBFC01234
 
@@ -47,3 +101,1828 @@ func TestLoadStore(t *testing.T) {
 	assertEqual(t, bus.LoadHalfword(addr+5), uint16(0xEA5A))
 	assertEqual(t, bus.LoadByte(addr), uint8(0x34))
 }
+
+// runProgram assembles source at 80010000h and steps through it until the
+// PC reaches the end of the code.
+func runProgram(t *testing.T, source string) (*CPU, *Bus) {
+	t.Helper()
+	bus := newBus(t)
+	cpu := NewCPU()
+	program := asm.MustAssemble(0x80010000, source)
+	bus.Write(program.Origin, program.Code)
+	cpu.Jump(program.Origin)
+
+	end := program.Origin + uint32(len(program.Code))
+	for i := 0; cpu.Pc != end; i++ {
+		if i == 1000 {
+			t.Fatalf("the program didn't reach %08Xh", end)
+		}
+		if err := cpu.Step(bus); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &cpu, bus
+}
+
+func TestBranches(t *testing.T) {
+	// Every taken branch lands on an instruction that sets a bit in $s1 and
+	// skips one that sets a bit in $s0.
+	cpu, _ := runProgram(t, `
+	.set noreorder
+	li    $t0, -1
+	li    $t1, 1
+	bltz  $t0, a
+	nop
+	ori   $s0, $s0, 1
+a:	ori   $s1, $s1, 1
+	bgez  $zero, b
+	nop
+	ori   $s0, $s0, 2
+b:	ori   $s1, $s1, 2
+	blez  $t0, c
+	nop
+	ori   $s0, $s0, 4
+c:	ori   $s1, $s1, 4
+	bgtz  $t1, d
+	nop
+	ori   $s0, $s0, 8
+d:	ori   $s1, $s1, 8
+	beq   $t0, $t0, e
+	nop
+	ori   $s0, $s0, 16
+e:	ori   $s1, $s1, 16
+	bne   $t0, $t1, f
+	nop
+	ori   $s0, $s0, 32
+f:	ori   $s1, $s1, 32
+	.word 0x05020002     # BCOND rt=02h is BLTZ $t0
+	nop
+	ori   $s0, $s0, 64
+	ori   $s1, $s1, 64
+	.word 0x04030002     # BCOND rt=03h is BGEZ $zero
+	nop
+	ori   $s0, $s0, 128
+	ori   $s1, $s1, 128
+`)
+	assertEqual(t, cpu.GetGPR(16), uint32(0))
+	assertEqual(t, cpu.GetGPR(17), uint32(0xFF))
+}
+
+func TestLinks(t *testing.T) {
+	cpu, _ := runProgram(t, `
+	.set noreorder
+	jal   f1
+	nop
+	la    $t2, f2
+	jalr  $s6, $t2
+	nop
+	bltzal $zero, end     # not taken, but links
+	nop
+	move  $s3, $ra
+	bgezal $zero, f1
+	nop
+	b     end
+	nop
+f1:	jr    $ra
+	move  $s0, $ra
+f2:	jr    $s6
+	move  $s1, $s6
+end:
+`)
+	// The return address skips the delay slot.
+	assertEqual(t, cpu.GetGPR(16), uint32(0x8001002C))
+	assertEqual(t, cpu.GetGPR(17), uint32(0x80010018))
+	assertEqual(t, cpu.GetGPR(19), uint32(0x80010020))
+}
+
+func TestArithmetic(t *testing.T) {
+	cpu, _ := runProgram(t, `
+	li    $t0, -1
+	li    $t1, 1
+	slt   $s0, $t0, $t1
+	sltu  $s1, $t0, $t1
+	slti  $s2, $t0, 0
+	sltiu $s3, $t1, -1
+	sltu  $s4, $zero, $t1
+	addiu $zero, $zero, 5
+	move  $s5, $zero
+	li    $t0, -2
+	li    $t1, 3
+	mult  $t0, $t1
+	mflo  $s6
+	mfhi  $s7
+`)
+	assertEqual(t, cpu.GetGPR(16), uint32(1))
+	assertEqual(t, cpu.GetGPR(17), uint32(0))
+	assertEqual(t, cpu.GetGPR(18), uint32(1))
+	assertEqual(t, cpu.GetGPR(19), uint32(1))
+	assertEqual(t, cpu.GetGPR(20), uint32(1))
+	assertEqual(t, cpu.GetGPR(21), uint32(0))
+	assertEqual(t, cpu.GetGPR(22), uint32(0xFFFFFFFA))
+	assertEqual(t, cpu.GetGPR(23), uint32(0xFFFFFFFF))
+}
+
+func TestDivision(t *testing.T) {
+	// Division by zero and overflow don't trap and give fixed results.
+	// http://problemkaputt.de/psx-spx.htm#cpuarithmeticinstructions
+	for _, test := range []struct {
+		n, d     int32
+		unsigned bool
+		lo, hi   uint32
+	}{
+		{7, 2, false, 3, 1},
+		{-7, 2, false, 0xFFFFFFFD, 0xFFFFFFFF},
+		{7, 0, false, 0xFFFFFFFF, 7},
+		{-7, 0, false, 1, 0xFFFFFFF9},
+		{-0x80000000, -1, false, 0x80000000, 0},
+		{7, 0, true, 0xFFFFFFFF, 7},
+		{-1, 2, true, 0x7FFFFFFF, 1},
+	} {
+		op := "div"
+		if test.unsigned {
+			op = "divu"
+		}
+		cpu, _ := runProgram(t, fmt.Sprintf(`
+	li    $t0, %d
+	li    $t1, %d
+	%s   $t0, $t1
+	mflo  $s0
+	mfhi  $s1
+`, test.n, test.d, op))
+		assertEqual(t, cpu.GetGPR(16), test.lo)
+		assertEqual(t, cpu.GetGPR(17), test.hi)
+	}
+}
+
+func TestUnalignedAccess(t *testing.T) {
+	cpu, bus := runProgram(t, `
+	lui   $a0, 0x8002
+	li    $t0, 0x11223344
+	sw    $t0, 0($a0)
+	li    $t0, 0x55667788
+	sw    $t0, 4($a0)
+	lwr   $s0, 1($a0)
+	lwl   $s0, 4($a0)
+	lwl   $s1, 5($a0)         # only the upper half changes
+	nop
+	li    $t0, -1
+	sw    $t0, 8($a0)
+	sw    $t0, 12($a0)
+	li    $t0, 0xAABBCCDD
+	swr   $t0, 9($a0)
+	swl   $t0, 12($a0)
+	nop
+`)
+	assertEqual(t, cpu.GetGPR(16), uint32(0x88112233))
+	assertEqual(t, cpu.GetGPR(17), uint32(0x77880000))
+	assertEqual(t, bus.LoadWord(0x80020008), uint32(0xBBCCDDFF))
+	assertEqual(t, bus.LoadWord(0x8002000C), uint32(0xFFFFFFAA))
+}
+
+func TestExceptions(t *testing.T) {
+	bus := newBus(t)
+	cpu := NewCPU()
+	program := asm.MustAssemble(0x80010000, `
+	.set noreorder
+	syscall
+	b     .
+	break
+	li    $t0, 0x3C
+	mtc0  $t0, $12
+	rfe
+	mfc0  $s0, $12
+	nop
+`)
+	bus.Write(program.Origin, program.Code)
+	cause := func() uint32 { return (cpu.COP0R[COP0Cause] >> 2) & 0x1F }
+
+	cpu.Jump(0x80010000)
+	assertEqual(t, cpu.Step(bus), nil)
+	assertEqual(t, cpu.Pc, uint32(ExceptionVector))
+	assertEqual(t, cause(), uint32(ExceptionSyscall))
+	assertEqual(t, cpu.COP0R[COP0EPC], uint32(0x80010000))
+	assertEqual(t, cpu.COP0R[COP0Cause]&causeBranchDelay, uint32(0))
+
+	// An exception in a delay slot returns to the branch.
+	cpu.Jump(0x80010004)
+	cpu.Step(bus)
+	cpu.Step(bus)
+	assertEqual(t, cpu.Pc, uint32(ExceptionVector))
+	assertEqual(t, cause(), uint32(ExceptionBreakpoint))
+	assertEqual(t, cpu.COP0R[COP0EPC], uint32(0x80010004))
+	assertEqual(t, cpu.COP0R[COP0Cause]&causeBranchDelay, uint32(causeBranchDelay))
+
+	// RFE pops the interrupt enable and mode bits.
+	cpu.Jump(0x8001000C)
+	for i := 0; i < 6; i++ {
+		cpu.Step(bus)
+	}
+	assertEqual(t, cpu.GetGPR(16), uint32(0x3F))
+
+	// A pending interrupt is taken instead of the next instruction when IEc
+	// and its IM bit are set, and the step runs the first instruction of the
+	// handler.
+	cpu.Jump(0x80010000)
+	bus.Interrupts().Mask = 1 << IRQVBlank
+	bus.Interrupts().Request(IRQVBlank)
+	cpu.COP0R[COP0SR] = 0x401
+	cpu.Step(bus)
+	assertEqual(t, cpu.Pc, uint32(ExceptionVector+4))
+	assertEqual(t, cause(), uint32(ExceptionInterrupt))
+	assertEqual(t, cpu.COP0R[COP0EPC], uint32(0x80010000))
+	assertEqual(t, cpu.COP0R[COP0SR]&1, uint32(0))
+
+	// An interrupt right after a load keeps the loaded value.
+	bus.StoreWord(0x80000100, 0xCAFE)
+	bus.StoreWord(0x80020000, 0x8C0B0100) // lw $t3, 0x100($zero)
+	cpu.Jump(0x80020000)
+	cpu.COP0R[COP0SR] = 0
+	cpu.Step(bus)
+	assertEqual(t, cpu.GetGPR(11), uint32(0))
+	cpu.COP0R[COP0SR] = 0x401
+	cpu.Step(bus)
+	assertEqual(t, cpu.Pc, uint32(ExceptionVector+4))
+	assertEqual(t, cpu.COP0R[COP0EPC], uint32(0x80020004))
+	assertEqual(t, cpu.GetGPR(11), uint32(0xCAFE))
+}
+
+func TestHooks(t *testing.T) {
+	bus := newBus(t)
+	cpu := NewCPU()
+	program := asm.MustAssemble(0x80010000, `
+load:	lw    $t2, 0x100($zero)
+from:	li    $t0, 1
+to:	li    $t1, 2
+`)
+	bus.Write(program.Origin, program.Code)
+	from, to := program.Labels["from"], program.Labels["to"]
+
+	var calls int
+	remove := cpu.AddHook(from, func(cpu *CPU, bus *Bus) { cpu.Jump(to) })
+	cpu.AddHook(to, func(cpu *CPU, bus *Bus) { calls++ })
+
+	// A redirecting hook ends the cycle, and the next one runs the hooks at
+	// the new address before its instruction.
+	cpu.Jump(from)
+	cpu.Cycle(bus)
+	assertEqual(t, cpu.Pc, to)
+	assertEqual(t, calls, 0)
+	assertEqual(t, cpu.GetGPR(8), uint32(0))
+	cpu.Cycle(bus)
+	assertEqual(t, calls, 1)
+	assertEqual(t, cpu.GetGPR(9), uint32(2))
+	assertEqual(t, cpu.Pc, to+4)
+
+	// Debuggers stop at the new address.
+	d := NewDebugger(&cpu, bus)
+	d.AddBreakpoint(to)
+	cpu.Jump(from)
+	assertEqual(t, d.Continue().Reason, StopBreakpoint)
+	assertEqual(t, cpu.Pc, to)
+	assertEqual(t, calls, 1)
+
+	// A load before the redirect isn't lost.
+	bus.StoreWord(0x80000100, 0xCAFE)
+	cpu.Jump(program.Labels["load"])
+	cpu.Cycle(bus)
+	cpu.Cycle(bus)
+	assertEqual(t, cpu.Pc, to)
+	assertEqual(t, cpu.GetGPR(10), uint32(0xCAFE))
+
+	remove()
+	cpu.Jump(from)
+	cpu.Cycle(bus)
+	assertEqual(t, cpu.GetGPR(8), uint32(1))
+}
+
+// newBus returns a bus with an empty BIOS.
+func newBus(t *testing.T) *Bus {
+	t.Helper()
+	bus, err := NewBus(make([]byte, BIOSSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bus
+}
+
+// exchange selects the controller port, sends packet over SIO0 and returns the
+// bytes received until the device stops acknowledging.
+func exchange(bus *Bus, port int, packet ...uint8) []uint8 {
+	bus.StoreHalfword(JoypadPort+0xA, uint16(0x1003|port<<13))
+	defer bus.StoreHalfword(JoypadPort+0xA, 0)
+
+	var reply []uint8
+	for _, value := range packet {
+		bus.StoreByte(JoypadPort, value)
+		for bus.LoadWord(JoypadPort+4)&0x2 == 0 {
+			bus.Tick(CyclesPerInstruction)
+		}
+		reply = append(reply, bus.LoadByte(JoypadPort))
+
+		acked := false
+		for i := 0; i < 1000 && !acked; i++ {
+			bus.Tick(CyclesPerInstruction)
+			acked = bus.LoadWord(JoypadPort+4)&0x80 != 0
+		}
+		if !acked {
+			break
+		}
+	}
+	return reply
+}
+
+func assertBytes(t *testing.T, actual []uint8, expected ...uint8) {
+	t.Helper()
+	if string(actual) != string(expected) {
+		t.Fatalf("assertion failed: % X != % X", actual, expected)
+	}
+}
+
+func TestDualShock(t *testing.T) {
+	bus := newBus(t)
+	pad := NewDualShock()
+	bus.ConnectController(0, pad)
+
+	pad.SetButton(ButtonCross, true)
+	assertBytes(t, exchange(bus, 0, 0x01, 0x42, 0x00, 0x00, 0x00), 0xFF, 0x41, 0x5A, 0xFF, 0xBF)
+	assertBytes(t, exchange(bus, 1, 0x01, 0x42), 0xFF)
+
+	// Enter config mode, force analog mode and lock it
+	exchange(bus, 0, 0x01, 0x43, 0x00, 0x01, 0x00)
+	assertBytes(t, exchange(bus, 0, 0x01, 0x44, 0x00, 0x01, 0x03, 0, 0, 0, 0),
+		0xFF, 0xF3, 0x5A, 0, 0, 0, 0, 0, 0)
+	assertBytes(t, exchange(bus, 0, 0x01, 0x45, 0x00, 0, 0, 0, 0, 0, 0),
+		0xFF, 0xF3, 0x5A, 0x01, 0x02, 0x01, 0x02, 0x01, 0x00)
+	assertBytes(t, exchange(bus, 0, 0x01, 0x46, 0x00, 0x01, 0, 0, 0, 0, 0),
+		0xFF, 0xF3, 0x5A, 0x00, 0x00, 0x01, 0x01, 0x01, 0x14)
+	exchange(bus, 0, 0x01, 0x4D, 0x00, 0x00, 0x01, 0xFF, 0xFF, 0xFF, 0xFF)
+	exchange(bus, 0, 0x01, 0x43, 0x00, 0x00, 0, 0, 0, 0, 0)
+
+	pad.PressAnalog()
+	assertEqual(t, pad.Analog(), true)
+
+	pad.SetAxis(AxisLeftX, 0xFF)
+	assertBytes(t, exchange(bus, 0, 0x01, 0x42, 0x00, 0xFF, 0x40, 0, 0, 0, 0),
+		0xFF, 0x73, 0x5A, 0xFF, 0xBF, 0x80, 0x80, 0xFF, 0x80)
+
+	small, large := pad.Motors()
+	assertEqual(t, small, uint8(0xFF))
+	assertEqual(t, large, uint8(0x40))
+}
+
+func TestMemoryCard(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "card.mcr")
+	card, err := OpenMemoryCard(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus := newBus(t)
+	bus.InsertMemoryCard(1, card)
+
+	assertBytes(t, exchange(bus, 1, 0x81, 'S', 0, 0, 0, 0, 0, 0, 0, 0),
+		0xFF, 0x08, 0x5A, 0x5D, 0x5C, 0x5D, 0x04, 0x00, 0x00, 0x80)
+
+	sector := make([]uint8, MemoryCardSectorSize)
+	checksum := uint8(0x00 ^ 0x3F)
+	for i := range sector {
+		sector[i] = uint8(i)
+		checksum ^= sector[i]
+	}
+
+	packet := append([]uint8{0x81, 'W', 0, 0, 0x00, 0x3F}, sector...)
+	packet = append(packet, checksum, 0, 0, 0)
+	reply := exchange(bus, 1, packet...)
+	assertBytes(t, reply[len(reply)-3:], 0x5C, 0x5D, 0x47)
+
+	packet = append([]uint8{0x81, 'R', 0, 0, 0x00, 0x3F, 0, 0, 0, 0}, make([]uint8, MemoryCardSectorSize+2)...)
+	reply = exchange(bus, 1, packet...)
+	assertBytes(t, reply[:10], 0xFF, 0x00, 0x5A, 0x5D, 0x00, 0x00, 0x5C, 0x5D, 0x00, 0x3F)
+	assertBytes(t, reply[10:10+MemoryCardSectorSize], sector...)
+	assertBytes(t, reply[10+MemoryCardSectorSize:], checksum, 0x47)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertBytes(t, data[0x3F*MemoryCardSectorSize:0x40*MemoryCardSectorSize], sector...)
+}
+
+func TestMultitap(t *testing.T) {
+	bus := newBus(t)
+	tap := NewMultitap()
+	bus.ConnectController(0, tap)
+
+	pads := []*DigitalPad{NewDigitalPad(), nil, NewDigitalPad(), nil}
+	for i, pad := range pads {
+		if pad != nil {
+			tap.Connect(i, pad)
+		}
+	}
+	pads[2].SetButton(ButtonStart, true)
+	tap.InsertMemoryCard(3, NewMemoryCard())
+
+	assertBytes(t, exchange(bus, 0, 0x03, 0x42, 0x00, 0x00, 0x00), 0xFF, 0x41, 0x5A, 0xF7, 0xFF)
+	assertBytes(t, exchange(bus, 0, 0x02, 0x42), 0xFF)
+	assertBytes(t, exchange(bus, 0, 0x84, 'S', 0, 0), 0xFF, 0x08, 0x5A, 0x5D)
+	assertBytes(t, exchange(bus, 0, 0x81, 'S'), 0xFF)
+
+	// Enable multitap mode, then read all four pads at once
+	exchange(bus, 0, 0x01, 0x42, 0x01, 0x00, 0x00)
+	packet := append([]uint8{0x01, 0x42, 0x01}, make([]uint8, 32)...)
+	reply := exchange(bus, 0, packet...)
+	assertBytes(t, reply[:3], 0xFF, 0x80, 0x5A)
+	assertBytes(t, reply[3:11], 0x41, 0x5A, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	assertBytes(t, reply[11:19], 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	assertBytes(t, reply[19:27], 0x41, 0x5A, 0xF7, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	assertEqual(t, len(reply), 35)
+}
+
+func TestLightguns(t *testing.T) {
+	bus := newBus(t)
+
+	guncon := NewGunCon()
+	bus.ConnectController(0, guncon)
+	assertBytes(t, exchange(bus, 0, 0x01, 0x42, 0, 0, 0, 0, 0, 0, 0),
+		0xFF, 0x63, 0x5A, 0xFF, 0xFF, 0x01, 0x00, 0x0A, 0x00)
+
+	guncon.Aim(0.5, 0.5)
+	guncon.SetButton(GunConTrigger, true)
+	x, y := guncon.Coordinates()
+	assertEqual(t, y, uint16(136))
+	assertBytes(t, exchange(bus, 0, 0x01, 0x42, 0, 0, 0, 0, 0, 0, 0),
+		0xFF, 0x63, 0x5A, 0xFF, 0xDF, uint8(x), uint8(x>>8), 136, 0)
+
+	justifier := NewJustifier()
+	bus.ConnectController(1, justifier)
+	justifier.Aim(0.25, 0.75)
+	exchange(bus, 1, 0x01, 0x42, 0x00, 0x10, 0x00)
+
+	bus.Interrupts().Stat = 0
+	for bus.Interrupts().Stat&(1<<IRQLightpen) == 0 {
+		bus.Tick(CyclesPerInstruction)
+	}
+	dot, line := bus.Timing().Beam()
+	assertEqual(t, line, uint32(16+180))
+	if dot < 0x260+(0xC60-0x260)/4 {
+		t.Fatalf("IRQ10 raised early at dot %d", dot)
+	}
+
+	// Moving the gun into a multitap on another console detaches it from
+	// the first one
+	other := newBus(t)
+	tap := NewMultitap()
+	other.ConnectController(0, tap)
+	bus.ConnectController(1, nil)
+	tap.Connect(2, justifier)
+	for _, ticker := range bus.tickers {
+		if ticker == Ticker(justifier) {
+			t.Fatal("unplugged Justifier still ticks")
+		}
+	}
+	if justifier.timing != other.Timing() || justifier.interrupts != other.Interrupts() {
+		t.Fatal("Justifier doesn't follow the bus it is plugged into")
+	}
+	tap.Connect(2, nil)
+	assertEqual(t, len(other.tickers), len(bus.tickers))
+}
+
+func TestMouse(t *testing.T) {
+	bus := newBus(t)
+	mouse := NewMouse()
+	bus.ConnectController(0, mouse)
+
+	mouse.SetButtons(true, false)
+	mouse.Move(200, -3)
+	assertBytes(t, exchange(bus, 0, 0x01, 0x42, 0, 0, 0, 0, 0), 0xFF, 0x12, 0x5A, 0xFF, 0xF4, 0x7F, 0xFD)
+
+	mouse.Enqueue(MouseMotion{DX: -5, DY: 10})
+	assertBytes(t, exchange(bus, 0, 0x01, 0x42, 0, 0, 0, 0, 0), 0xFF, 0x12, 0x5A, 0xFF, 0xF4, 68, 10)
+	assertBytes(t, exchange(bus, 0, 0x01, 0x42, 0, 0, 0, 0, 0), 0xFF, 0x12, 0x5A, 0xFF, 0xF4, 0, 0)
+}
+
+func TestSerialPort(t *testing.T) {
+	bus := newBus(t)
+	link, host := NewSerialPipe()
+	defer host.Close()
+	bus.ConnectSerial(link)
+
+	// 8N1 at MUL16, RX IRQ after each byte
+	bus.StoreHalfword(SerialPort+0x8, 0x4E)
+	bus.StoreHalfword(SerialPort+0xE, 0x12)
+	bus.StoreHalfword(SerialPort+0xA, 0x0827)
+	bus.Interrupts().Mask = 1 << IRQSIO
+	host.SetOutputs(true, true)
+
+	go host.Write([]byte("hi"))
+
+	var received []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for len(received) < 2 && time.Now().Before(deadline) {
+		bus.Tick(CyclesPerInstruction)
+		if bus.LoadWord(SerialPort+4)&0x2 != 0 {
+			received = append(received, bus.LoadByte(SerialPort))
+		}
+	}
+	assertEqual(t, string(received), "hi")
+	assertEqual(t, bus.Interrupts().Pending(), true)
+
+	dsr, cts := host.Inputs()
+	assertEqual(t, dsr && cts, true)
+
+	bus.StoreByte(SerialPort, '!')
+	for bus.LoadWord(SerialPort+4)&0x4 == 0 {
+		bus.Tick(CyclesPerInstruction)
+	}
+	buffer := make([]byte, 1)
+	host.Read(buffer)
+	assertEqual(t, string(buffer), "!")
+
+	// Reconnecting stops reading from the old link.
+	next, nextHost := NewSerialPipe()
+	defer nextHost.Close()
+	bus.ConnectSerial(next)
+	nextHost.SetOutputs(true, true)
+	go host.Write([]byte("old"))
+	go nextHost.Write([]byte("new"))
+	received = nil
+	deadline = time.Now().Add(5 * time.Second)
+	for len(received) < 3 && time.Now().Before(deadline) {
+		bus.Tick(CyclesPerInstruction)
+		if bus.LoadWord(SerialPort+4)&0x2 != 0 {
+			received = append(received, bus.LoadByte(SerialPort))
+		}
+	}
+	assertEqual(t, string(received), "new")
+
+	// A far end that stops reading leaves the transmitter busy instead of
+	// blocking the console.
+	bus.StoreHalfword(SerialPort+0x8, 0x4D)
+	bus.StoreHalfword(SerialPort+0xE, 0x1)
+	sent := 0
+	for ; sent < 5000; sent++ {
+		ticks := 0
+		for bus.LoadWord(SerialPort+4)&0x1 == 0 && ticks < 100 {
+			bus.Tick(16)
+			ticks++
+		}
+		if ticks == 100 {
+			break
+		}
+		bus.StoreByte(SerialPort, 'x')
+	}
+	if sent == 5000 {
+		t.Fatal("transmitter never backed up")
+	}
+	assertEqual(t, bus.LoadWord(SerialPort+4)&0x5, uint32(0))
+
+	// A file that isn't a socket is never replaced.
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	os.WriteFile(path, []byte("keep"), 0644)
+	if _, err := AcceptSerialSocket(path); err == nil {
+		t.Fatal("expected an error listening on a regular file")
+	}
+	data, err := os.ReadFile(path)
+	assertEqual(t, err, nil)
+	assertEqual(t, string(data), "keep")
+}
+
+func TestUniromShim(t *testing.T) {
+	bus := newBus(t)
+	cpu := NewCPU()
+	link, host := NewSerialPipe()
+	defer host.Close()
+	shim := NewUniromShim(link)
+
+	word := func(value uint32) []byte {
+		return []byte{uint8(value), uint8(value >> 8), uint8(value >> 16), uint8(value >> 24)}
+	}
+	expect := func(response string) {
+		buffer := make([]byte, len(response))
+		io.ReadFull(host, buffer)
+		if string(buffer) != response {
+			t.Errorf("got %q, want %q", buffer, response)
+		}
+	}
+
+	payload := []byte{0x01, 0x02, 0x03, 0x04, 0x05}
+	dumped := make([]byte, len(payload)+4)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		host.Write([]byte("SBIN"))
+		expect("OKV2")
+		host.Write([]byte("UPV2"))
+		expect("OKAY")
+		host.Write(word(0x80010000))
+		host.Write(word(uint32(len(payload))))
+		host.Write(word(15))
+		host.Write(payload)
+		expect("CHEK")
+		host.Write(word(14))
+		expect("ERR!")
+		host.Write(payload)
+		expect("CHEK")
+		host.Write(word(15))
+		expect("MORE")
+
+		// A transfer that doesn't match its checksum is rejected.
+		host.Write([]byte("SBIN"))
+		expect("OKV2")
+		host.Write(word(0x80020000))
+		host.Write(word(uint32(len(payload))))
+		host.Write(word(14))
+		host.Write(payload)
+		expect("ERR!")
+
+		// A DUMP of unmapped memory fails without stopping the emulator.
+		host.Write([]byte("DUMP"))
+		expect("OKV2")
+		host.Write(word(0x1F900000))
+		host.Write(word(4))
+
+		// Sizes larger than RAM are refused before allocating anything.
+		host.Write([]byte("DUMP"))
+		expect("OKV2")
+		host.Write(word(0x80010000))
+		host.Write(word(0xFFFFFFFF))
+
+		host.Write([]byte("DUMP"))
+		expect("OKV2")
+		host.Write(word(0x80010000))
+		host.Write(word(uint32(len(payload))))
+		io.ReadFull(host, dumped)
+
+		host.Write([]byte("JUMP"))
+		expect("OKV2")
+		host.Write(word(0x80010000))
+		// The shim is idle again once it answers the next command.
+		host.Write([]byte("JUMP"))
+		expect("OKV2")
+		host.Write(word(0x80010000))
+	}()
+
+	deadline := time.After(5 * time.Second)
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case <-deadline:
+			t.Fatal("timed out")
+		default:
+			shim.Service(&cpu, bus)
+		}
+	}
+
+	assertBytes(t, dumped, append(payload, word(15)...)...)
+	assertEqual(t, bus.LoadByte(0x80010004), uint8(0x05))
+	assertEqual(t, bus.LoadByte(0x80020004), uint8(0))
+	assertEqual(t, cpu.Pc, uint32(0x80010000))
+}
+
+func TestEXEFastBoot(t *testing.T) {
+	bus := newBus(t)
+	cpu := NewCPU()
+
+	file := make([]byte, EXEHeaderSize+8)
+	copy(file, "PS-X EXE")
+	for offset, value := range map[int]uint32{
+		0x10: 0x80010004, 0x14: 0x80018000,
+		0x18: 0x80010000, 0x1C: 8,
+		0x30: 0x801FFF00, 0x34: 0xF0,
+	} {
+		file[offset] = uint8(value)
+		file[offset+1] = uint8(value >> 8)
+		file[offset+2] = uint8(value >> 16)
+		file[offset+3] = uint8(value >> 24)
+	}
+	// ori $t0, $zero, 0x1234
+	copy(file[EXEHeaderSize+4:], []byte{0x34, 0x12, 0x08, 0x34})
+
+	exe, err := ParseEXE(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseEXE(file[:EXEHeaderSize+4])
+	assertEqual(t, err != nil, true)
+
+	// BSS segments must lie in RAM.
+	for _, bss := range [][2]uint32{{0x801F0000, 0x10000}, {0x801F0000, 0x10001}, {0x80010000, 0xFFFFFFFF}, {0x1F800000, 4}} {
+		bad := append([]byte(nil), file...)
+		binary.LittleEndian.PutUint32(bad[0x28:], bss[0])
+		binary.LittleEndian.PutUint32(bad[0x2C:], bss[1])
+		_, err := ParseEXE(bad)
+		assertEqual(t, err == nil, bss == [2]uint32{0x801F0000, 0x10000})
+	}
+
+	FastBoot(&cpu, exe)
+	cpu.Jump(ShellAddress)
+	cpu.Cycle(bus)
+	assertEqual(t, cpu.Pc, uint32(0x80010004))
+	cpu.Cycle(bus)
+
+	assertEqual(t, cpu.Pc, uint32(0x80010008))
+	assertEqual(t, cpu.GetGPR(8), uint32(0x1234))
+	assertEqual(t, cpu.GetGPR(28), uint32(0x80018000))
+	assertEqual(t, cpu.GetGPR(29), uint32(0x801FFFF0))
+
+	// The hook only fires once.
+	cpu.Jump(ShellAddress)
+	cpu.Cycle(bus)
+	assertEqual(t, cpu.Pc, uint32(ShellAddress+4))
+}
+
+// elfSection is an extra section for buildELF.
+type elfSection struct {
+	name string
+	data []byte
+}
+
+// buildELF returns a MIPS ELF executable with one segment holding text at
+// 80010000h, the symbols main, _gp and functions, and the extra sections.
+func buildELF(text []byte, functions map[string]uint32, sections ...elfSection) []byte {
+	var buffer bytes.Buffer
+	buffer.Write(make([]byte, 0x100))
+	// place writes data at the next 16-byte boundary and returns its offset.
+	place := func(data interface{}) uint32 {
+		for buffer.Len()%16 != 0 {
+			buffer.WriteByte(0)
+		}
+		offset := uint32(buffer.Len())
+		binary.Write(&buffer, binary.LittleEndian, data)
+		return offset
+	}
+
+	names := []string{"main"}
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	strtab := "\x00_gp\x00"
+	symbols := []elf.Sym32{
+		{},
+		{Name: 1, Value: 0x80018000, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_NOTYPE), Shndx: uint16(elf.SHN_ABS)},
+	}
+	for _, name := range names {
+		symbol := elf.Sym32{Name: uint32(len(strtab)), Value: functions[name], Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC), Shndx: 1}
+		if name == "main" {
+			symbol.Value, symbol.Size = 0x80010000, uint32(len(text))
+		}
+		symbols = append(symbols, symbol)
+		strtab += name + "\x00"
+	}
+
+	shstrtab := "\x00"
+	name := func(s string) uint32 {
+		shstrtab += s + "\x00"
+		return uint32(len(shstrtab) - len(s) - 1)
+	}
+	textOffset := place(text)
+	headers := []elf.Section32{
+		{},
+		{Name: name(".text"), Type: uint32(elf.SHT_PROGBITS), Addr: 0x80010000, Off: textOffset, Size: uint32(len(text))},
+		{Name: name(".symtab"), Type: uint32(elf.SHT_SYMTAB), Off: place(symbols), Size: uint32(len(symbols) * 16), Link: 3, Info: 1, Entsize: 16},
+		{Name: name(".strtab"), Type: uint32(elf.SHT_STRTAB), Off: place([]byte(strtab)), Size: uint32(len(strtab))},
+	}
+	for _, section := range sections {
+		headers = append(headers, elf.Section32{
+			Name: name(section.name), Type: uint32(elf.SHT_PROGBITS), Off: place(section.data), Size: uint32(len(section.data)),
+		})
+	}
+	shstrtabName := name(".shstrtab")
+	headers = append(headers, elf.Section32{Name: shstrtabName, Type: uint32(elf.SHT_STRTAB), Off: place([]byte(shstrtab)), Size: uint32(len(shstrtab))})
+	sectionsOffset := place(headers)
+
+	var start bytes.Buffer
+	header := elf.Header32{
+		Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_MIPS), Version: 1,
+		Entry: 0x80010000, Phoff: 52, Shoff: sectionsOffset,
+		Ehsize: 52, Phentsize: 32, Phnum: 1, Shentsize: 40,
+		Shnum: uint16(len(headers)), Shstrndx: uint16(len(headers) - 1),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(&start, binary.LittleEndian, header)
+	binary.Write(&start, binary.LittleEndian, elf.Prog32{
+		Type: uint32(elf.PT_LOAD), Off: textOffset, Vaddr: 0x80010000,
+		Filesz: uint32(len(text)), Memsz: uint32(len(text)) + 8, Flags: uint32(elf.PF_R | elf.PF_X),
+	})
+	data := buffer.Bytes()
+	copy(data, start.Bytes())
+	return data
+}
+
+func TestELF(t *testing.T) {
+	bus := newBus(t)
+	cpu := NewCPU()
+
+	// ori $t0, $zero, 0x1234; jal main
+	program, err := ParseELF(buildELF([]byte{
+		0x34, 0x12, 0x08, 0x34,
+		0x00, 0x40, 0x00, 0x0C,
+	}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, program.GP, uint32(0x80018000))
+
+	// Segments larger than the file or RAM are refused.
+	for _, sizes := range [][2]uint32{{0xFFFFFF00, 0xFFFFFF00}, {8, 0x40000000}, {8, 4}} {
+		bad := buildELF(make([]byte, 8), nil)
+		binary.LittleEndian.PutUint32(bad[52+16:], sizes[0])
+		binary.LittleEndian.PutUint32(bad[52+20:], sizes[1])
+		if _, err := ParseELF(bad); err == nil {
+			t.Errorf("segment of %d/%d bytes accepted", sizes[0], sizes[1])
+		}
+	}
+
+	bus.Write(0x80010008, []byte{0xFF, 0xFF, 0xFF, 0xFF})
+	program.Load(&cpu, bus)
+	assertEqual(t, cpu.Pc, uint32(0x80010000))
+	assertEqual(t, cpu.GetGPR(28), uint32(0x80018000))
+	assertEqual(t, bus.LoadWord(0x80010008), uint32(0))
+
+	symbols := program.Symbols
+	assertEqual(t, symbols.Format(0x80010000), "main")
+	assertEqual(t, symbols.Format(0x80010004), "main+0x4")
+	assertEqual(t, symbols.Format(0x80010008), "80010008h")
+	assertEqual(t, Disassemble(0x80010004, bus.LoadWord(0x80010004), symbols).String(), "JAL     main")
+}
+
+// buildISO returns an ISO9660 image with the files in its root directory.
+func buildISO(files map[string][]byte) []byte {
+	const rootSector = 18
+
+	image := make([]byte, (rootSector+1)*DiscSectorSize)
+	record := func(name string, sector, size uint32, flags uint8) []byte {
+		r := make([]byte, 33+len(name)+(len(name)+1)%2)
+		r[0] = uint8(len(r))
+		binary.LittleEndian.PutUint32(r[2:], sector)
+		binary.LittleEndian.PutUint32(r[10:], size)
+		r[25] = flags
+		r[32] = uint8(len(name))
+		copy(r[33:], name)
+		return r
+	}
+
+	pvd := image[16*DiscSectorSize:]
+	pvd[0] = 1
+	copy(pvd[1:], "CD001")
+	copy(pvd[156:], record("\x00", rootSector, DiscSectorSize, isoDirectoryFlag))
+
+	dir := append(record("\x00", rootSector, DiscSectorSize, isoDirectoryFlag), record("\x01", rootSector, DiscSectorSize, isoDirectoryFlag)...)
+	for name, data := range files {
+		sector := uint32(len(image) / DiscSectorSize)
+		dir = append(dir, record(name, sector, uint32(len(data)), 0)...)
+		image = append(image, data...)
+		for len(image)%DiscSectorSize != 0 {
+			image = append(image, 0)
+		}
+	}
+	copy(image[rootSector*DiscSectorSize:], dir)
+	return image
+}
+
+func TestBadDisc(t *testing.T) {
+	exe := asm.MustAssemble(0x80010000, "nop").EXE()
+	image := buildISO(map[string][]byte{"PSX.EXE;1": exe[:len(exe)-4]})
+
+	// An EXE shorter than its header says isn't loaded.
+	disc, err := NewDisc(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := newBus(t)
+	cpu := NewCPU()
+	k := NewKernel()
+	k.Disc = disc
+	writeString(bus, 0x80010000, "cdrom:\\PSX.EXE;1")
+	cpu.forceGPR(4, 0x80010000)
+	cpu.forceGPR(5, 0x80020000)
+	assertEqual(t, kernelLoad(k, &cpu, bus), uint32(0))
+
+	// Records too short for their name are errors, also at the end of a
+	// sector.
+	if _, _, err := parseDirectoryRecord(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseDirectoryRecord([]byte{16, 15: 0}); err != errBadDirectoryRecord {
+		t.Fatalf("expected errBadDirectoryRecord, got %v", err)
+	}
+	bad := append([]byte(nil), image...)
+	bad[18*DiscSectorSize+34+34+42] = 16
+	disc, err = NewDisc(bytes.NewReader(bad))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := disc.Lookup("cdrom:\\PSX.EXE;1"); err != errBadDirectoryRecord {
+		t.Fatalf("expected errBadDirectoryRecord, got %v", err)
+	}
+
+	bad[16*DiscSectorSize+156] = 20
+	if _, err := NewDisc(bytes.NewReader(bad)); err == nil {
+		t.Fatal("expected an error for a bad root directory record")
+	}
+}
+
+func TestHLE(t *testing.T) {
+	exe := asm.MustAssemble(0x80010000, `
+	la    $a0, message
+	li    $t2, 0xA0
+	.set noreorder
+	jalr  $t2
+	li    $t1, 0x1B          # strlen
+	move  $s0, $v0
+	la    $a0, message
+	jalr  $t2
+	li    $t1, 0x3E          # puts
+	.set reorder
+	li    $a0, 2             # ExitCriticalSection
+	syscall
+	b     .
+message:
+	.asciiz "hello"
+`).EXE()
+
+	disc, err := NewDisc(bytes.NewReader(buildISO(map[string][]byte{"PSX.EXE;1": exe})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := disc.ReadFile("cdrom:\\psx.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertBytes(t, data[:8], []byte("PS-X EXE")...)
+
+	bus := newBus(t)
+	cpu := NewCPU()
+	var tty bytes.Buffer
+	k := NewKernel()
+	k.Disc = disc
+	k.TTY = &tty
+	k.Install(&cpu)
+
+	for i := 0; i < 100; i++ {
+		cpu.Cycle(bus)
+	}
+
+	assertEqual(t, cpu.GetGPR(16), uint32(5))
+	assertEqual(t, tty.String(), "hello\n")
+	assertEqual(t, cpu.COP0R[COP0SR]&0x401, uint32(0x401))
+	assertEqual(t, cpu.Pc&^4, uint32(0x80010030))
+}
+
+func TestHLEGuestSizes(t *testing.T) {
+	bus := newBus(t)
+	cpu := NewCPU()
+	k := NewKernel()
+	k.heap.init(0x80100000, 0xF0000000)
+
+	// Sizes larger than RAM fail instead of allocating them on the host.
+	call := func(function kernelFunction, args ...uint32) uint32 {
+		for i, arg := range args {
+			cpu.forceGPR(uint32(4+i), arg)
+		}
+		return function(k, &cpu, bus)
+	}
+	assertEqual(t, call(kernelMemset, 0x80010000, 0, 0xFFFFFFFF), uint32(0))
+	assertEqual(t, call(kernelMemcpy, 0x80010000, 0x80020000, 0xFFFFFFFF), uint32(0))
+	assertEqual(t, call(kernelStrncpy, 0x80010000, 0x80020000, 0xFFFFFFFF), uint32(0))
+	assertEqual(t, call(kernelMalloc, 0xFFFFFFFF), uint32(0))
+	assertEqual(t, call(kernelCalloc, 0x10000, 0x10000), uint32(0))
+	assertEqual(t, call(kernelWrite, 1, 0x80010000, 0xFFFFFFFF), uint32(0xFFFFFFFF))
+	assertEqual(t, k.lastError, uint32(errorInvalid))
+
+	assertEqual(t, call(kernelMemset, 0x80010000, 0xAB, 4), uint32(0x80010000))
+	assertEqual(t, bus.LoadWord(0x80010000), uint32(0xABABABAB))
+}
+
+func TestHLEInterruptHandlers(t *testing.T) {
+	bus := newBus(t)
+	cpu := NewCPU()
+	k := NewKernel()
+	call := func(function kernelFunction, args ...uint32) {
+		for i, arg := range args {
+			cpu.forceGPR(uint32(4+i), arg)
+		}
+		function(k, &cpu, bus)
+	}
+
+	// An entry queued twice links to itself, which must not hang the walk.
+	call(kernelSysEnqIntRP, 0, 0x80010000)
+	call(kernelSysEnqIntRP, 0, 0x80010000)
+	assertEqual(t, fmt.Sprint(k.handlerChain(bus, 0)), fmt.Sprint([]uint32{0x80010000}))
+	call(kernelSysDeqIntRP, 0, 0x80010000)
+	assertEqual(t, k.handlers[0], uint32(0))
+
+	call(kernelSysEnqIntRP, 1, 0x80010000)
+	call(kernelSysEnqIntRP, 1, 0x80010010)
+	call(kernelSysEnqIntRP, 1, 0x80010020)
+	call(kernelSysDeqIntRP, 1, 0x80010010)
+	assertEqual(t, fmt.Sprint(k.handlerChain(bus, 1)), fmt.Sprint([]uint32{0x80010020, 0x80010000}))
+}
+
+func TestHLESyscallInDelaySlot(t *testing.T) {
+	bus := newBus(t)
+	cpu := NewCPU()
+	NewKernel().Install(&cpu)
+	program := asm.MustAssemble(0x80010000, `
+	li    $a0, 1             # EnterCriticalSection
+	.set noreorder
+	bne   $zero, $zero, skip
+	syscall
+	jal   skip
+	syscall
+	.set reorder
+	li    $s0, 1
+skip:
+	li    $s1, 1
+	b     .
+`)
+	bus.Write(program.Origin, program.Code)
+	cpu.Jump(program.Origin)
+
+	for i := 0; i < 100; i++ {
+		cpu.Cycle(bus)
+	}
+	assertEqual(t, cpu.GetGPR(16), uint32(0))
+	assertEqual(t, cpu.GetGPR(17), uint32(1))
+	assertEqual(t, cpu.GetGPR(31), uint32(0x80010014))
+}
+
+func TestKernelTracer(t *testing.T) {
+	var output bytes.Buffer
+	bus := newBus(t)
+	bus.SetLogOutput(&output)
+	cpu := NewCPU()
+	cpu.Tracer = NewKernelTracer()
+	NewKernel().Install(&cpu)
+
+	writeString(bus, 0x80010100, "hello")
+	cpu.forceGPR(4, 0x80010100)
+	cpu.forceGPR(9, 0x1B)
+	cpu.forceGPR(31, 0x80010000)
+	cpu.Jump(0xA0)
+	cpu.Cycle(bus)
+
+	trace := output.String()
+	assertEqual(t, strings.Contains(trace, `kernel: A0:1Bh strlen("hello") from 80010000h`), true)
+	assertEqual(t, strings.Contains(trace, "kernel: A0:1Bh strlen = 5"), true)
+	assertEqual(t, len(cpu.Tracer.pending), 0)
+}
+
+func TestConsole(t *testing.T) {
+	var output bytes.Buffer
+	console := NewConsole(&output)
+
+	bus := newBus(t)
+	bus.ConnectConsole(console)
+	cpu := NewCPU()
+	console.Install(&cpu)
+
+	for _, c := range []byte("duart\nput") {
+		assertEqual(t, bus.LoadByte(DUART+duartStatusA)&0x04, uint8(0x04))
+		bus.StoreByte(DUART+duartTransmitA, c)
+	}
+	assertEqual(t, output.String(), "duart\n")
+
+	// putchar('c') through the B0h table.
+	cpu.forceGPR(4, 'c')
+	cpu.forceGPR(9, 0x3D)
+	cpu.Jump(0xB0)
+	cpu.Cycle(bus)
+	console.Write([]byte("har\n"))
+	assertEqual(t, output.String(), "duart\nputchar\n")
+
+	console.Write([]byte("end"))
+	console.Flush()
+	assertEqual(t, output.String(), "duart\nputchar\nend")
+}
+
+func TestExitPort(t *testing.T) {
+	bus := newBus(t)
+	cpu := NewCPU()
+
+	program := asm.MustAssemble(0x80010000, `
+	lui  $t0, 0x1F80
+	li   $t1, 7
+	sb   $t1, 0x2041($t0)    # POST
+	li   $t1, 42
+	sb   $t1, 0x2082($t0)    # exit port
+	b    .
+`)
+	bus.Write(program.Origin, program.Code)
+
+	_, exited, err := cpu.Run(bus, 10)
+	assertEqual(t, exited, false)
+	assertEqual(t, err, nil)
+
+	cpu.Jump(0x80010000)
+	code, exited, err := cpu.Run(bus, 100)
+	assertEqual(t, exited, true)
+	assertEqual(t, err, nil)
+	assertEqual(t, code, 42)
+	assertEqual(t, bus.debug.post[0], uint8(7))
+
+	// The third expansion region is separate from the second.
+	bus.StoreWord(ThirdExpansionRegion, 0x12345678)
+	assertEqual(t, bus.LoadWord(ThirdExpansionRegion), uint32(0x12345678))
+	assertEqual(t, bus.LoadWord(SecondExpansionRegion), uint32(0))
+}
+
+func TestPCdrv(t *testing.T) {
+	root := t.TempDir()
+	bus := newBus(t)
+	cpu := NewCPU()
+	cpu.PCdrv = NewPCdrv(root)
+	defer cpu.PCdrv.Close()
+
+	call := func(code, a1, a2, a3 uint32) (uint32, uint32) {
+		bus.StoreWord(0x80010000, code<<6|0x0D) // break code
+		cpu.forceGPR(5, a1)
+		cpu.forceGPR(6, a2)
+		cpu.forceGPR(7, a3)
+		cpu.Jump(0x80010000)
+		cpu.Cycle(bus)
+		return cpu.GetGPR(2), cpu.GetGPR(3)
+	}
+
+	writeString(bus, 0x80011000, "..\\data\\out.txt")
+	writeString(bus, 0x80011100, "hello")
+	os.Mkdir(filepath.Join(root, "data"), 0755)
+
+	v0, fd := call(pcdrvCreat, 0x80011000, 0, 0)
+	assertEqual(t, v0, uint32(0))
+	v0, n := call(pcdrvWrite, fd, 5, 0x80011100)
+	assertEqual(t, v0, uint32(0))
+	assertEqual(t, n, uint32(5))
+	_, offset := call(pcdrvSeek, fd, 1, 0)
+	assertEqual(t, offset, uint32(1))
+	// Reads stop at the end of the file, however large the requested size.
+	_, n = call(pcdrvRead, fd, 0xFFFFFFFF, 0x80011200)
+	assertEqual(t, n, uint32(4))
+	assertEqual(t, readString(bus, 0x80011200), "ello")
+	v0, _ = call(pcdrvClose, fd, 0, 0)
+	assertEqual(t, v0, uint32(0))
+
+	// ".." stays inside the root.
+	data, err := os.ReadFile(filepath.Join(root, "data", "out.txt"))
+	assertEqual(t, err, nil)
+	assertEqual(t, string(data), "hello")
+
+	writeString(bus, 0x80011000, "missing")
+	v0, _ = call(pcdrvOpen, 0x80011000, 0, 0)
+	assertEqual(t, v0, uint32(0xFFFFFFFF))
+	v0, _ = call(pcdrvClose, fd, 0, 0)
+	assertEqual(t, v0, uint32(0xFFFFFFFF))
+}
+
+func TestDebugger(t *testing.T) {
+	bus := newBus(t)
+	cpu := NewCPU()
+	program := asm.MustAssemble(0x80010000, `
+_start:	la    $s0, counter
+	jal   bump
+	jal   bump
+	lw    $t0, 0($s0)
+	mtc2  $t0, $9
+	lui   $t1, 0x1F80
+	sb    $t0, 0x2082($t1)    # exit port
+	b     .
+bump:	lw    $t0, 0($s0)
+	nop
+	addiu $t0, $t0, 1
+	sw    $t0, 0($s0)
+	jr    $ra
+	.align 2
+counter: .word 0
+`)
+	bus.Write(program.Origin, program.Code)
+	cpu.Jump(program.Origin)
+	cpu.Symbols = NewSymbolTable()
+	for name, address := range program.Labels {
+		cpu.Symbols.Add(Symbol{Name: name, Address: address})
+	}
+
+	d := NewDebugger(&cpu, bus)
+	d.AddBreakpoint(program.Labels["bump"])
+	assertEqual(t, d.Continue().Reason, StopBreakpoint)
+	assertEqual(t, cpu.Pc, program.Labels["bump"])
+	assertEqual(t, d.RemoveBreakpoint(program.Labels["bump"]), true)
+
+	// Return to _start, then step over the second call.
+	assertEqual(t, d.Until(program.Labels["_start"]+0x10).Reason, StopStep)
+	assertEqual(t, d.Next().Reason, StopStep)
+	assertEqual(t, cpu.Pc, program.Labels["_start"]+0x18)
+
+	counter, err := d.Evaluate("counter")
+	assertEqual(t, err, nil)
+	d.AddWatchpoint(Watchpoint{Address: counter, Size: 4, Kind: WatchRead})
+	stop := d.Continue()
+	assertEqual(t, stop.Reason, StopWatchpoint)
+	assertEqual(t, stop.Value, uint32(2))
+
+	assertEqual(t, d.RemoveWatchpoint(counter), true)
+	stop = d.Continue()
+	assertEqual(t, stop.Reason, StopExit)
+	assertEqual(t, stop.Code, 2)
+	assertEqual(t, cpu.COP2D[9], uint32(2))
+
+	assertEqual(t, d.SetRegister("$a0", 0x10), nil)
+	value, err := d.Evaluate("$a0 + counter - 10h")
+	assertEqual(t, err, nil)
+	assertEqual(t, value, counter)
+
+	data := make([]byte, 4)
+	assertEqual(t, d.ReadMemory(counter, data), nil)
+	assertBytes(t, data, 2, 0, 0, 0)
+	if err := d.ReadMemory(0x1F900000, data); err == nil {
+		t.Fatal("expected an error reading unmapped memory")
+	}
+}
+
+// gdbClient sends GDB packets and returns the replies.
+type gdbClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *gdbClient) send(t *testing.T, packet string) string {
+	t.Helper()
+	fmt.Fprintf(c.conn, "$%s#%02x", packet, gdbChecksum(packet))
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != '$' {
+			continue
+		}
+		reply, err := c.r.ReadString('#')
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.r.Discard(2)
+		return reply[:len(reply)-1]
+	}
+}
+
+func TestGDB(t *testing.T) {
+	bus := newBus(t)
+	cpu := NewCPU()
+	program := asm.MustAssemble(0x80010000, `
+	li    $t0, 3
+loop:	addiu $t0, $t0, -1
+	bnez  $t0, loop
+	sw    $t0, 0x100($zero)
+	lui   $t1, 0x1F80
+	sb    $t0, 0x2082($t1)    # exit port
+	b     .
+`)
+	bus.Write(program.Origin, program.Code)
+	cpu.Jump(program.Origin)
+
+	server, conn := net.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- ServeGDB(NewDebugger(&cpu, bus), server)
+	}()
+	c := &gdbClient{conn: conn, r: bufio.NewReader(conn)}
+
+	assertEqual(t, strings.Contains(c.send(t, "qSupported:multiprocess+"), "qXfer:features:read+"), true)
+	assertEqual(t, c.send(t, "QStartNoAckMode"), "OK")
+	assertEqual(t, strings.HasPrefix(c.send(t, "qXfer:features:read:target.xml:0,20"), "m<?xml"), true)
+	assertEqual(t, c.send(t, "?"), "S05")
+
+	assertEqual(t, c.send(t, "s"), "S05")
+	assertEqual(t, c.send(t, "p8"), "03000000")
+	assertEqual(t, c.send(t, "p25"), "04000180")
+	assertEqual(t, len(c.send(t, "g")), 72*8)
+
+	assertEqual(t, c.send(t, "Z0,80010010,4"), "OK")
+	assertEqual(t, c.send(t, "c"), "S05")
+	assertEqual(t, c.send(t, "p25"), "10000180")
+	assertEqual(t, c.send(t, "z0,80010010,4"), "OK")
+
+	assertEqual(t, c.send(t, "P9=78563412"), "OK")
+	assertEqual(t, cpu.GPR[9], uint32(0x12345678))
+	assertEqual(t, c.send(t, "P-1=00000000"), "E01")
+	assertEqual(t, c.send(t, "P48=00000000"), "E01")
+	assertEqual(t, c.send(t, "M80010100,4:deadbeef"), "OK")
+	assertEqual(t, c.send(t, "m80010100,4"), "deadbeef")
+	assertEqual(t, c.send(t, "m1f900000,4"), "E14")
+	assertEqual(t, len(c.send(t, "m80000000,ffffffff")), 0x4000)
+
+	assertEqual(t, c.send(t, "Z2,80000100,4"), "OK")
+	// Removing a read watchpoint keeps the write watchpoint at the same address.
+	assertEqual(t, c.send(t, "Z3,80000100,4"), "OK")
+	assertEqual(t, c.send(t, "z3,80000100,4"), "OK")
+	assertEqual(t, c.send(t, "c"), "T05watch:00000100;")
+	assertEqual(t, c.send(t, "z2,80000100,4"), "OK")
+	assertEqual(t, c.send(t, "c"), "W00")
+
+	assertEqual(t, c.send(t, "D"), "OK")
+	assertEqual(t, <-done, nil)
+	conn.Close()
+}
+
+// buildLineTables returns DWARF 2 sections describing one compilation unit
+// with a line table that maps rows to lines of file and ends at end.
+func buildLineTables(file string, rows []SourceLine, end uint32) []elfSection {
+	// Compile unit: name, comp_dir and stmt_list
+	abbrev := []byte{1, 0x11, 0, 0x03, 0x08, 0x1B, 0x08, 0x10, 0x06, 0, 0, 0}
+
+	var info bytes.Buffer
+	info.Write([]byte{2, 0, 0, 0, 0, 0, 4, 1})
+	info.WriteString(filepath.Base(file) + "\x00" + filepath.Dir(file) + "\x00")
+	info.Write([]byte{0, 0, 0, 0})
+
+	var header bytes.Buffer
+	header.Write([]byte{1, 1, 0xFB, 14, 13, 0, 1, 1, 1, 1, 0, 0, 0, 1, 0, 0, 1, 0})
+	header.WriteString(filepath.Base(file) + "\x00")
+	header.Write([]byte{0, 0, 0, 0})
+
+	var program bytes.Buffer
+	setAddress := func(address uint32) {
+		program.Write([]byte{0, 5, 2})
+		binary.Write(&program, binary.LittleEndian, address)
+	}
+	line := 1
+	for _, row := range rows {
+		// advance_line with a one-byte SLEB128 operand and copy
+		setAddress(row.Address)
+		program.Write([]byte{3, byte(row.Line-line) & 0x7F, 1})
+		line = row.Line
+	}
+	setAddress(end)
+	program.Write([]byte{0, 1, 1})
+
+	var lines bytes.Buffer
+	binary.Write(&lines, binary.LittleEndian, uint32(2+4+header.Len()+program.Len()))
+	binary.Write(&lines, binary.LittleEndian, uint16(2))
+	binary.Write(&lines, binary.LittleEndian, uint32(header.Len()))
+	lines.Write(header.Bytes())
+	lines.Write(program.Bytes())
+
+	unit := make([]byte, 4, 4+info.Len())
+	binary.LittleEndian.PutUint32(unit, uint32(info.Len()))
+	return []elfSection{
+		{".debug_abbrev", abbrev},
+		{".debug_info", append(unit, info.Bytes()...)},
+		{".debug_line", lines.Bytes()},
+	}
+}
+
+// dapClient sends DAP requests and collects the events that arrive before
+// each response.
+type dapClient struct {
+	t      *testing.T
+	w      io.Writer
+	r      *bufio.Reader
+	seq    int
+	events []map[string]interface{}
+}
+
+func (c *dapClient) receive() map[string]interface{} {
+	c.t.Helper()
+	var length int
+	if _, err := fmt.Fscanf(c.r, "Content-Length: %d\r\n\r\n", &length); err != nil {
+		c.t.Fatal(err)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		c.t.Fatal(err)
+	}
+	var message map[string]interface{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		c.t.Fatal(err)
+	}
+	return message
+}
+
+func (c *dapClient) request(command string, arguments interface{}) map[string]interface{} {
+	c.t.Helper()
+	c.seq++
+	data, _ := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": arguments})
+	fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	for {
+		message := c.receive()
+		if message["type"] == "event" {
+			c.events = append(c.events, message)
+			continue
+		}
+		if message["success"] != true {
+			c.t.Fatalf("%s failed: %v", command, message["message"])
+		}
+		body, _ := message["body"].(map[string]interface{})
+		return body
+	}
+}
+
+// waitEvent returns the body of the next event with the given name.
+func (c *dapClient) waitEvent(name string) map[string]interface{} {
+	c.t.Helper()
+	for {
+		var event map[string]interface{}
+		if len(c.events) > 0 {
+			event, c.events = c.events[0], c.events[1:]
+		} else {
+			event = c.receive()
+		}
+		if event["event"] == name {
+			body, _ := event["body"].(map[string]interface{})
+			return body
+		}
+	}
+}
+
+// where returns the function and line of the innermost frames.
+func (c *dapClient) where() []string {
+	c.t.Helper()
+	var frames []string
+	body := c.request("stackTrace", map[string]interface{}{"threadId": 1})
+	for _, f := range body["stackFrames"].([]interface{}) {
+		frame := f.(map[string]interface{})
+		frames = append(frames, fmt.Sprintf("%s:%v", frame["name"], frame["line"]))
+	}
+	return frames
+}
+
+func TestDAP(t *testing.T) {
+	program := asm.MustAssemble(0x80010000, `
+main:	addiu $sp, $sp, -8
+	sw    $ra, 4($sp)
+	la    $s0, counter
+line4:	jal   bump
+line5:	jal   bump
+line6:	lw    $ra, 4($sp)
+	li    $t3, 1000000
+spin:	addiu $t3, $t3, -1
+	bnez  $t3, spin
+	nop
+exit:	lw    $t0, 0($s0)
+	lui   $t1, 0x1F80
+	sb    $t0, 0x2082($t1)    # exit port
+	b     .
+bump:	lw    $t0, 0($s0)
+	nop
+	addiu $t0, $t0, 1
+line10:	sw    $t0, 0($s0)
+	jr    $ra
+	.align 2
+counter: .word 0
+`)
+	labels := program.Labels
+	sections := buildLineTables("/src/main.c", []SourceLine{
+		{Address: labels["main"], Line: 3},
+		{Address: labels["line4"], Line: 4},
+		{Address: labels["line5"], Line: 5},
+		{Address: labels["line6"], Line: 6},
+		{Address: labels["spin"], Line: 7},
+		{Address: labels["exit"], Line: 12},
+		{Address: labels["bump"], Line: 9},
+		{Address: labels["line10"], Line: 10},
+	}, labels["counter"])
+	path := filepath.Join(t.TempDir(), "main.elf")
+	if err := os.WriteFile(path, buildELF(program.Code, map[string]uint32{"bump": labels["bump"]}, sections...), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	requests, server := io.Pipe()
+	client, responses := io.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- ServeDAP(requests, responses)
+	}()
+	c := &dapClient{t: t, w: server, r: bufio.NewReader(client)}
+
+	c.request("initialize", map[string]string{"adapterID": "ps"})
+	c.request("launch", map[string]interface{}{"program": path, "stopOnEntry": true})
+	c.waitEvent("initialized")
+	body := c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": "main.c"},
+		"breakpoints": []map[string]int{{"line": 8}},
+	})
+	breakpoint := body["breakpoints"].([]interface{})[0].(map[string]interface{})
+	assertEqual(t, breakpoint["verified"], true)
+	assertEqual(t, breakpoint["line"], float64(9))
+
+	c.request("configurationDone", nil)
+	assertEqual(t, c.waitEvent("stopped")["reason"], "entry")
+	assertEqual(t, fmt.Sprint(c.where()), "[main:3]")
+
+	c.request("next", map[string]int{"threadId": 1})
+	// The response comes before the program stops.
+	assertEqual(t, len(c.events), 0)
+	assertEqual(t, c.waitEvent("stopped")["reason"], "step")
+	assertEqual(t, fmt.Sprint(c.where()), "[main+0x10:4]")
+
+	c.request("continue", map[string]int{"threadId": 1})
+	assertEqual(t, c.waitEvent("stopped")["reason"], "breakpoint")
+	assertEqual(t, fmt.Sprint(c.where()), "[bump:9 main+0x10:4]")
+
+	c.request("stepOut", map[string]int{"threadId": 1})
+	assertEqual(t, c.waitEvent("stopped")["reason"], "step")
+	assertEqual(t, fmt.Sprint(c.where()), "[main+0x18:5]")
+
+	c.request("setBreakpoints", map[string]interface{}{"source": map[string]string{"path": "/src/main.c"}})
+	c.request("stepIn", map[string]int{"threadId": 1})
+	c.waitEvent("stopped")
+	assertEqual(t, fmt.Sprint(c.where()), "[bump:9 main+0x18:5]")
+
+	c.request("next", map[string]interface{}{"threadId": 1, "granularity": "instruction"})
+	c.waitEvent("stopped")
+	body = c.request("scopes", map[string]int{"frameId": 0})
+	assertEqual(t, len(body["scopes"].([]interface{})), 3)
+	body = c.request("variables", map[string]int{"variablesReference": 1})
+	registers := make(map[string]interface{})
+	for _, v := range body["variables"].([]interface{}) {
+		variable := v.(map[string]interface{})
+		registers[variable["name"].(string)] = variable["value"]
+	}
+	assertEqual(t, registers["pc"], fmt.Sprintf("0x%08X", labels["bump"]+4))
+	assertEqual(t, registers["s0"], fmt.Sprintf("0x%08X", labels["counter"]))
+	body = c.request("evaluate", map[string]string{"expression": "$pc - bump"})
+	assertEqual(t, body["result"], "0x00000004")
+
+	// Breakpoints can be set while the program runs.
+	c.request("continue", map[string]int{"threadId": 1})
+	body = c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": "/src/main.c"},
+		"breakpoints": []map[string]int{{"line": 12}},
+	})
+	assertEqual(t, body["breakpoints"].([]interface{})[0].(map[string]interface{})["verified"], true)
+	assertEqual(t, c.waitEvent("stopped")["reason"], "breakpoint")
+	assertEqual(t, fmt.Sprint(c.where()), "[main+0x3C:12]")
+
+	c.request("continue", map[string]int{"threadId": 1})
+	assertEqual(t, c.waitEvent("exited")["exitCode"], float64(2))
+	c.request("disconnect", nil)
+	assertEqual(t, <-done, nil)
+}
+
+func TestTrace(t *testing.T) {
+	bus := newBus(t)
+	cpu := NewCPU()
+	program := asm.MustAssemble(0x80010000, `
+	li    $t0, 0x1234
+	sw    $t0, 0x100($zero)
+	lw    $t1, 0x100($zero)
+	multu $t0, $t0
+	syscall
+`)
+	bus.Write(program.Origin, program.Code)
+	cpu.Jump(program.Origin)
+
+	var trace bytes.Buffer
+	recorder := NewTraceRecorder(&trace)
+	recorder.Attach(&cpu, bus)
+	for i := 0; i < 6; i++ {
+		cpu.Cycle(bus)
+	}
+	assertEqual(t, recorder.Flush(), nil)
+
+	var text strings.Builder
+	r, err := NewTraceReader(&trace)
+	assertEqual(t, err, nil)
+	for {
+		step, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		assertEqual(t, err, nil)
+		fmt.Fprintln(&text, step)
+	}
+	assertEqual(t, text.String(), `80010000 24081234 r8=00001234
+80010004 AC080100 s4@00000100=00001234
+80010008 8C090100 l4@00000100=00001234
+8001000C 01080019 r9=00001234 lo=014B5A90
+80010010 0000000C exc=08
+80000080 00000000
+`)
+
+	// The text format reads back the same.
+	r, err = NewTraceReader(strings.NewReader("# exported\n" + text.String()))
+	assertEqual(t, err, nil)
+	step, err := r.Next()
+	assertEqual(t, err, nil)
+	assertEqual(t, step.String(), "80010000 24081234 r8=00001234")
+	for i := 0; i < 4; i++ {
+		step, err = r.Next()
+	}
+	assertEqual(t, err, nil)
+	assertEqual(t, step.Exception, ExceptionSyscall)
+	for _, line := range []string{"80010000 34081234 q1=0", "80010000 00000000 =5"} {
+		if _, err := ParseTraceStep(line); err == nil {
+			t.Fatalf("expected an error for %q", line)
+		}
+	}
+}
+
+func TestCrashReport(t *testing.T) {
+	bus := newBus(t)
+	cpu := NewCPU()
+	program := asm.MustAssemble(0x80010000, `
+	li    $sp, 0x801FFF00
+	li    $t0, 0x1234
+	sw    $t0, 0($sp)
+	lui   $t1, 0x1F90
+	lw    $t2, 0($t1)
+`)
+	bus.Write(program.Origin, program.Code)
+	cpu.Jump(program.Origin)
+	NewHistory(4).Attach(&cpu, bus)
+
+	_, exited, err := cpu.Run(bus, 100)
+	assertEqual(t, exited, false)
+	var report *CrashReport
+	if !errors.As(err, &report) {
+		t.Fatalf("expected a crash report, got %v", err)
+	}
+	assertEqual(t, report.Error(), "crash at 80010014h: load at unmapped address 1F900000h")
+	var busError *BusError
+	if !errors.As(err, &busError) {
+		t.Fatalf("expected a bus error, got %v", err)
+	}
+	assertEqual(t, busError.Address, uint32(0x1F900000))
+	assertEqual(t, report.GPR[8], uint32(0x1234))
+	assertEqual(t, len(report.Recent), 4)
+	assertEqual(t, report.Recent[1].String(), "8001000C AFA80000 s4@801FFF00=00001234")
+	assertEqual(t, report.Recent[3].PC, uint32(0x80010014))
+	assertEqual(t, report.Stack[0], uint32(0x1234))
+
+	var text strings.Builder
+	report.WriteTo(&text)
+	assertEqual(t, strings.Contains(text.String(), "=> 80010014  8D2A0000  LW      $t2, 0h($t1)\n"), true)
+
+	// Unknown instructions crash too, and Step reports it.
+	bus.StoreWord(0x80010000, 0xFC000000)
+	cpu.Jump(0x80010000)
+	err = cpu.Step(bus)
+	if !errors.As(err, &report) {
+		t.Fatalf("expected a crash report, got %v", err)
+	}
+	assertEqual(t, report.PC, uint32(0x80010000))
+	var unimplemented *UnimplementedError
+	if !errors.As(err, &unimplemented) {
+		t.Fatalf("expected an unimplemented feature, got %v", err)
+	}
+	assertEqual(t, unimplemented.Feature, "primary instruction 3Fh")
+	assertEqual(t, report.GoStack == nil, true)
+
+	// Bugs in the emulator are reported with its stack.
+	cpu.AddHook(0x80010000, func(cpu *CPU, bus *Bus) { panic("boom") })
+	cpu.Jump(0x80010000)
+	err = cpu.Step(bus)
+	if !errors.As(err, &report) {
+		t.Fatalf("expected a crash report, got %v", err)
+	}
+	assertEqual(t, report.Err.Error(), "panic: boom")
+	assertEqual(t, strings.Contains(string(report.GoStack), "TestCrashReport"), true)
+	text.Reset()
+	report.WriteTo(&text)
+	assertEqual(t, strings.Contains(text.String(), "\nemulator stack:\n"), true)
+
+	if _, err := NewBus(make([]byte, 1024)); err != ErrBIOSSize {
+		t.Fatalf("expected ErrBIOSSize, got %v", err)
+	}
+}
+
+func TestSystem(t *testing.T) {
+	exe, err := ParseEXE(asm.MustAssemble(0x80010000, `
+	la    $a0, message
+	li    $t2, 0xA0
+	.set noreorder
+	jalr  $t2
+	li    $t1, 0x3E          # puts
+	.set reorder
+	li    $t0, 300000
+loop:
+	addiu $t0, $t0, -1
+	bnez  $t0, loop
+	lui   $t0, 0x1F80
+	li    $t1, 42
+	sb    $t1, 0x2082($t0)   # exit port
+	b     .
+message:
+	.asciiz "hello"
+`).EXE())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tty, trace bytes.Buffer
+	system, err := NewSystem(Config{Program: exe, TTY: &tty, Trace: &trace})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(t, system.RunFrame(), nil)
+	assertEqual(t, system.Bus.Timing().Frame(), uint64(1))
+	assertEqual(t, tty.String(), "hello\n")
+
+	// A paused system doesn't run until it is resumed, and Run still
+	// returns when its context is cancelled.
+	system.Pause()
+	assertEqual(t, system.RunCycles(100), ErrPaused)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- system.Run(ctx) }()
+	cancel()
+	assertEqual(t, <-done, context.Canceled)
+
+	system.Resume()
+	var exit *ExitError
+	if err := system.Run(context.Background()); !errors.As(err, &exit) {
+		t.Fatalf("expected the program to exit, got %v", err)
+	}
+	assertEqual(t, exit.Code, 42)
+
+	assertEqual(t, system.Reset(), nil)
+	assertEqual(t, system.Bus.Timing().Frame(), uint64(0))
+	assertEqual(t, system.RunCycles(100000), nil)
+	assertEqual(t, tty.String(), "hello\nhello\n")
+
+	// The trace goes on across the reset.
+	r, err := NewTraceReader(&trace)
+	assertEqual(t, err, nil)
+	for {
+		_, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		assertEqual(t, err, nil)
+	}
+
+	if _, err := NewSystem(Config{BIOS: make([]byte, BIOSSize), Disc: &Disc{}}); err == nil {
+		t.Fatal("expected an error for a disc without the emulated kernel")
+	}
+}
+
+func TestParallelSystems(t *testing.T) {
+	exe, err := ParseEXE(asm.MustAssemble(0x80010000, `
+	li    $s0, 1
+	li    $s1, 5000
+	lui   $s2, 0x8002
+loop:
+	sll   $t0, $s0, 5
+	xor   $s0, $s0, $t0
+	sw    $s0, 0($s2)
+	lw    $t1, 0($s2)
+	addu  $s0, $t1, $s1
+	addiu $s1, $s1, -1
+	bnez  $s1, loop
+	la    $a0, message
+	li    $t2, 0xA0
+	.set noreorder
+	jalr  $t2
+	li    $t1, 0x3E          # puts
+	.set reorder
+	lui   $t0, 0x1F80
+	sb    $s0, 0x2082($t0)   # exit port
+	b     .
+message:
+	.asciiz "done"
+`).EXE())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		tty, log string
+		trace    []byte
+		code     int
+	}
+	run := func(t *testing.T) result {
+		var tty, log, trace bytes.Buffer
+		system, err := NewSystem(Config{Program: exe, TTY: &tty, Log: &log, Trace: &trace})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exit *ExitError
+		if err := system.Run(context.Background()); !errors.As(err, &exit) {
+			t.Fatalf("expected the program to exit, got %v", err)
+		}
+		return result{tty.String(), log.String(), trace.Bytes(), exit.Code}
+	}
+
+	want := run(t)
+	assertEqual(t, want.tty, "done\n")
+	assertEqual(t, strings.Count(want.log, fmt.Sprintf("exit port: exit code %d\n", want.code)), 1)
+
+	// Every system has its own output and runs exactly like the first one.
+	for i := 0; i < 8; i++ {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			t.Parallel()
+			got := run(t)
+			assertEqual(t, got.tty, want.tty)
+			assertEqual(t, got.code, want.code)
+			assertEqual(t, strings.Count(got.log, "exit port"), 1)
+			if !bytes.Equal(got.trace, want.trace) {
+				t.Error("traces differ")
+			}
+		})
+	}
+}
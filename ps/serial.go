@@ -0,0 +1,86 @@
+package ps
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// SerialPipe is one end of an in-process serial link. The DTR and RTS lines
+// of each end show up as DSR and CTS on the other.
+type SerialPipe struct {
+	reader *io.PipeReader
+	writer *io.PipeWriter
+
+	lines *pipeLines
+	side  int
+}
+
+type pipeLines struct {
+	sync.Mutex
+	dtr, rts [2]bool
+}
+
+// NewSerialPipe returns the two ends of a serial link, e.g. to join the SIO1
+// ports of two emulator instances like a link cable.
+func NewSerialPipe() (*SerialPipe, *SerialPipe) {
+	aReader, bWriter := io.Pipe()
+	bReader, aWriter := io.Pipe()
+	lines := &pipeLines{}
+
+	a := &SerialPipe{reader: aReader, writer: aWriter, lines: lines, side: 0}
+	b := &SerialPipe{reader: bReader, writer: bWriter, lines: lines, side: 1}
+	return a, b
+}
+
+func (pipe *SerialPipe) Read(p []byte) (int, error) {
+	return pipe.reader.Read(p)
+}
+
+func (pipe *SerialPipe) Write(p []byte) (int, error) {
+	return pipe.writer.Write(p)
+}
+
+// Close closes both directions of this end.
+func (pipe *SerialPipe) Close() error {
+	pipe.reader.Close()
+	return pipe.writer.Close()
+}
+
+func (pipe *SerialPipe) SetOutputs(dtr, rts bool) {
+	pipe.lines.Lock()
+	defer pipe.lines.Unlock()
+	pipe.lines.dtr[pipe.side] = dtr
+	pipe.lines.rts[pipe.side] = rts
+}
+
+func (pipe *SerialPipe) Inputs() (dsr, cts bool) {
+	pipe.lines.Lock()
+	defer pipe.lines.Unlock()
+	other := 1 - pipe.side
+	return pipe.lines.dtr[other], pipe.lines.rts[other]
+}
+
+// AcceptSerialSocket listens on a Unix socket at path and waits for a single
+// client to connect. The socket file is removed once the client is accepted.
+// A socket left at path by an earlier run is replaced, other files are not.
+func AcceptSerialSocket(path string) (net.Conn, error) {
+	listener, err := ListenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	return listener.Accept()
+}
+
+// ListenUnix listens on a Unix socket at path. A socket left at path by an
+// earlier run is replaced. Any other file is kept, so that a mistyped path
+// can't delete it, and listening fails.
+func ListenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
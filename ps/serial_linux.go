@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package ps
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func ioctl(file *os.File, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// OpenPTY creates a pseudo terminal in raw mode and returns its master side
+// together with the path of the slave device (/dev/pts/N), which host tools
+// open like a real serial port.
+func OpenPTY() (*os.File, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, "", fmt.Errorf("unlock pty: %w", err)
+	}
+
+	var index uint32
+	if err := ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&index)); err != nil {
+		master.Close()
+		return nil, "", fmt.Errorf("get pty number: %w", err)
+	}
+
+	var termios syscall.Termios
+	if err := ioctl(master, syscall.TCGETS, unsafe.Pointer(&termios)); err != nil {
+		master.Close()
+		return nil, "", fmt.Errorf("get pty attributes: %w", err)
+	}
+
+	// Equivalent of cfmakeraw
+	termios.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	termios.Oflag &^= syscall.OPOST
+	termios.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	termios.Cflag &^= syscall.CSIZE | syscall.PARENB
+	termios.Cflag |= syscall.CS8
+
+	if err := ioctl(master, syscall.TCSETS, unsafe.Pointer(&termios)); err != nil {
+		master.Close()
+		return nil, "", fmt.Errorf("set pty attributes: %w", err)
+	}
+
+	return master, fmt.Sprintf("/dev/pts/%d", index), nil
+}
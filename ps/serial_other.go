@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package ps
+
+import (
+	"errors"
+	"os"
+)
+
+// OpenPTY is only supported on Linux.
+func OpenPTY() (*os.File, string, error) {
+	return nil, "", errors.New("pty serial links are only supported on Linux")
+}
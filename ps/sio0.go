@@ -0,0 +1,300 @@
+package ps
+
+// SIO0 register bits
+// http://problemkaputt.de/psx-spx.htm#controllerandmemorycardioports
+const (
+	sio0StatTXReady    = 1 << 0
+	sio0StatRXNotEmpty = 1 << 1
+	sio0StatTXFinished = 1 << 2
+	sio0StatACKLow     = 1 << 7
+	sio0StatIRQ        = 1 << 9
+
+	sio0CtrlSelect      = 1 << 1
+	sio0CtrlAcknowledge = 1 << 4
+	sio0CtrlReset       = 1 << 6
+	sio0CtrlACKIRQ      = 1 << 12
+	sio0CtrlSlot        = 1 << 13
+)
+
+// Address bytes sent by the console to pick a device on the selected port.
+const (
+	AddressController = 0x01
+	AddressMemoryCard = 0x81
+)
+
+// Delays (in CPU cycles) between the end of a byte transfer and the /ACK pulse
+// of the addressed device.
+const (
+	controllerAckDelay = 338
+	memoryCardAckDelay = 170
+)
+
+// Controller is a peripheral plugged into a controller port. The console
+// exchanges one byte at a time with it over SIO0.
+type Controller interface {
+	// Transfer receives a byte from the console and returns the byte sent
+	// back. ack reports whether the device pulses /ACK, i.e. whether it is
+	// expecting another byte.
+	Transfer(value uint8) (reply uint8, ack bool)
+
+	// Deselect is called when the console releases the port's select line and
+	// the device must get ready for a new command.
+	Deselect()
+}
+
+// pluggable is implemented by controllers that follow the video timing or
+// raise interrupts. ConnectController plugs them into its bus and unplugs
+// the controller they replace.
+type pluggable interface {
+	plug(bus *Bus)
+	unplug(bus *Bus)
+}
+
+// Hub is a Controller that other controllers and memory cards plug into, such
+// as the multitap. It receives every transfer whose address it accepts,
+// including memory card accesses.
+type Hub interface {
+	Controller
+	Accepts(address uint8) bool
+}
+
+// ControllerPort is one of the two controller/memory card slots.
+type ControllerPort struct {
+	Controller Controller
+	MemoryCard *MemoryCard
+
+	// active is the device addressed by the first byte of the current
+	// transfer, done is set once it stops acknowledging.
+	active  Controller
+	address uint8
+	done    bool
+}
+
+func (port *ControllerPort) transfer(value uint8) (uint8, bool) {
+	if port.done {
+		return 0xFF, false
+	}
+
+	if port.active == nil {
+		port.address = value
+		if hub, ok := port.Controller.(Hub); ok && hub.Accepts(value) {
+			port.active = hub
+		} else {
+			port.activate(value)
+		}
+
+		if port.active == nil {
+			port.done = true
+			return 0xFF, false
+		}
+	}
+
+	reply, ack := port.active.Transfer(value)
+	if !ack {
+		port.done = true
+	}
+	return reply, ack
+}
+
+func (port *ControllerPort) activate(address uint8) {
+	switch address {
+	case AddressController:
+		port.active = port.Controller
+	case AddressMemoryCard:
+		if port.MemoryCard != nil {
+			port.active = port.MemoryCard
+		}
+	}
+}
+
+func (port *ControllerPort) deselect() {
+	if port.Controller != nil {
+		port.Controller.Deselect()
+	}
+	if port.MemoryCard != nil {
+		port.MemoryCard.Deselect()
+	}
+	port.active = nil
+	port.address = 0
+	port.done = false
+}
+
+// exchange sends a packet without SIO0 timing and returns the replies until
+// the device stops acknowledging. It is used by the HLE kernel.
+func (port *ControllerPort) exchange(packet ...uint8) []uint8 {
+	port.deselect()
+	defer port.deselect()
+
+	var reply []uint8
+	for _, value := range packet {
+		b, ack := port.transfer(value)
+		reply = append(reply, b)
+		if !ack {
+			break
+		}
+	}
+	return reply
+}
+
+func (port *ControllerPort) ackDelay() uint32 {
+	if port.address&0x80 != 0 {
+		return memoryCardAckDelay
+	}
+	return controllerAckDelay
+}
+
+// SIO0 is the serial interface used by controllers and memory cards.
+type SIO0 struct {
+	interrupts *Interrupts
+	ports      [2]ControllerPort
+
+	stat uint32
+	mode uint16
+	ctrl uint16
+	baud uint16
+
+	rx      uint8
+	rxValid bool
+
+	// transferCycles counts down until the byte being exchanged arrives,
+	// ackCycles until the addressed device pulses /ACK.
+	transferCycles uint32
+	ackCycles      uint32
+	reply          uint8
+	ack            bool
+}
+
+func NewSIO0(interrupts *Interrupts) *SIO0 {
+	return &SIO0{
+		interrupts: interrupts,
+		stat:       sio0StatTXReady | sio0StatTXFinished,
+		baud:       0x88,
+	}
+}
+
+// Port returns controller port 0 or 1.
+func (sio *SIO0) Port(index int) *ControllerPort {
+	return &sio.ports[index]
+}
+
+func (sio *SIO0) selectedPort() *ControllerPort {
+	return &sio.ports[(sio.ctrl&sio0CtrlSlot)>>13]
+}
+
+func (sio *SIO0) write(value uint8) {
+	sio.stat &^= sio0StatTXFinished | sio0StatACKLow
+	sio.transferCycles = uint32(sio.baud) * 8
+	if sio.transferCycles == 0 {
+		sio.transferCycles = 1
+	}
+
+	if sio.ctrl&sio0CtrlSelect == 0 {
+		sio.reply, sio.ack = 0xFF, false
+		return
+	}
+
+	sio.reply, sio.ack = sio.selectedPort().transfer(value)
+}
+
+func (sio *SIO0) read() uint8 {
+	value := uint8(0xFF)
+	if sio.rxValid {
+		value = sio.rx
+		sio.rxValid = false
+		sio.stat &^= sio0StatRXNotEmpty
+	}
+	return value
+}
+
+func (sio *SIO0) setControl(value uint16) {
+	if value&sio0CtrlReset != 0 {
+		sio.reset()
+		return
+	}
+
+	if value&sio0CtrlAcknowledge != 0 {
+		sio.stat &^= sio0StatIRQ
+	}
+
+	previous := sio.ctrl
+	sio.ctrl = value &^ (sio0CtrlAcknowledge | sio0CtrlReset)
+
+	deselected := previous&sio0CtrlSelect != 0 && sio.ctrl&sio0CtrlSelect == 0
+	switched := previous&sio0CtrlSlot != sio.ctrl&sio0CtrlSlot
+	if deselected || switched {
+		sio.ports[(previous&sio0CtrlSlot)>>13].deselect()
+	}
+}
+
+func (sio *SIO0) reset() {
+	for i := range sio.ports {
+		sio.ports[i].deselect()
+	}
+	sio.stat = sio0StatTXReady | sio0StatTXFinished
+	sio.mode = 0
+	sio.ctrl = 0
+	sio.rxValid = false
+	sio.transferCycles = 0
+	sio.ackCycles = 0
+}
+
+func (sio *SIO0) Tick(cycles uint32) {
+	if sio.transferCycles > 0 {
+		if cycles < sio.transferCycles {
+			sio.transferCycles -= cycles
+			return
+		}
+		cycles -= sio.transferCycles
+		sio.transferCycles = 0
+
+		sio.rx = sio.reply
+		sio.rxValid = true
+		sio.stat |= sio0StatRXNotEmpty | sio0StatTXFinished
+		if sio.ack {
+			sio.ackCycles = sio.selectedPort().ackDelay()
+		}
+	}
+
+	if sio.ackCycles > 0 {
+		if cycles < sio.ackCycles {
+			sio.ackCycles -= cycles
+			return
+		}
+		sio.ackCycles = 0
+
+		sio.stat |= sio0StatACKLow
+		if sio.ctrl&sio0CtrlACKIRQ != 0 {
+			sio.stat |= sio0StatIRQ
+			sio.interrupts.Request(IRQController)
+		}
+	}
+}
+
+func (sio *SIO0) Load(offset uint32) uint32 {
+	switch offset {
+	case 0x0:
+		return uint32(sio.read())
+	case 0x4:
+		return sio.stat
+	case 0x8:
+		return uint32(sio.mode)
+	case 0xA:
+		return uint32(sio.ctrl)
+	case 0xE:
+		return uint32(sio.baud)
+	}
+	return 0
+}
+
+func (sio *SIO0) Store(offset uint32, value uint32) {
+	switch offset {
+	case 0x0:
+		sio.write(uint8(value))
+	case 0x8:
+		sio.mode = uint16(value)
+	case 0xA:
+		sio.setControl(uint16(value))
+	case 0xE:
+		sio.baud = uint16(value)
+	}
+}
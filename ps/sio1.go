@@ -0,0 +1,318 @@
+package ps
+
+import (
+	"io"
+)
+
+// SIO1 register bits
+// http://problemkaputt.de/psx-spx.htm#serialportsio
+const (
+	sio1StatTXReady    = 1 << 0
+	sio1StatRXNotEmpty = 1 << 1
+	sio1StatTXIdle     = 1 << 2
+	sio1StatRXOverrun  = 1 << 4
+	sio1StatDSR        = 1 << 7
+	sio1StatCTS        = 1 << 8
+	sio1StatIRQ        = 1 << 9
+
+	sio1CtrlTXEnable    = 1 << 0
+	sio1CtrlDTR         = 1 << 1
+	sio1CtrlRXEnable    = 1 << 2
+	sio1CtrlAcknowledge = 1 << 4
+	sio1CtrlRTS         = 1 << 5
+	sio1CtrlReset       = 1 << 6
+	sio1CtrlTXIRQ       = 1 << 10
+	sio1CtrlRXIRQ       = 1 << 11
+	sio1CtrlDSRIRQ      = 1 << 12
+)
+
+const (
+	sio1FIFOSize = 8
+
+	// sio1BitsPerCharacter counts the start and stop bits of 8N1 framing.
+	sio1BitsPerCharacter = 10
+)
+
+// ModemLines is implemented by serial links that carry the handshake lines.
+// Links that don't implement it behave as if the far end always asserts DSR
+// and CTS.
+type ModemLines interface {
+	// SetOutputs sets the DTR and RTS lines driven by the console.
+	SetOutputs(dtr, rts bool)
+	// Inputs returns the DSR and CTS lines driven by the far end.
+	Inputs() (dsr, cts bool)
+}
+
+// SIO1 is the serial port at 1F801050h. Its far end is an io.ReadWriter such
+// as a pty, a socket or one end of a SerialPipe.
+type SIO1 struct {
+	interrupts *Interrupts
+
+	link     io.ReadWriter
+	received chan byte
+	transmit chan byte
+	stop     chan struct{}
+
+	stat uint32
+	mode uint16
+	ctrl uint16
+	baud uint16
+
+	rx       []byte
+	tx       byte
+	txFull   bool
+	txCycles uint32
+	rxCycles uint32
+}
+
+func NewSIO1(interrupts *Interrupts) *SIO1 {
+	return &SIO1{
+		interrupts: interrupts,
+		stat:       sio1StatTXReady | sio1StatTXIdle,
+		baud:       0xDC,
+		mode:       0x4E,
+	}
+}
+
+// Connect attaches link as the far end of the port. Bytes are read from and
+// written to link by background goroutines. Passing nil disconnects the port.
+// The goroutines of a previous link stop; one blocked reading the old link
+// exits when that read returns, so close the old link to release it at once.
+func (sio *SIO1) Connect(link io.ReadWriter) {
+	if sio.transmit != nil {
+		close(sio.transmit)
+		close(sio.stop)
+	}
+
+	sio.link = link
+	sio.received = nil
+	sio.transmit = nil
+	sio.stop = nil
+	if link == nil {
+		return
+	}
+
+	received := make(chan byte, 4096)
+	stop := make(chan struct{})
+	go func() {
+		defer close(received)
+		buffer := make([]byte, 256)
+		for {
+			n, err := link.Read(buffer)
+			for _, b := range buffer[:n] {
+				select {
+				case received <- b:
+				case <-stop:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+
+	transmit := make(chan byte, 4096)
+	go func() {
+		for b := range transmit {
+			if _, err := link.Write([]byte{b}); err != nil {
+				return
+			}
+		}
+	}()
+
+	sio.received = received
+	sio.transmit = transmit
+	sio.stop = stop
+	sio.updateOutputs()
+}
+
+// cyclesPerCharacter returns the time it takes to shift one character at the
+// configured baud rate.
+func (sio *SIO1) cyclesPerCharacter() uint32 {
+	factor := [4]uint32{1, 1, 16, 64}[sio.mode&3]
+	cycles := uint32(sio.baud) * factor * sio1BitsPerCharacter
+	if cycles == 0 {
+		cycles = 1
+	}
+	return cycles
+}
+
+func (sio *SIO1) inputs() (dsr, cts bool) {
+	if sio.link == nil {
+		return false, false
+	}
+	if lines, ok := sio.link.(ModemLines); ok {
+		return lines.Inputs()
+	}
+	return true, true
+}
+
+func (sio *SIO1) updateOutputs() {
+	if lines, ok := sio.link.(ModemLines); ok {
+		lines.SetOutputs(sio.ctrl&sio1CtrlDTR != 0, sio.ctrl&sio1CtrlRTS != 0)
+	}
+}
+
+func (sio *SIO1) write(value uint8) {
+	sio.tx = value
+	sio.txFull = true
+	sio.stat &^= sio1StatTXReady | sio1StatTXIdle
+}
+
+func (sio *SIO1) read() uint8 {
+	if len(sio.rx) == 0 {
+		return 0
+	}
+	value := sio.rx[0]
+	sio.rx = sio.rx[1:]
+	if len(sio.rx) == 0 {
+		sio.stat &^= sio1StatRXNotEmpty
+	}
+	return value
+}
+
+func (sio *SIO1) setControl(value uint16) {
+	if value&sio1CtrlReset != 0 {
+		sio.reset()
+		return
+	}
+
+	if value&sio1CtrlAcknowledge != 0 {
+		sio.stat &^= sio1StatIRQ | sio1StatRXOverrun
+	}
+
+	sio.ctrl = value &^ (sio1CtrlAcknowledge | sio1CtrlReset)
+	sio.updateOutputs()
+}
+
+func (sio *SIO1) reset() {
+	sio.stat = sio1StatTXReady | sio1StatTXIdle
+	sio.mode = 0
+	sio.ctrl = 0
+	sio.rx = nil
+	sio.txFull = false
+	sio.txCycles = 0
+	sio.updateOutputs()
+}
+
+func (sio *SIO1) requestIRQ() {
+	if sio.stat&sio1StatIRQ == 0 {
+		sio.stat |= sio1StatIRQ
+		sio.interrupts.Request(IRQSIO)
+	}
+}
+
+func (sio *SIO1) Tick(cycles uint32) {
+	dsr, cts := sio.inputs()
+	sio.stat &^= sio1StatDSR | sio1StatCTS
+	if dsr {
+		sio.stat |= sio1StatDSR
+		if sio.ctrl&sio1CtrlDSRIRQ != 0 {
+			sio.requestIRQ()
+		}
+	}
+	if cts {
+		sio.stat |= sio1StatCTS
+	}
+
+	sio.tickTransmit(cycles, cts)
+	sio.tickReceive(cycles)
+}
+
+func (sio *SIO1) tickTransmit(cycles uint32, cts bool) {
+	if sio.txCycles > cycles {
+		sio.txCycles -= cycles
+		return
+	}
+	sio.txCycles = 0
+
+	if !sio.txFull || sio.ctrl&sio1CtrlTXEnable == 0 || !cts {
+		if !sio.txFull {
+			sio.stat |= sio1StatTXIdle
+		}
+		return
+	}
+
+	// The character stays in the transmitter while the link is backed up,
+	// just as it would while the far end holds off CTS.
+	if sio.transmit != nil {
+		select {
+		case sio.transmit <- sio.tx:
+		default:
+			return
+		}
+	}
+	sio.txFull = false
+	sio.txCycles = sio.cyclesPerCharacter()
+	sio.stat |= sio1StatTXReady
+	if sio.ctrl&sio1CtrlTXIRQ != 0 {
+		sio.requestIRQ()
+	}
+}
+
+func (sio *SIO1) tickReceive(cycles uint32) {
+	if sio.rxCycles > cycles {
+		sio.rxCycles -= cycles
+		return
+	}
+	sio.rxCycles = 0
+
+	// Bytes are left in the channel while the FIFO is full, as host links
+	// have no flow control that could stop the far end.
+	if sio.ctrl&sio1CtrlRXEnable == 0 || sio.received == nil || len(sio.rx) == sio1FIFOSize {
+		return
+	}
+
+	select {
+	case b, ok := <-sio.received:
+		if !ok {
+			sio.received = nil
+			return
+		}
+		sio.rx = append(sio.rx, b)
+		sio.stat |= sio1StatRXNotEmpty
+		sio.rxCycles = sio.cyclesPerCharacter()
+	default:
+		return
+	}
+
+	threshold := 1 << ((sio.ctrl >> 8) & 3)
+	if sio.ctrl&sio1CtrlRXIRQ != 0 && len(sio.rx) >= threshold {
+		sio.requestIRQ()
+	}
+}
+
+func (sio *SIO1) Load(offset uint32) uint32 {
+	switch offset {
+	case 0x0:
+		return uint32(sio.read())
+	case 0x4:
+		return sio.stat
+	case 0x8:
+		return uint32(sio.mode)
+	case 0xA:
+		return uint32(sio.ctrl)
+	case 0xE:
+		return uint32(sio.baud)
+	}
+	return 0
+}
+
+func (sio *SIO1) Store(offset uint32, value uint32) {
+	switch offset {
+	case 0x0:
+		sio.write(uint8(value))
+	case 0x8:
+		sio.mode = uint16(value)
+	case 0xA:
+		sio.setControl(uint16(value))
+	case 0xE:
+		sio.baud = uint16(value)
+	}
+}
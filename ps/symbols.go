@@ -0,0 +1,79 @@
+package ps
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Symbol is a named address range of a program, such as a function.
+type Symbol struct {
+	Name    string
+	Address uint32
+	// Size is zero when the extent of the symbol is unknown.
+	Size uint32
+}
+
+// SymbolTable maps addresses to symbols. A nil *SymbolTable is empty.
+type SymbolTable struct {
+	symbols []Symbol
+}
+
+func NewSymbolTable() *SymbolTable {
+	return &SymbolTable{}
+}
+
+// Add registers symbols, e.g. the ones imported from an ELF file. The table
+// is sorted again on every call, so add many symbols with a single call.
+func (table *SymbolTable) Add(symbols ...Symbol) {
+	table.symbols = append(table.symbols, symbols...)
+	sort.SliceStable(table.symbols, func(i, j int) bool {
+		return table.symbols[i].Address < table.symbols[j].Address
+	})
+}
+
+// Lookup finds the symbol containing address, which is the closest symbol at
+// or below it.
+func (table *SymbolTable) Lookup(address uint32) (Symbol, bool) {
+	if table == nil {
+		return Symbol{}, false
+	}
+
+	i := sort.Search(len(table.symbols), func(i int) bool {
+		return table.symbols[i].Address > address
+	})
+	if i == 0 {
+		return Symbol{}, false
+	}
+
+	symbol := table.symbols[i-1]
+	if symbol.Size != 0 && address-symbol.Address >= symbol.Size {
+		return Symbol{}, false
+	}
+	return symbol, true
+}
+
+// Address returns the address of the symbol called name.
+func (table *SymbolTable) Address(name string) (uint32, bool) {
+	if table == nil {
+		return 0, false
+	}
+	for _, symbol := range table.symbols {
+		if symbol.Name == name {
+			return symbol.Address, true
+		}
+	}
+	return 0, false
+}
+
+// Format returns address as "symbol+0x14", or as a hexadecimal number if no
+// symbol contains it.
+func (table *SymbolTable) Format(address uint32) string {
+	symbol, ok := table.Lookup(address)
+	switch {
+	case !ok:
+		return fmt.Sprintf("%08Xh", address)
+	case address == symbol.Address:
+		return symbol.Name
+	}
+	return fmt.Sprintf("%s+0x%X", symbol.Name, address-symbol.Address)
+}
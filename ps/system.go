@@ -0,0 +1,283 @@
+package ps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Config describes the machine built by NewSystem.
+type Config struct {
+	// BIOS is a 512 KiB BIOS image. Without one, the kernel is emulated.
+	BIOS []byte
+	// Disc is booted by the emulated kernel. It needs an empty BIOS.
+	Disc *Disc
+	// Program is a PS-X EXE or ELF that is loaded when the kernel has been
+	// initialized, instead of booting the disc.
+	Program Program
+	Region  Region
+
+	// Controllers and MemoryCards are plugged into ports 1 and 2.
+	Controllers [2]Controller
+	MemoryCards [2]*MemoryCard
+
+	// TTY receives the text printed by the guest if set.
+	TTY io.Writer
+	// Trace receives a binary execution trace if set, see TraceRecorder.
+	Trace io.Writer
+	// Log receives diagnostics about the guest if set, see Bus.SetLogOutput.
+	Log io.Writer
+}
+
+// ExitError is returned by the System run methods when the guest wrote its
+// exit code to the exit port.
+type ExitError struct {
+	Code int
+}
+
+func (err *ExitError) Error() string {
+	return fmt.Sprintf("program exited with code %d", err.Code)
+}
+
+// ErrPaused is returned by RunCycles and RunFrame when the system is paused.
+var ErrPaused = errors.New("system is paused")
+
+// runSlice is the number of cycles that run between checks for Pause and
+// context cancellation.
+const runSlice = 4096
+
+// System is a complete machine built from a Config. The run methods return
+// an *ExitError when the guest exits and a *CrashReport when emulation
+// cannot continue.
+//
+// Systems share no state, so any number of them can run in parallel
+// goroutines, and a system runs the same way each time for the same Config.
+type System struct {
+	// CPU, Bus and Console are replaced by Reset. They may only be used
+	// while the system isn't running.
+	CPU     *CPU
+	Bus     *Bus
+	Console *Console
+
+	config Config
+	trace  *TraceRecorder
+
+	// machine is held while the CPU runs a slice of cycles.
+	machine sync.Mutex
+
+	// resumed is closed by Resume, and nil while the system isn't paused.
+	pause   sync.Mutex
+	resumed chan struct{}
+}
+
+// NewSystem builds and powers on the machine described by config.
+func NewSystem(config Config) (*System, error) {
+	s := &System{config: config}
+	if config.Trace != nil {
+		s.trace = NewTraceRecorder(config.Trace)
+	}
+	if err := s.Reset(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reset powers the machine off and on again. Controllers, memory cards and the
+// disc stay inserted.
+func (s *System) Reset() error {
+	s.machine.Lock()
+	defer s.machine.Unlock()
+
+	config := s.config
+	hle := config.BIOS == nil
+	bios := config.BIOS
+	if hle {
+		bios = make([]byte, BIOSSize)
+	} else if config.Disc != nil {
+		return errors.New("discs can only be booted by the emulated kernel")
+	}
+
+	bus, err := NewBus(bios)
+	if err != nil {
+		return err
+	}
+	cpu := NewCPU()
+	bus.SetLogOutput(config.Log)
+	bus.Timing().SetRegion(config.Region)
+	NewHistory(64).Attach(&cpu, bus)
+
+	tty := config.TTY
+	if tty == nil {
+		tty = io.Discard
+	}
+	console := NewConsole(tty)
+	bus.ConnectConsole(console)
+	if hle {
+		kernel := NewKernel()
+		kernel.Disc = config.Disc
+		kernel.TTY = console
+		kernel.Install(&cpu)
+	} else {
+		console.Install(&cpu)
+	}
+
+	for port := range config.Controllers {
+		if config.Controllers[port] != nil {
+			bus.ConnectController(port, config.Controllers[port])
+		}
+		if config.MemoryCards[port] != nil {
+			bus.InsertMemoryCard(port, config.MemoryCards[port])
+		}
+	}
+
+	if config.Program != nil {
+		if elf, ok := config.Program.(*ELF); ok {
+			cpu.Symbols = elf.Symbols
+		}
+		FastBoot(&cpu, config.Program)
+	}
+
+	// The trace continues across resets.
+	if s.trace != nil {
+		s.trace.Attach(&cpu, bus)
+	}
+
+	s.CPU, s.Bus, s.Console = &cpu, bus, console
+	return nil
+}
+
+// Pause stops running the system at the next slice of cycles. It may be
+// called from any goroutine.
+func (s *System) Pause() {
+	s.pause.Lock()
+	defer s.pause.Unlock()
+	if s.resumed == nil {
+		s.resumed = make(chan struct{})
+	}
+}
+
+// Resume lets a paused system run again. It may be called from any
+// goroutine.
+func (s *System) Resume() {
+	s.pause.Lock()
+	defer s.pause.Unlock()
+	if s.resumed != nil {
+		close(s.resumed)
+		s.resumed = nil
+	}
+}
+
+// paused returns a channel that is closed on Resume, or nil if the system
+// isn't paused.
+func (s *System) paused() chan struct{} {
+	s.pause.Lock()
+	defer s.pause.Unlock()
+	return s.resumed
+}
+
+// Paused reports whether Pause was called without a Resume since.
+func (s *System) Paused() bool {
+	return s.paused() != nil
+}
+
+// RunCycles runs n cycles, or fewer if the system is paused meanwhile.
+func (s *System) RunCycles(n int) error {
+	defer s.Flush()
+	for n > 0 {
+		if s.Paused() {
+			return ErrPaused
+		}
+		slice := runSlice
+		if n < slice {
+			slice = n
+		}
+		if _, err := s.run(slice, nil); err != nil {
+			return err
+		}
+		n -= slice
+	}
+	return nil
+}
+
+// RunFrame runs until the next VBlank starts.
+func (s *System) RunFrame() error {
+	defer s.Flush()
+	s.machine.Lock()
+	frame := s.Bus.Timing().Frame()
+	s.machine.Unlock()
+	done := func() bool { return s.Bus.Timing().Frame() != frame }
+
+	for {
+		if s.Paused() {
+			return ErrPaused
+		}
+		if finished, err := s.run(runSlice, done); err != nil || finished {
+			return err
+		}
+	}
+}
+
+// Run runs until ctx is cancelled, the guest exits or emulation fails. While
+// the system is paused, Run waits for Resume.
+func (s *System) Run(ctx context.Context) error {
+	defer s.Flush()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if resumed := s.paused(); resumed != nil {
+			select {
+			case <-resumed:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		if _, err := s.run(runSlice, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// run executes up to n cycles and reports whether it stopped early because
+// done returned true.
+func (s *System) run(n int, done func() bool) (finished bool, err error) {
+	s.machine.Lock()
+	defer s.machine.Unlock()
+	cpu, bus := s.CPU, s.Bus
+	defer cpu.recoverCrash(bus, &err)
+
+	for i := 0; ; i++ {
+		if code, exited := bus.ExitCode(); exited {
+			return false, &ExitError{Code: code}
+		}
+		if done != nil && done() {
+			return true, nil
+		}
+		if i == n {
+			return false, nil
+		}
+		cpu.Cycle(bus)
+	}
+}
+
+// Flush writes out the buffered console and trace output. It reports the
+// first error writing the console, the trace or the memory card images.
+func (s *System) Flush() error {
+	s.machine.Lock()
+	defer s.machine.Unlock()
+	err := s.Console.Flush()
+	if s.trace != nil {
+		if traceErr := s.trace.Flush(); err == nil {
+			err = traceErr
+		}
+	}
+	for _, card := range s.config.MemoryCards {
+		if card != nil && err == nil {
+			err = card.Err()
+		}
+	}
+	return err
+}
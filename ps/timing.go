@@ -0,0 +1,144 @@
+package ps
+
+// Region is the video standard of the console.
+type Region int
+
+const (
+	RegionNTSC Region = iota
+	RegionPAL
+)
+
+func (region Region) String() string {
+	if region == RegionPAL {
+		return "PAL"
+	}
+	return "NTSC"
+}
+
+// VideoClock is the frequency of the GPU video clock. DotClock is the 8 MHz
+// clock used by the GunCon for horizontal coordinates.
+const (
+	VideoClock = 53693175
+	DotClock   = 8000000
+)
+
+// CPU cycles are converted to video cycles with the ratio 11/7, which is close
+// to 53.69 MHz / 33.87 MHz.
+const (
+	videoCyclesPerCPU = 11
+	cpuCyclesPerVideo = 7
+)
+
+const (
+	ntscCyclesPerLine = 3413
+	ntscLinesPerFrame = 263
+	ntscFirstLine     = 16
+	ntscLastLine      = 256
+
+	palCyclesPerLine = 3406
+	palLinesPerFrame = 314
+	palFirstLine     = 20
+	palLastLine      = 308
+
+	displayFirstDot = 0x260
+	displayLastDot  = 0xC60
+)
+
+// VideoTiming tracks the position of the video beam and raises the VBlank
+// interrupt. Horizontal positions are counted in video clock cycles since the
+// start of the scanline.
+// http://problemkaputt.de/psx-spx.htm#gputimings
+type VideoTiming struct {
+	interrupts *Interrupts
+	region     Region
+
+	// remainder holds CPU cycles * 11 that didn't make up a whole video cycle.
+	remainder uint32
+	dot       uint32
+	line      uint32
+	frame     uint64
+}
+
+func NewVideoTiming(interrupts *Interrupts, region Region) *VideoTiming {
+	return &VideoTiming{
+		interrupts: interrupts,
+		region:     region,
+	}
+}
+
+// Region returns the video standard.
+func (timing *VideoTiming) Region() Region {
+	return timing.region
+}
+
+// SetRegion changes the video standard, as the region of the console does.
+func (timing *VideoTiming) SetRegion(region Region) {
+	timing.region = region
+}
+
+func (timing *VideoTiming) cyclesPerLine() uint32 {
+	if timing.region == RegionPAL {
+		return palCyclesPerLine
+	}
+	return ntscCyclesPerLine
+}
+
+func (timing *VideoTiming) linesPerFrame() uint32 {
+	if timing.region == RegionPAL {
+		return palLinesPerFrame
+	}
+	return ntscLinesPerFrame
+}
+
+// DisplayArea returns the first and last (exclusive) dot and scanline of the
+// displayed picture.
+func (timing *VideoTiming) DisplayArea() (firstDot, lastDot, firstLine, lastLine uint32) {
+	if timing.region == RegionPAL {
+		return displayFirstDot, displayLastDot, palFirstLine, palLastLine
+	}
+	return displayFirstDot, displayLastDot, ntscFirstLine, ntscLastLine
+}
+
+// Beam returns the current beam position.
+func (timing *VideoTiming) Beam() (dot, line uint32) {
+	return timing.dot, timing.line
+}
+
+// Frame returns the number of frames that have started VBlank so far.
+func (timing *VideoTiming) Frame() uint64 {
+	return timing.frame
+}
+
+// BeamPosition maps normalized screen coordinates (0..1 from the top left
+// corner of the displayed picture) to a beam position. ok is false for
+// coordinates outside the picture.
+func (timing *VideoTiming) BeamPosition(x, y float64) (dot, line uint32, ok bool) {
+	if x < 0 || x >= 1 || y < 0 || y >= 1 {
+		return 0, 0, false
+	}
+
+	firstDot, lastDot, firstLine, lastLine := timing.DisplayArea()
+	dot = firstDot + uint32(x*float64(lastDot-firstDot))
+	line = firstLine + uint32(y*float64(lastLine-firstLine))
+	return dot, line, true
+}
+
+func (timing *VideoTiming) Tick(cycles uint32) {
+	timing.remainder += cycles * videoCyclesPerCPU
+	timing.dot += timing.remainder / cpuCyclesPerVideo
+	timing.remainder %= cpuCyclesPerVideo
+
+	for timing.dot >= timing.cyclesPerLine() {
+		timing.dot -= timing.cyclesPerLine()
+		timing.line++
+
+		_, _, _, lastLine := timing.DisplayArea()
+		if timing.line == lastLine {
+			timing.frame++
+			timing.interrupts.Request(IRQVBlank)
+		}
+		if timing.line == timing.linesPerFrame() {
+			timing.line = 0
+		}
+	}
+}
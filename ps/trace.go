@@ -0,0 +1,354 @@
+package ps
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Execution traces record every instruction the CPU executes with its
+// effects, so that two runs can be compared step by step.
+//
+// The binary format starts with traceMagic, followed by one record per
+// step. All numbers are little-endian:
+//
+//	u32       PC
+//	u32       instruction word
+//	u8        exception code, FFh if none was raised
+//	uvarint   number of register writes, then for each:
+//	  u8      register: 0-31 for the GPRs, 32 for HI, 33 for LO
+//	  u32     new value
+//	uvarint   number of memory accesses, then for each:
+//	  u8      size in bytes, with bit 7 set for stores
+//	  u32     address
+//	  u32     value loaded or stored
+//
+// The text format has one step per line, which makes it easy to export from
+// other emulators. Empty lines and lines starting with # are ignored:
+//
+//	PPPPPPPP WWWWWWWW [rN=VVVVVVVV | hi=VVVVVVVV | lo=VVVVVVVV | lS@AAAAAAAA=VVVVVVVV | sS@AAAAAAAA=VVVVVVVV | exc=CC]...
+//
+// with hexadecimal PC, word, values, addresses and exception code, decimal
+// register numbers N and access sizes S, "l" for loads and "s" for stores.
+//
+// A register write is a register whose value differs after the step, so a
+// delayed load is recorded at the step where it lands. Register writes and
+// memory accesses made by HLE hooks are recorded with the next instruction,
+// and an interrupt with the first instruction of the handler.
+const traceMagic = "PSTRACE1"
+
+// Pseudo register numbers of TraceRegister.
+const (
+	TraceHI = 32
+	TraceLO = 33
+)
+
+// TraceStep is the record of one executed instruction.
+type TraceStep struct {
+	PC, Word  uint32
+	Registers []TraceRegister
+	Accesses  []TraceAccess
+	// Exception is the exception code, or -1.
+	Exception int
+}
+
+type TraceRegister struct {
+	Index uint8
+	Value uint32
+}
+
+type TraceAccess struct {
+	Op      MemoryOperation
+	Size    uint8
+	Address uint32
+	Value   uint32
+}
+
+// String formats the step in the text trace format.
+func (step TraceStep) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%08X %08X", step.PC, step.Word)
+	for _, r := range step.Registers {
+		switch r.Index {
+		case TraceHI:
+			fmt.Fprintf(&b, " hi=%08X", r.Value)
+		case TraceLO:
+			fmt.Fprintf(&b, " lo=%08X", r.Value)
+		default:
+			fmt.Fprintf(&b, " r%d=%08X", r.Index, r.Value)
+		}
+	}
+	for _, a := range step.Accesses {
+		op := "l"
+		if a.Op == OpStore {
+			op = "s"
+		}
+		fmt.Fprintf(&b, " %s%d@%08X=%08X", op, a.Size, a.Address, a.Value)
+	}
+	if step.Exception >= 0 {
+		fmt.Fprintf(&b, " exc=%02X", step.Exception)
+	}
+	return b.String()
+}
+
+// ParseTraceStep parses a line of a text trace.
+func ParseTraceStep(line string) (TraceStep, error) {
+	step := TraceStep{Exception: -1}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return step, fmt.Errorf("trace: bad step %q", line)
+	}
+	pc, err1 := strconv.ParseUint(fields[0], 16, 32)
+	word, err2 := strconv.ParseUint(fields[1], 16, 32)
+	if err1 != nil || err2 != nil {
+		return step, fmt.Errorf("trace: bad step %q", line)
+	}
+	step.PC, step.Word = uint32(pc), uint32(word)
+
+	for _, field := range fields[2:] {
+		eq := strings.IndexByte(field, '=')
+		if eq <= 0 {
+			return step, fmt.Errorf("trace: bad field %q", field)
+		}
+		key := field[:eq]
+		value, err := strconv.ParseUint(field[eq+1:], 16, 32)
+		if err != nil {
+			return step, fmt.Errorf("trace: bad field %q", field)
+		}
+
+		var at, size uint64
+		switch {
+		case key == "exc":
+			step.Exception = int(value)
+		case key == "hi":
+			step.Registers = append(step.Registers, TraceRegister{TraceHI, uint32(value)})
+		case key == "lo":
+			step.Registers = append(step.Registers, TraceRegister{TraceLO, uint32(value)})
+		case key[0] == 'r':
+			n, err := strconv.ParseUint(key[1:], 10, 8)
+			if err != nil || n > 31 {
+				return step, fmt.Errorf("trace: bad register %q", field)
+			}
+			step.Registers = append(step.Registers, TraceRegister{uint8(n), uint32(value)})
+		case key[0] == 'l' || key[0] == 's':
+			i := strings.IndexByte(key, '@')
+			if i < 0 {
+				return step, fmt.Errorf("trace: bad access %q", field)
+			}
+			if size, err = strconv.ParseUint(key[1:i], 10, 8); err != nil {
+				return step, fmt.Errorf("trace: bad access %q", field)
+			}
+			if at, err = strconv.ParseUint(key[i+1:], 16, 32); err != nil {
+				return step, fmt.Errorf("trace: bad access %q", field)
+			}
+			op := OpLoad
+			if key[0] == 's' {
+				op = OpStore
+			}
+			step.Accesses = append(step.Accesses, TraceAccess{op, uint8(size), uint32(at), uint32(value)})
+		default:
+			return step, fmt.Errorf("trace: bad field %q", field)
+		}
+	}
+	return step, nil
+}
+
+// TraceRecorder writes a binary trace of the instructions executed by a CPU.
+type TraceRecorder struct {
+	w   *bufio.Writer
+	err error
+
+	step TraceStep
+	// registers holds the GPRs, HI and LO after the previous step.
+	registers [34]uint32
+}
+
+func NewTraceRecorder(w io.Writer) *TraceRecorder {
+	t := &TraceRecorder{w: bufio.NewWriter(w), step: TraceStep{Exception: -1}}
+	t.w.WriteString(traceMagic)
+	return t
+}
+
+// Attach starts recording the steps of cpu and the memory accesses on bus.
+func (t *TraceRecorder) Attach(cpu *CPU, bus *Bus) {
+	cpu.trace, bus.trace = t, t
+	copy(t.registers[:], cpu.GPR)
+	t.registers[TraceHI], t.registers[TraceLO] = cpu.HI, cpu.LO
+}
+
+// Flush writes out buffered steps and reports the first write error.
+func (t *TraceRecorder) Flush() error {
+	if t.err != nil {
+		return t.err
+	}
+	t.err = t.w.Flush()
+	return t.err
+}
+
+func (t *TraceRecorder) access(address, size uint32, op MemoryOperation, value uint32) {
+	t.step.Accesses = append(t.step.Accesses, TraceAccess{op, uint8(size), address, value})
+}
+
+func (t *TraceRecorder) exception(code uint32) {
+	t.step.Exception = int(code)
+}
+
+// record completes the step of the instruction at pc.
+func (t *TraceRecorder) record(cpu *CPU, pc, word uint32) {
+	step := &t.step
+	step.PC, step.Word = pc, word
+	for i, value := range cpu.GPR {
+		t.update(uint8(i), value)
+	}
+	t.update(TraceHI, cpu.HI)
+	t.update(TraceLO, cpu.LO)
+
+	if t.err == nil {
+		t.err = writeTraceStep(t.w, step)
+	}
+	step.Registers = step.Registers[:0]
+	step.Accesses = step.Accesses[:0]
+	step.Exception = -1
+}
+
+func (t *TraceRecorder) update(register uint8, value uint32) {
+	if t.registers[register] != value {
+		t.registers[register] = value
+		t.step.Registers = append(t.step.Registers, TraceRegister{register, value})
+	}
+}
+
+func writeTraceStep(w *bufio.Writer, step *TraceStep) error {
+	var buf [binary.MaxVarintLen64 + 9]byte
+	binary.LittleEndian.PutUint32(buf[0:], step.PC)
+	binary.LittleEndian.PutUint32(buf[4:], step.Word)
+	buf[8] = 0xFF
+	if step.Exception >= 0 {
+		buf[8] = uint8(step.Exception)
+	}
+	n := 9 + binary.PutUvarint(buf[9:], uint64(len(step.Registers)))
+	w.Write(buf[:n])
+	for _, r := range step.Registers {
+		buf[0] = r.Index
+		binary.LittleEndian.PutUint32(buf[1:], r.Value)
+		w.Write(buf[:5])
+	}
+
+	n = binary.PutUvarint(buf[:], uint64(len(step.Accesses)))
+	w.Write(buf[:n])
+	for _, a := range step.Accesses {
+		buf[0] = a.Size
+		if a.Op == OpStore {
+			buf[0] |= 0x80
+		}
+		binary.LittleEndian.PutUint32(buf[1:], a.Address)
+		binary.LittleEndian.PutUint32(buf[5:], a.Value)
+		w.Write(buf[:9])
+	}
+	// bufio.Writer returns its first error from all later writes.
+	_, err := w.Write(nil)
+	return err
+}
+
+// TraceReader reads a binary or text trace.
+type TraceReader struct {
+	r    *bufio.Reader
+	text bool
+	line int
+}
+
+// NewTraceReader detects the format of the trace in r.
+func NewTraceReader(r io.Reader) (*TraceReader, error) {
+	t := &TraceReader{r: bufio.NewReader(r)}
+	magic, err := t.r.Peek(len(traceMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(magic, []byte(traceMagic)) {
+		t.r.Discard(len(traceMagic))
+	} else {
+		t.text = true
+	}
+	return t, nil
+}
+
+// Next returns the next step, or io.EOF at the end of the trace.
+func (t *TraceReader) Next() (TraceStep, error) {
+	if t.text {
+		return t.nextText()
+	}
+
+	var header [9]byte
+	if _, err := io.ReadFull(t.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errTruncatedTrace
+		}
+		return TraceStep{}, err
+	}
+	step := TraceStep{
+		PC:        binary.LittleEndian.Uint32(header[0:]),
+		Word:      binary.LittleEndian.Uint32(header[4:]),
+		Exception: -1,
+	}
+	if header[8] != 0xFF {
+		step.Exception = int(header[8])
+	}
+
+	var record [9]byte
+	count, err := binary.ReadUvarint(t.r)
+	if err != nil {
+		return step, errTruncatedTrace
+	}
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(t.r, record[:5]); err != nil {
+			return step, errTruncatedTrace
+		}
+		step.Registers = append(step.Registers, TraceRegister{record[0], binary.LittleEndian.Uint32(record[1:])})
+	}
+
+	if count, err = binary.ReadUvarint(t.r); err != nil {
+		return step, errTruncatedTrace
+	}
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(t.r, record[:]); err != nil {
+			return step, errTruncatedTrace
+		}
+		op := OpLoad
+		if record[0]&0x80 != 0 {
+			op = OpStore
+		}
+		step.Accesses = append(step.Accesses, TraceAccess{
+			Op:      op,
+			Size:    record[0] &^ 0x80,
+			Address: binary.LittleEndian.Uint32(record[1:]),
+			Value:   binary.LittleEndian.Uint32(record[5:]),
+		})
+	}
+	return step, nil
+}
+
+var errTruncatedTrace = errors.New("trace: truncated step")
+
+func (t *TraceReader) nextText() (TraceStep, error) {
+	for {
+		line, err := t.r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return TraceStep{}, err
+		}
+		t.line++
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		step, err := ParseTraceStep(line)
+		if err != nil {
+			return step, fmt.Errorf("line %d: %v", t.line, err)
+		}
+		return step, nil
+	}
+}
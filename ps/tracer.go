@@ -0,0 +1,387 @@
+package ps
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// KernelTracer logs calls to the BIOS function tables at A0h, B0h and C0h
+// with their decoded arguments and results.
+// http://problemkaputt.de/psx-spx.htm#biosfunctionsummary
+type KernelTracer struct {
+	// pending holds the calls that have not returned yet, innermost last.
+	pending []pendingCall
+}
+
+type pendingCall struct {
+	id   string
+	call kernelCall
+	ra   uint32
+}
+
+// maxPendingCalls limits the calls remembered for their result. Functions
+// such as longjmp or Exec never return.
+const maxPendingCalls = 32
+
+// kernelCall describes a kernel function. args holds one character per
+// argument and result one for the result:
+//
+//	s  string
+//	p  pointer
+//	f  function pointer
+//	i  signed integer
+//	x  hexadecimal
+//	c  character
+//	-  no result
+type kernelCall struct {
+	name   string
+	args   string
+	result byte
+}
+
+func NewKernelTracer() *KernelTracer {
+	return &KernelTracer{}
+}
+
+// enter logs a call if the CPU is at a table entry point. It runs before the
+// hooks so that calls handled by the HLE kernel are seen.
+func (tracer *KernelTracer) enter(cpu *CPU, bus *Bus) {
+	table := cpu.Pc & 0x1FFFFFFF
+	if table != 0xA0 && table != 0xB0 && table != 0xC0 {
+		return
+	}
+
+	number := cpu.GPR[9]
+	id := fmt.Sprintf("%02X:%02Xh", table, number)
+	call, ok := kernelCalls[table<<8|number]
+	if !ok || number > 0xFF {
+		call = kernelCall{name: "unknown", args: "xxxx", result: 'x'}
+	}
+
+	args := make([]string, len(call.args))
+	for i := range call.args {
+		args[i] = formatKernelValue(cpu, bus, call.args[i], arg(cpu, bus, i))
+	}
+	bus.logf("kernel: %s %s(%s) from %s", id, call.name, strings.Join(args, ", "), formatKernelValue(cpu, bus, 'f', cpu.GPR[31]))
+
+	if call.result == '-' {
+		return
+	}
+	if len(tracer.pending) == maxPendingCalls {
+		tracer.pending = tracer.pending[1:]
+	}
+	tracer.pending = append(tracer.pending, pendingCall{id: id, call: call, ra: cpu.GPR[31]})
+}
+
+// leave logs the result of a call once execution reaches its return address.
+// Calls that were left without returning are dropped.
+func (tracer *KernelTracer) leave(cpu *CPU, bus *Bus) {
+	for i := len(tracer.pending) - 1; i >= 0; i-- {
+		p := tracer.pending[i]
+		if p.ra != cpu.Pc {
+			continue
+		}
+		bus.logf("kernel: %s %s = %s", p.id, p.call.name, formatKernelValue(cpu, bus, p.call.result, cpu.GPR[2]))
+		tracer.pending = tracer.pending[:i]
+		return
+	}
+}
+
+func formatKernelValue(cpu *CPU, bus *Bus, kind byte, value uint32) string {
+	switch kind {
+	case 's':
+		if s, ok := traceString(bus, value); ok {
+			return strconv.Quote(s)
+		}
+	case 'f':
+		if cpu.Symbols != nil && value != 0 {
+			return cpu.Symbols.Format(value)
+		}
+	case 'i':
+		return strconv.Itoa(int(int32(value)))
+	case 'x':
+		return fmt.Sprintf("%Xh", value)
+	case 'c':
+		if value >= 0x20 && value < 0x7F {
+			return strconv.QuoteRune(rune(value))
+		}
+		return fmt.Sprintf("%02Xh", value)
+	}
+
+	if value == 0 {
+		return "NULL"
+	}
+	return fmt.Sprintf("%08Xh", value)
+}
+
+// traceString reads a string for the trace, limited to memory that can be
+// read without side effects.
+func traceString(bus *Bus, address uint32) (string, bool) {
+	const maxLength = 64
+
+	var s strings.Builder
+	for i := uint32(0); i < maxLength; i++ {
+		a := (address + i) & 0x1FFFFFFF
+		if !inRange(a, MainRAM, MainRAMSize) && !inRange(a, Scratchpad, ScratchpadSize) && !inRange(a, BIOSAddress, BIOSSize) {
+			return "", false
+		}
+		c := bus.LoadByte(address + i)
+		if c == 0 {
+			return s.String(), true
+		}
+		s.WriteByte(c)
+	}
+	return s.String() + "...", true
+}
+
+var kernelCalls = map[uint32]kernelCall{
+	0xA000: {"open", "si", 'i'},
+	0xA001: {"lseek", "iii", 'i'},
+	0xA002: {"read", "ipi", 'i'},
+	0xA003: {"write", "ipi", 'i'},
+	0xA004: {"close", "i", 'i'},
+	0xA005: {"ioctl", "iix", 'i'},
+	0xA006: {"exit", "i", '-'},
+	0xA007: {"isatty", "i", 'i'},
+	0xA008: {"getc", "i", 'c'},
+	0xA009: {"putc", "ci", 'c'},
+	0xA00A: {"todigit", "c", 'i'},
+	0xA00B: {"atof", "s", 'x'},
+	0xA00C: {"strtoul", "spi", 'x'},
+	0xA00D: {"strtol", "spi", 'i'},
+	0xA00E: {"abs", "i", 'i'},
+	0xA00F: {"labs", "i", 'i'},
+	0xA010: {"atoi", "s", 'i'},
+	0xA011: {"atol", "s", 'i'},
+	0xA012: {"atob", "sp", 'i'},
+	0xA013: {"setjmp", "p", 'i'},
+	0xA014: {"longjmp", "pi", '-'},
+	0xA015: {"strcat", "ps", 'p'},
+	0xA016: {"strncat", "psi", 'p'},
+	0xA017: {"strcmp", "ss", 'i'},
+	0xA018: {"strncmp", "ssi", 'i'},
+	0xA019: {"strcpy", "ps", 'p'},
+	0xA01A: {"strncpy", "psi", 'p'},
+	0xA01B: {"strlen", "s", 'i'},
+	0xA01C: {"index", "sc", 'p'},
+	0xA01D: {"rindex", "sc", 'p'},
+	0xA01E: {"strchr", "sc", 'p'},
+	0xA01F: {"strrchr", "sc", 'p'},
+	0xA020: {"strpbrk", "ss", 'p'},
+	0xA021: {"strspn", "ss", 'i'},
+	0xA022: {"strcspn", "ss", 'i'},
+	0xA023: {"strtok", "ss", 'p'},
+	0xA024: {"strstr", "ss", 'p'},
+	0xA025: {"toupper", "c", 'c'},
+	0xA026: {"tolower", "c", 'c'},
+	0xA027: {"bcopy", "ppi", '-'},
+	0xA028: {"bzero", "pi", '-'},
+	0xA029: {"bcmp", "ppi", 'i'},
+	0xA02A: {"memcpy", "ppi", 'p'},
+	0xA02B: {"memset", "pxi", 'p'},
+	0xA02C: {"memmove", "ppi", 'p'},
+	0xA02D: {"memcmp", "ppi", 'i'},
+	0xA02E: {"memchr", "pxi", 'p'},
+	0xA02F: {"rand", "", 'i'},
+	0xA030: {"srand", "x", '-'},
+	0xA031: {"qsort", "piif", '-'},
+	0xA032: {"strtod", "sp", 'x'},
+	0xA033: {"malloc", "i", 'p'},
+	0xA034: {"free", "p", '-'},
+	0xA035: {"lsearch", "ppiif", 'p'},
+	0xA036: {"bsearch", "ppiif", 'p'},
+	0xA037: {"calloc", "ii", 'p'},
+	0xA038: {"realloc", "pi", 'p'},
+	0xA039: {"InitHeap", "pi", '-'},
+	0xA03A: {"_exit", "i", '-'},
+	0xA03B: {"getchar", "", 'c'},
+	0xA03C: {"putchar", "c", 'c'},
+	0xA03D: {"gets", "p", 'p'},
+	0xA03E: {"puts", "s", 'i'},
+	0xA03F: {"printf", "sxxx", 'i'},
+	0xA040: {"SystemErrorUnresolvedException", "", '-'},
+	0xA041: {"LoadTest", "sp", 'i'},
+	0xA042: {"Load", "sp", 'i'},
+	0xA043: {"Exec", "pii", 'i'},
+	0xA044: {"FlushCache", "", '-'},
+	0xA045: {"init_a0_b0_c0_vectors", "", '-'},
+	0xA046: {"GPU_dw", "iiiip", '-'},
+	0xA047: {"gpu_send_dma", "iiiip", '-'},
+	0xA048: {"SendGP1Command", "x", '-'},
+	0xA049: {"GPU_cw", "x", 'i'},
+	0xA04A: {"GPU_cwp", "pi", '-'},
+	0xA04B: {"send_gpu_linked_list", "p", '-'},
+	0xA04C: {"gpu_abort_dma", "", '-'},
+	0xA04D: {"GetGPUStatus", "", 'x'},
+	0xA04E: {"gpu_sync", "", 'i'},
+	0xA04F: {"SystemError", "", '-'},
+	0xA050: {"SystemError", "", '-'},
+	0xA051: {"LoadExec", "sxx", 'i'},
+	0xA052: {"GetSysSp", "", 'x'},
+	0xA053: {"SystemError", "", '-'},
+	0xA054: {"_96_init", "", '-'},
+	0xA055: {"_bu_init", "", '-'},
+	0xA056: {"_96_remove", "", '-'},
+	0xA05B: {"dev_tty_init", "", '-'},
+	0xA05C: {"dev_tty_open", "psi", 'i'},
+	0xA05D: {"dev_tty_in_out", "px", 'i'},
+	0xA05E: {"dev_tty_ioctl", "pxx", 'i'},
+	0xA05F: {"dev_cd_open", "psi", 'i'},
+	0xA060: {"dev_cd_read", "ppi", 'i'},
+	0xA061: {"dev_cd_close", "p", 'i'},
+	0xA062: {"dev_cd_firstfile", "psp", 'p'},
+	0xA063: {"dev_cd_nextfile", "pp", 'p'},
+	0xA064: {"dev_cd_chdir", "ps", 'i'},
+	0xA065: {"dev_card_open", "psi", 'i'},
+	0xA066: {"dev_card_read", "ppi", 'i'},
+	0xA067: {"dev_card_write", "ppi", 'i'},
+	0xA068: {"dev_card_close", "p", 'i'},
+	0xA069: {"dev_card_firstfile", "psp", 'p'},
+	0xA06A: {"dev_card_nextfile", "pp", 'p'},
+	0xA06B: {"dev_card_erase", "ps", 'i'},
+	0xA06C: {"dev_card_undelete", "ps", 'i'},
+	0xA06D: {"dev_card_format", "p", 'i'},
+	0xA06E: {"dev_card_rename", "psps", 'i'},
+	0xA06F: {"card_clear_error", "p", '-'},
+	0xA070: {"_bu_init", "", '-'},
+	0xA071: {"_96_init", "", '-'},
+	0xA072: {"_96_remove", "", '-'},
+	0xA078: {"CdAsyncSeekL", "p", 'i'},
+	0xA07C: {"CdAsyncGetStatus", "p", 'i'},
+	0xA07E: {"CdAsyncReadSector", "ipx", 'i'},
+	0xA081: {"CdAsyncSetMode", "x", 'i'},
+	0xA090: {"CdromIoIrqFunc1", "", '-'},
+	0xA091: {"CdromDmaIrqFunc1", "", '-'},
+	0xA092: {"CdromIoIrqFunc2", "", '-'},
+	0xA093: {"CdromDmaIrqFunc2", "", '-'},
+	0xA094: {"CdromGetInt5errCode", "pp", 'i'},
+	0xA095: {"CdInitSubFunc", "", 'i'},
+	0xA096: {"AddCDROMDevice", "", '-'},
+	0xA097: {"AddMemCardDevice", "", '-'},
+	0xA098: {"AddDuartTtyDevice", "", '-'},
+	0xA099: {"AddDummyTtyDevice", "", '-'},
+	0xA09A: {"SystemError", "", '-'},
+	0xA09B: {"SystemError", "", '-'},
+	0xA09C: {"SetConf", "iix", '-'},
+	0xA09D: {"GetConf", "ppp", '-'},
+	0xA09E: {"SetCdromIrqAutoAbort", "ii", '-'},
+	0xA09F: {"SetMemSize", "i", '-'},
+	0xA0A0: {"WarmBoot", "", '-'},
+	0xA0A1: {"SystemErrorBootOrDiskFailure", "cx", '-'},
+	0xA0A2: {"EnqueueCdIntr", "", '-'},
+	0xA0A3: {"DequeueCdIntr", "", '-'},
+	0xA0A4: {"CdGetLbn", "s", 'i'},
+	0xA0A5: {"CdReadSector", "iip", 'i'},
+	0xA0A6: {"CdGetStatus", "", 'x'},
+	0xA0A7: {"bufs_cb_0", "", '-'},
+	0xA0A8: {"bufs_cb_1", "", '-'},
+	0xA0A9: {"bufs_cb_2", "", '-'},
+	0xA0AA: {"bufs_cb_3", "", '-'},
+	0xA0AB: {"_card_info", "x", 'i'},
+	0xA0AC: {"_card_load", "x", 'i'},
+	0xA0AD: {"_card_auto", "i", 'i'},
+	0xA0AE: {"bufs_cb_4", "", '-'},
+	0xA0AF: {"card_write_test", "x", 'i'},
+	0xA0B2: {"ioabort_raw", "i", '-'},
+	0xA0B4: {"GetSystemInfo", "i", 'x'},
+
+	0xB000: {"alloc_kernel_memory", "i", 'p'},
+	0xB001: {"free_kernel_memory", "p", '-'},
+	0xB002: {"init_timer", "iix", 'i'},
+	0xB003: {"get_timer", "i", 'i'},
+	0xB004: {"enable_timer_irq", "i", 'i'},
+	0xB005: {"disable_timer_irq", "i", 'i'},
+	0xB006: {"restart_timer", "i", 'i'},
+	0xB007: {"DeliverEvent", "xx", '-'},
+	0xB008: {"OpenEvent", "xxxf", 'x'},
+	0xB009: {"CloseEvent", "x", 'i'},
+	0xB00A: {"WaitEvent", "x", 'i'},
+	0xB00B: {"TestEvent", "x", 'i'},
+	0xB00C: {"EnableEvent", "x", 'i'},
+	0xB00D: {"DisableEvent", "x", 'i'},
+	0xB00E: {"OpenThread", "fxx", 'x'},
+	0xB00F: {"CloseThread", "x", 'i'},
+	0xB010: {"ChangeThread", "x", 'i'},
+	0xB011: {"jump_to_00000000h", "", '-'},
+	0xB012: {"InitPad", "pipi", 'i'},
+	0xB013: {"StartPad", "", 'i'},
+	0xB014: {"StopPad", "", '-'},
+	0xB015: {"OutdatedPadInitAndStart", "xpxx", 'i'},
+	0xB016: {"OutdatedPadGetButtons", "", 'x'},
+	0xB017: {"ReturnFromException", "", '-'},
+	0xB018: {"SetDefaultExitFromException", "", '-'},
+	0xB019: {"SetCustomExitFromException", "p", '-'},
+	0xB020: {"UnDeliverEvent", "xx", '-'},
+	0xB032: {"open", "si", 'i'},
+	0xB033: {"lseek", "iii", 'i'},
+	0xB034: {"read", "ipi", 'i'},
+	0xB035: {"write", "ipi", 'i'},
+	0xB036: {"close", "i", 'i'},
+	0xB037: {"ioctl", "iix", 'i'},
+	0xB038: {"exit", "i", '-'},
+	0xB039: {"isatty", "i", 'i'},
+	0xB03A: {"getc", "i", 'c'},
+	0xB03B: {"putc", "ci", 'c'},
+	0xB03C: {"getchar", "", 'c'},
+	0xB03D: {"putchar", "c", 'c'},
+	0xB03E: {"gets", "p", 'p'},
+	0xB03F: {"puts", "s", 'i'},
+	0xB040: {"cd", "s", 'i'},
+	0xB041: {"format", "s", 'i'},
+	0xB042: {"firstfile", "sp", 'p'},
+	0xB043: {"nextfile", "p", 'p'},
+	0xB044: {"rename", "ss", 'i'},
+	0xB045: {"erase", "s", 'i'},
+	0xB046: {"undelete", "s", 'i'},
+	0xB047: {"AddDrv", "p", 'i'},
+	0xB048: {"DelDrv", "s", 'i'},
+	0xB049: {"PrintInstalledDevices", "", '-'},
+	0xB04A: {"InitCard", "i", '-'},
+	0xB04B: {"StartCard", "", '-'},
+	0xB04C: {"StopCard", "", '-'},
+	0xB04D: {"_card_info_subfunc", "x", 'i'},
+	0xB04E: {"write_card_sector", "xip", 'i'},
+	0xB04F: {"read_card_sector", "xip", 'i'},
+	0xB050: {"allow_new_card", "", '-'},
+	0xB051: {"Krom2RawAdd", "x", 'p'},
+	0xB053: {"Krom2Offset", "x", 'i'},
+	0xB054: {"GetLastError", "", 'i'},
+	0xB055: {"GetLastFileError", "i", 'i'},
+	0xB056: {"GetC0Table", "", 'p'},
+	0xB057: {"GetB0Table", "", 'p'},
+	0xB058: {"get_bu_callback_port", "", 'i'},
+	0xB059: {"testdevice", "s", 'i'},
+	0xB05B: {"ChangeClearPad", "i", '-'},
+	0xB05C: {"get_card_status", "x", 'i'},
+	0xB05D: {"wait_card_status", "x", 'i'},
+
+	0xC000: {"EnqueueTimerAndVblankIrqs", "i", '-'},
+	0xC001: {"EnqueueSyscallHandler", "i", '-'},
+	0xC002: {"SysEnqIntRP", "ip", 'i'},
+	0xC003: {"SysDeqIntRP", "ip", 'i'},
+	0xC004: {"get_free_EvCB_slot", "", 'i'},
+	0xC005: {"get_free_TCB_slot", "", 'i'},
+	0xC006: {"ExceptionHandler", "", '-'},
+	0xC007: {"InstallExceptionHandlers", "", '-'},
+	0xC008: {"SysInitMemory", "pi", '-'},
+	0xC009: {"SysInitKernelVariables", "", '-'},
+	0xC00A: {"ChangeClearRCnt", "ii", 'i'},
+	0xC00C: {"InitDefInt", "i", '-'},
+	0xC00D: {"SetIrqAutoAck", "ii", '-'},
+	0xC00E: {"dev_sio_init", "", '-'},
+	0xC00F: {"dev_sio_open", "psi", 'i'},
+	0xC010: {"dev_sio_in_out", "px", 'i'},
+	0xC011: {"dev_sio_ioctl", "pxx", 'i'},
+	0xC012: {"InstallDevices", "i", '-'},
+	0xC013: {"FlushStdInOutPut", "", '-'},
+	0xC015: {"tty_cdevinput", "pc", '-'},
+	0xC016: {"tty_cdevscan", "", '-'},
+	0xC017: {"tty_circgetc", "p", 'c'},
+	0xC018: {"tty_circputc", "cp", '-'},
+	0xC019: {"ioabort", "ss", '-'},
+	0xC01A: {"set_card_find_mode", "i", '-'},
+	0xC01B: {"KernelRedirect", "i", '-'},
+	0xC01C: {"AdjustA0Table", "", '-'},
+	0xC01D: {"get_card_find_mode", "", 'i'},
+}
@@ -0,0 +1,371 @@
+package ps
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Unirom protocol constants. Commands and responses are 4 ASCII characters,
+// numbers are little-endian 32-bit words and checksums are the sum of all
+// bytes of a transfer.
+// https://github.com/JonathanDotCel/NOTPSXSerial
+const (
+	uniromChunkSize = 2048
+	uniromStackTop  = 0x801FFFF0
+	// uniromMaxSize bounds transfers, which never need to be larger than
+	// RAM.
+	uniromMaxSize = MainRAMSize
+)
+
+// UniromShim speaks the Unirom serial protocol on behalf of the guest, so
+// that NOTPSXSerial (nops) can upload and run programs without Unirom running
+// in the emulator. It supports SEXE, SBIN, JUMP, CALL, DUMP and POKE, and the
+// V2 protocol with per-chunk checksums.
+//
+// The protocol is served by a background goroutine. Memory and register
+// accesses are queued and performed by Service, which the emulation loop
+// must call regularly.
+type UniromShim struct {
+	link io.ReadWriter
+	ops  chan uniromOp
+
+	// v2 is set once the host has upgraded the current command with UPV2.
+	v2 bool
+}
+
+func NewUniromShim(link io.ReadWriter) *UniromShim {
+	shim := &UniromShim{
+		link: link,
+		ops:  make(chan uniromOp),
+	}
+	go shim.serve()
+	return shim
+}
+
+// uniromOp is an operation queued for Service and the channel its result
+// goes to.
+type uniromOp struct {
+	run  func(cpu *CPU, bus *Bus) error
+	done chan error
+}
+
+// Service performs memory and register operations requested by the host.
+// Operations that fail, such as a DUMP of unmapped memory, fail the command
+// without stopping emulation.
+func (shim *UniromShim) Service(cpu *CPU, bus *Bus) {
+	for {
+		select {
+		case op := <-shim.ops:
+			op.done <- perform(op.run, cpu, bus)
+		default:
+			return
+		}
+	}
+}
+
+// perform runs op and turns a panic that stops emulation, such as an access
+// to unmapped memory while loading a program, into an error.
+func perform(op func(cpu *CPU, bus *Bus) error, cpu *CPU, bus *Bus) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			cause, ok := r.(fatalError)
+			if !ok {
+				panic(r)
+			}
+			err = cause.err
+		}
+	}()
+	return op(cpu, bus)
+}
+
+// do runs op on the emulation goroutine and waits for it to finish.
+func (shim *UniromShim) do(op func(cpu *CPU, bus *Bus) error) error {
+	done := make(chan error, 1)
+	shim.ops <- uniromOp{op, done}
+	return <-done
+}
+
+// logf logs through the bus on the emulation goroutine.
+func (shim *UniromShim) logf(format string, v ...interface{}) {
+	shim.do(func(cpu *CPU, bus *Bus) error {
+		bus.logf(format, v...)
+		return nil
+	})
+}
+
+func (shim *UniromShim) serve() {
+	var window [4]byte
+	for {
+		if _, err := io.ReadFull(shim.link, window[3:]); err != nil {
+			return
+		}
+
+		command := string(window[:])
+		copy(window[:], window[1:])
+
+		var err error
+		switch command {
+		case "SEXE":
+			err = shim.sendEXE()
+		case "SBIN", "POKE":
+			err = shim.sendBinary()
+		case "JUMP":
+			err = shim.jump(false)
+		case "CALL":
+			err = shim.jump(true)
+		case "DUMP":
+			err = shim.dump()
+		default:
+			continue
+		}
+
+		window = [4]byte{}
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
+			shim.logf("unirom: %s: %v", command, err)
+		}
+	}
+}
+
+func (shim *UniromShim) send(response string) error {
+	_, err := io.WriteString(shim.link, response)
+	return err
+}
+
+func (shim *UniromShim) readWord() (uint32, error) {
+	var word [4]byte
+	if _, err := io.ReadFull(shim.link, word[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(word[:]), nil
+}
+
+// acknowledge answers a command and lets the host upgrade to the V2 protocol.
+// It returns the first word of the command's payload.
+func (shim *UniromShim) acknowledge() (uint32, error) {
+	shim.v2 = false
+	if err := shim.send("OKV2"); err != nil {
+		return 0, err
+	}
+
+	word, err := shim.readWord()
+	if err != nil {
+		return 0, err
+	}
+
+	var upgrade [4]byte
+	binary.LittleEndian.PutUint32(upgrade[:], word)
+	if string(upgrade[:]) == "UPV2" {
+		shim.v2 = true
+		if err := shim.send("OKAY"); err != nil {
+			return 0, err
+		}
+		return shim.readWord()
+	}
+
+	return word, nil
+}
+
+var errChecksum = errors.New("checksum mismatch")
+
+func checkTransferSize(size uint32) error {
+	if size > uniromMaxSize {
+		return fmt.Errorf("transfer of %d bytes is larger than RAM", size)
+	}
+	return nil
+}
+
+func checksum(data []byte) uint32 {
+	var sum uint32
+	for _, b := range data {
+		sum += uint32(b)
+	}
+	return sum
+}
+
+// receiveData reads size bytes. With V2, every chunk is confirmed with a
+// checksum and resent on mismatch.
+func (shim *UniromShim) receiveData(size uint32) ([]byte, error) {
+	if err := checkTransferSize(size); err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	for offset := uint32(0); offset < size; {
+		end := offset + uniromChunkSize
+		if end > size {
+			end = size
+		}
+
+		chunk := data[offset:end]
+		if _, err := io.ReadFull(shim.link, chunk); err != nil {
+			return nil, err
+		}
+
+		if shim.v2 {
+			if err := shim.send("CHEK"); err != nil {
+				return nil, err
+			}
+			sum, err := shim.readWord()
+			if err != nil {
+				return nil, err
+			}
+			if sum != checksum(chunk) {
+				if err := shim.send("ERR!"); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err := shim.send("MORE"); err != nil {
+				return nil, err
+			}
+		}
+
+		offset = end
+	}
+
+	return data, nil
+}
+
+func (shim *UniromShim) write(address uint32, data []byte) error {
+	return shim.do(func(cpu *CPU, bus *Bus) error {
+		return bus.Write(address, data)
+	})
+}
+
+// verify rejects a transfer whose data doesn't match the checksum sent by the
+// host, answering with the same error reply as for a bad V2 chunk.
+func (shim *UniromShim) verify(data []byte, sum uint32) error {
+	if checksum(data) == sum {
+		return nil
+	}
+	if err := shim.send("ERR!"); err != nil {
+		return err
+	}
+	return errChecksum
+}
+
+// sendEXE receives the PS-X EXE header, the checksum of the text segment
+// and the text segment itself, then starts the program. Nothing is loaded if
+// the checksum doesn't match.
+func (shim *UniromShim) sendEXE() error {
+	first, err := shim.acknowledge()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, EXEHeaderSize)
+	binary.LittleEndian.PutUint32(header, first)
+	if _, err := io.ReadFull(shim.link, header[4:]); err != nil {
+		return err
+	}
+
+	sum, err := shim.readWord()
+	if err != nil {
+		return err
+	}
+
+	exe, size, err := ParseEXEHeader(header)
+	if err != nil {
+		return err
+	}
+	if exe.StackBase == 0 {
+		exe.StackBase = uniromStackTop
+	}
+
+	data, err := shim.receiveData(size)
+	if err != nil {
+		return err
+	}
+	if err := shim.verify(data, sum); err != nil {
+		return err
+	}
+
+	exe.Text = data
+	return shim.do(func(cpu *CPU, bus *Bus) error {
+		exe.Load(cpu, bus)
+		return nil
+	})
+}
+
+// sendBinary receives an address, a size, a checksum and the data, and
+// writes the data to memory unless the checksum doesn't match.
+func (shim *UniromShim) sendBinary() error {
+	address, err := shim.acknowledge()
+	if err != nil {
+		return err
+	}
+
+	size, err := shim.readWord()
+	if err != nil {
+		return err
+	}
+	sum, err := shim.readWord()
+	if err != nil {
+		return err
+	}
+
+	data, err := shim.receiveData(size)
+	if err != nil {
+		return err
+	}
+	if err := shim.verify(data, sum); err != nil {
+		return err
+	}
+
+	return shim.write(address, data)
+}
+
+// jump receives an address and continues execution there. With call, $ra is
+// set so that the called function returns to the interrupted code.
+func (shim *UniromShim) jump(call bool) error {
+	address, err := shim.acknowledge()
+	if err != nil {
+		return err
+	}
+
+	return shim.do(func(cpu *CPU, bus *Bus) error {
+		if call {
+			cpu.forceGPR(31, cpu.Pc)
+		}
+		cpu.Jump(address)
+		return nil
+	})
+}
+
+// dump receives an address and a size and sends back the memory contents
+// followed by their checksum.
+func (shim *UniromShim) dump() error {
+	address, err := shim.acknowledge()
+	if err != nil {
+		return err
+	}
+
+	size, err := shim.readWord()
+	if err != nil {
+		return err
+	}
+
+	if err := checkTransferSize(size); err != nil {
+		return err
+	}
+	data := make([]byte, size)
+	err = shim.do(func(cpu *CPU, bus *Bus) error {
+		return bus.Read(address, data)
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := shim.link.Write(data); err != nil {
+		return err
+	}
+
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], checksum(data))
+	_, err = shim.link.Write(sum[:])
+	return err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/weqqr/ps/ps"
+)
+
+const tracediffUsage = `usage: ps tracediff [flags] A B
+
+Compares two execution traces recorded with "ps -trace" or written in the
+text format described in ps/trace.go, and shows the first step where they
+differ.
+
+flags:
+`
+
+func tracediffCommand(args []string) {
+	flags := flag.NewFlagSet("ps tracediff", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, tracediffUsage)
+		flags.PrintDefaults()
+	}
+	context := flags.Int("context", 8, "number of matching steps to show before the difference")
+	ignore := flags.String("ignore", "", "comma-separated parts of steps not to compare: regs, mem, exc")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ignored := make(map[string]bool)
+	for _, part := range strings.Split(*ignore, ",") {
+		switch part {
+		case "":
+		case "regs", "mem", "exc":
+			ignored[part] = true
+		default:
+			fmt.Fprintf(os.Stderr, "ps tracediff: unknown part %q\n", part)
+			os.Exit(2)
+		}
+	}
+
+	same, err := tracediff(flags.Arg(0), flags.Arg(1), *context, ignored)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ps tracediff: %v\n", err)
+		os.Exit(2)
+	}
+	if !same {
+		os.Exit(1)
+	}
+}
+
+// tracediff reports whether the traces a and b are the same and prints the
+// first difference otherwise.
+func tracediff(a, b string, context int, ignored map[string]bool) (bool, error) {
+	traceA, err := openTrace(a)
+	if err != nil {
+		return false, err
+	}
+	traceB, err := openTrace(b)
+	if err != nil {
+		return false, err
+	}
+
+	var history []string
+	for n := 0; ; n++ {
+		stepA, errA := traceA.Next()
+		stepB, errB := traceB.Next()
+		switch {
+		case errA != nil && errA != io.EOF:
+			return false, fmt.Errorf("%s: %v", a, errA)
+		case errB != nil && errB != io.EOF:
+			return false, fmt.Errorf("%s: %v", b, errB)
+		case errA == io.EOF && errB == io.EOF:
+			fmt.Printf("traces match, %d steps\n", n)
+			return true, nil
+		}
+
+		lineA, lineB := compared(stepA, ignored), compared(stepB, ignored)
+		if errA == nil && errB == nil && lineA == lineB {
+			history = append(history, lineA)
+			if len(history) > context {
+				history = history[1:]
+			}
+			continue
+		}
+
+		fmt.Printf("traces differ at step %d\n", n)
+		for i, line := range history {
+			fmt.Printf("  %-10d %s\n", n-len(history)+i, line)
+		}
+		for _, trace := range []struct {
+			name string
+			line string
+			err  error
+		}{{"A", lineA, errA}, {"B", lineB, errB}} {
+			if trace.err == io.EOF {
+				trace.line = "(end of trace)"
+			}
+			fmt.Printf("%s %-10d %s\n", trace.name, n, trace.line)
+		}
+		return false, nil
+	}
+}
+
+// compared formats the parts of step that are compared.
+func compared(step ps.TraceStep, ignored map[string]bool) string {
+	if ignored["regs"] {
+		step.Registers = nil
+	}
+	if ignored["mem"] {
+		step.Accesses = nil
+	}
+	if ignored["exc"] {
+		step.Exception = -1
+	}
+	return step.String()
+}
+
+// openTrace opens a trace file, which stays open until the program exits.
+func openTrace(path string) (*ps.TraceReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return ps.NewTraceReader(file)
+}